@@ -21,9 +21,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
@@ -35,6 +38,16 @@ import (
 type Client struct {
 	base *url.URL
 	http *http.Client
+
+	// Timeout, if set, limits requests whose context has no deadline.
+	// Requests that stream responses, such as Generate, Chat and Pull, fail
+	// when no response is received for Timeout rather than after Timeout
+	// in total.
+	Timeout time.Duration
+
+	// APIKey, if set, is sent as a bearer token with every request to
+	// authenticate with a server that requires an API key.
+	APIKey string
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -61,22 +74,53 @@ func checkError(resp *http.Response, body []byte) error {
 //	<scheme>://<host>:<port>
 //
 // If the variable is not specified, a default ollama host and port will be
-// used.
+// used. The first key of OLLAMA_API_KEY, if any, is used as the client's
+// APIKey.
 func ClientFromEnvironment() (*Client, error) {
-	return &Client{
-		base: envconfig.Host(),
-		http: http.DefaultClient,
-	}, nil
+	c := NewClient(envconfig.Host(), http.DefaultClient)
+	c.APIKey, _, _ = strings.Cut(envconfig.APIKey(), ",")
+	c.APIKey = strings.TrimSpace(c.APIKey)
+	return c, nil
 }
 
+// NewClient returns a client of the server at base. A base with the "unix"
+// scheme, e.g. "unix:///run/ollama.sock", connects to the Unix socket at its
+// path with a copy of http.
 func NewClient(base *url.URL, http *http.Client) *Client {
+	if base.Scheme == "unix" {
+		return &Client{
+			base: &url.URL{Scheme: "http", Host: "localhost"},
+			http: unixClient(http, base.Path),
+		}
+	}
+
 	return &Client{
 		base: base,
 		http: http,
 	}
 }
 
+// unixClient returns a copy of client which sends requests to the Unix
+// socket at path
+func unixClient(client *http.Client, path string) *http.Client {
+	c := *client
+	c.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+
+	return &c
+}
+
 func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
 	var reqBody io.Reader
 	var data []byte
 	var err error
@@ -105,6 +149,9 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
 
 	respObj, err := c.http.Do(request)
 	if err != nil {
@@ -131,7 +178,16 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 
 const maxBufferSize = 512 * format.KiloByte
 
+// maxEmbedBufferSize is the size of the largest response of a streamed embed
+// request, the final one with every embedding
+const maxEmbedBufferSize = 256 * format.MegaByte
+
 func (c *Client) stream(ctx context.Context, method, path string, data any, fn func([]byte) error) error {
+	return c.streamWithLimit(ctx, method, path, data, maxBufferSize, fn)
+}
+
+// streamWithLimit is like stream for responses of up to limit bytes each
+func (c *Client) streamWithLimit(ctx context.Context, method, path string, data any, limit int, fn func([]byte) error) error {
 	var buf *bytes.Buffer
 	if data != nil {
 		bts, err := json.Marshal(data)
@@ -142,6 +198,19 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		buf = bytes.NewBuffer(bts)
 	}
 
+	// the timeout of a stream is how long to wait for each response
+	var idle *time.Timer
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		idle = time.AfterFunc(c.Timeout, func() {
+			cancel(fmt.Errorf("no response from the server for %s: %w", c.Timeout, context.DeadlineExceeded))
+		})
+		defer idle.Stop()
+	}
+
 	requestURL := c.base.JoinPath(path)
 	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), buf)
 	if err != nil {
@@ -151,20 +220,28 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
 
 	response, err := c.http.Do(request)
 	if err != nil {
+		if cause := context.Cause(ctx); idle != nil && errors.Is(cause, context.DeadlineExceeded) {
+			return cause
+		}
+
 		return err
 	}
 	defer response.Body.Close()
 
 	scanner := bufio.NewScanner(response.Body)
 	// increase the buffer size to avoid running out of space
-	scanBuf := make([]byte, 0, maxBufferSize)
-	scanner.Buffer(scanBuf, maxBufferSize)
+	scanBuf := make([]byte, 0, min(limit, maxBufferSize))
+	scanner.Buffer(scanBuf, limit)
 	for scanner.Scan() {
 		var errorResponse struct {
 			Error string `json:"error,omitempty"`
+			Code  string `json:"code,omitempty"`
 		}
 
 		bts := scanner.Bytes()
@@ -172,6 +249,15 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			return fmt.Errorf("unmarshal: %w", err)
 		}
 
+		if errorResponse.Code != "" {
+			err := StatusError{ErrorMessage: errorResponse.Error, Code: errorResponse.Code}
+			if response.StatusCode >= http.StatusBadRequest {
+				err.StatusCode = response.StatusCode
+			}
+
+			return err
+		}
+
 		if errorResponse.Error != "" {
 			return errors.New(errorResponse.Error)
 		}
@@ -184,9 +270,21 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			}
 		}
 
+		if idle != nil {
+			idle.Stop()
+		}
+
 		if err := fn(bts); err != nil {
 			return err
 		}
+
+		if idle != nil {
+			idle.Reset(c.Timeout)
+		}
+	}
+
+	if cause := context.Cause(ctx); idle != nil && scanner.Err() != nil && errors.Is(cause, context.DeadlineExceeded) {
+		return cause
 	}
 
 	return nil
@@ -307,6 +405,27 @@ func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	return &lr, nil
 }
 
+// Reload unloads a model, once its requests complete, and loads it again
+// with its current parameters, returning the reloaded model.
+func (c *Client) Reload(ctx context.Context, req *ReloadRequest) (*ProcessModelResponse, error) {
+	var resp ProcessModelResponse
+	if err := c.do(ctx, http.MethodPost, "/api/reload", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GenerateBatch generates completions of independent prompts with one model.
+// The prompts are generated together for throughput and a prompt that fails
+// has an error in its result rather than failing the batch.
+func (c *Client) GenerateBatch(ctx context.Context, req *GenerateBatchRequest) (*GenerateBatchResponse, error) {
+	var resp GenerateBatchResponse
+	if err := c.do(ctx, http.MethodPost, "/api/generate/batch", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Copy copies a model - creating a model with another name from an existing
 // model.
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
@@ -316,6 +435,33 @@ func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	return nil
 }
 
+// CopyProgressFunc is a function that [Client.CopyWithProgress] invokes when
+// progress is made.
+// It's similar to other progress function types like [PullProgressFunc].
+type CopyProgressFunc func(ProgressResponse) error
+
+// CopyWithProgress copies a model like [Client.Copy], calling fn each time
+// progress is made. Cancelling ctx aborts the copy.
+func (c *Client) CopyWithProgress(ctx context.Context, req *CopyRequest, fn CopyProgressFunc) error {
+	stream := true
+	r := *req
+	r.Stream = &stream
+	return c.stream(ctx, http.MethodPost, "/api/copy", &r, func(bts []byte) error {
+		var resp ProgressResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
+// Alias gives an existing model another name which shares the model's
+// layers.
+func (c *Client) Alias(ctx context.Context, req *AliasRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/alias", req, nil)
+}
+
 // Delete deletes a model and its data.
 func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, nil); err != nil {
@@ -324,6 +470,21 @@ func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	return nil
 }
 
+// Prune removes blobs that no local model references.
+func (c *Client) Prune(ctx context.Context, req *PruneRequest) (*PruneResponse, error) {
+	var resp PruneResponse
+	if err := c.do(ctx, http.MethodPost, "/api/prune", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Cancel stops the in-flight generate or chat request with the given
+// [GenerateRequest.RequestID].
+func (c *Client) Cancel(ctx context.Context, requestID string) error {
+	return c.do(ctx, http.MethodDelete, "/api/generate/"+url.PathEscape(requestID), nil, nil)
+}
+
 // Show obtains model information, including details, modelfile, license etc.
 func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
 	var resp ShowResponse
@@ -351,6 +512,106 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// EmbedProgressFunc is a function that [Client.EmbedWithProgress] invokes
+// each time an input is embedded.
+type EmbedProgressFunc func(ProgressResponse) error
+
+// EmbedWithProgress generates embeddings like [Client.Embed], calling fn each
+// time an input is embedded with the number of inputs embedded so far.
+func (c *Client) EmbedWithProgress(ctx context.Context, req *EmbedRequest, fn EmbedProgressFunc) (*EmbedResponse, error) {
+	stream := true
+	r := *req
+	r.Stream = &stream
+
+	var resp *EmbedResponse
+	err := c.streamWithLimit(ctx, http.MethodPost, "/api/embed", &r, maxEmbedBufferSize, func(bts []byte) error {
+		var final struct {
+			Embeddings json.RawMessage `json:"embeddings"`
+		}
+		if err := json.Unmarshal(bts, &final); err != nil {
+			return err
+		}
+
+		// the final response is the only one with embeddings
+		if final.Embeddings != nil {
+			resp = &EmbedResponse{}
+			return json.Unmarshal(bts, resp)
+		}
+
+		var progress ProgressResponse
+		if err := json.Unmarshal(bts, &progress); err != nil {
+			return err
+		}
+
+		return fn(progress)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, errors.New("unexpected end of embed response")
+	}
+
+	return resp, nil
+}
+
+// Tokenize converts a prompt to the tokens of a model without generating.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize converts the tokens of a model back to text.
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Render renders the prompt of a chat from a template without generating.
+func (c *Client) Render(ctx context.Context, req *RenderRequest) (*RenderResponse, error) {
+	var resp RenderResponse
+	if err := c.do(ctx, http.MethodPost, "/api/render", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Estimate predicts how much memory a model would take and how much of it
+// would be offloaded to GPUs, without loading it.
+func (c *Client) Estimate(ctx context.Context, req *EstimateRequest) (*EstimateResponse, error) {
+	var resp EstimateResponse
+	if err := c.do(ctx, http.MethodPost, "/api/estimate", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SaveCache snapshots a chat session and the model's cache of it.
+func (c *Client) SaveCache(ctx context.Context, req *CacheSaveRequest) (*CacheSaveResponse, error) {
+	var resp CacheSaveResponse
+	if err := c.do(ctx, http.MethodPost, "/api/cache/save", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RestoreCache restores a chat session and the model's cache of it to a
+// snapshot saved by SaveCache.
+func (c *Client) RestoreCache(ctx context.Context, req *CacheRestoreRequest) (*CacheRestoreResponse, error) {
+	var resp CacheRestoreResponse
+	if err := c.do(ctx, http.MethodPost, "/api/cache/restore", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
@@ -378,3 +639,13 @@ func (c *Client) Version(ctx context.Context) (string, error) {
 
 	return version.Version, nil
 }
+
+// ServerVersion returns the versions and capabilities of the Ollama server.
+func (c *Client) ServerVersion(ctx context.Context) (*VersionResponse, error) {
+	var resp VersionResponse
+	if err := c.do(ctx, http.MethodGet, "/api/version", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
@@ -1,7 +1,17 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestClientFromEnvironment(t *testing.T) {
@@ -43,3 +53,171 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestClientTimeout(t *testing.T) {
+	// the server waits delay before the response and between each of frames
+	slowServer := func(t *testing.T, delay time.Duration, frames int) *Client {
+		t.Helper()
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// read the body so the server notices the client going away
+			io.Copy(io.Discard, r.Body)
+
+			for range frames {
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+
+				fmt.Fprintln(w, `{"response":"a"}`)
+				w.(http.Flusher).Flush()
+			}
+		}))
+		t.Cleanup(s.Close)
+
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return NewClient(u, http.DefaultClient)
+	}
+
+	generate := func(c *Client, ctx context.Context) (int, error) {
+		var n int
+		err := c.Generate(ctx, &GenerateRequest{Model: "test"}, func(GenerateResponse) error {
+			n++
+			return nil
+		})
+		return n, err
+	}
+
+	t.Run("request", func(t *testing.T) {
+		c := slowServer(t, time.Second, 1)
+		c.Timeout = 50 * time.Millisecond
+
+		start := time.Now()
+		if _, err := c.Embed(context.Background(), &EmbedRequest{Model: "test"}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a deadline exceeded error, got %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("expected the request to time out, took %s", elapsed)
+		}
+	})
+
+	t.Run("stream idle", func(t *testing.T) {
+		c := slowServer(t, 20*time.Millisecond, 10)
+		c.Timeout = 100 * time.Millisecond
+
+		// the stream takes longer than the timeout in total
+		n, err := generate(c, context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 10 {
+			t.Errorf("expected 10 responses, got %d", n)
+		}
+	})
+
+	t.Run("stream stalled", func(t *testing.T) {
+		c := slowServer(t, time.Second, 2)
+		c.Timeout = 50 * time.Millisecond
+
+		n, err := generate(c, context.Background())
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a deadline exceeded error, got %v", err)
+		}
+
+		if n != 0 {
+			t.Errorf("expected no responses, got %d", n)
+		}
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		c := slowServer(t, 100*time.Millisecond, 1)
+		c.Timeout = 10 * time.Millisecond
+
+		// the caller's deadline takes precedence over the timeout
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if n, err := generate(c, ctx); err != nil || n != 1 {
+			t.Fatalf("expected 1 response, got %d: %v", n, err)
+		}
+	})
+}
+
+func TestEmbedWithProgress(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req EmbedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Stream == nil || !*req.Stream {
+			http.Error(w, "expected a streamed request", http.StatusBadRequest)
+			return
+		}
+
+		for i := range 3 {
+			fmt.Fprintf(w, `{"status":"embedded %d/3","completed":%d,"total":3}`+"\n", i+1, i+1)
+		}
+
+		fmt.Fprintln(w, `{"model":"test","embeddings":[[1],[2],[3]]}`)
+	}))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var completed []int64
+	resp, err := NewClient(u, http.DefaultClient).EmbedWithProgress(context.Background(), &EmbedRequest{Model: "test", Input: []string{"a", "b", "c"}}, func(p ProgressResponse) error {
+		completed = append(completed, p.Completed)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(completed, []int64{1, 2, 3}) {
+		t.Errorf("expected progress 1, 2, 3, got %v", completed)
+	}
+
+	if len(resp.Embeddings) != 3 {
+		t.Errorf("expected 3 embeddings, got %d", len(resp.Embeddings))
+	}
+}
+
+func TestClientAPIKey(t *testing.T) {
+	var got []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		fmt.Fprintln(w, `{"models":[]}`)
+	}))
+	t.Cleanup(s.Close)
+
+	t.Setenv("OLLAMA_HOST", s.URL)
+	t.Setenv("OLLAMA_API_KEY", " new-key , old-key")
+
+	client, err := ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.APIKey != "new-key" {
+		t.Errorf("expected the first key of OLLAMA_API_KEY, got %q", client.APIKey)
+	}
+
+	if _, err := client.List(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Generate(context.Background(), &GenerateRequest{Model: "test"}, func(GenerateResponse) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(got, []string{"Bearer new-key", "Bearer new-key"}) {
+		t.Errorf("expected the key as a bearer token, got %q", got)
+	}
+}
@@ -17,8 +17,33 @@ type StatusError struct {
 	StatusCode   int
 	Status       string
 	ErrorMessage string `json:"error"`
+
+	// Code is one of the ErrorCode constants. Unlike ErrorMessage it's stable
+	// so it can be used to handle specific errors.
+	Code string `json:"code,omitempty"`
 }
 
+// Error codes of a [StatusError]
+const (
+	ErrorCodeInvalidRequest   = "invalid_request"
+	ErrorCodeModelNotFound    = "model_not_found"
+	ErrorCodeBlobNotFound     = "blob_not_found"
+	ErrorCodeRequestNotFound  = "request_not_found"
+	ErrorCodeRequestConflict  = "request_conflict"
+	ErrorCodeRequestCanceled  = "request_canceled"
+	ErrorCodeUnsupported      = "unsupported"
+	ErrorCodeContextExceeded  = "context_exceeded"
+	ErrorCodeOutOfMemory      = "out_of_memory"
+	ErrorCodeServerBusy       = "server_busy"
+	ErrorCodeRateLimited      = "rate_limited"
+	ErrorCodeUnauthorized     = "unauthorized"
+	ErrorCodeModelCorrupted   = "model_corrupted"
+	ErrorCodeNotReady         = "not_ready"
+	ErrorCodeSessionNotFound  = "session_not_found"
+	ErrorCodeSnapshotNotFound = "snapshot_not_found"
+	ErrorCodeInternal         = "internal_error"
+)
+
 func (e StatusError) Error() string {
 	switch {
 	case e.Status != "" && e.ErrorMessage != "":
@@ -66,11 +91,22 @@ type GenerateRequest struct {
 	// Raw set to true means that no formatting will be applied to the prompt.
 	Raw bool `json:"raw,omitempty"`
 
-	// Format specifies the format to return a response in.
-	Format string `json:"format"`
+	// Format specifies the format to return a response in. It is either
+	// "json" or a JSON schema object the response must conform to.
+	Format Format `json:"format"`
+
+	// Grammar is a GBNF grammar the response is constrained to. It's passed
+	// to the runner's sampler as is and can't be combined with Format.
+	Grammar string `json:"grammar,omitempty"`
+
+	// DebugRender returns the prompt sent to the model, rendered from its
+	// template, with the final response.
+	DebugRender bool `json:"debug_render,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded in memory following
-	// this request.
+	// this request. A negative value keeps the model loaded indefinitely and
+	// zero unloads it as soon as the request completes. If unset, the server
+	// default from OLLAMA_KEEP_ALIVE is used.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
 	// Images is an optional list of base64-encoded images accompanying this
@@ -80,6 +116,44 @@ type GenerateRequest struct {
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
+
+	// Logprobs is the number of most likely alternative tokens to return
+	// with their log probabilities for each generated token. Zero disables
+	// log probabilities.
+	Logprobs int `json:"logprobs,omitempty"`
+
+	// StreamStats emits periodic stats-only responses with the current eval
+	// count and elapsed durations while streaming.
+	StreamStats bool `json:"stream_stats,omitempty"`
+
+	// ContextShift controls whether older tokens are discarded when the
+	// prompt and response no longer fit in the context window. When false,
+	// generation stops with the done reason "context_full" instead. Defaults
+	// to true.
+	ContextShift *bool `json:"context_shift,omitempty"`
+
+	// Truncate cuts prompts longer than the context window down to fit.
+	// If false, such prompts are an error. Defaults to true.
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// RequestID optionally identifies the request so it can be cancelled
+	// while in flight with [Client.Cancel].
+	RequestID string `json:"request_id,omitempty"`
+
+	// Load, with an empty prompt, loads the model without generating when
+	// true and unloads it when false.
+	Load *bool `json:"load,omitempty"`
+
+	// Priority orders the request among those waiting to be scheduled.
+	// Requests with a higher priority are served first, and requests of the
+	// same priority in the order they were made.
+	Priority int `json:"priority,omitempty"`
+
+	// Think separates the reasoning of models with thinking tags in their
+	// template from the response. When true the reasoning is returned in
+	// [GenerateResponse.Thinking] and when false it's dropped. When unset the
+	// reasoning is left in the response as the model generates it.
+	Think *bool `json:"think,omitempty"`
 }
 
 // ChatRequest describes a request sent by [Client.Chat].
@@ -90,14 +164,27 @@ type ChatRequest struct {
 	// Messages is the messages of the chat - can be used to keep a chat memory.
 	Messages []Message `json:"messages"`
 
+	// System overrides the model's system message for this request. It's
+	// ignored if Messages starts with a system message.
+	System string `json:"system,omitempty"`
+
 	// Stream enable streaming of returned response; true by default.
 	Stream *bool `json:"stream,omitempty"`
 
-	// Format is the format to return the response in (e.g. "json").
-	Format string `json:"format"`
+	// Format is the format to return the response in, as in
+	// [GenerateRequest].
+	Format Format `json:"format,omitempty"`
+
+	// Grammar is a GBNF grammar the response is constrained to, as in
+	// [GenerateRequest].
+	Grammar string `json:"grammar,omitempty"`
+
+	// DebugRender returns the rendered prompt with the final response, as in
+	// [GenerateRequest].
+	DebugRender bool `json:"debug_render,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded into memory
-	// followin the request.
+	// following the request, as in [GenerateRequest].
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
 	// Tools is an optional list of tools the model has access to.
@@ -105,6 +192,31 @@ type ChatRequest struct {
 
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
+
+	// StreamStats is the same as [GenerateRequest.StreamStats].
+	StreamStats bool `json:"stream_stats,omitempty"`
+
+	// Truncate is the same as [GenerateRequest.Truncate]. Chat prompts are
+	// truncated by leaving out the oldest messages.
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// RequestID is the same as [GenerateRequest.RequestID].
+	RequestID string `json:"request_id,omitempty"`
+
+	// Priority is the same as [GenerateRequest.Priority].
+	Priority int `json:"priority,omitempty"`
+
+	// Think is the same as [GenerateRequest.Think] with the reasoning
+	// returned in [Message.Thinking].
+	Think *bool `json:"think,omitempty"`
+
+	// Session starts a session in which the server keeps the messages of
+	// the chat. Its ID is returned in the final [ChatResponse].
+	Session bool `json:"session,omitempty"`
+
+	// SessionID continues a session, so Messages only holds the messages
+	// since its last request.
+	SessionID string `json:"session_id,omitempty"`
 }
 
 type Tools []Tool
@@ -123,8 +235,11 @@ func (t Tool) String() string {
 // role ("system", "user", or "assistant"), the content and an optional list
 // of images.
 type Message struct {
-	Role      string      `json:"role"`
-	Content   string      `json:"content"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Thinking is the reasoning of the model before Content when requested
+	// with [ChatRequest.Think].
+	Thinking  string      `json:"thinking,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
 }
@@ -142,12 +257,19 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 }
 
 type ToolCall struct {
+	// Index identifies the tool call a streamed fragment belongs to.
+	Index    int              `json:"index,omitempty"`
 	Function ToolCallFunction `json:"function"`
 }
 
 type ToolCallFunction struct {
 	Name      string                    `json:"name"`
 	Arguments ToolCallFunctionArguments `json:"arguments"`
+
+	// PartialArguments is a fragment of the JSON encoded arguments, sent while
+	// a streamed tool call is generated. The fragments of a tool call
+	// concatenate to its complete arguments.
+	PartialArguments string `json:"partial_arguments,omitempty"`
 }
 
 type ToolCallFunctionArguments map[string]any
@@ -176,6 +298,22 @@ type ToolFunction struct {
 	} `json:"parameters"`
 }
 
+// UnmarshalJSON names the function in errors decoding its definition
+func (t *ToolFunction) UnmarshalJSON(b []byte) error {
+	type Alias ToolFunction
+	var a Alias
+	if err := json.Unmarshal(b, &a); err != nil {
+		if a.Name != "" {
+			return fmt.Errorf("invalid tool %q: %w", a.Name, err)
+		}
+
+		return err
+	}
+
+	*t = ToolFunction(a)
+	return nil
+}
+
 func (t *ToolFunction) String() string {
 	bts, _ := json.Marshal(t)
 	return string(bts)
@@ -191,6 +329,18 @@ type ChatResponse struct {
 
 	Done bool `json:"done"`
 
+	// Seed is the seed the response was sampled with, chosen at random if
+	// the request didn't set one. It's only set on the final response.
+	Seed *int `json:"seed,omitempty"`
+
+	// RenderedPrompt is the prompt sent to the model when requested with
+	// [ChatRequest.DebugRender]. It's only set on the final response.
+	RenderedPrompt string `json:"rendered_prompt,omitempty"`
+
+	// SessionID is the ID of the session of the request, if it has one.
+	// It's only set on the final response.
+	SessionID string `json:"session_id,omitempty"`
+
 	Metrics
 }
 
@@ -227,6 +377,7 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+	StopRegex        []string `json:"stop_regex,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -242,6 +393,10 @@ type Runner struct {
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	UseMLock  bool  `json:"use_mlock,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// NumReplicas is the number of instances of the model loaded to share
+	// its requests, overriding OLLAMA_NUM_REPLICAS
+	NumReplicas int `json:"num_replicas,omitempty"`
 }
 
 // EmbedRequest is the request passed to [Client.Embed].
@@ -256,8 +411,17 @@ type EmbedRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Truncate cuts inputs longer than the context length down to fit.
+	// If false, such inputs are an error. Defaults to true.
 	Truncate *bool `json:"truncate,omitempty"`
 
+	// Normalize scales embeddings to unit length. Defaults to true.
+	Normalize *bool `json:"normalize,omitempty"`
+
+	// Stream reports the progress of embedding the inputs before the
+	// embeddings. Defaults to false.
+	Stream *bool `json:"stream,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -272,6 +436,143 @@ type EmbedResponse struct {
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
 }
 
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is the text to tokenize.
+	Prompt string `json:"prompt"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+	Count  int   `json:"count"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens are the tokens to convert back to text.
+	Tokens []int `json:"tokens"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Prompt string `json:"prompt"`
+}
+
+// CacheSaveRequest is the request passed to [Client.SaveCache].
+type CacheSaveRequest struct {
+	// Model is the model of the session.
+	Model string `json:"model"`
+
+	// SessionID is the chat session whose cache is saved.
+	SessionID string `json:"session_id"`
+}
+
+// CacheSaveResponse is the response from [Client.SaveCache].
+type CacheSaveResponse struct {
+	// Token identifies the snapshot to restore it.
+	Token string `json:"token"`
+
+	// ExpiresAt is when the snapshot is removed.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CacheRestoreRequest is the request passed to [Client.RestoreCache].
+type CacheRestoreRequest struct {
+	// Token is the token of the snapshot.
+	Token string `json:"token"`
+}
+
+// CacheRestoreResponse is the response from [Client.RestoreCache].
+type CacheRestoreResponse struct {
+	// Model is the model of the session.
+	Model string `json:"model"`
+
+	// SessionID is the chat session restored to the snapshot.
+	SessionID string `json:"session_id"`
+}
+
+// RenderRequest is the request passed to [Client.Render].
+type RenderRequest struct {
+	// Model is the name of the model whose template, system message and
+	// messages are rendered.
+	Model string `json:"model,omitempty"`
+
+	// Template overrides the template of Model. It's required if Model is
+	// empty.
+	Template string `json:"template,omitempty"`
+
+	// System overrides the system message of Model.
+	System string `json:"system,omitempty"`
+
+	// Messages are the messages of the chat to render.
+	Messages []Message `json:"messages"`
+
+	// Tools are the tools available to the model.
+	Tools `json:"tools,omitempty"`
+}
+
+// RenderResponse is the response from [Client.Render].
+type RenderResponse struct {
+	// Prompt is the rendered prompt.
+	Prompt string `json:"prompt"`
+}
+
+// EstimateRequest is the request passed to [Client.Estimate].
+type EstimateRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// NumCtx, NumGPU and NumBatch override the options of the model, as
+	// the options of a request to it would.
+	NumCtx   *int `json:"num_ctx,omitempty"`
+	NumGPU   *int `json:"num_gpu,omitempty"`
+	NumBatch *int `json:"num_batch,omitempty"`
+}
+
+// EstimateResponse is the response from [Client.Estimate]. It describes how
+// the model would be loaded given the memory free now.
+type EstimateResponse struct {
+	Model string `json:"model"`
+
+	// Library is the library of the GPUs the model would be loaded on, or
+	// "cpu" if none of it would be offloaded.
+	Library string `json:"library"`
+
+	// Size is the memory the model would take in total, of which SizeVRAM
+	// would be on GPUs and SizeRAM in system memory.
+	Size     int64 `json:"size"`
+	SizeVRAM int64 `json:"size_vram"`
+	SizeRAM  int64 `json:"size_ram"`
+
+	ContextLength int `json:"context_length"`
+	GPULayers     int `json:"gpu_layers"`
+	CPULayers     int `json:"cpu_layers"`
+
+	// GPUs are the GPUs the model would be loaded on.
+	GPUs []EstimateGPU `json:"gpus,omitempty"`
+}
+
+// EstimateGPU is the part of the model that would be loaded on a GPU in
+// [EstimateResponse].
+type EstimateGPU struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Library string `json:"library"`
+
+	// Size is the memory the model would take on the GPU, out of the
+	// FreeMemory left by the models already loaded and TotalMemory.
+	Size        int64 `json:"size"`
+	FreeMemory  int64 `json:"free_memory"`
+	TotalMemory int64 `json:"total_memory"`
+}
+
 // EmbeddingRequest is the request passed to [Client.Embeddings].
 type EmbeddingRequest struct {
 	// Model is the model name.
@@ -300,6 +601,10 @@ type CreateRequest struct {
 	Stream    *bool  `json:"stream,omitempty"`
 	Quantize  string `json:"quantize,omitempty"`
 
+	// DryRun plans the layers of the model without writing them. The plan is
+	// reported in the Layers of the final [ProgressResponse].
+	DryRun bool `json:"dry_run,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 
@@ -318,6 +623,28 @@ type DeleteRequest struct {
 	Name string `json:"name"`
 }
 
+// PruneRequest is the request passed to [Client.Prune].
+type PruneRequest struct {
+	// DryRun reports the blobs that would be removed without removing them
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// PruneResponse is the response returned from [Client.Prune].
+type PruneResponse struct {
+	// Blobs are the removed blobs, or with DryRun the blobs that would be
+	// removed
+	Blobs []PrunedBlob `json:"blobs,omitempty"`
+
+	// Size is the total size of Blobs in bytes
+	Size int64 `json:"size"`
+}
+
+// PrunedBlob is a blob that no model references.
+type PrunedBlob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
 // ShowRequest is the request passed to [Client.Show].
 type ShowRequest struct {
 	Model  string `json:"model"`
@@ -329,10 +656,80 @@ type ShowRequest struct {
 
 	Options map[string]interface{} `json:"options"`
 
+	// ShowTemplate, ShowParameters and ShowSystem limit the response to the
+	// selected sections and the model info. They're encoded as
+	// "template": true, "parameters": true and "system": true, so
+	// ShowTemplate and ShowSystem take precedence over Template and System.
+	ShowTemplate   bool `json:"-"`
+	ShowParameters bool `json:"parameters,omitempty"`
+	ShowSystem     bool `json:"-"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
 
+func (r ShowRequest) MarshalJSON() ([]byte, error) {
+	type Alias ShowRequest
+	a := struct {
+		Alias
+		System   any `json:"system,omitempty"`
+		Template any `json:"template,omitempty"`
+	}{Alias: Alias(r)}
+
+	if r.ShowSystem {
+		a.System = true
+	} else if r.System != "" {
+		a.System = r.System
+	}
+
+	if r.ShowTemplate {
+		a.Template = true
+	} else if r.Template != "" {
+		a.Template = r.Template
+	}
+
+	return json.Marshal(a)
+}
+
+func (r *ShowRequest) UnmarshalJSON(b []byte) error {
+	type Alias ShowRequest
+	var a struct {
+		Alias
+		System   json.RawMessage `json:"system"`
+		Template json.RawMessage `json:"template"`
+	}
+
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+
+	*r = ShowRequest(a.Alias)
+
+	// system and template are either strings or booleans selecting a section
+	for _, f := range []struct {
+		raw  json.RawMessage
+		s    *string
+		show *bool
+	}{
+		{a.System, &r.System, &r.ShowSystem},
+		{a.Template, &r.Template, &r.ShowTemplate},
+	} {
+		if len(f.raw) == 0 || string(f.raw) == "null" {
+			continue
+		}
+
+		if err := json.Unmarshal(f.raw, f.show); err == nil {
+			continue
+		}
+
+		if err := json.Unmarshal(f.raw, f.s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // ShowResponse is the response returned from [Client.Show].
 type ShowResponse struct {
 	License       string         `json:"license,omitempty"`
@@ -345,12 +742,26 @@ type ShowResponse struct {
 	ModelInfo     map[string]any `json:"model_info,omitempty"`
 	ProjectorInfo map[string]any `json:"projector_info,omitempty"`
 	ModifiedAt    time.Time      `json:"modified_at,omitempty"`
+
+	// Capabilities are what the model supports: "completion", "vision",
+	// "tools", "embedding" and "insert"
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
 type CopyRequest struct {
 	Source      string `json:"source"`
 	Destination string `json:"destination"`
+
+	// Stream specifies whether progress is streamed; it is false by default
+	// and always true for [Client.CopyWithProgress].
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// AliasRequest is the request passed to [Client.Alias].
+type AliasRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
 }
 
 // PullRequest is the request passed to [Client.Pull].
@@ -365,6 +776,19 @@ type PullRequest struct {
 	Name string `json:"name"`
 }
 
+// VersionResponse is the response returned by [Client.ServerVersion].
+type VersionResponse struct {
+	// Version is the version of the server build
+	Version string `json:"version"`
+
+	// APIVersion is the semantic version of the API
+	APIVersion string `json:"api_version"`
+
+	// Capabilities are the endpoints and request features the server
+	// supports, e.g. "embed" or "tools"
+	Capabilities []string `json:"capabilities"`
+}
+
 // ProgressResponse is the response passed to progress functions like
 // [PullProgressFunc] and [PushProgressFunc].
 type ProgressResponse struct {
@@ -372,6 +796,24 @@ type ProgressResponse struct {
 	Digest    string `json:"digest,omitempty"`
 	Total     int64  `json:"total,omitempty"`
 	Completed int64  `json:"completed,omitempty"`
+
+	// Layers are the planned layers of a dry run create
+	Layers []PlannedLayer `json:"layers,omitempty"`
+}
+
+// PlannedLayer is a layer a dry run [Client.Create] would write.
+type PlannedLayer struct {
+	MediaType string `json:"media_type"`
+
+	// Digest is empty if the layer isn't known until it's created, e.g.
+	// when it's quantized
+	Digest string `json:"digest,omitempty"`
+
+	// Size is the estimated size of the layer in bytes
+	Size int64 `json:"size"`
+
+	// From is the model the layer is inherited from, if any
+	From string `json:"from,omitempty"`
 }
 
 // PushRequest is the request passed to [Client.Push].
@@ -406,15 +848,38 @@ type ListModelResponse struct {
 	Details    ModelDetails `json:"details,omitempty"`
 }
 
+// ReloadRequest is the request passed to [Client.Reload].
+type ReloadRequest struct {
+	Model string `json:"model"`
+
+	// KeepAlive controls how long the reloaded model will stay loaded into
+	// memory after the request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+}
+
 // ProcessModelResponse is a single model description in [ProcessResponse].
 type ProcessModelResponse struct {
-	Name      string       `json:"name"`
-	Model     string       `json:"model"`
-	Size      int64        `json:"size"`
-	Digest    string       `json:"digest"`
-	Details   ModelDetails `json:"details,omitempty"`
-	ExpiresAt time.Time    `json:"expires_at"`
-	SizeVRAM  int64        `json:"size_vram"`
+	Name          string       `json:"name"`
+	Model         string       `json:"model"`
+	Size          int64        `json:"size"`
+	Digest        string       `json:"digest"`
+	Details       ModelDetails `json:"details,omitempty"`
+	ExpiresAt     time.Time    `json:"expires_at"`
+	SizeVRAM      int64        `json:"size_vram"`
+	ContextLength int          `json:"context_length"`
+	GPULayers     int          `json:"gpu_layers"`
+	CPULayers     int          `json:"cpu_layers"`
+
+	// Replica is the index of the instance of a model loaded several times
+	Replica int `json:"replica,omitempty"`
+}
+
+// EventResponse is a scheduler event streamed by the /api/events endpoint.
+type EventResponse struct {
+	// Type is one of "load", "unload", "queued", "completed" or "crash".
+	Type      string    `json:"type"`
+	Model     string    `json:"model"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type RetrieveModelResponse struct {
@@ -439,6 +904,10 @@ type GenerateResponse struct {
 	// Response is the textual response itself.
 	Response string `json:"response"`
 
+	// Thinking is the reasoning of the model before Response when requested
+	// with [GenerateRequest.Think].
+	Thinking string `json:"thinking,omitempty"`
+
 	// Done specifies if the response is complete.
 	Done bool `json:"done"`
 
@@ -449,9 +918,104 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs contains the log probabilities of the tokens in Response when
+	// requested with [GenerateRequest.Logprobs].
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
+	// Seed is the seed the response was sampled with, chosen at random if
+	// the request didn't set one. It's only set on the final response.
+	Seed *int `json:"seed,omitempty"`
+
+	// RenderedPrompt is the prompt sent to the model when requested with
+	// [GenerateRequest.DebugRender]. It's only set on the final response.
+	RenderedPrompt string `json:"rendered_prompt,omitempty"`
+
 	Metrics
 }
 
+// GenerateBatchRequest describes a request sent by [Client.GenerateBatch].
+type GenerateBatchRequest struct {
+	// Model is the model name, as in [GenerateRequest].
+	Model string `json:"model"`
+
+	// Requests are the independent prompts to generate completions of.
+	Requests []GenerateBatchItem `json:"requests"`
+
+	// Options are the options of every request, under the options of each.
+	// Options which change how the model is loaded, such as num_ctx, are
+	// only taken from here.
+	Options map[string]any `json:"options,omitempty"`
+
+	// KeepAlive is the same as [GenerateRequest.KeepAlive].
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+}
+
+// GenerateBatchItem is a prompt of a [GenerateBatchRequest].
+type GenerateBatchItem struct {
+	// Prompt is the textual prompt to send to the model.
+	Prompt string `json:"prompt"`
+
+	// System overrides the model's default system message/prompt.
+	System string `json:"system,omitempty"`
+
+	// Options lists model-specific options of this prompt.
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// GenerateBatchResponse is the response returned by [Client.GenerateBatch].
+type GenerateBatchResponse struct {
+	// Model is the model name that generated the responses.
+	Model string `json:"model"`
+
+	// CreatedAt is the timestamp of the response.
+	CreatedAt time.Time `json:"created_at"`
+
+	// Responses are the completions of the requests in the same order.
+	Responses []GenerateBatchResult `json:"responses"`
+
+	// TotalDuration is the time spent generating every completion.
+	TotalDuration time.Duration `json:"total_duration,omitempty"`
+
+	// LoadDuration is the time spent loading the model.
+	LoadDuration time.Duration `json:"load_duration,omitempty"`
+}
+
+// GenerateBatchResult is the completion of a [GenerateBatchItem]. A request
+// that failed has an Error and no Response.
+type GenerateBatchResult struct {
+	// Response is the textual response itself.
+	Response string `json:"response"`
+
+	// DoneReason is the reason the model stopped generating text.
+	DoneReason string `json:"done_reason,omitempty"`
+
+	// Error is the error message of a request that failed.
+	Error string `json:"error,omitempty"`
+
+	// Code is the [StatusError] code of Error.
+	Code string `json:"code,omitempty"`
+
+	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int           `json:"eval_count,omitempty"`
+	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+}
+
+// TokenLogprob is the log probability of a generated token along with the
+// most likely alternatives at its position. Logprob is nil if the runner
+// only reported the probabilities of alternatives the token isn't among.
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     *float64     `json:"logprob,omitempty"`
+	TopLogprobs []TopLogprob `json:"top_logprobs,omitempty"`
+}
+
+// TopLogprob is a candidate token and its log probability.
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -620,6 +1184,44 @@ func DefaultOptions() Options {
 	}
 }
 
+// Format is the format of a response: empty, "json", or a JSON schema object
+// the response must conform to. It's decoded from a JSON string or object and
+// a schema is kept as its JSON text, so "json" can be set as a string.
+type Format string
+
+// IsSchema reports whether f is a JSON schema object
+func (f Format) IsSchema() bool {
+	return strings.HasPrefix(strings.TrimSpace(string(f)), "{")
+}
+
+func (f Format) MarshalJSON() ([]byte, error) {
+	if f.IsSchema() && json.Valid([]byte(f)) {
+		return []byte(f), nil
+	}
+
+	return json.Marshal(string(f))
+}
+
+func (f *Format) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch t := v.(type) {
+	case nil:
+		*f = ""
+	case string:
+		*f = Format(t)
+	case map[string]any:
+		*f = Format(strings.TrimSpace(string(b)))
+	default:
+		return fmt.Errorf("invalid format: %s; expected \"json\" or a JSON schema object", b)
+	}
+
+	return nil
+}
+
 type Duration struct {
 	time.Duration
 }
@@ -649,7 +1251,12 @@ func (d *Duration) UnmarshalJSON(b []byte) (err error) {
 	case string:
 		d.Duration, err = time.ParseDuration(t)
 		if err != nil {
-			return err
+			// a string without a unit is a number of seconds
+			n, nerr := strconv.ParseFloat(t, 64)
+			if nerr != nil {
+				return err
+			}
+			d.Duration = time.Duration(int(n) * int(time.Second))
 		}
 		if d.Duration < 0 {
 			d.Duration = time.Duration(math.MaxInt64)
@@ -107,6 +107,83 @@ func TestDurationMarshalUnmarshal(t *testing.T) {
 	}
 }
 
+func TestFormatJSON(t *testing.T) {
+	cases := map[string]struct {
+		format Format
+		json   string
+	}{
+		"empty":  {"", `""`},
+		"json":   {"json", `"json"`},
+		"schema": {`{"type":"object"}`, `{"type":"object"}`},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			b, err := json.Marshal(tt.format)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.json, string(b))
+
+			var f Format
+			require.NoError(t, json.Unmarshal(b, &f))
+			assert.Equal(t, tt.format, f)
+		})
+	}
+
+	t.Run("requests", func(t *testing.T) {
+		// both requests accept a string or a schema object
+		for _, body := range []string{`{"format":"json"}`, `{"format":{"type":"object"}}`} {
+			var generate GenerateRequest
+			require.NoError(t, json.Unmarshal([]byte(body), &generate))
+
+			var chat ChatRequest
+			require.NoError(t, json.Unmarshal([]byte(body), &chat))
+			assert.Equal(t, generate.Format, chat.Format)
+		}
+
+		var req ChatRequest
+		require.NoError(t, json.Unmarshal([]byte(`{"format":null}`), &req))
+		assert.Empty(t, req.Format)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, body := range []string{`42`, `["json"]`, `true`} {
+			var f Format
+			assert.Error(t, json.Unmarshal([]byte(body), &f), body)
+		}
+	})
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+	}{
+		{`0`, 0},
+		{`30`, 30 * time.Second},
+		{`"2.5"`, 2 * time.Second},
+		{`-1`, time.Duration(math.MaxInt64)},
+		{`"0"`, 0},
+		{`"30"`, 30 * time.Second},
+		{`"-1"`, time.Duration(math.MaxInt64)},
+		{`"10m"`, 10 * time.Minute},
+		{`"-10m"`, time.Duration(math.MaxInt64)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			var d Duration
+			require.NoError(t, json.Unmarshal([]byte(test.input), &d))
+			assert.Equal(t, test.expected, d.Duration)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		var d Duration
+		assert.Error(t, json.Unmarshal([]byte(`"soon"`), &d))
+		assert.Error(t, json.Unmarshal([]byte(`true`), &d))
+	})
+}
+
 func TestUseMmapParsingFromJSON(t *testing.T) {
 	tr := true
 	fa := false
@@ -231,3 +308,46 @@ func TestMessage_UnmarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestToolFunction_UnmarshalJSON(t *testing.T) {
+	var f ToolFunction
+	err := json.Unmarshal([]byte(`{"name": "get_weather", "parameters": "location"}`), &f)
+	require.ErrorContains(t, err, `invalid tool "get_weather": `)
+
+	err = json.Unmarshal([]byte(`{"parameters": []}`), &f)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "invalid tool")
+
+	require.NoError(t, json.Unmarshal([]byte(`{"name": "get_weather", "parameters": {"type": "object"}}`), &f))
+	assert.Equal(t, "get_weather", f.Name)
+	assert.Equal(t, "object", f.Parameters.Type)
+}
+
+func TestShowRequestJSON(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected ShowRequest
+	}{
+		{`{"model": "m"}`, ShowRequest{Model: "m"}},
+		{`{"model": "m", "system": "You are a pirate."}`, ShowRequest{Model: "m", System: "You are a pirate."}},
+		{`{"model": "m", "system": true, "template": true, "parameters": true}`, ShowRequest{Model: "m", ShowSystem: true, ShowTemplate: true, ShowParameters: true}},
+		{`{"model": "m", "system": false, "template": null}`, ShowRequest{Model: "m"}},
+	}
+
+	for _, test := range tests {
+		var req ShowRequest
+		require.NoError(t, json.Unmarshal([]byte(test.input), &req), test.input)
+		assert.Equal(t, test.expected, req, test.input)
+
+		// requests round trip through the client's encoding
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+
+		var roundTrip ShowRequest
+		require.NoError(t, json.Unmarshal(b, &roundTrip), string(b))
+		assert.Equal(t, test.expected, roundTrip, string(b))
+	}
+
+	var req ShowRequest
+	assert.Error(t, json.Unmarshal([]byte(`{"system": 1}`), &req))
+}
@@ -4,17 +4,18 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -26,6 +27,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/containerd/console"
@@ -73,20 +75,39 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if err := modelfile.ReadFiles(filepath.Dir(filename)); err != nil {
+		return err
+	}
+
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
 
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
 	status := "transferring model data"
+	if dryRun {
+		status = "planning model"
+	}
+
 	spinner := progress.NewSpinner(status)
 	p.Add(status, spinner)
 	defer p.Stop()
 
 	for i := range modelfile.Commands {
 		switch modelfile.Commands[i].Name {
-		case "model", "adapter":
-			path := modelfile.Commands[i].Args
+		case "model", "adapter", "merge":
+			// adapters may be followed by a weight which is kept as is
+			adapter := parser.Adapter{Path: modelfile.Commands[i].Args, Weight: 1}
+			if modelfile.Commands[i].Name == "adapter" {
+				adapter, err = parser.ParseAdapter(modelfile.Commands[i].Args)
+				if err != nil {
+					return err
+				}
+			}
+
+			path := adapter.Path
 			if path == "~" {
 				path = home
 			} else if strings.HasPrefix(path, "~/") {
@@ -104,6 +125,14 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 				return err
 			}
 
+			// a dry run reads local files and directories from the server's
+			// filesystem so it doesn't transfer blobs to it
+			if dryRun {
+				adapter.Path = path
+				modelfile.Commands[i].Args = adapter.String()
+				continue
+			}
+
 			if fi.IsDir() {
 				// this is likely a safetensors or pytorch directory
 				// TODO make this work w/ adapters
@@ -121,12 +150,19 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 				return err
 			}
 
-			modelfile.Commands[i].Args = "@" + digest
+			adapter.Path = "@" + digest
+			modelfile.Commands[i].Args = adapter.String()
 		}
 	}
 
+	var planned []api.PlannedLayer
+	var quantizing *progress.Bar
 	bars := make(map[string]*progress.Bar)
 	fn := func(resp api.ProgressResponse) error {
+		if resp.Layers != nil {
+			planned = resp.Layers
+		}
+
 		if resp.Digest != "" {
 			spinner.Stop()
 
@@ -138,6 +174,16 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 			}
 
 			bar.Set(resp.Completed)
+		} else if resp.Total > 0 {
+			// quantization reports the tensors quantized without a digest
+			spinner.Stop()
+
+			if quantizing == nil {
+				quantizing = progress.NewCountBar("quantizing tensors", resp.Total, resp.Completed)
+				p.Add("quantizing", quantizing)
+			}
+
+			quantizing.Set(resp.Completed)
 		} else if status != resp.Status {
 			spinner.Stop()
 
@@ -151,14 +197,46 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 
 	quantize, _ := cmd.Flags().GetString("quantize")
 
-	request := api.CreateRequest{Name: args[0], Modelfile: modelfile.String(), Quantize: quantize}
+	request := api.CreateRequest{Name: args[0], Modelfile: modelfile.String(), Quantize: quantize, DryRun: dryRun}
 	if err := client.Create(cmd.Context(), &request, fn); err != nil {
 		return err
 	}
 
+	if dryRun {
+		p.Stop()
+		printLayerPlan(planned)
+	}
+
 	return nil
 }
 
+func printLayerPlan(layers []api.PlannedLayer) {
+	var data [][]string
+	var total int64
+	for _, layer := range layers {
+		digest := "-"
+		if layer.Digest != "" {
+			digest = strings.TrimPrefix(layer.Digest, "sha256:")[:12]
+		}
+
+		data = append(data, []string{layer.MediaType, digest, format.HumanBytes(layer.Size), cmp.Or(layer.From, "-")})
+		total += layer.Size
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"MEDIA TYPE", "DIGEST", "SIZE", "FROM"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	fmt.Printf("\n%d layers, %s total\n", len(layers), format.HumanBytes(total))
+}
+
 func tempZipFiles(path string) (string, error) {
 	tempfile, err := os.CreateTemp("", "ollama-tf")
 	if err != nil {
@@ -545,7 +623,7 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 
 			bar, ok := bars[resp.Digest]
 			if !ok {
-				bar = progress.NewBar(fmt.Sprintf("pushing %s...", resp.Digest[7:19]), resp.Total, resp.Completed)
+				bar = progress.NewBar(resp.Status+"...", resp.Total, resp.Completed)
 				bars[resp.Digest] = bar
 				p.Add(resp.Digest, bar)
 			}
@@ -588,22 +666,41 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 }
 
 func ListHandler(cmd *cobra.Command, args []string) error {
+	outputFormat, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	return listModels(cmd.Context(), args, outputFormat)
+}
+
+// listModels lists the models starting with args[0], if given, in a table
+// or in outputFormat
+func listModels(ctx context.Context, args []string, outputFormat string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
 		return err
 	}
 
-	models, err := client.List(cmd.Context())
+	models, err := client.List(ctx)
 	if err != nil {
 		return err
 	}
 
+	if len(args) > 0 {
+		models.Models = slices.DeleteFunc(models.Models, func(m api.ListModelResponse) bool {
+			return !strings.HasPrefix(m.Name, args[0])
+		})
+	}
+
+	if outputFormat != "" {
+		return writeFormatted(os.Stdout, outputFormat, models, models.Models)
+	}
+
 	var data [][]string
 
 	for _, m := range models.Models {
-		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")})
-		}
+		data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")})
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
@@ -626,42 +723,60 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	outputFormat, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
 	models, err := client.ListRunning(cmd.Context())
 	if err != nil {
 		return err
 	}
 
+	if len(args) > 0 {
+		models.Models = slices.DeleteFunc(models.Models, func(m api.ProcessModelResponse) bool {
+			return !strings.HasPrefix(m.Name, args[0])
+		})
+	}
+
+	if outputFormat != "" {
+		return writeFormatted(os.Stdout, outputFormat, models, models.Models)
+	}
+
 	var data [][]string
 
 	for _, m := range models.Models {
-		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
-			var procStr string
-			switch {
-			case m.SizeVRAM == 0:
-				procStr = "100% CPU"
-			case m.SizeVRAM == m.Size:
-				procStr = "100% GPU"
-			case m.SizeVRAM > m.Size || m.Size == 0:
-				procStr = "Unknown"
-			default:
-				sizeCPU := m.Size - m.SizeVRAM
-				cpuPercent := math.Round(float64(sizeCPU) / float64(m.Size) * 100)
-				procStr = fmt.Sprintf("%d%%/%d%% CPU/GPU", int(cpuPercent), int(100-cpuPercent))
-			}
+		var procStr string
+		switch {
+		case m.SizeVRAM == 0:
+			procStr = "100% CPU"
+		case m.SizeVRAM == m.Size:
+			procStr = "100% GPU"
+		case m.SizeVRAM > m.Size || m.Size == 0:
+			procStr = "Unknown"
+		default:
+			sizeCPU := m.Size - m.SizeVRAM
+			cpuPercent := math.Round(float64(sizeCPU) / float64(m.Size) * 100)
+			procStr = fmt.Sprintf("%d%%/%d%% CPU/GPU", int(cpuPercent), int(100-cpuPercent))
+		}
 
-			var until string
-			delta := time.Since(m.ExpiresAt)
-			if delta > 0 {
-				until = "Stopping..."
-			} else {
-				until = format.HumanTime(m.ExpiresAt, "Never")
-			}
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, until})
+		var until string
+		delta := time.Since(m.ExpiresAt)
+		if delta > 0 {
+			until = "Stopping..."
+		} else {
+			until = format.HumanTime(m.ExpiresAt, "Never")
 		}
+		var layers string
+		if total := m.GPULayers + m.CPULayers; total > 0 {
+			layers = fmt.Sprintf("%d/%d GPU", m.GPULayers, total)
+		}
+
+		data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, layers, strconv.Itoa(m.ContextLength), until})
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"NAME", "ID", "SIZE", "PROCESSOR", "UNTIL"})
+	table.SetHeader([]string{"NAME", "ID", "SIZE", "PROCESSOR", "LAYERS", "CONTEXT", "UNTIL"})
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetHeaderLine(false)
@@ -701,6 +816,40 @@ func DeleteHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func PruneHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Prune(cmd.Context(), &api.PruneRequest{DryRun: dryRun})
+	if err != nil {
+		return err
+	}
+
+	verb := "deleted"
+	if dryRun {
+		verb = "would delete"
+	}
+
+	for _, blob := range resp.Blobs {
+		fmt.Printf("%s '%s' (%s)\n", verb, blob.Digest, format.HumanBytes(blob.Size))
+	}
+
+	if dryRun {
+		fmt.Printf("%d unused blobs, %s would be reclaimed\n", len(resp.Blobs), format.HumanBytes(resp.Size))
+	} else {
+		fmt.Printf("%d unused blobs, %s reclaimed\n", len(resp.Blobs), format.HumanBytes(resp.Size))
+	}
+
+	return nil
+}
+
 func ShowHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
@@ -751,7 +900,21 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', or '--template' can be specified")
 	}
 
-	req := api.ShowRequest{Name: args[0]}
+	outputFormat, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	if flagsSet == 1 && outputFormat != "" {
+		return fmt.Errorf("'--format' can't be specified with '--%s'", showType)
+	}
+
+	req := api.ShowRequest{
+		Name:           args[0],
+		ShowParameters: showType == "parameters",
+		ShowSystem:     showType == "system",
+		ShowTemplate:   showType == "template",
+	}
 	resp, err := client.Show(cmd.Context(), &req)
 	if err != nil {
 		return err
@@ -774,9 +937,41 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	if outputFormat != "" {
+		return writeFormatted(os.Stdout, outputFormat, resp, []*api.ShowResponse{resp})
+	}
+
 	return showInfo(resp, os.Stdout)
 }
 
+// writeFormatted writes resp to w as indented JSON when outputFormat is
+// "json". Otherwise outputFormat is a Go template executed on each of items
+// followed by a new line, e.g. '{{.Name}}' for each model of a list.
+func writeFormatted[T any](w io.Writer, outputFormat string, resp any, items []T) error {
+	if outputFormat == "json" {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(resp)
+	}
+
+	tmpl, err := template.New("format").Parse(outputFormat)
+	if err != nil {
+		return fmt.Errorf("invalid format: %w", err)
+	}
+
+	for _, item := range items {
+		if err := tmpl.Execute(w, item); err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func showInfo(resp *api.ShowResponse, w io.Writer) error {
 	tableRender := func(header string, rows func() [][]string) {
 		fmt.Fprintln(w, " ", header)
@@ -865,14 +1060,65 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	p := progress.NewProgress(os.Stderr)
+
+	bars := make(map[string]*progress.Bar)
+	var status string
+	var spinner *progress.Spinner
+
+	fn := func(resp api.ProgressResponse) error {
+		if resp.Digest != "" {
+			if spinner != nil {
+				spinner.Stop()
+			}
+
+			bar, ok := bars[resp.Digest]
+			if !ok {
+				bar = progress.NewBar(fmt.Sprintf("copying %s...", resp.Digest[7:19]), resp.Total, resp.Completed)
+				bars[resp.Digest] = bar
+				p.Add(resp.Digest, bar)
+			}
+
+			bar.Set(resp.Completed)
+		} else if status != resp.Status && resp.Status != "success" {
+			if spinner != nil {
+				spinner.Stop()
+			}
+
+			status = resp.Status
+			spinner = progress.NewSpinner(status)
+			p.Add(status, spinner)
+		}
+
+		return nil
+	}
+
 	req := api.CopyRequest{Source: args[0], Destination: args[1]}
-	if err := client.Copy(cmd.Context(), &req); err != nil {
+	err = client.CopyWithProgress(cmd.Context(), &req, fn)
+	p.Stop()
+	if err != nil {
 		return err
 	}
+
 	fmt.Printf("copied '%s' to '%s'\n", args[0], args[1])
 	return nil
 }
 
+func AliasHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	req := api.AliasRequest{Source: args[0], Destination: args[1]}
+	if err := client.Alias(cmd.Context(), &req); err != nil {
+		return err
+	}
+
+	fmt.Printf("aliased '%s' as '%s'\n", args[0], args[1])
+	return nil
+}
+
 func PullHandler(cmd *cobra.Command, args []string) error {
 	insecure, err := cmd.Flags().GetBool("insecure")
 	if err != nil {
@@ -1041,10 +1287,13 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 	req := &api.ChatRequest{
 		Model:    opts.Model,
 		Messages: opts.Messages,
-		Format:   opts.Format,
 		Options:  opts.Options,
 	}
 
+	if opts.Format != "" {
+		req.Format = api.Format(opts.Format)
+	}
+
 	if opts.KeepAlive != nil {
 		req.KeepAlive = opts.KeepAlive
 	}
@@ -1128,7 +1377,7 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		Prompt:    opts.Prompt,
 		Context:   generateContext,
 		Images:    opts.Images,
-		Format:    opts.Format,
+		Format:    api.Format(opts.Format),
 		System:    opts.System,
 		Options:   opts.Options,
 		KeepAlive: opts.KeepAlive,
@@ -1166,11 +1415,17 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 }
 
 func RunServer(_ *cobra.Command, _ []string) error {
+	if path := envconfig.EnvFile(); path != "" {
+		if err := envconfig.LoadConfigFile(path); err != nil {
+			return err
+		}
+	}
+
 	if err := initializeKeypair(); err != nil {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", envconfig.Host().Host)
+	ln, err := server.Listen(envconfig.Host())
 	if err != nil {
 		return err
 	}
@@ -1318,6 +1573,7 @@ func NewCLI() *cobra.Command {
 
 	createCmd.Flags().StringP("file", "f", "Modelfile", "Name of the Modelfile")
 	createCmd.Flags().StringP("quantize", "q", "", "Quantize model to this level (e.g. q4_0)")
+	createCmd.Flags().Bool("dry-run", false, "Print the layers that would be created without creating them")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
@@ -1332,6 +1588,7 @@ func NewCLI() *cobra.Command {
 	showCmd.Flags().Bool("parameters", false, "Show parameters of a model")
 	showCmd.Flags().Bool("template", false, "Show template of a model")
 	showCmd.Flags().Bool("system", false, "Show system message of a model")
+	showCmd.Flags().String("format", "", "Output format: json or a Go template (e.g. '{{.Details.Family}}')")
 
 	runCmd := &cobra.Command{
 		Use:     "run MODEL [PROMPT]",
@@ -1343,7 +1600,7 @@ func NewCLI() *cobra.Command {
 
 	runCmd.Flags().String("keepalive", "", "Duration to keep a model loaded (e.g. 5m)")
 	runCmd.Flags().Bool("verbose", false, "Show timings for response")
-	runCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	runCmd.Flags().Bool("insecure", false, "Skip TLS verification of the registry")
 	runCmd.Flags().Bool("nowordwrap", false, "Don't wrap words to the next line automatically")
 	runCmd.Flags().String("format", "", "Response format (e.g. json)")
 
@@ -1371,7 +1628,7 @@ func NewCLI() *cobra.Command {
 		RunE:    PullHandler,
 	}
 
-	pullCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pullCmd.Flags().Bool("insecure", false, "Skip TLS verification of the registry")
 
 	pushCmd := &cobra.Command{
 		Use:     "push MODEL",
@@ -1381,7 +1638,7 @@ func NewCLI() *cobra.Command {
 		RunE:    PushHandler,
 	}
 
-	pushCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pushCmd.Flags().Bool("insecure", false, "Skip TLS verification of the registry")
 
 	listCmd := &cobra.Command{
 		Use:     "list",
@@ -1391,6 +1648,8 @@ func NewCLI() *cobra.Command {
 		RunE:    ListHandler,
 	}
 
+	listCmd.Flags().String("format", "", "Output format: json or a Go template for each model (e.g. '{{.Name}}')")
+
 	psCmd := &cobra.Command{
 		Use:     "ps",
 		Short:   "List running models",
@@ -1398,6 +1657,8 @@ func NewCLI() *cobra.Command {
 		RunE:    ListRunningHandler,
 	}
 
+	psCmd.Flags().String("format", "", "Output format: json or a Go template for each model (e.g. '{{.Name}}')")
+
 	copyCmd := &cobra.Command{
 		Use:     "cp SOURCE DESTINATION",
 		Short:   "Copy a model",
@@ -1406,6 +1667,14 @@ func NewCLI() *cobra.Command {
 		RunE:    CopyHandler,
 	}
 
+	aliasCmd := &cobra.Command{
+		Use:     "alias SOURCE ALIAS",
+		Short:   "Give a model another name sharing its layers",
+		Args:    cobra.ExactArgs(2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    AliasHandler,
+	}
+
 	deleteCmd := &cobra.Command{
 		Use:     "rm MODEL [MODEL...]",
 		Short:   "Remove a model",
@@ -1414,6 +1683,16 @@ func NewCLI() *cobra.Command {
 		RunE:    DeleteHandler,
 	}
 
+	pruneCmd := &cobra.Command{
+		Use:     "prune",
+		Short:   "Remove blobs no model uses",
+		Args:    cobra.ExactArgs(0),
+		PreRunE: checkServerHeartbeat,
+		RunE:    PruneHandler,
+	}
+
+	pruneCmd.Flags().Bool("dry-run", false, "List the blobs that would be removed without removing them")
+
 	envVars := envconfig.AsMap()
 
 	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"]}
@@ -1428,7 +1707,9 @@ func NewCLI() *cobra.Command {
 		listCmd,
 		psCmd,
 		copyCmd,
+		aliasCmd,
 		deleteCmd,
+		pruneCmd,
 		serveCmd,
 	} {
 		switch cmd {
@@ -1437,20 +1718,57 @@ func NewCLI() *cobra.Command {
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["OLLAMA_DEBUG"],
+				envVars["OLLAMA_LOG_FORMAT"],
+				envVars["OLLAMA_LOG_SAMPLE"],
+				envVars["OLLAMA_LOG_LEVEL"],
+				envVars["OLLAMA_ENV_FILE"],
 				envVars["OLLAMA_HOST"],
+				envVars["OLLAMA_HTTP_IDLE_TIMEOUT"],
+				envVars["OLLAMA_HTTP_READ_TIMEOUT"],
 				envVars["OLLAMA_KEEP_ALIVE"],
 				envVars["OLLAMA_MAX_LOADED_MODELS"],
 				envVars["OLLAMA_MAX_QUEUE"],
+				envVars["OLLAMA_MAX_PULL_CONCURRENCY"],
 				envVars["OLLAMA_MODELS"],
+				envVars["OLLAMA_MODEL_RATE_LIMIT"],
 				envVars["OLLAMA_NUM_PARALLEL"],
+				envVars["OLLAMA_NUM_REPLICAS"],
 				envVars["OLLAMA_NOPRUNE"],
 				envVars["OLLAMA_ORIGINS"],
+				envVars["OLLAMA_ORIGINS_STRICT"],
+				envVars["OLLAMA_PULL_RETRIES"],
+				envVars["OLLAMA_REGISTRY_MIRRORS"],
+				envVars["OLLAMA_REGISTRY_AUTH"],
+				envVars["OLLAMA_RUNNER_CPU_AFFINITY"],
 				envVars["OLLAMA_SCHED_SPREAD"],
+				envVars["OLLAMA_SHUTDOWN_TIMEOUT"],
+				envVars["OLLAMA_SESSION_TTL"],
+				envVars["OLLAMA_CACHE_TTL"],
+				envVars["OLLAMA_SKIP_VERIFY"],
+				envVars["OLLAMA_ALLOW_CONTEXT_OVERFLOW"],
+				envVars["OLLAMA_API_KEY"],
+				envVars["OLLAMA_API_KEYS_FILE"],
+				envVars["OLLAMA_METRICS"],
+				envVars["OLLAMA_STORAGE"],
+				envVars["OLLAMA_PROMPT_CACHE"],
+				envVars["OLLAMA_MAX_PROMPT_TOKENS"],
+				envVars["OLLAMA_SOCKET_MODE"],
+				envVars["OLLAMA_TLS_CERT"],
+				envVars["OLLAMA_TLS_KEY"],
 				envVars["OLLAMA_TMPDIR"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
 				envVars["OLLAMA_LLM_LIBRARY"],
 				envVars["OLLAMA_GPU_OVERHEAD"],
+				envVars["OLLAMA_IMAGE_DIR"],
+				envVars["OLLAMA_MAX_IMAGE_SIZE"],
 				envVars["OLLAMA_LOAD_TIMEOUT"],
+				envVars["OLLAMA_VISIBLE_DEVICES"],
+				envVars["OLLAMA_DEFAULT_TEMPERATURE"],
+				envVars["OLLAMA_DEFAULT_TOP_P"],
+				envVars["OLLAMA_DEFAULT_TOP_K"],
+				envVars["OLLAMA_DEFAULT_MIN_P"],
+				envVars["OLLAMA_DEFAULT_REPEAT_PENALTY"],
+				envVars["OLLAMA_DEFAULT_NUM_CTX"],
 			})
 		default:
 			appendEnvDocs(cmd, envs)
@@ -1468,7 +1786,9 @@ func NewCLI() *cobra.Command {
 		listCmd,
 		psCmd,
 		copyCmd,
+		aliasCmd,
 		deleteCmd,
+		pruneCmd,
 	)
 
 	return rootCmd
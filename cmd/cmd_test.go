@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/spf13/cobra"
@@ -211,6 +213,83 @@ Weigh anchor!
 	})
 }
 
+func TestWriteFormatted(t *testing.T) {
+	models := &api.ListResponse{
+		Models: []api.ListModelResponse{
+			{
+				Name:       "llama3.2:latest",
+				Model:      "llama3.2:latest",
+				ModifiedAt: time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC),
+				Size:       2019393189,
+				Digest:     "a80c4f17acd55265feec403c7aef86be0c25983ab279d83f3bcd3abbcb5b8b72",
+				Details:    api.ModelDetails{Family: "llama", QuantizationLevel: "Q4_K_M"},
+			},
+			{
+				Name:    "mistral:7b",
+				Model:   "mistral:7b",
+				Size:    4113301824,
+				Digest:  "f974a74358d62a017b37c6f424fcdf2744ca02926c4f952513ddf474b2fa5091",
+				Details: api.ModelDetails{Family: "llama", QuantizationLevel: "Q4_0"},
+			},
+		},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := writeFormatted(&b, "json", models, models.Models); err != nil {
+			t.Fatal(err)
+		}
+
+		var got api.ListResponse
+		if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(*models, got); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+
+		if !strings.HasPrefix(b.String(), "{\n  \"models\": [\n") {
+			t.Errorf("expected indented json, got %s", b.String())
+		}
+	})
+
+	t.Run("template", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := writeFormatted(&b, "{{.Name}} {{.Details.QuantizationLevel}}", models, models.Models); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := "llama3.2:latest Q4_K_M\nmistral:7b Q4_0\n"
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("show template", func(t *testing.T) {
+		resp := &api.ShowResponse{Details: api.ModelDetails{Family: "llama", ParameterSize: "3.2B"}}
+
+		var b bytes.Buffer
+		if err := writeFormatted(&b, "{{.Details.Family}}/{{.Details.ParameterSize}}", resp, []*api.ShowResponse{resp}); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff("llama/3.2B\n", b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		if err := writeFormatted(io.Discard, "{{.Name", models, models.Models); err == nil {
+			t.Error("expected an error for an invalid template")
+		}
+
+		if err := writeFormatted(io.Discard, "{{.Missing}}", models, models.Models); err == nil {
+			t.Error("expected an error for a missing field")
+		}
+	})
+}
+
 func TestDeleteHandler(t *testing.T) {
 	stopped := false
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -12,6 +12,10 @@ import (
 	"github.com/ollama/ollama/llm"
 )
 
+// ErrUnsupportedArchitecture is returned when a model or adapter has an
+// architecture that can't be converted.
+var ErrUnsupportedArchitecture = errors.New("unsupported architecture")
+
 type ModelParameters struct {
 	Architectures []string `json:"architectures"`
 	VocabSize     uint32   `json:"vocab_size"`
@@ -141,7 +145,7 @@ func ConvertAdapter(fsys fs.FS, ws io.WriteSeeker, baseKV llm.KV) error {
 	case "gemma2":
 		conv = &gemma2Adapter{}
 	default:
-		return errors.New("unsupported architecture")
+		return fmt.Errorf("%w %q for adapters, supported architectures are llama, gemma2", ErrUnsupportedArchitecture, arch)
 	}
 
 	ts, err := parseTensors(fsys, strings.NewReplacer(conv.Replacements()...))
@@ -156,6 +160,17 @@ func ConvertAdapter(fsys fs.FS, ws io.WriteSeeker, baseKV llm.KV) error {
 	return conv.writeFile(ws, conv.KV(baseKV), conv.Tensors(ts))
 }
 
+// supportedArchitectures are the model architectures ConvertModel converts
+var supportedArchitectures = []string{
+	"LlamaForCausalLM",
+	"MistralForCausalLM",
+	"MixtralForCausalLM",
+	"GemmaForCausalLM",
+	"Gemma2ForCausalLM",
+	"Phi3ForCausalLM",
+	"BertModel",
+}
+
 // Convert writes an Ollama compatible model to the provided io.WriteSeeker based on configurations
 // and files it finds in the input path.
 // Supported input model formats include safetensors.
@@ -190,7 +205,7 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 	case "BertModel":
 		conv = &bertModel{}
 	default:
-		return errors.New("unsupported architecture")
+		return fmt.Errorf("%w %q, supported architectures are %s", ErrUnsupportedArchitecture, p.Architectures[0], strings.Join(supportedArchitectures, ", "))
 	}
 
 	if err := json.Unmarshal(bts, conv); err != nil {
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -208,6 +209,28 @@ func TestConvertInvalidDatatype(t *testing.T) {
 	}
 }
 
+func TestConvertUnsupportedArchitecture(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "testmodel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "config.json"), []byte(`{"architectures": ["GPT2LMHeadModel"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ConvertModel(os.DirFS(tempDir), f)
+	if !errors.Is(err, ErrUnsupportedArchitecture) {
+		t.Fatalf("expected unsupported architecture, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), `"GPT2LMHeadModel"`) {
+		t.Errorf("expected the architecture in the error, got %v", err)
+	}
+}
+
 func generateSafetensorTestData(t *testing.T, tempDir string, tensorData map[string]*tensorData) {
 	data, err := json.Marshal(tensorData)
 	if err != nil {
@@ -1,6 +1,8 @@
 package envconfig
 
 import (
+	"bufio"
+	"cmp"
 	"fmt"
 	"log/slog"
 	"math"
@@ -8,19 +10,24 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ollama/ollama/format"
 )
 
 // Host returns the scheme and host. Host can be configured via the OLLAMA_HOST environment variable.
-// Default is scheme "http" and host "127.0.0.1:11434"
+// Default is scheme "http" and host "127.0.0.1:11434". A Unix socket is given with the "unix" scheme and
+// its path, e.g. "unix:///run/ollama.sock".
 func Host() *url.URL {
 	defaultPort := "11434"
 
 	s := strings.TrimSpace(Var("OLLAMA_HOST"))
 	scheme, hostport, ok := strings.Cut(s, "://")
+	scheme = strings.ToLower(scheme)
 	switch {
 	case !ok:
 		scheme, hostport = "http", s
@@ -28,6 +35,8 @@ func Host() *url.URL {
 		defaultPort = "80"
 	case scheme == "https":
 		defaultPort = "443"
+	case scheme == "unix":
+		return &url.URL{Scheme: scheme, Path: hostport}
 	}
 
 	hostport, path, _ := strings.Cut(hostport, "/")
@@ -53,10 +62,61 @@ func Host() *url.URL {
 	}
 }
 
+// SocketMode returns the permissions of the Unix socket the server listens on. SocketMode can be configured via the
+// OLLAMA_SOCKET_MODE environment variable as an octal mode, e.g. "0600". Default is 0660.
+func SocketMode() os.FileMode {
+	const defaultMode = 0o660
+	if s := Var("OLLAMA_SOCKET_MODE"); s != "" {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || mode > 0o777 {
+			slog.Warn("invalid socket mode, using default", "mode", s, "default", fmt.Sprintf("%#o", defaultMode))
+			return defaultMode
+		}
+
+		return os.FileMode(mode)
+	}
+
+	return defaultMode
+}
+
+// VisibleDevices returns the GPUs discovery is limited to, by index in the
+// list of discovered GPUs of all vendors or by ID such as a UUID.
+// VisibleDevices can be configured via the OLLAMA_VISIBLE_DEVICES environment
+// variable as a comma separated list and overrides the vendor variables such
+// as CUDA_VISIBLE_DEVICES. Empty entries and negative indices are skipped.
+func VisibleDevices() (devices []string) {
+	s := Var("OLLAMA_VISIBLE_DEVICES")
+	if s == "" {
+		return nil
+	}
+
+	for _, device := range strings.Split(s, ",") {
+		device = strings.TrimSpace(device)
+		if n, err := strconv.Atoi(device); device == "" || (err == nil && n < 0) {
+			slog.Warn("invalid visible device, skipping", "key", "OLLAMA_VISIBLE_DEVICES", "value", s, "device", device)
+			continue
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices
+}
+
 // Origins returns a list of allowed origins. Origins can be configured via the OLLAMA_ORIGINS environment variable.
+// Origins may be separated by commas or newlines; surrounding whitespace and empty entries are ignored.
+// Default local origins are appended unless OLLAMA_ORIGINS_STRICT is set.
 func Origins() (origins []string) {
 	if s := Var("OLLAMA_ORIGINS"); s != "" {
-		origins = strings.Split(s, ",")
+		for _, origin := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+	}
+
+	if OriginsStrict() {
+		return origins
 	}
 
 	for _, origin := range []string{"localhost", "127.0.0.1", "0.0.0.0"} {
@@ -77,11 +137,24 @@ func Origins() (origins []string) {
 	return origins
 }
 
-// Models returns the path to the models directory. Models directory can be configured via the OLLAMA_MODELS environment variable.
-// Default is $HOME/.ollama/models
+// Models returns the path to the primary models directory, the first entry of [ModelsPaths].
 func Models() string {
-	if s := Var("OLLAMA_MODELS"); s != "" {
-		return s
+	return ModelsPaths()[0]
+}
+
+// ModelsPaths returns the list of models directories in search order. Models directories can be configured via the
+// OLLAMA_MODELS environment variable as a list separated by the OS path list separator (":" or ";" on Windows).
+// Default is $HOME/.ollama/models
+func ModelsPaths() []string {
+	var paths []string
+	for _, p := range filepath.SplitList(Var("OLLAMA_MODELS")) {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	if len(paths) > 0 {
+		return paths
 	}
 
 	home, err := os.UserHomeDir()
@@ -89,22 +162,140 @@ func Models() string {
 		panic(err)
 	}
 
-	return filepath.Join(home, ".ollama", "models")
+	return []string{filepath.Join(home, ".ollama", "models")}
+}
+
+// RegistryMirrors returns the base URLs of mirrors to pull models of the default registry from. RegistryMirrors can be configured via the OLLAMA_REGISTRY_MIRRORS environment variable.
+// Mirrors are separated by commas; surrounding whitespace and empty entries are ignored.
+func RegistryMirrors() (mirrors []string) {
+	for _, mirror := range strings.Split(Var("OLLAMA_REGISTRY_MIRRORS"), ",") {
+		if mirror = strings.TrimSpace(mirror); mirror != "" {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+
+	return mirrors
+}
+
+// RegistryAuth returns the path of the docker style config file with the credentials of registries. RegistryAuth can be configured via the OLLAMA_REGISTRY_AUTH environment variable.
+// Default is config.json in DOCKER_CONFIG or ~/.docker.
+func RegistryAuth() string {
+	if s := Var("OLLAMA_REGISTRY_AUTH"); s != "" {
+		return s
+	}
+
+	if s := Var("DOCKER_CONFIG"); s != "" {
+		return filepath.Join(s, "config.json")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// RateLimit allows Requests requests every Per, in bursts of up to Requests,
+// and at most Concurrent requests at once. Zero values don't limit.
+type RateLimit struct {
+	Requests   uint
+	Per        time.Duration
+	Concurrent uint
+}
+
+func (l RateLimit) String() string {
+	var limits []string
+	if l.Requests > 0 {
+		limits = append(limits, fmt.Sprintf("%d/%s", l.Requests, l.Per))
+	}
+
+	if l.Concurrent > 0 {
+		limits = append(limits, fmt.Sprintf("%d concurrent", l.Concurrent))
+	}
+
+	return strings.Join(limits, ", ")
+}
+
+// ModelRateLimits returns the request rate and concurrency limits of models. ModelRateLimits can be configured via the OLLAMA_MODEL_RATE_LIMIT environment variable.
+// See ParseRateLimits for the format. Invalid values log a warning and no limits are applied.
+// Default is no limits.
+func ModelRateLimits() map[string]RateLimit {
+	limits, err := ParseRateLimits(Var("OLLAMA_MODEL_RATE_LIMIT"))
+	if err != nil {
+		slog.Warn("invalid environment variable, ignoring", "key", "OLLAMA_MODEL_RATE_LIMIT", "error", err)
+		return nil
+	}
+
+	return limits
+}
+
+// ParseRateLimits parses a comma separated list of model=requests/period
+// rate limits and model=requests concurrency limits such as
+// "llama3=10/s,llama3=2,mistral=100/m". The period is a duration with an
+// optional count, e.g. "s", "m", "h" or "30s". A model may have one limit of
+// each kind.
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	var limits map[string]RateLimit
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		model, limit, ok := strings.Cut(spec, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid rate limit %q: expected model=requests/period or model=requests", spec)
+		}
+
+		requests, period, isRate := strings.Cut(limit, "/")
+		n, err := strconv.ParseUint(strings.TrimSpace(requests), 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid rate limit %q: requests must be a positive integer", spec)
+		}
+
+		l := limits[model]
+		if isRate {
+			period = strings.TrimSpace(period)
+			if period != "" && (period[0] < '0' || period[0] > '9') {
+				period = "1" + period
+			}
+
+			per, err := time.ParseDuration(period)
+			if err != nil || per <= 0 {
+				return nil, fmt.Errorf("invalid rate limit %q: period must be a positive duration", spec)
+			}
+
+			if l.Requests > 0 {
+				return nil, fmt.Errorf("invalid rate limit %q: %s already has a rate limit", spec, model)
+			}
+
+			l.Requests, l.Per = uint(n), per
+		} else {
+			if l.Concurrent > 0 {
+				return nil, fmt.Errorf("invalid rate limit %q: %s already has a concurrency limit", spec, model)
+			}
+
+			l.Concurrent = uint(n)
+		}
+
+		if limits == nil {
+			limits = make(map[string]RateLimit)
+		}
+
+		limits[model] = l
+	}
+
+	return limits, nil
 }
 
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the OLLAMA_KEEP_ALIVE environment variable.
+// Values are parsed as a Go duration (e.g. "500ms", "2.5m", "1h"); a plain integer is treated as seconds.
 // Negative values are treated as infinite. Zero is treated as no keep alive.
 // Default is 5 minutes.
 func KeepAlive() (keepAlive time.Duration) {
-	keepAlive = 5 * time.Minute
-	if s := Var("OLLAMA_KEEP_ALIVE"); s != "" {
-		if d, err := time.ParseDuration(s); err == nil {
-			keepAlive = d
-		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
-			keepAlive = time.Duration(n) * time.Second
-		}
-	}
-
+	keepAlive = duration("OLLAMA_KEEP_ALIVE", 5*time.Minute)
 	if keepAlive < 0 {
 		return time.Duration(math.MaxInt64)
 	}
@@ -113,18 +304,11 @@ func KeepAlive() (keepAlive time.Duration) {
 }
 
 // LoadTimeout returns the duration for stall detection during model loads. LoadTimeout can be configured via the OLLAMA_LOAD_TIMEOUT environment variable.
+// Values are parsed the same way as KeepAlive.
 // Zero or Negative values are treated as infinite.
 // Default is 5 minutes.
 func LoadTimeout() (loadTimeout time.Duration) {
-	loadTimeout = 5 * time.Minute
-	if s := Var("OLLAMA_LOAD_TIMEOUT"); s != "" {
-		if d, err := time.ParseDuration(s); err == nil {
-			loadTimeout = d
-		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
-			loadTimeout = time.Duration(n) * time.Second
-		}
-	}
-
+	loadTimeout = duration("OLLAMA_LOAD_TIMEOUT", 5*time.Minute)
 	if loadTimeout <= 0 {
 		return time.Duration(math.MaxInt64)
 	}
@@ -132,18 +316,144 @@ func LoadTimeout() (loadTimeout time.Duration) {
 	return loadTimeout
 }
 
+// HTTPIdleTimeout returns how long the server keeps idle client connections open. HTTPIdleTimeout can be configured via the OLLAMA_HTTP_IDLE_TIMEOUT environment variable.
+// Values are parsed the same way as KeepAlive.
+// Zero or Negative values fall back to HTTPReadTimeout.
+// Default is no timeout.
+func HTTPIdleTimeout() time.Duration {
+	return max(duration("OLLAMA_HTTP_IDLE_TIMEOUT", 0), 0)
+}
+
+// HTTPReadTimeout returns the maximum duration for reading a request, including its body. HTTPReadTimeout can be configured via the OLLAMA_HTTP_READ_TIMEOUT environment variable.
+// Values are parsed the same way as KeepAlive.
+// Zero or Negative values are treated as infinite.
+// Default is no timeout.
+func HTTPReadTimeout() time.Duration {
+	return max(duration("OLLAMA_HTTP_READ_TIMEOUT", 0), 0)
+}
+
+// ShutdownTimeout returns how long the server waits for in-flight requests to finish when shutting down. ShutdownTimeout can be configured via the OLLAMA_SHUTDOWN_TIMEOUT environment variable.
+// Values are parsed the same way as KeepAlive.
+// Zero or Negative values stop the server without waiting.
+// Default is 30 seconds.
+func ShutdownTimeout() time.Duration {
+	return max(duration("OLLAMA_SHUTDOWN_TIMEOUT", 30*time.Second), 0)
+}
+
+// SessionTTL returns how long chat sessions are kept after their last request. SessionTTL can be configured via the OLLAMA_SESSION_TTL environment variable.
+// Values are parsed the same way as KeepAlive.
+// Zero or Negative values disable sessions.
+// Default is 30 minutes.
+func SessionTTL() time.Duration {
+	return max(duration("OLLAMA_SESSION_TTL", 30*time.Minute), 0)
+}
+
+// CacheTTL returns how long KV cache snapshots are kept after they're saved. CacheTTL can be configured via the OLLAMA_CACHE_TTL environment variable.
+// Values are parsed the same way as KeepAlive.
+// Zero or Negative values disable snapshots.
+// Default is 24 hours.
+func CacheTTL() time.Duration {
+	return max(duration("OLLAMA_CACHE_TTL", 24*time.Hour), 0)
+}
+
+// LogFormat returns the format of server logs, "text" or "json". LogFormat can be configured via the OLLAMA_LOG_FORMAT
+// environment variable. Invalid values log a warning and use the default.
+// Default is "text".
+func LogFormat() string {
+	switch s := strings.ToLower(strings.TrimSpace(Var("OLLAMA_LOG_FORMAT"))); s {
+	case "", "text":
+		return "text"
+	case "json":
+		return "json"
+	default:
+		slog.Warn("invalid environment variable, using default", "key", "OLLAMA_LOG_FORMAT", "value", s, "default", "text")
+		return "text"
+	}
+}
+
+// LogSample returns the fraction of requests, from 0 to 1, whose prompts and options are logged at the debug level.
+// LogSample can be configured via the OLLAMA_LOG_SAMPLE environment variable. Values out of range log a warning and
+// use the default.
+// Default is 1.
+func LogSample() float64 {
+	if s := Var("OLLAMA_LOG_SAMPLE"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || !(f >= 0 && f <= 1) {
+			slog.Warn("invalid environment variable, using default", "key", "OLLAMA_LOG_SAMPLE", "value", s, "default", 1)
+			return 1
+		}
+
+		return f
+	}
+
+	return 1
+}
+
+// LogLevel returns the minimum level of server logs. LogLevel can be configured via the OLLAMA_LOG_LEVEL environment
+// variable as one of "debug", "info", "warn" or "error". Invalid values log a warning and use the default.
+// Default is "debug" if OLLAMA_DEBUG is set and "info" otherwise.
+func LogLevel() slog.Level {
+	level := slog.LevelInfo
+	if Debug() {
+		level = slog.LevelDebug
+	}
+
+	if s := Var("OLLAMA_LOG_LEVEL"); s != "" {
+		switch strings.ToLower(s) {
+		case "debug":
+			return slog.LevelDebug
+		case "info":
+			return slog.LevelInfo
+		case "warn", "warning":
+			return slog.LevelWarn
+		case "error":
+			return slog.LevelError
+		default:
+			slog.Warn("invalid environment variable, using default", "key", "OLLAMA_LOG_LEVEL", "value", s, "default", level)
+		}
+	}
+
+	return level
+}
+
+// duration parses the environment variable key as a Go duration, falling back to an
+// integer number of seconds. Unparsable values return defaultValue.
+func duration(key string, defaultValue time.Duration) time.Duration {
+	if s := Var(key); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Duration(n) * time.Second
+		}
+	}
+
+	return defaultValue
+}
+
+// Bool returns a function that parses the environment variable k as a boolean.
+// The tokens "0", "f", "false", "n", "no", "off", and "disabled" are false and
+// "1", "t", "true", "y", "yes", "on", and "enabled" are true, ignoring case.
+// Any other non-empty value is treated as true. An unset variable is false.
 func Bool(k string) func() bool {
+	return BoolWithDefault(k, false)
+}
+
+// BoolWithDefault returns a function that parses the environment variable k
+// as a boolean like [Bool] but is defaultValue when k is unset.
+func BoolWithDefault(k string, defaultValue bool) func() bool {
 	return func() bool {
 		if s := Var(k); s != "" {
-			b, err := strconv.ParseBool(s)
-			if err != nil {
+			switch strings.ToLower(s) {
+			case "0", "f", "false", "n", "no", "off", "disabled":
+				return false
+			case "1", "t", "true", "y", "yes", "on", "enabled":
+				return true
+			default:
 				return true
 			}
-
-			return b
 		}
 
-		return false
+		return defaultValue
 	}
 }
 
@@ -162,6 +472,16 @@ var (
 	IntelGPU = Bool("OLLAMA_INTEL_GPU")
 	// MultiUserCache optimizes prompt caching for multi-user scenarios
 	MultiUserCache = Bool("OLLAMA_MULTIUSER_CACHE")
+	// OriginsStrict disables the default local origins so only OLLAMA_ORIGINS are allowed.
+	OriginsStrict = Bool("OLLAMA_ORIGINS_STRICT")
+	// SkipVerify disables verifying model blobs against their digests before loading.
+	SkipVerify = Bool("OLLAMA_SKIP_VERIFY")
+	// Metrics serves Prometheus metrics at /metrics.
+	Metrics = Bool("OLLAMA_METRICS")
+	// AllowContextOverflow allows a context larger than the one a model was trained with, extending it with RoPE scaling.
+	AllowContextOverflow = Bool("OLLAMA_ALLOW_CONTEXT_OVERFLOW")
+	// PromptCache reuses the context of the previous request which shares a prompt prefix. Default is true.
+	PromptCache = BoolWithDefault("OLLAMA_PROMPT_CACHE", true)
 )
 
 func String(s string) func() string {
@@ -171,8 +491,21 @@ func String(s string) func() string {
 }
 
 var (
+	EnvFile    = String("OLLAMA_ENV_FILE")
+	TLSCert    = String("OLLAMA_TLS_CERT")
+	TLSKey     = String("OLLAMA_TLS_KEY")
 	LLMLibrary = String("OLLAMA_LLM_LIBRARY")
 	TmpDir     = String("OLLAMA_TMPDIR")
+	// Storage is where model blobs are stored: "fs", the default, or "s3://bucket/prefix".
+	Storage = String("OLLAMA_STORAGE")
+	// APIKey is a comma separated list of keys the API requires as a bearer token.
+	APIKey = String("OLLAMA_API_KEY")
+	// APIKeysFile is a file of keys the API requires as a bearer token, one per line.
+	APIKeysFile = String("OLLAMA_API_KEYS_FILE")
+	// ImageDir is the directory images given by file:// URL are read from. File URLs are rejected if it's unset.
+	ImageDir = String("OLLAMA_IMAGE_DIR")
+	// RunnerCPUAffinity is the CPU cores runners are bound to, e.g. "0-7" or "0,2,4".
+	RunnerCPUAffinity = String("OLLAMA_RUNNER_CPU_AFFINITY")
 
 	CudaVisibleDevices    = String("CUDA_VISIBLE_DEVICES")
 	HipVisibleDevices     = String("HIP_VISIBLE_DEVICES")
@@ -181,10 +514,12 @@ var (
 	HsaOverrideGfxVersion = String("HSA_OVERRIDE_GFX_VERSION")
 )
 
+// Uint returns a function that parses the environment variable key as an unsigned integer.
+// Negative, non-numeric, or out of range values log a warning and fall back to defaultValue.
 func Uint(key string, defaultValue uint) func() uint {
 	return func() uint {
 		if s := Var(key); s != "" {
-			if n, err := strconv.ParseUint(s, 10, 64); err != nil {
+			if n, err := strconv.ParseUint(s, 10, strconv.IntSize); err != nil {
 				slog.Warn("invalid environment variable, using default", "key", key, "value", s, "default", defaultValue)
 			} else {
 				return uint(n)
@@ -196,16 +531,45 @@ func Uint(key string, defaultValue uint) func() uint {
 }
 
 var (
-	// NumParallel sets the number of parallel model requests. NumParallel can be configured via the OLLAMA_NUM_PARALLEL environment variable.
-	NumParallel = Uint("OLLAMA_NUM_PARALLEL", 0)
 	// MaxRunners sets the maximum number of loaded models. MaxRunners can be configured via the OLLAMA_MAX_LOADED_MODELS environment variable.
 	MaxRunners = Uint("OLLAMA_MAX_LOADED_MODELS", 0)
 	// MaxQueue sets the maximum number of queued requests. MaxQueue can be configured via the OLLAMA_MAX_QUEUE environment variable.
+	// Default is 512.
 	MaxQueue = Uint("OLLAMA_MAX_QUEUE", 512)
 	// MaxVRAM sets a maximum VRAM override in bytes. MaxVRAM can be configured via the OLLAMA_MAX_VRAM environment variable.
 	MaxVRAM = Uint("OLLAMA_MAX_VRAM", 0)
+	// MaxPullConcurrency sets the maximum number of blobs downloaded at once during a pull. MaxPullConcurrency can be configured via the OLLAMA_MAX_PULL_CONCURRENCY environment variable.
+	// Default is 3.
+	MaxPullConcurrency = Uint("OLLAMA_MAX_PULL_CONCURRENCY", 3)
+	// MaxPromptTokens sets the maximum number of tokens in a prompt for any model. MaxPromptTokens can be configured via the OLLAMA_MAX_PROMPT_TOKENS environment variable.
+	// Default is 0, no maximum.
+	MaxPromptTokens = Uint("OLLAMA_MAX_PROMPT_TOKENS", 0)
+	// NumReplicas sets the number of instances of a model loaded to share its requests. NumReplicas can be configured via the OLLAMA_NUM_REPLICAS environment variable.
+	// Default is 1.
+	NumReplicas = Uint("OLLAMA_NUM_REPLICAS", 1)
+	// PullRetries sets the maximum number of attempts for a registry request that's rate limited or the registry is temporarily unavailable. PullRetries can be configured via the OLLAMA_PULL_RETRIES environment variable.
+	// Default is 6.
+	PullRetries = Uint("OLLAMA_PULL_RETRIES", 6)
 )
 
+// NumParallel returns the number of parallel model requests. NumParallel can be configured via the OLLAMA_NUM_PARALLEL environment variable.
+// An unset, zero, or "auto" value returns auto as true so the scheduler can pick a value based on available memory.
+// Invalid values log a warning and are treated as auto.
+func NumParallel() (n int, auto bool) {
+	s := Var("OLLAMA_NUM_PARALLEL")
+	switch strings.ToLower(s) {
+	case "", "0", "auto":
+		return 0, true
+	}
+
+	if n, err := strconv.ParseUint(s, 10, strconv.IntSize-1); err == nil {
+		return int(n), false
+	}
+
+	slog.Warn("invalid environment variable, using auto", "key", "OLLAMA_NUM_PARALLEL", "value", s)
+	return 0, true
+}
+
 func Uint64(key string, defaultValue uint64) func() uint64 {
 	return func() uint64 {
 		if s := Var(key); s != "" {
@@ -220,8 +584,146 @@ func Uint64(key string, defaultValue uint64) func() uint64 {
 	}
 }
 
-// Set aside VRAM per GPU
-var GpuOverhead = Uint64("OLLAMA_GPU_OVERHEAD", 0)
+// Float returns a function that parses the environment variable key as a
+// floating point number. It returns nil when key is unset. Invalid values log
+// a warning and are treated as unset.
+func Float(key string) func() *float64 {
+	return func() *float64 {
+		if s := Var(key); s != "" {
+			if f, err := strconv.ParseFloat(s, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				slog.Warn("invalid environment variable, ignoring", "key", key, "value", s)
+			} else {
+				return &f
+			}
+		}
+
+		return nil
+	}
+}
+
+// Int returns a function that parses the environment variable key as an
+// integer. It returns nil when key is unset. Invalid values log a warning and
+// are treated as unset.
+func Int(key string) func() *int64 {
+	return func() *int64 {
+		if s := Var(key); s != "" {
+			if n, err := strconv.ParseInt(s, 10, 64); err != nil {
+				slog.Warn("invalid environment variable, ignoring", "key", key, "value", s)
+			} else {
+				return &n
+			}
+		}
+
+		return nil
+	}
+}
+
+var (
+	// DefaultTemperature sets the temperature of models which don't set one in their Modelfile.
+	DefaultTemperature = Float("OLLAMA_DEFAULT_TEMPERATURE")
+	// DefaultTopP sets the top_p of models which don't set one in their Modelfile.
+	DefaultTopP = Float("OLLAMA_DEFAULT_TOP_P")
+	// DefaultMinP sets the min_p of models which don't set one in their Modelfile.
+	DefaultMinP = Float("OLLAMA_DEFAULT_MIN_P")
+	// DefaultRepeatPenalty sets the repeat_penalty of models which don't set one in their Modelfile.
+	DefaultRepeatPenalty = Float("OLLAMA_DEFAULT_REPEAT_PENALTY")
+	// DefaultTopK sets the top_k of models which don't set one in their Modelfile.
+	DefaultTopK = Int("OLLAMA_DEFAULT_TOP_K")
+	// DefaultNumCtx sets the num_ctx of models which don't set one in their Modelfile.
+	DefaultNumCtx = Int("OLLAMA_DEFAULT_NUM_CTX")
+)
+
+// DefaultOptions returns the options set by the OLLAMA_DEFAULT_* environment
+// variables keyed by option name. They replace the built in defaults and are
+// in turn replaced by Modelfile parameters and request options.
+func DefaultOptions() map[string]any {
+	opts := make(map[string]any)
+	for name, f := range map[string]*float64{
+		"temperature":    DefaultTemperature(),
+		"top_p":          DefaultTopP(),
+		"min_p":          DefaultMinP(),
+		"repeat_penalty": DefaultRepeatPenalty(),
+	} {
+		if f != nil {
+			opts[name] = *f
+		}
+	}
+
+	for name, n := range map[string]*int64{
+		"top_k":   DefaultTopK(),
+		"num_ctx": DefaultNumCtx(),
+	} {
+		if n != nil {
+			opts[name] = *n
+		}
+	}
+
+	return opts
+}
+
+// Bytes returns a byte size such as "512MiB" or "1073741824". See ParseBytes for the format.
+func Bytes(key string, defaultValue uint64) func() uint64 {
+	return func() uint64 {
+		if s := Var(key); s != "" {
+			if n, err := ParseBytes(s); err != nil {
+				slog.Warn("invalid environment variable, using default", "key", key, "value", s, "default", defaultValue)
+			} else {
+				return n
+			}
+		}
+
+		return defaultValue
+	}
+}
+
+var byteUnits = map[string]float64{
+	"":    format.Byte,
+	"b":   format.Byte,
+	"kb":  format.KiloByte,
+	"mb":  format.MegaByte,
+	"gb":  format.GigaByte,
+	"tb":  format.TeraByte,
+	"kib": format.KibiByte,
+	"mib": format.MebiByte,
+	"gib": format.GibiByte,
+	"tib": format.TebiByte,
+}
+
+// ParseBytes parses a number of bytes with an optional, case insensitive
+// unit suffix, e.g. "1024", "512MiB", "1.5 GB".
+func ParseBytes(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid byte size %q: unknown unit %q", s, s[i:])
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+
+	b := n * unit
+	if b >= math.MaxUint64 {
+		return 0, fmt.Errorf("invalid byte size %q: too large", s)
+	}
+
+	return uint64(b), nil
+}
+
+var (
+	// Set aside VRAM per GPU
+	GpuOverhead = Bytes("OLLAMA_GPU_OVERHEAD", 0)
+	// Set the maximum size of an image given by URL
+	MaxImageSize = Bytes("OLLAMA_MAX_IMAGE_SIZE", 20*format.MebiByte)
+)
 
 type EnvVar struct {
 	Name        string
@@ -230,24 +732,61 @@ type EnvVar struct {
 }
 
 func AsMap() map[string]EnvVar {
+	numParallel, _ := NumParallel()
 	ret := map[string]EnvVar{
-		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
-		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
-		"OLLAMA_GPU_OVERHEAD":      {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
-		"OLLAMA_HOST":              {"OLLAMA_HOST", Host(), "IP Address for the ollama server (default 127.0.0.1:11434)"},
-		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
-		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
-		"OLLAMA_LOAD_TIMEOUT":      {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
-		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
-		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
-		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
-		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
-		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
-		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
-		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", Origins(), "A comma separated list of allowed origins"},
-		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
-		"OLLAMA_TMPDIR":            {"OLLAMA_TMPDIR", TmpDir(), "Location for temporary files"},
-		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
+		"OLLAMA_DEBUG":                  {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_DEFAULT_MIN_P":          {"OLLAMA_DEFAULT_MIN_P", optional(DefaultMinP()), "Default min_p of models without one in their Modelfile"},
+		"OLLAMA_DEFAULT_NUM_CTX":        {"OLLAMA_DEFAULT_NUM_CTX", optional(DefaultNumCtx()), "Default context length of models without one in their Modelfile"},
+		"OLLAMA_DEFAULT_REPEAT_PENALTY": {"OLLAMA_DEFAULT_REPEAT_PENALTY", optional(DefaultRepeatPenalty()), "Default repeat_penalty of models without one in their Modelfile"},
+		"OLLAMA_DEFAULT_TEMPERATURE":    {"OLLAMA_DEFAULT_TEMPERATURE", optional(DefaultTemperature()), "Default temperature of models without one in their Modelfile"},
+		"OLLAMA_DEFAULT_TOP_K":          {"OLLAMA_DEFAULT_TOP_K", optional(DefaultTopK()), "Default top_k of models without one in their Modelfile"},
+		"OLLAMA_DEFAULT_TOP_P":          {"OLLAMA_DEFAULT_TOP_P", optional(DefaultTopP()), "Default top_p of models without one in their Modelfile"},
+		"OLLAMA_ENV_FILE":               {"OLLAMA_ENV_FILE", EnvFile(), "Path to a file of KEY=VALUE environment variables to load at startup"},
+		"OLLAMA_FLASH_ATTENTION":        {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
+		"OLLAMA_GPU_OVERHEAD":           {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes, e.g. 512MiB)"},
+		"OLLAMA_HOST":                   {"OLLAMA_HOST", Host(), "IP Address for the ollama server (default 127.0.0.1:11434)"},
+		"OLLAMA_HTTP_IDLE_TIMEOUT":      {"OLLAMA_HTTP_IDLE_TIMEOUT", HTTPIdleTimeout(), "How long to keep idle client connections open (default none)"},
+		"OLLAMA_HTTP_READ_TIMEOUT":      {"OLLAMA_HTTP_READ_TIMEOUT", HTTPReadTimeout(), "Maximum duration for reading a request, including its body (default none)"},
+		"OLLAMA_KEEP_ALIVE":             {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
+		"OLLAMA_LLM_LIBRARY":            {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
+		"OLLAMA_LOAD_TIMEOUT":           {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
+		"OLLAMA_LOG_FORMAT":             {"OLLAMA_LOG_FORMAT", LogFormat(), "Format of server logs, text or json (default \"text\")"},
+		"OLLAMA_LOG_SAMPLE":             {"OLLAMA_LOG_SAMPLE", LogSample(), "Fraction of requests whose prompts are logged at debug level, 0 to 1 (default 1)"},
+		"OLLAMA_LOG_LEVEL":              {"OLLAMA_LOG_LEVEL", LogLevel(), "Minimum level of server logs, debug, info, warn or error (default \"info\")"},
+		"OLLAMA_IMAGE_DIR":              {"OLLAMA_IMAGE_DIR", ImageDir(), "Directory images given by file URL are read from (default disabled)"},
+		"OLLAMA_MAX_IMAGE_SIZE":         {"OLLAMA_MAX_IMAGE_SIZE", MaxImageSize(), "Maximum size of an image given by URL (default 20MiB)"},
+		"OLLAMA_MAX_LOADED_MODELS":      {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
+		"OLLAMA_MAX_QUEUE":              {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests (default 512)"},
+		"OLLAMA_MAX_PULL_CONCURRENCY":   {"OLLAMA_MAX_PULL_CONCURRENCY", MaxPullConcurrency(), "Maximum number of blobs downloaded at once during a pull (default 3)"},
+		"OLLAMA_MODELS":                 {"OLLAMA_MODELS", Models(), "The path to the models directory"},
+		"OLLAMA_MODEL_RATE_LIMIT":       {"OLLAMA_MODEL_RATE_LIMIT", ModelRateLimits(), "A comma separated list of per model request rate and concurrency limits (e.g. llama3=10/s,llama3=2)"},
+		"OLLAMA_NOHISTORY":              {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
+		"OLLAMA_NOPRUNE":                {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
+		"OLLAMA_NUM_PARALLEL":           {"OLLAMA_NUM_PARALLEL", numParallel, "Maximum number of parallel requests (default auto)"},
+		"OLLAMA_NUM_REPLICAS":           {"OLLAMA_NUM_REPLICAS", NumReplicas(), "Number of instances of a model loaded to share its requests (default 1)"},
+		"OLLAMA_ORIGINS":                {"OLLAMA_ORIGINS", Origins(), "A comma separated list of allowed origins"},
+		"OLLAMA_ORIGINS_STRICT":         {"OLLAMA_ORIGINS_STRICT", OriginsStrict(), "Do not allow default local origins"},
+		"OLLAMA_PULL_RETRIES":           {"OLLAMA_PULL_RETRIES", PullRetries(), "Maximum number of attempts for rate limited registry requests (default 6)"},
+		"OLLAMA_REGISTRY_MIRRORS":       {"OLLAMA_REGISTRY_MIRRORS", RegistryMirrors(), "A comma separated list of registry mirrors to pull from"},
+		"OLLAMA_REGISTRY_AUTH":          {"OLLAMA_REGISTRY_AUTH", RegistryAuth(), "Docker style config file with registry credentials (default ~/.docker/config.json)"},
+		"OLLAMA_RUNNER_CPU_AFFINITY":    {"OLLAMA_RUNNER_CPU_AFFINITY", RunnerCPUAffinity(), "CPU cores to bind runners to, e.g. \"0-7\" or \"0,2,4\" (Linux only)"},
+		"OLLAMA_SCHED_SPREAD":           {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
+		"OLLAMA_SHUTDOWN_TIMEOUT":       {"OLLAMA_SHUTDOWN_TIMEOUT", ShutdownTimeout(), "How long to wait for in-flight requests on shutdown (default \"30s\")"},
+		"OLLAMA_CACHE_TTL":              {"OLLAMA_CACHE_TTL", CacheTTL(), "How long cache snapshots are kept after they're saved (default \"24h\")"},
+		"OLLAMA_SESSION_TTL":            {"OLLAMA_SESSION_TTL", SessionTTL(), "How long chat sessions are kept after their last request (default \"30m\")"},
+		"OLLAMA_API_KEY":                {"OLLAMA_API_KEY", APIKey(), "Comma separated API keys to require as a bearer token"},
+		"OLLAMA_API_KEYS_FILE":          {"OLLAMA_API_KEYS_FILE", APIKeysFile(), "File of API keys to require as a bearer token, one per line"},
+		"OLLAMA_ALLOW_CONTEXT_OVERFLOW": {"OLLAMA_ALLOW_CONTEXT_OVERFLOW", AllowContextOverflow(), "Allow a num_ctx larger than the context length a model was trained with"},
+		"OLLAMA_SKIP_VERIFY":            {"OLLAMA_SKIP_VERIFY", SkipVerify(), "Do not verify model blobs before loading"},
+		"OLLAMA_METRICS":                {"OLLAMA_METRICS", Metrics(), "Serve Prometheus metrics at /metrics"},
+		"OLLAMA_STORAGE":                {"OLLAMA_STORAGE", Storage(), "Where model blobs are stored, \"fs\" (default) or \"s3://bucket/prefix\""},
+		"OLLAMA_SOCKET_MODE":            {"OLLAMA_SOCKET_MODE", fmt.Sprintf("%#o", SocketMode()), "Permissions of the Unix socket when OLLAMA_HOST is unix:// (default 0660)"},
+		"OLLAMA_MAX_PROMPT_TOKENS":      {"OLLAMA_MAX_PROMPT_TOKENS", MaxPromptTokens(), "Maximum number of tokens in a prompt for any model (default 0, no maximum)"},
+		"OLLAMA_PROMPT_CACHE":           {"OLLAMA_PROMPT_CACHE", PromptCache(), "Reuse the context of previous requests with the same prompt prefix (default true)"},
+		"OLLAMA_TLS_CERT":               {"OLLAMA_TLS_CERT", TLSCert(), "Path to a PEM certificate to serve HTTPS with, with OLLAMA_TLS_KEY"},
+		"OLLAMA_TLS_KEY":                {"OLLAMA_TLS_KEY", TLSKey(), "Path to the PEM private key of OLLAMA_TLS_CERT"},
+		"OLLAMA_TMPDIR":                 {"OLLAMA_TMPDIR", TmpDir(), "Location for temporary files"},
+		"OLLAMA_MULTIUSER_CACHE":        {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
@@ -269,17 +808,272 @@ func AsMap() map[string]EnvVar {
 		ret["GPU_DEVICE_ORDINAL"] = EnvVar{"GPU_DEVICE_ORDINAL", GpuDeviceOrdinal(), "Set which AMD devices are visible"}
 		ret["HSA_OVERRIDE_GFX_VERSION"] = EnvVar{"HSA_OVERRIDE_GFX_VERSION", HsaOverrideGfxVersion(), "Override the gfx used for all detected AMD GPUs"}
 		ret["OLLAMA_INTEL_GPU"] = EnvVar{"OLLAMA_INTEL_GPU", IntelGPU(), "Enable experimental Intel GPU detection"}
+		ret["OLLAMA_VISIBLE_DEVICES"] = EnvVar{"OLLAMA_VISIBLE_DEVICES", VisibleDevices(), "Set which GPUs of any vendor are visible by index or ID, overriding the vendor variables"}
 	}
 
 	return ret
 }
 
-func Values() map[string]string {
-	vals := make(map[string]string)
-	for k, v := range AsMap() {
-		vals[k] = fmt.Sprintf("%v", v.Value)
+// Config is a snapshot of the effective configuration. Each field is tagged
+// with the environment variable it was read from.
+type Config struct {
+	Debug                bool                 `env:"OLLAMA_DEBUG"`
+	DefaultMinP          *float64             `env:"OLLAMA_DEFAULT_MIN_P"`
+	DefaultNumCtx        *int64               `env:"OLLAMA_DEFAULT_NUM_CTX"`
+	DefaultRepeatPenalty *float64             `env:"OLLAMA_DEFAULT_REPEAT_PENALTY"`
+	DefaultTemperature   *float64             `env:"OLLAMA_DEFAULT_TEMPERATURE"`
+	DefaultTopK          *int64               `env:"OLLAMA_DEFAULT_TOP_K"`
+	DefaultTopP          *float64             `env:"OLLAMA_DEFAULT_TOP_P"`
+	EnvFile              string               `env:"OLLAMA_ENV_FILE"`
+	FlashAttention       bool                 `env:"OLLAMA_FLASH_ATTENTION"`
+	GpuOverhead          uint64               `env:"OLLAMA_GPU_OVERHEAD"`
+	Host                 *url.URL             `env:"OLLAMA_HOST"`
+	HTTPIdleTimeout      time.Duration        `env:"OLLAMA_HTTP_IDLE_TIMEOUT"`
+	HTTPReadTimeout      time.Duration        `env:"OLLAMA_HTTP_READ_TIMEOUT"`
+	IntelGPU             bool                 `env:"OLLAMA_INTEL_GPU"`
+	KeepAlive            time.Duration        `env:"OLLAMA_KEEP_ALIVE"`
+	LLMLibrary           string               `env:"OLLAMA_LLM_LIBRARY"`
+	LoadTimeout          time.Duration        `env:"OLLAMA_LOAD_TIMEOUT"`
+	LogFormat            string               `env:"OLLAMA_LOG_FORMAT"`
+	LogSample            float64              `env:"OLLAMA_LOG_SAMPLE"`
+	LogLevel             slog.Level           `env:"OLLAMA_LOG_LEVEL"`
+	ImageDir             string               `env:"OLLAMA_IMAGE_DIR"`
+	MaxImageSize         uint64               `env:"OLLAMA_MAX_IMAGE_SIZE"`
+	MaxRunners           uint                 `env:"OLLAMA_MAX_LOADED_MODELS"`
+	MaxQueue             uint                 `env:"OLLAMA_MAX_QUEUE"`
+	MaxPromptTokens      uint                 `env:"OLLAMA_MAX_PROMPT_TOKENS"`
+	MaxPullConcurrency   uint                 `env:"OLLAMA_MAX_PULL_CONCURRENCY"`
+	MaxVRAM              uint                 `env:"OLLAMA_MAX_VRAM"`
+	Models               []string             `env:"OLLAMA_MODELS"`
+	ModelRateLimits      map[string]RateLimit `env:"OLLAMA_MODEL_RATE_LIMIT"`
+	MultiUserCache       bool                 `env:"OLLAMA_MULTIUSER_CACHE"`
+	NoHistory            bool                 `env:"OLLAMA_NOHISTORY"`
+	NoPrune              bool                 `env:"OLLAMA_NOPRUNE"`
+	NumParallel          int                  `env:"OLLAMA_NUM_PARALLEL"` // zero means auto
+	NumReplicas          uint                 `env:"OLLAMA_NUM_REPLICAS"`
+	Origins              []string             `env:"OLLAMA_ORIGINS"`
+	OriginsStrict        bool                 `env:"OLLAMA_ORIGINS_STRICT"`
+	PromptCache          bool                 `env:"OLLAMA_PROMPT_CACHE"`
+	PullRetries          uint                 `env:"OLLAMA_PULL_RETRIES"`
+	RegistryMirrors      []string             `env:"OLLAMA_REGISTRY_MIRRORS"`
+	RegistryAuth         string               `env:"OLLAMA_REGISTRY_AUTH"`
+	RunnerCPUAffinity    string               `env:"OLLAMA_RUNNER_CPU_AFFINITY"`
+	SchedSpread          bool                 `env:"OLLAMA_SCHED_SPREAD"`
+	ShutdownTimeout      time.Duration        `env:"OLLAMA_SHUTDOWN_TIMEOUT"`
+	SessionTTL           time.Duration        `env:"OLLAMA_SESSION_TTL"`
+	CacheTTL             time.Duration        `env:"OLLAMA_CACHE_TTL"`
+	SkipVerify           bool                 `env:"OLLAMA_SKIP_VERIFY"`
+	AllowContextOverflow bool                 `env:"OLLAMA_ALLOW_CONTEXT_OVERFLOW"`
+	APIKey               string               `env:"OLLAMA_API_KEY" secret:"true"`
+	APIKeysFile          string               `env:"OLLAMA_API_KEYS_FILE"`
+	Metrics              bool                 `env:"OLLAMA_METRICS"`
+	Storage              string               `env:"OLLAMA_STORAGE"`
+	SocketMode           os.FileMode          `env:"OLLAMA_SOCKET_MODE"`
+	TLSCert              string               `env:"OLLAMA_TLS_CERT"`
+	TLSKey               string               `env:"OLLAMA_TLS_KEY"`
+	TmpDir               string               `env:"OLLAMA_TMPDIR"`
+	VisibleDevices       []string             `env:"OLLAMA_VISIBLE_DEVICES"`
+
+	CudaVisibleDevices    string `env:"CUDA_VISIBLE_DEVICES"`
+	HipVisibleDevices     string `env:"HIP_VISIBLE_DEVICES"`
+	RocrVisibleDevices    string `env:"ROCR_VISIBLE_DEVICES"`
+	GpuDeviceOrdinal      string `env:"GPU_DEVICE_ORDINAL"`
+	HsaOverrideGfxVersion string `env:"HSA_OVERRIDE_GFX_VERSION"`
+
+	HTTPProxy  string `env:"HTTP_PROXY"`
+	HTTPSProxy string `env:"HTTPS_PROXY"`
+	NoProxy    string `env:"NO_PROXY"`
+}
+
+// Values returns a snapshot of the current configuration.
+func Values() Config {
+	numParallel, _ := NumParallel()
+	return Config{
+		Debug:                Debug(),
+		DefaultMinP:          DefaultMinP(),
+		DefaultNumCtx:        DefaultNumCtx(),
+		DefaultRepeatPenalty: DefaultRepeatPenalty(),
+		DefaultTemperature:   DefaultTemperature(),
+		DefaultTopK:          DefaultTopK(),
+		DefaultTopP:          DefaultTopP(),
+		EnvFile:              EnvFile(),
+		FlashAttention:       FlashAttention(),
+		GpuOverhead:          GpuOverhead(),
+		Host:                 Host(),
+		HTTPIdleTimeout:      HTTPIdleTimeout(),
+		HTTPReadTimeout:      HTTPReadTimeout(),
+		IntelGPU:             IntelGPU(),
+		KeepAlive:            KeepAlive(),
+		LLMLibrary:           LLMLibrary(),
+		LoadTimeout:          LoadTimeout(),
+		LogFormat:            LogFormat(),
+		LogSample:            LogSample(),
+		LogLevel:             LogLevel(),
+		ImageDir:             ImageDir(),
+		MaxImageSize:         MaxImageSize(),
+		MaxRunners:           MaxRunners(),
+		MaxQueue:             MaxQueue(),
+		MaxPromptTokens:      MaxPromptTokens(),
+		MaxPullConcurrency:   MaxPullConcurrency(),
+		MaxVRAM:              MaxVRAM(),
+		Models:               ModelsPaths(),
+		ModelRateLimits:      ModelRateLimits(),
+		MultiUserCache:       MultiUserCache(),
+		NoHistory:            NoHistory(),
+		NoPrune:              NoPrune(),
+		NumParallel:          numParallel,
+		NumReplicas:          NumReplicas(),
+		Origins:              Origins(),
+		OriginsStrict:        OriginsStrict(),
+		PromptCache:          PromptCache(),
+		PullRetries:          PullRetries(),
+		RegistryMirrors:      RegistryMirrors(),
+		RegistryAuth:         RegistryAuth(),
+		RunnerCPUAffinity:    RunnerCPUAffinity(),
+		SchedSpread:          SchedSpread(),
+		ShutdownTimeout:      ShutdownTimeout(),
+		SessionTTL:           SessionTTL(),
+		CacheTTL:             CacheTTL(),
+		SkipVerify:           SkipVerify(),
+		AllowContextOverflow: AllowContextOverflow(),
+		APIKey:               APIKey(),
+		APIKeysFile:          APIKeysFile(),
+		Metrics:              Metrics(),
+		Storage:              Storage(),
+		SocketMode:           SocketMode(),
+		TLSCert:              TLSCert(),
+		TLSKey:               TLSKey(),
+		TmpDir:               TmpDir(),
+		VisibleDevices:       VisibleDevices(),
+
+		CudaVisibleDevices:    CudaVisibleDevices(),
+		HipVisibleDevices:     HipVisibleDevices(),
+		RocrVisibleDevices:    RocrVisibleDevices(),
+		GpuDeviceOrdinal:      GpuDeviceOrdinal(),
+		HsaOverrideGfxVersion: HsaOverrideGfxVersion(),
+
+		HTTPProxy:  cmp.Or(Var("HTTP_PROXY"), Var("http_proxy")),
+		HTTPSProxy: cmp.Or(Var("HTTPS_PROXY"), Var("https_proxy")),
+		NoProxy:    cmp.Or(Var("NO_PROXY"), Var("no_proxy")),
+	}
+}
+
+// attrs returns the configuration as attributes in field order. Credentials
+// embedded in URLs, such as proxy or mirror passwords, and secret fields are
+// redacted.
+func (c Config) attrs() []slog.Attr {
+	v := reflect.ValueOf(c)
+	t := v.Type()
+
+	attrs := make([]slog.Attr, 0, t.NumField())
+	for i := range t.NumField() {
+		var value any
+		switch f := v.Field(i).Interface().(type) {
+		case string:
+			if f != "" && t.Field(i).Tag.Get("secret") == "true" {
+				f = "xxxxx"
+			} else if u, err := url.Parse(f); err == nil && u.User != nil {
+				f = u.Redacted()
+			}
+			value = f
+		case *url.URL:
+			value = f.Redacted()
+		case *float64:
+			value = optional(f)
+		case *int64:
+			value = optional(f)
+		case []string:
+			redacted := make([]string, len(f))
+			for i, s := range f {
+				if u, err := url.Parse(s); err == nil && u.User != nil {
+					s = u.Redacted()
+				}
+				redacted[i] = s
+			}
+			value = redacted
+		default:
+			value = f
+		}
+
+		attrs = append(attrs, slog.Any(t.Field(i).Tag.Get("env"), value))
 	}
-	return vals
+
+	return attrs
+}
+
+// optional returns the value of v or an empty string if v is nil
+func optional[T any](v *T) any {
+	if v == nil {
+		return ""
+	}
+
+	return *v
+}
+
+// String renders the configuration as KEY=value lines.
+func (c Config) String() string {
+	var sb strings.Builder
+	for _, attr := range c.attrs() {
+		fmt.Fprintf(&sb, "%s=%v\n", attr.Key, attr.Value)
+	}
+
+	return sb.String()
+}
+
+// LogValue implements [slog.LogValuer].
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(c.attrs()...)
+}
+
+// LoadConfigFile reads environment variables from a dotenv style file at path. Each line
+// is a KEY=VALUE pair; blank lines and lines starting with # are ignored and values may
+// be wrapped in single or double quotes. Variables already set in the process environment
+// take precedence over values in the file.
+func LoadConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("%s:%d: invalid line %q", path, n, line)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"':
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: invalid quoted value for %s: %w", path, n, key, err)
+			}
+		case len(value) > 1 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			// strip trailing comments from unquoted values
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
 }
 
 // Var returns an environment variable stripped of leading and trailing quotes or spaces
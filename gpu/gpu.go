@@ -198,6 +198,16 @@ func GetGPUInfo() GpuInfoList {
 	if !bootstrapped {
 		slog.Info("looking for compatible GPUs")
 		needRefresh = false
+		visibleDevices := envconfig.VisibleDevices()
+		if len(visibleDevices) > 0 {
+			// OLLAMA_VISIBLE_DEVICES selects from the GPUs of every vendor
+			for _, key := range []string{"CUDA_VISIBLE_DEVICES", "HIP_VISIBLE_DEVICES", "ROCR_VISIBLE_DEVICES", "GPU_DEVICE_ORDINAL", "ONEAPI_DEVICE_SELECTOR"} {
+				if value, ok := os.LookupEnv(key); ok {
+					slog.Info("OLLAMA_VISIBLE_DEVICES is set, ignoring "+key, "value", value)
+					os.Unsetenv(key)
+				}
+			}
+		}
 		cpuCapability = GetCPUCapability()
 		var memInfo C.mem_info_t
 
@@ -342,6 +352,25 @@ func GetGPUInfo() GpuInfoList {
 		}
 
 		rocmGPUs = AMDGetGPUInfo()
+
+		if len(visibleDevices) > 0 {
+			var all GpuInfoList
+			for _, gpu := range cudaGPUs {
+				all = append(all, gpu.GpuInfo)
+			}
+			for _, gpu := range rocmGPUs {
+				all = append(all, gpu.GpuInfo)
+			}
+			for _, gpu := range oneapiGPUs {
+				all = append(all, gpu.GpuInfo)
+			}
+
+			visible := all.selected(visibleDevices)
+			cudaGPUs, visible = filterVisible(cudaGPUs, visible)
+			rocmGPUs, visible = filterVisible(rocmGPUs, visible)
+			oneapiGPUs, _ = filterVisible(oneapiGPUs, visible)
+		}
+
 		bootstrapped = true
 		if len(cudaGPUs) == 0 && len(rocmGPUs) == 0 && len(oneapiGPUs) == 0 {
 			slog.Info("no compatible GPUs were discovered")
@@ -58,3 +58,29 @@ func TestByLibrary(t *testing.T) {
 }
 
 // TODO - add some logic to figure out card type through other means and actually verify we got back what we expected
+
+func TestSelectedGPUs(t *testing.T) {
+	gpus := GpuInfoList{
+		{ID: "GPU-4a8e9c2d", Library: "cuda"},
+		{ID: "GPU-7f31b0e5", Library: "cuda"},
+		{ID: "0", Library: "rocm"},
+	}
+
+	cases := []struct {
+		devices []string
+		want    []bool
+	}{
+		{nil, []bool{false, false, false}},
+		{[]string{"2", "GPU-4a8e9c2d"}, []bool{true, false, true}},
+		{[]string{"1", "GPU-7f31b0e5", "1"}, []bool{false, true, false}},
+		{[]string{"3", "GPU-missing", "0"}, []bool{true, false, false}},
+	}
+
+	for _, tt := range cases {
+		assert.Equal(t, tt.want, gpus.selected(tt.devices), tt.devices)
+	}
+
+	cuda, visible := filterVisible(gpus[:2], []bool{false, true, true})
+	assert.Equal(t, GpuInfoList{gpus[1]}, GpuInfoList(cuda))
+	assert.Equal(t, []bool{true}, visible)
+}
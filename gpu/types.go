@@ -3,6 +3,8 @@ package gpu
 import (
 	"fmt"
 	"log/slog"
+	"slices"
+	"strconv"
 
 	"github.com/ollama/ollama/format"
 )
@@ -101,6 +103,40 @@ func (l GpuInfoList) ByLibrary() []GpuInfoList {
 	return resp
 }
 
+// selected reports which GPUs of l are selected by devices, each the index of
+// a GPU in l or its ID. Devices that don't match a GPU are logged and skipped.
+func (l GpuInfoList) selected(devices []string) []bool {
+	visible := make([]bool, len(l))
+	for _, device := range devices {
+		i, err := strconv.Atoi(device)
+		if err != nil {
+			i = slices.IndexFunc(l, func(info GpuInfo) bool { return info.ID == device })
+		}
+
+		if i < 0 || i >= len(l) {
+			slog.Warn("visible device not found, skipping", "device", device)
+			continue
+		}
+
+		visible[i] = true
+	}
+
+	return visible
+}
+
+// filterVisible returns the GPUs of gpus marked in the leading elements of
+// visible and the elements of visible which follow them
+func filterVisible[T any](gpus []T, visible []bool) ([]T, []bool) {
+	var filtered []T
+	for i, gpu := range gpus {
+		if visible[i] {
+			filtered = append(filtered, gpu)
+		}
+	}
+
+	return filtered, visible[len(gpus):]
+}
+
 // Report the GPU information into the log an Info level
 func (l GpuInfoList) LogDetails() {
 	for _, g := range l {
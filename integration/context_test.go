@@ -7,6 +7,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/ollama/ollama/api"
 )
 
@@ -32,3 +34,34 @@ func TestContextExhaustion(t *testing.T) {
 	}
 	DoGenerate(ctx, t, client, req, []string{"once", "upon", "lived"}, 120*time.Second, 10*time.Second)
 }
+
+func TestPromptCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	client, _, cleanup := InitServerConnection(ctx, t)
+	defer cleanup()
+	require.NoError(t, PullIfMissing(ctx, client, "orca-mini"))
+
+	system := "You are a helpful assistant who answers questions about llamas in a single short sentence. Llamas are domesticated South American camelids."
+	generate := func(prompt string) int {
+		var promptEvalCount int
+		req := api.GenerateRequest{
+			Model:   "orca-mini",
+			System:  system,
+			Prompt:  prompt,
+			Stream:  &stream,
+			Options: map[string]any{"temperature": 0, "seed": 123, "num_predict": 8},
+		}
+		require.NoError(t, client.Generate(ctx, &req, func(resp api.GenerateResponse) error {
+			if resp.Done {
+				promptEvalCount = resp.PromptEvalCount
+			}
+			return nil
+		}))
+		return promptEvalCount
+	}
+
+	first := generate("What do llamas eat?")
+	second := generate("Where do llamas live?")
+	require.Less(t, second, first, "expected the shared system prompt to be cached")
+}
@@ -17870,6 +17870,10 @@ static void llama_model_quantize_internal(const std::string & fname_inp, const s
         // write tensor data + padding
         fout.write((const char *) new_data, new_size);
         zeros(fout, GGML_PAD(new_size, align) - new_size);
+
+        if (params->progress_callback) {
+            params->progress_callback(idx, ml.n_tensors, params->progress_callback_user_data);
+        }
     }
     close_ofstream();
     for (auto & c:ctx_outs) {
@@ -18170,6 +18174,8 @@ struct llama_model_quantize_params llama_model_quantize_default_params() {
         /*.keep_split                  =*/ false,
         /*.imatrix                     =*/ nullptr,
         /*.kv_overrides                =*/ nullptr,
+        /*.progress_callback           =*/ nullptr,
+        /*.progress_callback_user_data =*/ nullptr,
     };
 
     return result;
@@ -43,6 +43,7 @@ package llama
 #include "sampling_ext.h"
 
 bool llamaProgressCallback(float progress, void *user_data);
+void llamaQuantizeProgressCallback(int32_t tensor, int32_t n_tensors, void *user_data);
 */
 import "C"
 
@@ -147,6 +148,49 @@ func (c *Context) KvCacheSeqCp(srcSeqId int, dstSeqId int, p0 int, p1 int) {
 	C.llama_kv_cache_seq_cp(c.c, C.int(srcSeqId), C.int(dstSeqId), C.int(p0), C.int(p1))
 }
 
+// StateSeqSaveFile saves the KV cache of a sequence, along with its tokens, to
+// a file at path
+func (c *Context) StateSeqSaveFile(path string, seqId int, tokens []int) error {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	cTokens := make([]C.llama_token, len(tokens))
+	for i, t := range tokens {
+		cTokens[i] = C.llama_token(t)
+	}
+
+	var tokensPtr *C.llama_token
+	if len(cTokens) > 0 {
+		tokensPtr = &cTokens[0]
+	}
+
+	if C.llama_state_seq_save_file(c.c, cPath, C.llama_seq_id(seqId), tokensPtr, C.size_t(len(cTokens))) == 0 {
+		return errors.New("error saving sequence state")
+	}
+
+	return nil
+}
+
+// StateSeqLoadFile loads the KV cache saved by StateSeqSaveFile into a
+// sequence and returns its tokens, of which there may be up to capacity
+func (c *Context) StateSeqLoadFile(path string, seqId int, capacity int) ([]int, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	cTokens := make([]C.llama_token, max(capacity, 1))
+	var n C.size_t
+	if C.llama_state_seq_load_file(c.c, cPath, C.llama_seq_id(seqId), &cTokens[0], C.size_t(capacity), &n) == 0 {
+		return nil, errors.New("error loading sequence state")
+	}
+
+	tokens := make([]int, n)
+	for i := range tokens {
+		tokens[i] = int(cTokens[i])
+	}
+
+	return tokens, nil
+}
+
 // Get the embeddings for a sequence id
 func (c *Context) GetEmbeddingsSeq(seqId int) []float32 {
 	embeddings := unsafe.Pointer(C.llama_get_embeddings_seq(c.c, C.int(seqId)))
@@ -387,7 +431,16 @@ func (m *Model) NEmbd() int {
 	return int(C.llama_n_embd(m.c))
 }
 
-func Quantize(infile, outfile string, ftype uint32) error {
+//export llamaQuantizeProgressCallback
+func llamaQuantizeProgressCallback(tensor, nTensors C.int32_t, userData unsafe.Pointer) {
+	handle := *(*cgo.Handle)(userData)
+	callback := handle.Value().(func(int, int))
+	callback(int(tensor), int(nTensors))
+}
+
+// Quantize quantizes infile to ftype in outfile. progress, if not nil, is
+// called with the number of tensors quantized and the total after each tensor.
+func Quantize(infile, outfile string, ftype uint32, progress func(tensor, total int)) error {
 	cinfile := C.CString(infile)
 	defer C.free(unsafe.Pointer(cinfile))
 
@@ -398,6 +451,18 @@ func Quantize(infile, outfile string, ftype uint32) error {
 	params.nthread = -1
 	params.ftype = ftype
 
+	if progress != nil {
+		handle := cgo.NewHandle(progress)
+		defer handle.Delete()
+
+		var handlePin runtime.Pinner
+		handlePin.Pin(&handle)
+		defer handlePin.Unpin()
+
+		params.progress_callback = C.llama_quantize_progress_callback(C.llamaQuantizeProgressCallback)
+		params.progress_callback_user_data = unsafe.Pointer(&handle)
+	}
+
 	if rc := C.llama_model_quantize(cinfile, coutfile, &params); rc != 0 {
 		return fmt.Errorf("llama_model_quantize: %d", rc)
 	}
@@ -467,7 +532,11 @@ type SamplingParams struct {
 	Grammar        string
 }
 
-func NewSamplingContext(params SamplingParams) *SamplingContext {
+// ErrInvalidGrammar is returned by NewSamplingContext when its grammar fails to
+// parse or has no root rule
+var ErrInvalidGrammar = errors.New("invalid grammar")
+
+func NewSamplingContext(params SamplingParams) (*SamplingContext, error) {
 	var cparams C.struct_llama_sampling_cparams
 	cparams.top_k = C.int32_t(params.TopK)
 	cparams.top_p = C.float(params.TopP)
@@ -489,10 +558,15 @@ func NewSamplingContext(params SamplingParams) *SamplingContext {
 	defer C.free(unsafe.Pointer(grammar))
 
 	cparams.grammar = grammar
-	context := &SamplingContext{c: C.llama_sampling_cinit(&cparams)}
+	c := C.llama_sampling_cinit(&cparams)
+	if c == nil {
+		return nil, ErrInvalidGrammar
+	}
+
+	context := &SamplingContext{c: c}
 	runtime.SetFinalizer(context, func(s *SamplingContext) { C.llama_sampling_cfree(s.c) })
 
-	return context
+	return context, nil
 }
 
 func (s *SamplingContext) Reset() {
@@ -511,3 +585,39 @@ func (s *SamplingContext) Sample(ctxMain *Context, ctxConfig *Context, idx int)
 func (s *SamplingContext) Accept(ctxMain *Context, id int, applyGrammar bool) {
 	C.llama_sampling_caccept(s.c, ctxMain.c, C.llama_token(id), C.bool(applyGrammar))
 }
+
+var (
+	// ErrInvalidSchema is returned by SchemaToGrammar when its schema is
+	// invalid JSON or an invalid JSON schema
+	ErrInvalidSchema = errors.New("invalid JSON schema")
+
+	// ErrGrammarTooLarge is returned by SchemaToGrammar when the grammar of
+	// its schema is larger than maxGrammarSize
+	ErrGrammarTooLarge = errors.New("grammar too large")
+)
+
+// maxGrammarSize is the largest grammar SchemaToGrammar converts a schema to
+const maxGrammarSize = 4 << 20
+
+// SchemaToGrammar converts the provided JSON schema to a grammar.
+func SchemaToGrammar(schema []byte) ([]byte, error) {
+	cStr := C.CString(string(schema))
+	defer C.free(unsafe.Pointer(cStr))
+
+	// start with a buffer large enough for most schemas and grow it to fit
+	// the grammar of larger ones
+	buf := make([]byte, 32768)
+	for {
+		n := int(C.schema_to_grammar(cStr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf))))
+		switch {
+		case n < 0:
+			return nil, ErrInvalidSchema
+		case n < len(buf):
+			return buf[:n], nil
+		case n >= maxGrammarSize:
+			return nil, ErrGrammarTooLarge
+		}
+
+		buf = make([]byte, n+1)
+	}
+}
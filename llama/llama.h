@@ -239,6 +239,9 @@ extern "C" {
 
     typedef bool (*llama_progress_callback)(float progress, void * user_data);
 
+    // Called after each of the n_tensors tensors of a model is quantized
+    typedef void (*llama_quantize_progress_callback)(int32_t tensor, int32_t n_tensors, void * user_data);
+
     // Input data for llama_decode
     // A llama_batch object can contain input about one or many sequences
     // The provided arrays (i.e. token, embd, pos, etc.) must have size of n_tokens
@@ -380,6 +383,9 @@ extern "C" {
         bool keep_split;                     // quantize to the same number of shards
         void * imatrix;                      // pointer to importance matrix data
         void * kv_overrides;                 // pointer to vector containing overrides
+
+        llama_quantize_progress_callback progress_callback; // called with the progress of quantizing tensors
+        void * progress_callback_user_data;                  // context pointer passed to the progress callback
     } llama_model_quantize_params;
 
     // grammar types
@@ -1 +1,78 @@
 package llama
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSchemaToGrammar(t *testing.T) {
+	cases := []struct {
+		schema string
+		expect []string
+	}{
+		{
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "number"}}, "required": ["name", "age"]}`,
+			expect: []string{"root ::=", `"\"name\""`, `"\"age\""`},
+		},
+		{
+			schema: `{"type": "array", "items": {"type": "integer"}}`,
+			expect: []string{"root ::="},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.schema, func(t *testing.T) {
+			g, err := SchemaToGrammar([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, e := range tt.expect {
+				if !strings.Contains(string(g), e) {
+					t.Errorf("expected grammar to contain %q, got:\n%s", e, g)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, schema := range []string{``, `{`, `not json`} {
+			if g, err := SchemaToGrammar([]byte(schema)); !errors.Is(err, ErrInvalidSchema) {
+				t.Errorf("%q: expected ErrInvalidSchema, got %s, %v", schema, g, err)
+			}
+		}
+	})
+
+	t.Run("large", func(t *testing.T) {
+		// a grammar larger than the initial buffer
+		var properties, required []string
+		for i := range 1000 {
+			properties = append(properties, fmt.Sprintf(`"property_%d": {"type": "string"}`, i))
+			required = append(required, fmt.Sprintf(`"property_%d"`, i))
+		}
+
+		schema := fmt.Sprintf(`{"type": "object", "properties": {%s}, "required": [%s]}`, strings.Join(properties, ", "), strings.Join(required, ", "))
+		g, err := SchemaToGrammar([]byte(schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(g) <= 32768 || !strings.Contains(string(g), `"\"property_999\""`) {
+			t.Errorf("expected a grammar of all properties larger than 32KiB, got %d bytes", len(g))
+		}
+	})
+}
+
+func TestNewSamplingContext(t *testing.T) {
+	if _, err := NewSamplingContext(SamplingParams{Grammar: `root ::= "yes" | "no"`}); err != nil {
+		t.Errorf("expected a yes/no grammar to compile, got %v", err)
+	}
+
+	for _, grammar := range []string{`root ::= "yes" | "no`, `answer ::= "yes" | "no"`, `root ::= (`} {
+		if _, err := NewSamplingContext(SamplingParams{Grammar: grammar}); !errors.Is(err, ErrInvalidGrammar) {
+			t.Errorf("%q: expected ErrInvalidGrammar, got %v", grammar, err)
+		}
+	}
+}
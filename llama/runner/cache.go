@@ -182,6 +182,91 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	return oldestSlot, longest, nil
 }
 
+var errNoCache = errors.New("no cache")
+
+// SaveCacheSlot saves the KV cache of the slot sharing the longest prefix with
+// prompt to path, up to that prefix, and returns its length
+func (c *InputCache) SaveCacheSlot(path string, prompt []input) (int, error) {
+	slot, tokens, err := c.findSaveCacheSlot(prompt)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.lc.StateSeqSaveFile(path, slot.Id, tokens); err != nil {
+		return 0, err
+	}
+
+	return len(tokens), nil
+}
+
+// findSaveCacheSlot returns the slot sharing the longest prefix with prompt and
+// the tokens of that prefix
+func (c *InputCache) findSaveCacheSlot(prompt []input) (*InputCacheSlot, []int, error) {
+	var slot *InputCacheSlot
+	var longest int
+	for i, s := range c.slots {
+		if s.InUse {
+			continue
+		}
+
+		if count := countCommonPrefix(s.Inputs, prompt); count > longest {
+			longest = count
+			slot = &c.slots[i]
+		}
+	}
+
+	if slot == nil {
+		return nil, nil, errNoCache
+	}
+
+	tokens := make([]int, longest)
+	for i, input := range slot.Inputs[:longest] {
+		if input.embed != nil {
+			return nil, nil, errors.New("caches with images can't be saved")
+		}
+
+		tokens[i] = input.token
+	}
+
+	return slot, tokens, nil
+}
+
+// RestoreCacheSlot loads the KV cache saved by SaveCacheSlot at path into the
+// least recently used slot and returns its length
+func (c *InputCache) RestoreCacheSlot(path string) (int, error) {
+	var slot *InputCacheSlot
+	for i, s := range c.slots {
+		if !s.InUse && (slot == nil || s.lastUsed.Before(slot.lastUsed)) {
+			slot = &c.slots[i]
+		}
+	}
+
+	if slot == nil {
+		return 0, errors.New("no available cache slots")
+	}
+
+	c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+	slot.Inputs = slot.Inputs[:0]
+
+	tokens, err := c.lc.StateSeqLoadFile(path, slot.Id, c.numCtx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the file holds the whole sequence, which may go past the tokens saved
+	if !c.lc.KvCacheSeqRm(slot.Id, len(tokens), -1) {
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		return 0, errors.New("cache can't be truncated for this model")
+	}
+
+	for _, t := range tokens {
+		slot.Inputs = append(slot.Inputs, input{token: t})
+	}
+
+	slot.lastUsed = time.Now()
+	return len(tokens), nil
+}
+
 func countCommonPrefix(a []input, b []input) int {
 	var count int
 
@@ -302,3 +302,29 @@ func TestImageCache(t *testing.T) {
 		t.Errorf("failed to find expected value: result %v, err %v", result, err)
 	}
 }
+
+func TestFindSaveCacheSlot(t *testing.T) {
+	cache := InputCache{slots: []InputCacheSlot{
+		{Id: 0, Inputs: []input{{token: 1}, {token: 2}}},
+		{Id: 1, Inputs: []input{{token: 1}, {token: 2}, {token: 3}, {token: 4}}},
+		{Id: 2, Inputs: []input{{token: 1}, {token: 2}, {token: 3}, {token: 4}, {token: 5}}, InUse: true},
+		{Id: 3, Inputs: []input{{token: 9}, {embed: []float32{0.1}}}},
+	}}
+
+	slot, tokens, err := cache.findSaveCacheSlot([]input{{token: 1}, {token: 2}, {token: 3}, {token: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slot.Id != 1 || !reflect.DeepEqual(tokens, []int{1, 2, 3}) {
+		t.Errorf("expected the first 3 tokens of slot 1, got %v of slot %d", tokens, slot.Id)
+	}
+
+	if _, _, err := cache.findSaveCacheSlot([]input{{token: 8}}); err != errNoCache {
+		t.Errorf("expected %v, got %v", errNoCache, err)
+	}
+
+	if _, _, err := cache.findSaveCacheSlot([]input{{token: 9}, {embed: []float32{0.1}}}); err == nil {
+		t.Error("expected a cache with images to be rejected")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+)
+
+// CompletionProbability is the probability of a generated token along with
+// the most likely tokens at its position, as the C++ server reports them
+type CompletionProbability struct {
+	Content string             `json:"content"`
+	Prob    float64            `json:"prob"`
+	Probs   []TokenProbability `json:"probs"`
+}
+
+type TokenProbability struct {
+	TokStr string  `json:"tok_str"`
+	Prob   float64 `json:"prob"`
+}
+
+// softmax returns the probabilities of the tokens of the vocabulary given
+// their logits
+func softmax(logits []float32) []float64 {
+	maxLogit := math.Inf(-1)
+	for _, l := range logits {
+		maxLogit = max(maxLogit, float64(l))
+	}
+
+	probs := make([]float64, len(logits))
+	var sum float64
+	for i, l := range logits {
+		probs[i] = math.Exp(float64(l) - maxLogit)
+		sum += probs[i]
+	}
+
+	for i := range probs {
+		probs[i] /= sum
+	}
+
+	return probs
+}
+
+// topTokens returns the n tokens with the highest probabilities, the most
+// likely first
+func topTokens(probs []float64, n int) []int {
+	tokens := make([]int, len(probs))
+	for i := range tokens {
+		tokens[i] = i
+	}
+
+	slices.SortStableFunc(tokens, func(a, b int) int {
+		return cmp.Compare(probs[b], probs[a])
+	})
+
+	return tokens[:min(n, len(tokens))]
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestSoftmax(t *testing.T) {
+	probs := softmax([]float32{1, 2, 3})
+
+	var sum float64
+	for _, p := range probs {
+		sum += p
+	}
+
+	if math.Abs(sum-1) > 1e-9 {
+		t.Errorf("expected probabilities to sum to 1, got %v", sum)
+	}
+
+	if probs[0] >= probs[1] || probs[1] >= probs[2] {
+		t.Errorf("expected probabilities ordered by logit, got %v", probs)
+	}
+
+	// large logits don't overflow
+	if probs := softmax([]float32{1000, 1000}); probs[0] != 0.5 || probs[1] != 0.5 {
+		t.Errorf("expected [0.5 0.5], got %v", probs)
+	}
+}
+
+func TestTopTokens(t *testing.T) {
+	probs := []float64{0.1, 0.4, 0.05, 0.4, 0.05}
+
+	if got := topTokens(probs, 3); !slices.Equal(got, []int{1, 3, 0}) {
+		t.Errorf("expected [1 3 0], got %v", got)
+	}
+
+	if got := topTokens(probs, 10); len(got) != len(probs) {
+		t.Errorf("expected all %d tokens, got %v", len(probs), got)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,11 +49,14 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// probabilities of the pending responses if they're requested
+	pendingProbs []CompletionProbability
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
 	// channel to send responses over
-	responses chan string
+	responses chan CompletionResponse
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -60,6 +64,9 @@ type Sequence struct {
 	// number of tokens to predict
 	numPredict int
 
+	// number of most likely tokens to report the probabilities of
+	numProbs int
+
 	samplingCtx *llama.SamplingContext
 
 	// channel to send back the embedding if embedding only
@@ -68,6 +75,10 @@ type Sequence struct {
 	// stop sequences
 	stop []string
 
+	// stop patterns and the response returned so far for them to match
+	stopRegex []*regexp.Regexp
+	returned  strings.Builder
+
 	// number of inputs to keep at the beginning when shifting context window
 	numKeep int
 
@@ -86,7 +97,9 @@ type Sequence struct {
 type NewSequenceParams struct {
 	numPredict     int
 	stop           []string
+	stopRegex      []*regexp.Regexp
 	numKeep        int
+	numProbs       int
 	samplingParams *llama.SamplingParams
 	embedding      bool
 }
@@ -126,7 +139,12 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 
 	var sc *llama.SamplingContext
 	if params.samplingParams != nil {
-		sc = llama.NewSamplingContext(*params.samplingParams)
+		var err error
+		sc, err = llama.NewSamplingContext(*params.samplingParams)
+		if err != nil {
+			return nil, err
+		}
+
 		for _, input := range inputs {
 			if input.embed == nil {
 				sc.Accept(s.lc, input.token, false)
@@ -139,13 +157,15 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		numPromptInputs:     len(inputs),
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
+		numProbs:            params.numProbs,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan CompletionResponse, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
+		stopRegex:           params.stopRegex,
 		numKeep:             params.numKeep,
 	}, nil
 }
@@ -272,18 +292,61 @@ func (s *Server) shiftContext(seq *Sequence) {
 	seq.numPast -= numDiscard
 }
 
+// flushPending sends the pending pieces as a single response, so that a
+// character split across several tokens is never sent in parts
 func flushPending(seq *Sequence) bool {
-	for _, p := range seq.pendingResponses {
-		select {
-		case seq.responses <- p:
-		case <-seq.quit:
-			seq.pendingResponses = []string{}
-			return false
+	joined := strings.Join(seq.pendingResponses, "")
+	probs := seq.pendingProbs
+	seq.pendingResponses, seq.pendingProbs = []string{}, nil
+	if joined == "" {
+		return true
+	}
+
+	select {
+	case seq.responses <- CompletionResponse{Content: joined, CompletionProbabilities: probs}:
+		if len(seq.stopRegex) > 0 {
+			seq.returned.WriteString(joined)
 		}
+		return true
+	case <-seq.quit:
+		return false
 	}
+}
 
-	seq.pendingResponses = []string{}
-	return true
+// flushStopRegex flushes the pending pieces up to where the stop patterns
+// could still match once more pieces follow
+func flushStopRegex(seq *Sequence) bool {
+	returned := seq.returned.String()
+	index := partialStopRegex(returned+strings.Join(seq.pendingResponses, ""), seq.stopRegex)
+	if index < 0 {
+		return flushPending(seq)
+	}
+
+	return flushPendingBefore(seq, max(index-len(returned), 0))
+}
+
+// flushPendingBefore sends the pending text before index and keeps the rest
+// pending. A piece split by index keeps its tail pending so the pending pieces
+// still line up with the tokens they came from.
+func flushPendingBefore(seq *Sequence, index int) bool {
+	var head []string
+	tail := slices.Clone(seq.pendingResponses)
+	for len(tail) > 0 && len(tail[0]) <= index {
+		index -= len(tail[0])
+		head, tail = append(head, tail[0]), tail[1:]
+	}
+
+	probs := seq.pendingProbs
+	n := min(len(head), len(probs))
+	if index > 0 {
+		head = append(head, tail[0][:index])
+		tail[0] = tail[0][index:]
+	}
+
+	seq.pendingResponses, seq.pendingProbs = head, probs[:n]
+	ok := flushPending(seq)
+	seq.pendingResponses, seq.pendingProbs = tail, probs[n:]
+	return ok
 }
 
 func (s *Server) removeSequence(seqIndex int, reason string) {
@@ -428,6 +491,12 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		// the probabilities of the model before sampling adjusts the logits
+		var probs []float64
+		if seq.numProbs > 0 {
+			probs = softmax(s.lc.GetLogitsIth(seq.iBatch))
+		}
+
 		// sample a token
 		token := seq.samplingCtx.Sample(s.lc, nil, seq.iBatch)
 		seq.samplingCtx.Accept(s.lc, token, true)
@@ -450,19 +519,47 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		seq.pendingResponses = append(seq.pendingResponses, piece)
 		sequence := strings.Join(seq.pendingResponses, "")
 
+		if probs != nil {
+			p := CompletionProbability{Content: piece, Prob: probs[token]}
+			for _, t := range topTokens(probs, seq.numProbs) {
+				p.Probs = append(p.Probs, TokenProbability{TokStr: s.model.TokenToPiece(t), Prob: probs[t]})
+			}
+
+			seq.pendingProbs = append(seq.pendingProbs, p)
+		}
+
+		index := -1
 		if ok, stop := findStop(sequence, seq.stop); ok {
 			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+			index = strings.Index(sequence, stop)
+		}
 
+		// patterns are matched against the whole response but only the part
+		// of a match that hasn't been returned yet can be removed
+		if len(seq.stopRegex) > 0 {
+			if i := findStopRegex(seq.returned.String()+sequence, seq.stopRegex); i >= 0 {
+				i = max(i-seq.returned.Len(), 0)
+				if index < 0 || i < index {
+					slog.Debug("hit stop pattern", "pending", seq.pendingResponses)
+					index = i
+				}
+			}
+		}
+
+		if index >= 0 {
 			var tokenTruncated bool
 			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = truncateStop(seq.pendingResponses, stop)
+			seq.pendingResponses, tokenTruncated = truncateAt(seq.pendingResponses, index)
 			newLen := len(seq.pendingResponses)
+			if len(seq.pendingProbs) > newLen {
+				seq.pendingProbs = seq.pendingProbs[:newLen]
+			}
 
 			// Update the cache based on the tokens that will be returned:
 			// - We have 1 token more than is currently in the cache because
 			// the last one generated wasn't submitted to Decode
 			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
+			// - If truncateAt removed a portion of a token, drop that
 			// - As defense-in-depth, if truncatedToken didn't find a stop token
 			// remove the extra one that we added to the cache len
 			tokenLen := len(seq.cache.Inputs) + 1
@@ -484,7 +581,12 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
-		if !flushPending(seq) {
+		flush := flushPending
+		if len(seq.stopRegex) > 0 {
+			flush = flushStopRegex
+		}
+
+		if !flush(seq) {
 			s.removeSequence(i, "connection")
 		}
 	}
@@ -514,6 +616,7 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta"`
 	PenalizeNewline  bool     `json:"penalize_nl"`
 	Stop             []string `json:"stop"`
+	StopRegex        []string `json:"stop_regex"`
 }
 
 type ImageData struct {
@@ -526,6 +629,7 @@ type CompletionRequest struct {
 	Images      []ImageData `json:"image_data"`
 	Grammar     string      `json:"grammar"`
 	CachePrompt bool        `json:"cache_prompt"`
+	NumProbs    int         `json:"n_probs"`
 
 	Options
 }
@@ -541,6 +645,8 @@ type CompletionResponse struct {
 	Content string `json:"content"`
 	Stop    bool   `json:"stop"`
 
+	CompletionProbabilities []CompletionProbability `json:"completion_probabilities,omitempty"`
+
 	Model        string  `json:"model,omitempty"`
 	Prompt       string  `json:"prompt,omitempty"`
 	StoppedLimit bool    `json:"stopped_limit,omitempty"`
@@ -588,14 +694,30 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	samplingParams.Seed = uint32(req.Seed)
 	samplingParams.Grammar = req.Grammar
 
+	stopRegex := make([]*regexp.Regexp, len(req.StopRegex))
+	for i, pattern := range req.StopRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid stop_regex: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		stopRegex[i] = re
+	}
+
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
 		numPredict:     req.NumPredict,
 		stop:           req.Stop,
+		stopRegex:      stopRegex,
 		numKeep:        req.NumKeep,
+		numProbs:       req.NumProbs,
 		samplingParams: &samplingParams,
 		embedding:      false,
 	})
-	if err != nil {
+	if errors.Is(err, llama.ErrInvalidGrammar) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -611,6 +733,9 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
+
+			// only report the inputs that weren't cached as evaluated
+			seq.numPromptInputs = len(seq.inputs)
 			s.seqs[i] = seq
 			s.cond.Signal()
 			break
@@ -623,11 +748,9 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case resp, ok := <-seq.responses:
 			if ok {
-				if err := json.NewEncoder(w).Encode(&CompletionResponse{
-					Content: content,
-				}); err != nil {
+				if err := json.NewEncoder(w).Encode(&resp); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
 					return
@@ -707,9 +830,78 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type CacheRequest struct {
+	// Path is the file the cache is saved to or restored from
+	Path string `json:"path"`
+
+	// Prompt picks the cache to save by its longest common prefix
+	Prompt string `json:"prompt,omitempty"`
+}
+
+type CacheResponse struct {
+	// Inputs is the number of inputs saved or restored
+	Inputs int `json:"inputs"`
+}
+
+func (s *Server) saveCache(w http.ResponseWriter, r *http.Request) {
+	var req CacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	inputs, err := s.inputs(req.Prompt, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to process prompt: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	n, err := s.cache.SaveCacheSlot(req.Path, inputs)
+	s.mu.Unlock()
+	if errors.Is(err, errNoCache) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("failed to save cache: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Debug("saved cache", "path", req.Path, "inputs", n)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&CacheResponse{Inputs: n}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) restoreCache(w http.ResponseWriter, r *http.Request) {
+	var req CacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	n, err := s.cache.RestoreCacheSlot(req.Path)
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to restore cache: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Debug("restored cache", "path", req.Path, "inputs", n)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&CacheResponse{Inputs: n}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
 type HealthResponse struct {
-	Status   string  `json:"status"`
-	Progress float32 `json:"progress"`
+	Status    string  `json:"status"`
+	Progress  float32 `json:"progress"`
+	StopRegex bool    `json:"stop_regex"`
 }
 
 type ServerStatus int
@@ -734,8 +926,9 @@ func (s ServerStatus) ToString() string {
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&HealthResponse{
-		Status:   s.status.ToString(),
-		Progress: s.progress,
+		Status:    s.status.ToString(),
+		Progress:  s.progress,
+		StopRegex: true,
 	}); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
@@ -877,6 +1070,8 @@ func main() {
 	mux.HandleFunc("/embedding", server.embeddings)
 	mux.HandleFunc("/completion", server.completion)
 	mux.HandleFunc("/health", server.health)
+	mux.HandleFunc("/cache/save", server.saveCache)
+	mux.HandleFunc("/cache/restore", server.restoreCache)
 
 	httpServer := http.Server{
 		Handler: mux,
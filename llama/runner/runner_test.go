@@ -0,0 +1,103 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFlushPending(t *testing.T) {
+	// "世" and "👋" split across tokens the way a tokenizer might
+	seq := &Sequence{
+		pendingResponses: []string{"a ", "\xe4\xb8", "\x96", "\xf0\x9f", "\x91", "\x8b\n"},
+		responses:        make(chan CompletionResponse, 10),
+		quit:             make(chan bool),
+	}
+
+	if !flushPending(seq) {
+		t.Fatal("expected the pending responses to be flushed")
+	}
+
+	if len(seq.pendingResponses) != 0 {
+		t.Errorf("expected no pending responses, got %q", seq.pendingResponses)
+	}
+
+	close(seq.responses)
+
+	var got []string
+	for r := range seq.responses {
+		if !utf8.ValidString(r.Content) {
+			t.Errorf("expected whole characters, got %q", r.Content)
+		}
+
+		got = append(got, r.Content)
+	}
+
+	if len(got) != 1 || got[0] != "a 世👋\n" {
+		t.Errorf("expected a single response %q, got %q", "a 世👋\n", got)
+	}
+}
+
+func TestFlushStopRegex(t *testing.T) {
+	seq := &Sequence{
+		stopRegex: []*regexp.Regexp{regexp.MustCompile(`\n\d`)},
+		responses: make(chan CompletionResponse, 10),
+		quit:      make(chan bool),
+	}
+
+	// the match starts in one token and ends in the next
+	for _, piece := range []string{"Steps:", "\n", "first", "\n", "2", "."} {
+		seq.pendingResponses = append(seq.pendingResponses, piece)
+		if index := findStopRegex(seq.returned.String()+strings.Join(seq.pendingResponses, ""), seq.stopRegex); index >= 0 {
+			if index < seq.returned.Len() {
+				t.Fatalf("expected the match at %d to be held back, got %q returned", index, seq.returned.String())
+			}
+
+			seq.pendingResponses, _ = truncateAt(seq.pendingResponses, index-seq.returned.Len())
+			break
+		}
+
+		if !flushStopRegex(seq) {
+			t.Fatal("expected the pending responses to be flushed")
+		}
+	}
+
+	if !flushPending(seq) {
+		t.Fatal("expected the pending responses to be flushed")
+	}
+
+	close(seq.responses)
+
+	var got strings.Builder
+	for r := range seq.responses {
+		got.WriteString(r.Content)
+	}
+
+	if got.String() != "Steps:\nfirst" {
+		t.Errorf("expected %q, got %q", "Steps:\nfirst", got.String())
+	}
+}
+
+func TestFlushPendingBefore(t *testing.T) {
+	seq := &Sequence{
+		pendingResponses: []string{"ab", "cd", "ef"},
+		pendingProbs:     []CompletionProbability{{Content: "ab"}, {Content: "cd"}, {Content: "ef"}},
+		responses:        make(chan CompletionResponse, 10),
+		quit:             make(chan bool),
+	}
+
+	if !flushPendingBefore(seq, 3) {
+		t.Fatal("expected the pending responses to be flushed")
+	}
+
+	r := <-seq.responses
+	if r.Content != "abc" || len(r.CompletionProbabilities) != 1 {
+		t.Errorf("expected %q with 1 probability, got %q with %d", "abc", r.Content, len(r.CompletionProbabilities))
+	}
+
+	// the split token stays pending with its probability
+	if strings.Join(seq.pendingResponses, ",") != "d,ef" || len(seq.pendingProbs) != 2 {
+		t.Errorf("expected pending %q with 2 probabilities, got %q with %d", "d,ef", seq.pendingResponses, len(seq.pendingProbs))
+	}
+}
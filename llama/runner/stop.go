@@ -1,7 +1,10 @@
 package main
 
 import (
+	"regexp"
+	"regexp/syntax"
 	"strings"
+	"unicode/utf8"
 )
 
 func findStop(sequence string, stops []string) (bool, string) {
@@ -14,6 +17,131 @@ func findStop(sequence string, stops []string) (bool, string) {
 	return false, ""
 }
 
+// findStopRegex returns the start of the earliest match of stops in
+// sequence or -1 if none match
+func findStopRegex(sequence string, stops []*regexp.Regexp) int {
+	index := -1
+	for _, stop := range stops {
+		if loc := stop.FindStringIndex(sequence); loc != nil && (index < 0 || loc[0] < index) {
+			index = loc[0]
+		}
+	}
+
+	return index
+}
+
+// partialStopRegex returns the start of the earliest suffix of sequence that
+// stops could still match once more text follows, or -1 if none could
+func partialStopRegex(sequence string, stops []*regexp.Regexp) int {
+	index := -1
+	for _, stop := range stops {
+		re, err := syntax.Parse(stop.String(), syntax.Perl)
+		if err != nil {
+			continue
+		}
+
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil {
+			continue
+		}
+
+		if i := partialMatch(sequence, prog); i >= 0 && (index < 0 || i < index) {
+			index = i
+		}
+	}
+
+	return index
+}
+
+// partialMatch runs prog from every position of sequence at once and returns
+// the earliest start of a run that's still matching at the end of sequence,
+// or -1 if every run has failed
+func partialMatch(sequence string, prog *syntax.Prog) int {
+	// the earliest start of the runs at each instruction, or -1
+	clist, nlist := make([]int, len(prog.Inst)), make([]int, len(prog.Inst))
+	for i := range clist {
+		clist[i], nlist[i] = -1, -1
+	}
+
+	// add follows the instructions that don't consume a rune. The text after
+	// the end of sequence isn't known so empty-width assertions there hold.
+	var add func(list []int, pc uint32, start int, prev, next rune)
+	add = func(list []int, pc uint32, start int, prev, next rune) {
+		if list[pc] >= 0 && list[pc] <= start {
+			return
+		}
+
+		list[pc] = start
+		switch inst := prog.Inst[pc]; inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			add(list, inst.Out, start, prev, next)
+			add(list, inst.Arg, start, prev, next)
+		case syntax.InstCapture, syntax.InstNop:
+			add(list, inst.Out, start, prev, next)
+		case syntax.InstEmptyWidth:
+			if next < 0 || syntax.EmptyOp(inst.Arg)&^syntax.EmptyOpContext(prev, next) == 0 {
+				add(list, inst.Out, start, prev, next)
+			}
+		}
+	}
+
+	prev := rune(-1)
+	for pos := 0; ; {
+		r, width := rune(-1), 0
+		if pos < len(sequence) {
+			r, width = utf8.DecodeRuneInString(sequence[pos:])
+		}
+
+		if pos >= len(sequence) {
+			break
+		}
+
+		add(clist, uint32(prog.Start), pos, prev, r)
+
+		next := rune(-1)
+		if pos+width < len(sequence) {
+			next, _ = utf8.DecodeRuneInString(sequence[pos+width:])
+		}
+
+		for pc, start := range clist {
+			if start < 0 {
+				continue
+			}
+
+			clist[pc] = -1
+			inst := prog.Inst[pc]
+			var ok bool
+			switch inst.Op {
+			case syntax.InstRune, syntax.InstRune1:
+				ok = inst.MatchRune(r)
+			case syntax.InstRuneAny:
+				ok = true
+			case syntax.InstRuneAnyNotNL:
+				ok = r != '\n'
+			}
+
+			if ok {
+				add(nlist, inst.Out, start, r, next)
+			}
+		}
+
+		clist, nlist = nlist, clist
+		prev, pos = r, pos+width
+	}
+
+	index := -1
+	for pc, start := range clist {
+		switch prog.Inst[pc].Op {
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL, syntax.InstMatch:
+			if start >= 0 && (index < 0 || start < index) {
+				index = start
+			}
+		}
+	}
+
+	return index
+}
+
 func containsStopSuffix(sequence string, stops []string) bool {
 	for _, stop := range stops {
 		for i := 1; i <= len(stop); i++ {
@@ -37,7 +165,13 @@ func truncateStop(pieces []string, stop string) ([]string, bool) {
 		return pieces, false
 	}
 
-	joined = joined[:index]
+	return truncateAt(pieces, index)
+}
+
+// truncateAt removes everything from index of the joined pieces onwards,
+// truncating the last piece if required (and signalling if this was the case)
+func truncateAt(pieces []string, index int) ([]string, bool) {
+	joined := strings.Join(pieces, "")[:index]
 
 	// Split truncated string back into pieces of original lengths
 	lengths := make([]int, len(pieces))
@@ -2,6 +2,7 @@ package main
 
 import (
 	"reflect"
+	"regexp"
 	"testing"
 )
 
@@ -60,6 +61,178 @@ func TestTruncateStop(t *testing.T) {
 	}
 }
 
+func TestFindStopRegex(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence string
+		stops    []string
+		expected int
+	}{
+		{
+			name:     "Literal",
+			sequence: "Hello User: hi",
+			stops:    []string{"User:"},
+			expected: 6,
+		},
+		{
+			name:     "Quoted literal",
+			sequence: "1 + 1 = 2 (a.b)",
+			stops:    []string{regexp.QuoteMeta("(a.b)")},
+			expected: 10,
+		},
+		{
+			name:     "No match",
+			sequence: "Hello there",
+			stops:    []string{`\d+`, "User:"},
+			expected: -1,
+		},
+		{
+			name:     "Newline followed by a number",
+			sequence: "Steps:\nfirst\n2. second",
+			stops:    []string{`\n\d`},
+			expected: 12,
+		},
+		{
+			name:     "Earliest of several",
+			sequence: "a:\n1 User: b",
+			stops:    []string{`(?i)user:`, `\n\d`},
+			expected: 2,
+		},
+		{
+			name:     "Alternation",
+			sequence: "done.</answer> more",
+			stops:    []string{`</(answer|response)>`},
+			expected: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stops := make([]*regexp.Regexp, len(tt.stops))
+			for i, stop := range tt.stops {
+				stops[i] = regexp.MustCompile(stop)
+			}
+
+			if index := findStopRegex(tt.sequence, stops); index != tt.expected {
+				t.Errorf("findStopRegex(%q, %v): have %d; want %d", tt.sequence, tt.stops, index, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPartialStopRegex(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence string
+		stops    []string
+		expected int
+	}{
+		{
+			name:     "Could match once more follows",
+			sequence: "Steps:\nfirst\n",
+			stops:    []string{`\n\d`},
+			expected: 12,
+		},
+		{
+			name:     "Can't match",
+			sequence: "Steps:\nfirst",
+			stops:    []string{`\n\d`},
+			expected: -1,
+		},
+		{
+			name:     "Prefix of a literal",
+			sequence: "Hello Us",
+			stops:    []string{"User:"},
+			expected: 6,
+		},
+		{
+			name:     "Earliest of several",
+			sequence: "done.</ans",
+			stops:    []string{`\n\d`, `</(answer|response)>`, `(?i)ANS`},
+			expected: 5,
+		},
+		{
+			name:     "Begin line",
+			sequence: "a\nx",
+			stops:    []string{`(?m)^x:`},
+			expected: 2,
+		},
+		{
+			name:     "Begin line mid line",
+			sequence: "ax",
+			stops:    []string{`(?m)^x:`},
+			expected: -1,
+		},
+		{
+			name:     "Open-ended",
+			sequence: "a <b> ",
+			stops:    []string{`<[a-z]+>\s*\d`},
+			expected: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stops := make([]*regexp.Regexp, len(tt.stops))
+			for i, stop := range tt.stops {
+				stops[i] = regexp.MustCompile(stop)
+			}
+
+			if index := partialStopRegex(tt.sequence, stops); index != tt.expected {
+				t.Errorf("partialStopRegex(%q, %v): have %d; want %d", tt.sequence, tt.stops, index, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTruncateAt(t *testing.T) {
+	tests := []struct {
+		name          string
+		pieces        []string
+		index         int
+		expected      []string
+		expectedTrunc bool
+	}{
+		{
+			name:          "Piece boundary",
+			pieces:        []string{"first", "\n", "2"},
+			index:         5,
+			expected:      []string{"first"},
+			expectedTrunc: false,
+		},
+		{
+			name:          "Within piece",
+			pieces:        []string{"first", "\n2"},
+			index:         5,
+			expected:      []string{"first"},
+			expectedTrunc: false,
+		},
+		{
+			name:          "Partial piece",
+			pieces:        []string{"fir", "st\n2"},
+			index:         5,
+			expected:      []string{"fir", "st"},
+			expectedTrunc: true,
+		},
+		{
+			name:          "Start",
+			pieces:        []string{"\n", "2"},
+			index:         0,
+			expected:      nil,
+			expectedTrunc: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, resultTrunc := truncateAt(tt.pieces, tt.index)
+			if !reflect.DeepEqual(result, tt.expected) || resultTrunc != tt.expectedTrunc {
+				t.Errorf("truncateAt(%v, %d): have %v (%v); want %v (%v)", tt.pieces, tt.index, result, resultTrunc, tt.expected, tt.expectedTrunc)
+			}
+		})
+	}
+}
+
 func TestIncompleteUnicode(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -1,6 +1,7 @@
 // TODO: this is a temporary wrapper to allow calling C++ code from CGo
 #include "sampling.h"
 #include "sampling_ext.h"
+#include "json-schema-to-grammar.h"
 
 struct llama_sampling_context *llama_sampling_cinit(struct llama_sampling_cparams *params)
 {
@@ -51,3 +52,23 @@ void llama_sampling_caccept(
 {
     llama_sampling_accept(ctx_sampling, ctx_main, id, apply_grammar);
 }
+
+int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len)
+{
+    try
+    {
+        nlohmann::ordered_json schema = nlohmann::ordered_json::parse(json_schema);
+        std::string grammar_str = json_schema_to_grammar(schema);
+        size_t len = grammar_str.length();
+        if (len < max_len)
+        {
+            strncpy(grammar, grammar_str.c_str(), len);
+        }
+        // the caller retries with a larger buffer if it's too small
+        return len;
+    }
+    catch (const std::exception &e)
+    {
+        return -1;
+    }
+}
@@ -45,6 +45,10 @@ extern "C"
         llama_token id,
         bool apply_grammar);
 
+    // schema_to_grammar writes the grammar of json_schema to grammar if it's
+    // shorter than max_len and returns its length, or -1 if the schema is invalid
+    int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len);
+
 #ifdef __cplusplus
 }
 #endif
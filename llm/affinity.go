@@ -0,0 +1,89 @@
+package llm
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// maxCPU bounds the cores of a CPU set, matching the size of a Linux cpu_set_t
+const maxCPU = 1024
+
+// parseCPUSet parses a list of CPU cores and ranges of them such as "0-7" or
+// "0,2,4-6". The cores are returned sorted and without duplicates.
+func parseCPUSet(spec string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+
+		lo, err := parseCPU(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU set %q: %w", spec, err)
+		}
+
+		hi := lo
+		if isRange {
+			if hi, err = parseCPU(last); err != nil {
+				return nil, fmt.Errorf("invalid CPU set %q: %w", spec, err)
+			}
+
+			if hi < lo {
+				return nil, fmt.Errorf("invalid CPU set %q: range %q is reversed", spec, part)
+			}
+		}
+
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	slices.Sort(cpus)
+	return slices.Compact(cpus), nil
+}
+
+func parseCPU(s string) (int, error) {
+	cpu, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || cpu < 0 {
+		return 0, fmt.Errorf("%q is not a CPU core", s)
+	}
+
+	if cpu >= maxCPU {
+		return 0, fmt.Errorf("CPU core %d is out of range", cpu)
+	}
+
+	return cpu, nil
+}
+
+// runnerCPUs returns the cores of OLLAMA_RUNNER_CPU_AFFINITY, or nil if runners
+// aren't bound to any
+func runnerCPUs() []int {
+	spec := envconfig.RunnerCPUAffinity()
+	if spec == "" {
+		return nil
+	}
+
+	cpus, err := parseCPUSet(spec)
+	if err != nil {
+		slog.Warn("invalid environment variable, ignoring", "key", "OLLAMA_RUNNER_CPU_AFFINITY", "error", err)
+		return nil
+	}
+
+	return cpus
+}
+
+// startRunner starts the runner cmd bound to the cores of
+// OLLAMA_RUNNER_CPU_AFFINITY, if any
+func startRunner(cmd *exec.Cmd) error {
+	cpus := runnerCPUs()
+	if len(cpus) == 0 {
+		return cmd.Start()
+	}
+
+	return startWithAffinity(cmd, cpus)
+}
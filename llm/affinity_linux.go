@@ -0,0 +1,48 @@
+package llm
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// startWithAffinity starts cmd bound to cpus. The child inherits the affinity
+// of the thread that forks it, so the mask is applied to the current thread
+// for the duration of the start and restored after.
+func startWithAffinity(cmd *exec.Cmd, cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+
+	runtime.LockOSThread()
+
+	var prev unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &prev); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("get CPU affinity: %w", err)
+	}
+
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("set CPU affinity %v: %w", cpus, err)
+	}
+
+	err := cmd.Start()
+	if err := unix.SchedSetaffinity(0, &prev); err != nil {
+		// leave the thread locked so it exits with the goroutine rather than
+		// running other goroutines with the runner's affinity
+		slog.Warn("failed to restore CPU affinity", "error", err)
+	} else {
+		runtime.UnlockOSThread()
+	}
+
+	if err == nil {
+		slog.Info("bound llama runner to CPU cores", "cpus", cpus)
+	}
+
+	return err
+}
@@ -0,0 +1,40 @@
+package llm
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestStartWithAffinity(t *testing.T) {
+	var before unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &before); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("grep", "Cpus_allowed_list", "/proc/self/status")
+	cmd.Stdout = &out
+	if err := startWithAffinity(cmd, []int{0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bytes.Fields(out.Bytes()); len(got) != 2 || string(got[1]) != "0" {
+		t.Errorf("expected the runner to be bound to core 0, got %q", out.String())
+	}
+
+	var after unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &after); err != nil {
+		t.Fatal(err)
+	}
+
+	if after != before {
+		t.Errorf("expected the affinity of the server to be restored")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package llm
+
+import (
+	"log/slog"
+	"os/exec"
+	"runtime"
+)
+
+func startWithAffinity(cmd *exec.Cmd, cpus []int) error {
+	slog.Warn("OLLAMA_RUNNER_CPU_AFFINITY is not supported, ignoring", "os", runtime.GOOS)
+	return cmd.Start()
+}
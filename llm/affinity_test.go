@@ -0,0 +1,52 @@
+package llm
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCPUSet(t *testing.T) {
+	cases := map[string][]int{
+		"0":          {0},
+		"0-7":        {0, 1, 2, 3, 4, 5, 6, 7},
+		"0,2,4":      {0, 2, 4},
+		"8-9, 0-1,4": {0, 1, 4, 8, 9},
+		"3,3,2-3":    {2, 3},
+		"1023":       {1023},
+	}
+
+	for spec, want := range cases {
+		got, err := parseCPUSet(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+			continue
+		}
+
+		if !slices.Equal(got, want) {
+			t.Errorf("%q: expected %v, got %v", spec, want, got)
+		}
+	}
+
+	for _, spec := range []string{"", ",", "0,", "a", "-1", "1-", "-", "7-0", "0-1-2", "1024", "0.5"} {
+		if cpus, err := parseCPUSet(spec); err == nil {
+			t.Errorf("expected %q to be invalid, got %v", spec, cpus)
+		}
+	}
+}
+
+func TestRunnerCPUs(t *testing.T) {
+	t.Setenv("OLLAMA_RUNNER_CPU_AFFINITY", "")
+	if cpus := runnerCPUs(); cpus != nil {
+		t.Errorf("expected no cores, got %v", cpus)
+	}
+
+	t.Setenv("OLLAMA_RUNNER_CPU_AFFINITY", "0-3")
+	if cpus := runnerCPUs(); !slices.Equal(cpus, []int{0, 1, 2, 3}) {
+		t.Errorf("expected cores 0-3, got %v", cpus)
+	}
+
+	t.Setenv("OLLAMA_RUNNER_CPU_AFFINITY", "3-0")
+	if cpus := runnerCPUs(); cpus != nil {
+		t.Errorf("expected an invalid spec to be ignored, got %v", cpus)
+	}
+}
@@ -87,8 +87,9 @@ enum slot_command {
 };
 
 struct slot_params {
-    bool stream       = true;
-    bool cache_prompt = false; // remember the prompt to avoid reprocessing all prompt
+    bool stream        = true;
+    bool cache_prompt  = false; // remember the prompt to avoid reprocessing all prompt
+    bool context_shift = true;  // discard old tokens when the context is full instead of stopping
 
     uint32_t seed      = -1; // RNG seed
     int32_t  n_keep    =  0; // number of tokens to keep from initial prompt
@@ -147,6 +148,7 @@ struct server_slot {
     bool stopped_eos = false;
     bool stopped_word = false;
     bool stopped_limit = false;
+    bool stopped_context = false;
 
     std::string stopping_word;
 
@@ -183,6 +185,7 @@ struct server_slot {
         stopped_eos            = false;
         stopped_word           = false;
         stopped_limit          = false;
+        stopped_context        = false;
         stopping_word          = "";
         n_past                 = 0;
         n_sent_text            = 0;
@@ -555,6 +558,7 @@ struct llama_server_context
 
         slot->params.stream             = json_value(data, "stream",            false);
         slot->params.cache_prompt       = json_value(data, "cache_prompt",      false);
+        slot->params.context_shift      = json_value(data, "context_shift",     default_params.context_shift);
         slot->params.n_predict          = json_value(data, "n_predict",         default_params.n_predict);
         slot->sparams.top_k             = json_value(data, "top_k",             default_sparams.top_k);
         slot->sparams.top_p             = json_value(data, "top_p",             default_sparams.top_p);
@@ -1164,6 +1168,7 @@ struct llama_server_context
             {"stopped_eos",         slot.stopped_eos},
             {"stopped_word",        slot.stopped_word},
             {"stopped_limit",       slot.stopped_limit},
+            {"stopped_context",     slot.stopped_context},
             {"stopping_word",       slot.stopping_word},
             {"tokens_cached",       slot.n_past},
             {"timings",             slot.get_formated_timings()}
@@ -1593,6 +1598,18 @@ struct llama_server_context
             {
                 if (slot.is_processing() && system_tokens.size() + slot.cache_tokens.size() >= (size_t) slot.n_ctx)
                 {
+                    if (!slot.params.context_shift)
+                    {
+                        // stop rather than discard tokens from the context
+                        slot.stopped_context = true;
+                        slot.has_next_token = false;
+                        slot.release();
+                        slot.print_timings();
+                        send_final_response(slot);
+                        metrics.on_prediction(slot);
+                        continue;
+                    }
+
                     // Shift context
                     const int n_keep    = slot.params.n_keep + add_bos_token;
                     const int n_left    = (int) system_tokens.size() + slot.n_past - n_keep;
@@ -1705,6 +1722,21 @@ struct llama_server_context
                     slot.params.n_keep = std::min(slot.n_ctx - 4, slot.params.n_keep);
 
                     // if input prompt is too big, truncate it, if group attention self-extend is disabled
+                    if (slot.ga_n == 1 && slot.n_prompt_tokens >= slot.n_ctx && !slot.params.context_shift)
+                    {
+                        // the prompt does not fit and may not be truncated
+                        LOG_INFO("input exceeds context", {
+                            {"n_ctx",           slot.n_ctx},
+                            {"n_prompt_tokens", slot.n_prompt_tokens},
+                        });
+                        slot.stopped_context = true;
+                        slot.has_next_token = false;
+                        slot.t_start_genereration = ggml_time_us();
+                        slot.release();
+                        send_final_response(slot);
+                        continue;
+                    }
+
                     if (slot.ga_n == 1 && slot.n_prompt_tokens >= slot.n_ctx)
                     {
                         const int n_left = slot.n_ctx - slot.params.n_keep;
@@ -41,6 +41,33 @@ const (
 	fileTypeUnknown
 )
 
+// quantizationTypes are the file types a F16 or F32 model can be quantized to
+var quantizationTypes = []fileType{
+	fileTypeQ4_0,
+	fileTypeQ4_1,
+	fileTypeQ5_0,
+	fileTypeQ5_1,
+	fileTypeQ8_0,
+	fileTypeQ3_K_S,
+	fileTypeQ3_K_M,
+	fileTypeQ3_K_L,
+	fileTypeQ4_K_S,
+	fileTypeQ4_K_M,
+	fileTypeQ5_K_S,
+	fileTypeQ5_K_M,
+	fileTypeQ6_K,
+}
+
+// QuantizationTypes returns the names of the supported quantization types.
+func QuantizationTypes() []string {
+	names := make([]string, len(quantizationTypes))
+	for i, t := range quantizationTypes {
+		names[i] = t.String()
+	}
+
+	return names
+}
+
 func ParseFileType(s string) (fileType, error) {
 	switch s {
 	case "F32":
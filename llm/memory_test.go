@@ -125,4 +125,23 @@ func TestEstimateGPULayers(t *testing.T) {
 			}
 		})
 	}
+	t.Run("overhead", func(t *testing.T) {
+		for i := range gpus {
+			gpus[i].FreeMemory = memoryLayerOutput + gpuMinimumMemory + layerSize + 3*layerSize + 1 + max(graphFullOffload, graphPartialOffload)
+		}
+
+		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+		assert.Equal(t, "3,3", estimate.TensorSplit)
+
+		// reserving a layer's worth of VRAM leaves space for one layer less per GPU
+		t.Setenv("OLLAMA_GPU_OVERHEAD", fmt.Sprintf("%dB", layerSize))
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		assert.Equal(t, 4, estimate.Layers)
+		assert.Equal(t, "2,2", estimate.TensorSplit)
+
+		// reserving more than is free offloads nothing
+		t.Setenv("OLLAMA_GPU_OVERHEAD", "1TiB")
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		assert.Equal(t, 0, estimate.Layers)
+	})
 }
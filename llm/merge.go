@@ -0,0 +1,145 @@
+package llm
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ErrMergeConflict is returned when the tensors of an overlay can't replace
+// those of the model it's merged into
+var ErrMergeConflict = errors.New("merge conflict")
+
+// Overlay is a GGUF file whose tensors replace the tensors of the same name
+// when it's merged into a model with MergeGGUF. Name identifies it in errors.
+type Overlay struct {
+	Name string
+	io.ReadSeeker
+}
+
+// replacement is a tensor of an overlay replacing one of the model
+type replacement struct {
+	base, overlay *Tensor
+	r             io.ReadSeeker
+
+	// offset is the offset of the tensor data in the overlay
+	offset int64
+}
+
+// planMerge decodes base and overlays and returns the tensors of base that
+// the overlays replace, ordered by their offset in base, along with the
+// offset of tensor data in base. The tensors of an overlay must be in base
+// with the same shape and type and can't be in any other overlay, and an
+// overlay of an architecture must be of the architecture of base.
+func planMerge(base io.ReadSeeker, overlays []Overlay) ([]replacement, int64, error) {
+	ggml, _, err := DecodeGGML(base, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if ggml.Name() != "gguf" {
+		return nil, 0, fmt.Errorf("%w: only gguf models can be merged into", ErrMergeConflict)
+	}
+
+	tensors := make(map[string]*Tensor)
+	for _, t := range ggml.Tensors().Items {
+		tensors[t.Name] = t
+	}
+
+	replaced := make(map[string]string)
+	var replacements []replacement
+	for _, o := range overlays {
+		overlay, _, err := DecodeGGML(o, 0)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", o.Name, err)
+		}
+
+		if overlay.Name() != "gguf" {
+			return nil, 0, fmt.Errorf("%w: %s: only gguf files can be merged", ErrMergeConflict, o.Name)
+		}
+
+		if arch, ok := overlay.KV()["general.architecture"].(string); ok && arch != ggml.KV().Architecture() {
+			return nil, 0, fmt.Errorf("%w: %s: architecture %q doesn't match the model's %q", ErrMergeConflict, o.Name, arch, ggml.KV().Architecture())
+		}
+
+		if len(overlay.Tensors().Items) == 0 {
+			return nil, 0, fmt.Errorf("%w: %s: no tensors to merge", ErrMergeConflict, o.Name)
+		}
+
+		for _, t := range overlay.Tensors().Items {
+			bt, ok := tensors[t.Name]
+			switch {
+			case !ok:
+				return nil, 0, fmt.Errorf("%w: %s: tensor %q isn't in the model", ErrMergeConflict, o.Name, t.Name)
+			case bt.Kind != t.Kind || !slices.Equal(bt.Shape, t.Shape):
+				return nil, 0, fmt.Errorf("%w: %s: tensor %q has type %d and shape %v but the model's has type %d and shape %v", ErrMergeConflict, o.Name, t.Name, t.Kind, t.Shape, bt.Kind, bt.Shape)
+			case replaced[t.Name] != "":
+				return nil, 0, fmt.Errorf("%w: tensor %q is in both %s and %s", ErrMergeConflict, t.Name, replaced[t.Name], o.Name)
+			}
+
+			replaced[t.Name] = o.Name
+			replacements = append(replacements, replacement{
+				base:    bt,
+				overlay: t,
+				r:       o.ReadSeeker,
+				offset:  int64(overlay.Tensors().Offset + t.Offset),
+			})
+		}
+	}
+
+	slices.SortFunc(replacements, func(a, b replacement) int {
+		return cmp.Compare(a.base.Offset, b.base.Offset)
+	})
+
+	return replacements, int64(ggml.Tensors().Offset), nil
+}
+
+// CheckMerge checks overlays can be merged into base with MergeGGUF without
+// merging them.
+func CheckMerge(base io.ReadSeeker, overlays []Overlay) error {
+	_, _, err := planMerge(base, overlays)
+	return err
+}
+
+// MergeGGUF copies the GGUF file base to w with the data of its tensors
+// replaced by that of the tensors of the same name in overlays. Key-values
+// and tensor infos are copied unchanged since replacements must have the
+// same shape and type, which CheckMerge checks.
+func MergeGGUF(w io.Writer, base io.ReadSeeker, overlays []Overlay) error {
+	replacements, offset, err := planMerge(base, overlays)
+	if err != nil {
+		return err
+	}
+
+	if _, err := base.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var n int64
+	for _, r := range replacements {
+		start := offset + int64(r.base.Offset)
+		if _, err := io.CopyN(w, base, start-n); err != nil {
+			return err
+		}
+
+		if _, err := r.r.Seek(r.offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		size := int64(r.base.Size())
+		if _, err := io.CopyN(w, r.r, size); err != nil {
+			return fmt.Errorf("%s: %w", r.overlay.Name, err)
+		}
+
+		if _, err := base.Seek(size, io.SeekCurrent); err != nil {
+			return err
+		}
+
+		n = start + size
+	}
+
+	_, err = io.Copy(w, base)
+	return err
+}
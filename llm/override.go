@@ -0,0 +1,341 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// ggufSchema holds a zero value of the type of well known GGUF keys. Keys
+// starting with "." follow the model architecture, e.g. "llama.context_length".
+var ggufSchema = map[string]any{
+	"general.name":                 "",
+	"general.basename":             "",
+	"general.finetune":             "",
+	"general.author":               "",
+	"general.organization":         "",
+	"general.version":              "",
+	"general.description":          "",
+	"general.license":              "",
+	"general.url":                  "",
+	"general.size_label":           "",
+	"general.quantized_by":         "",
+	"general.file_type":            uint32(0),
+	"general.quantization_version": uint32(0),
+
+	".context_length":                       uint32(0),
+	".embedding_length":                     uint32(0),
+	".block_count":                          uint32(0),
+	".feed_forward_length":                  uint32(0),
+	".vocab_size":                           uint32(0),
+	".expert_count":                         uint32(0),
+	".expert_used_count":                    uint32(0),
+	".attention.head_count":                 uint32(0),
+	".attention.head_count_kv":              uint32(0),
+	".attention.key_length":                 uint32(0),
+	".attention.value_length":               uint32(0),
+	".attention.layer_norm_epsilon":         float32(0),
+	".attention.layer_norm_rms_epsilon":     float32(0),
+	".rope.dimension_count":                 uint32(0),
+	".rope.freq_base":                       float32(0),
+	".rope.scaling.type":                    "",
+	".rope.scaling.factor":                  float32(0),
+	".rope.scaling.attn_factor":             float32(0),
+	".rope.scaling.original_context_length": uint32(0),
+
+	"tokenizer.ggml.model":              "",
+	"tokenizer.ggml.pre":                "",
+	"tokenizer.ggml.bos_token_id":       uint32(0),
+	"tokenizer.ggml.eos_token_id":       uint32(0),
+	"tokenizer.ggml.unknown_token_id":   uint32(0),
+	"tokenizer.ggml.separator_token_id": uint32(0),
+	"tokenizer.ggml.padding_token_id":   uint32(0),
+	"tokenizer.ggml.add_bos_token":      false,
+	"tokenizer.ggml.add_eos_token":      false,
+	"tokenizer.chat_template":           "",
+}
+
+// ParseOverrides parses the values in overrides, keyed by GGUF key, to the
+// type of the key in kv or, for keys kv doesn't have, the type of the well
+// known GGUF key. Arrays and keys that describe the file layout can't be
+// overridden.
+func (kv KV) ParseOverrides(overrides map[string]string) (KV, error) {
+	parsed := make(KV, len(overrides))
+	for key, s := range overrides {
+		switch key {
+		case "general.alignment", "general.architecture", "general.parameter_count":
+			return nil, fmt.Errorf("gguf key %q can't be overridden", key)
+		}
+
+		like, ok := kv[key]
+		if !ok {
+			like, ok = ggufSchema[key]
+		}
+
+		if arch := kv.Architecture(); !ok && strings.HasPrefix(key, arch+".") {
+			like, ok = ggufSchema[strings.TrimPrefix(key, arch)]
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("unknown gguf key %q", key)
+		}
+
+		v, err := parseKV(s, like)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for gguf key %q: %w", key, err)
+		}
+
+		parsed[key] = v
+	}
+
+	return parsed, nil
+}
+
+// parseKV parses s to the type of like
+func parseKV(s string, like any) (any, error) {
+	switch like.(type) {
+	case uint8:
+		n, err := strconv.ParseUint(s, 10, 8)
+		return uint8(n), err
+	case int8:
+		n, err := strconv.ParseInt(s, 10, 8)
+		return int8(n), err
+	case uint16:
+		n, err := strconv.ParseUint(s, 10, 16)
+		return uint16(n), err
+	case int16:
+		n, err := strconv.ParseInt(s, 10, 16)
+		return int16(n), err
+	case uint32:
+		n, err := strconv.ParseUint(s, 10, 32)
+		return uint32(n), err
+	case int32:
+		n, err := strconv.ParseInt(s, 10, 32)
+		return int32(n), err
+	case uint64:
+		return strconv.ParseUint(s, 10, 64)
+	case int64:
+		return strconv.ParseInt(s, 10, 64)
+	case float32:
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	case float64:
+		return strconv.ParseFloat(s, 64)
+	case bool:
+		return strconv.ParseBool(s)
+	case string:
+		return s, nil
+	default:
+		return nil, fmt.Errorf("%T values can't be overridden", like)
+	}
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// PatchGGUF copies the little endian GGUF v2 or v3 file read from r to w
+// with the key-values in kv replacing existing ones or added after them.
+// Tensor infos and data are copied unchanged.
+func PatchGGUF(w io.Writer, r io.Reader, kv KV) error {
+	br := bufio.NewReaderSize(r, 32<<10)
+
+	var header struct {
+		Magic     uint32
+		Version   uint32
+		NumTensor uint64
+		NumKV     uint64
+	}
+
+	if err := binary.Read(br, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	if header.Magic != FILE_MAGIC_GGUF_LE {
+		return errors.New("only little endian gguf files can be patched")
+	} else if header.Version < 2 {
+		return fmt.Errorf("gguf version %d can't be patched", header.Version)
+	}
+
+	read := int64(binary.Size(header))
+
+	var raw bytes.Buffer
+	tr := io.TeeReader(br, &raw)
+
+	type rawKV struct {
+		key string
+		b   []byte
+	}
+
+	var alignment int64 = 32
+	kvs := make([]rawKV, 0, header.NumKV)
+	for range header.NumKV {
+		raw.Reset()
+
+		key, err := readRawString(tr)
+		if err != nil {
+			return err
+		}
+
+		var t uint32
+		if err := binary.Read(tr, binary.LittleEndian, &t); err != nil {
+			return err
+		}
+
+		if err := discardRaw(tr, t); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		if key == "general.alignment" && t == ggufTypeUint32 {
+			alignment = int64(binary.LittleEndian.Uint32(raw.Bytes()[raw.Len()-4:]))
+		}
+
+		kvs = append(kvs, rawKV{key, bytes.Clone(raw.Bytes())})
+		read += int64(raw.Len())
+	}
+
+	raw.Reset()
+	for range header.NumTensor {
+		if _, err := readRawString(tr); err != nil {
+			return err
+		}
+
+		var dims uint32
+		if err := binary.Read(tr, binary.LittleEndian, &dims); err != nil {
+			return err
+		}
+
+		// shape, kind and offset
+		if _, err := io.CopyN(io.Discard, tr, int64(dims)*8+4+8); err != nil {
+			return err
+		}
+	}
+	tensorInfos := raw.Bytes()
+	read += int64(len(tensorInfos))
+
+	if _, err := br.Discard(int(ggufPadding(read, alignment))); err != nil {
+		return err
+	}
+
+	added := slices.DeleteFunc(maps.Keys(kv), func(key string) bool {
+		return slices.ContainsFunc(kvs, func(e rawKV) bool { return e.key == key })
+	})
+	slices.Sort(added)
+
+	cw := &countingWriter{w: w}
+	header.NumKV += uint64(len(added))
+	if err := binary.Write(cw, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	for _, e := range kvs {
+		if v, ok := kv[e.key]; ok {
+			if err := ggufWriteKV(cw, e.key, v); err != nil {
+				return err
+			}
+		} else if _, err := cw.Write(e.b); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range added {
+		if err := ggufWriteKV(cw, key, kv[key]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := cw.Write(tensorInfos); err != nil {
+		return err
+	}
+
+	if _, err := cw.Write(make([]byte, ggufPadding(cw.n, alignment))); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(cw, br)
+	return err
+}
+
+func readRawString(r io.Reader) (string, error) {
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if _, err := io.CopyN(&b, r, int64(n)); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// ggufTypeSize returns the size of a fixed size GGUF type t or zero
+func ggufTypeSize(t uint32) int64 {
+	switch t {
+	case ggufTypeUint8, ggufTypeInt8, ggufTypeBool:
+		return 1
+	case ggufTypeUint16, ggufTypeInt16:
+		return 2
+	case ggufTypeUint32, ggufTypeInt32, ggufTypeFloat32:
+		return 4
+	case ggufTypeUint64, ggufTypeInt64, ggufTypeFloat64:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// discardRaw reads past a little endian value of GGUF type t
+func discardRaw(r io.Reader, t uint32) error {
+	if n := ggufTypeSize(t); n > 0 {
+		_, err := io.CopyN(io.Discard, r, n)
+		return err
+	}
+
+	switch t {
+	case ggufTypeString:
+		_, err := readRawString(r)
+		return err
+	case ggufTypeArray:
+		var header struct {
+			Type uint32
+			Len  uint64
+		}
+
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			return err
+		}
+
+		if n := ggufTypeSize(header.Type); n > 0 {
+			_, err := io.CopyN(io.Discard, r, n*int64(header.Len))
+			return err
+		}
+
+		for range header.Len {
+			if err := discardRaw(r, header.Type); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("invalid type: %d", t)
+	}
+}
@@ -0,0 +1,134 @@
+package llm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseOverrides(t *testing.T) {
+	kv := KV{
+		"general.architecture":  "llama",
+		"llama.context_length":  uint32(2048),
+		"llama.rope.freq_base":  float32(10000),
+		"general.custom":        uint64(1),
+		"tokenizer.ggml.tokens": &array{},
+	}
+
+	overrides, err := kv.ParseOverrides(map[string]string{
+		"llama.context_length":         "16384",
+		"llama.rope.freq_base":         "500000",
+		"general.custom":               "2",
+		"general.name":                 "patched",
+		"llama.attention.head_count":   "32",
+		"tokenizer.ggml.add_bos_token": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(overrides, KV{
+		"llama.context_length":         uint32(16384),
+		"llama.rope.freq_base":         float32(500000),
+		"general.custom":               uint64(2),
+		"general.name":                 "patched",
+		"llama.attention.head_count":   uint32(32),
+		"tokenizer.ggml.add_bos_token": true,
+	}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	for key, value := range map[string]string{
+		"llama.context_length":    "-1",
+		"llama.rope.freq_base":    "fast",
+		"tokenizer.ggml.tokens":   "a",
+		"general.alignment":       "64",
+		"general.architecture":    "mistral",
+		"qwen2.context_length":    "4096",
+		"llama.unknown":           "1",
+		"general.unknown.setting": "1",
+	} {
+		t.Run(key, func(t *testing.T) {
+			if _, err := kv.ParseOverrides(map[string]string{key: value}); err == nil {
+				t.Errorf("expected an error overriding %s with %q", key, value)
+			}
+		})
+	}
+}
+
+func TestPatchGGUF(t *testing.T) {
+	kv := KV{
+		"general.architecture":  "llama",
+		"llama.context_length":  uint32(2048),
+		"llama.block_count":     uint32(1),
+		"tokenizer.ggml.tokens": []string{"a", "b", "c"},
+		"tokenizer.ggml.scores": []float32{0, 1, 2},
+	}
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// WriteGGUF pads tensors to 32 bytes so keep them aligned
+	data := [][]byte{bytes.Repeat([]byte{1}, 64), bytes.Repeat([]byte{2}, 128)}
+	if err := WriteGGUF(f, kv, []Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{16}, WriterTo: bytes.NewReader(data[0])},
+		{Name: "output.weight", Shape: []uint64{32}, WriterTo: bytes.NewReader(data[1])},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := PatchGGUF(&b, f, KV{
+		"llama.context_length": uint32(16384),
+		"general.name":         "a much longer name which changes the header padding",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _, err := DecodeGGML(bytes.NewReader(b.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ggml.KV()
+	if got.ContextLength() != 16384 {
+		t.Errorf("expected context length 16384, got %d", got.ContextLength())
+	}
+
+	if name := got["general.name"]; name != "a much longer name which changes the header padding" {
+		t.Errorf("expected added general.name, got %v", name)
+	}
+
+	if got.BlockCount() != 1 || got.Architecture() != "llama" {
+		t.Errorf("expected other keys to be unchanged, got %v", got)
+	}
+
+	tensors := ggml.Tensors()
+	if len(tensors.Items) != 2 {
+		t.Fatalf("expected 2 tensors, got %d", len(tensors.Items))
+	}
+
+	for _, tensor := range tensors.Items {
+		want := data[0]
+		if tensor.Name == "output.weight" {
+			want = data[1]
+		}
+
+		start := tensors.Offset + tensor.Offset
+		if actual := b.Bytes()[start : start+tensor.Size()]; !bytes.Equal(actual, want) {
+			t.Errorf("%s: tensor data mismatch", tensor.Name)
+		}
+	}
+}
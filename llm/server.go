@@ -10,6 +10,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -20,6 +21,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/semaphore"
@@ -40,17 +42,72 @@ type LlamaServer interface {
 	Embedding(ctx context.Context, input string) ([]float32, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
+	SaveCache(ctx context.Context, prompt, path string) error
+	RestoreCache(ctx context.Context, path string) error
 	Close() error
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
+	EstimatedLayers() (gpuLayers, totalLayers int)
+}
+
+// ErrInsufficientMemory is returned when a model doesn't fit in the memory
+// available to load it
+var ErrInsufficientMemory = errors.New("insufficient memory")
+
+// ErrRunnerExited is returned when the llama runner process exits while
+// loading or running a request
+var ErrRunnerExited = errors.New("llama runner process has terminated")
+
+// ErrInvalidGrammar is returned when the runner fails to compile the grammar
+// of a request
+var ErrInvalidGrammar = errors.New("invalid grammar")
+
+// ErrStopRegexUnsupported is returned when the runner can't match stop
+// patterns
+var ErrStopRegexUnsupported = errors.New("runner doesn't support stop_regex")
+
+// memoryError reports the system memory a model requires. It matches
+// ErrInsufficientMemory.
+type memoryError struct {
+	required, available uint64
+}
+
+func (e memoryError) Error() string {
+	return fmt.Sprintf("model requires more system memory (%s) than is available (%s)", format.HumanBytes2(e.required), format.HumanBytes2(e.available))
+}
+
+func (e memoryError) Is(target error) bool {
+	return target == ErrInsufficientMemory
+}
+
+// outOfMemoryError is an error reported by the runner when a backend fails
+// to allocate memory. It matches ErrInsufficientMemory.
+type outOfMemoryError string
+
+func (e outOfMemoryError) Error() string {
+	return string(e)
+}
+
+func (e outOfMemoryError) Is(target error) bool {
+	return target == ErrInsufficientMemory
+}
+
+// statusError returns an error for the last error message of the runner
+func statusError(msg string) error {
+	if strings.Contains(msg, "out of memory") {
+		return outOfMemoryError(msg)
+	}
+
+	return errors.New(msg)
 }
 
 // llmServer is an instance of the llama.cpp server
 type llmServer struct {
 	port        int
 	cmd         *exec.Cmd
-	done        chan error // Channel to signal when the process exits
+	done        chan error    // Channel to signal when the process exits
+	exited      chan struct{} // Closed once the process has exited
 	status      *StatusWriter
 	options     api.Options
 	numParallel int
@@ -65,6 +122,10 @@ type llmServer struct {
 	loadDuration time.Duration   // Record how long it took the model to load
 	loadProgress float32
 
+	// stopRegex is set once the runner reports it matches stop patterns.
+	// Runners other than the Go runner would ignore them.
+	stopRegex atomic.Bool
+
 	sem *semaphore.Weighted
 }
 
@@ -88,9 +149,15 @@ func LoadModel(model string, maxArraySize int) (*GGML, error) {
 	return ggml, err
 }
 
+// Adapter is a LoRA adapter applied to a model with a weight
+type Adapter struct {
+	Path   string
+	Weight float32
+}
+
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
-func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters []Adapter, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
 	var err error
 	var cpuRunner string
 	var estimate MemoryEstimate
@@ -139,7 +206,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		available := systemFreeMemory + systemSwapFreeMemory
 		if systemMemoryRequired > available {
 			slog.Warn("model request too large for system", "requested", format.HumanBytes2(systemMemoryRequired), "available", available, "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "swap", format.HumanBytes2(systemSwapFreeMemory))
-			return nil, fmt.Errorf("model requires more system memory (%s) than is available (%s)", format.HumanBytes2(systemMemoryRequired), format.HumanBytes2(available))
+			return nil, memoryError{required: systemMemoryRequired, available: available}
 		}
 	}
 
@@ -148,10 +215,6 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	// Loop through potential servers
 	finalErr := errors.New("no suitable llama servers found")
 
-	if len(adapters) > 1 {
-		return nil, errors.New("ollama supports only one lora adapter, but multiple were provided")
-	}
-
 	rDir, err := runners.Refresh(build.EmbedFS)
 	if err != nil {
 		return nil, err
@@ -207,9 +270,12 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		params = append(params, "--main-gpu", strconv.Itoa(opts.MainGPU))
 	}
 
-	if len(adapters) > 0 {
-		// TODO: applying multiple adapters is not supported by the llama.cpp server yet
-		params = append(params, "--lora", adapters[0])
+	for _, adapter := range adapters {
+		if adapter.Weight == 1 {
+			params = append(params, "--lora", adapter.Path)
+		} else {
+			params = append(params, "--lora-scaled", adapter.Path, strconv.FormatFloat(float64(adapter.Weight), 'f', -1, 32))
+		}
 	}
 
 	if len(projectors) > 0 {
@@ -356,6 +422,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 			totalLayers: ggml.KV().BlockCount() + 1,
 			gpus:        gpus,
 			done:        make(chan error, 1),
+			exited:      make(chan struct{}),
 		}
 
 		s.cmd.Env = os.Environ()
@@ -416,7 +483,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 			slog.Debug("subprocess", "environment", filteredEnv)
 		}
 
-		if err = s.cmd.Start(); err != nil {
+		if err = startRunner(s.cmd); err != nil {
 			// Detect permission denied and augment the message about noexec
 			if errors.Is(err, os.ErrPermission) {
 				finalErr = fmt.Errorf("unable to start server %w.  %s may have noexec set.  Set OLLAMA_TMPDIR for server to a writable executable directory", err, dir)
@@ -433,6 +500,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 
 		// reap subprocess when it exits
 		go func() {
+			defer close(s.exited)
 			err := s.cmd.Wait()
 			// Favor a more detailed message over the process exit status
 			if err != nil && s.status != nil && s.status.LastErrMsg != "" {
@@ -440,7 +508,7 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 				if strings.Contains(s.status.LastErrMsg, "unknown model") {
 					s.status.LastErrMsg = "this model is not supported by your version of Ollama. You may need to upgrade"
 				}
-				s.done <- errors.New(s.status.LastErrMsg)
+				s.done <- statusError(s.status.LastErrMsg)
 			} else {
 				s.done <- err
 			}
@@ -504,6 +572,7 @@ type ServerStatusResp struct {
 	SlotsProcessing int     `json:"slots_processing"`
 	Error           string  `json:"error"`
 	Progress        float32 `json:"progress"`
+	StopRegex       bool    `json:"stop_regex"`
 }
 
 func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
@@ -517,7 +586,7 @@ func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
 			// Most likely a signal killed it, log some more details to try to help troubleshoot
 			slog.Warn("llama runner process no longer running", "sys", s.cmd.ProcessState.Sys(), "string", s.cmd.ProcessState.String())
 		}
-		return ServerStatusError, fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg)
+		return ServerStatusError, fmt.Errorf("llama runner process no longer running: %d %w", s.cmd.ProcessState.ExitCode(), statusError(msg))
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/health", s.port), nil)
@@ -545,6 +614,8 @@ func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
 		return ServerStatusError, fmt.Errorf("health unmarshal encode response: %w", err)
 	}
 
+	s.stopRegex.Store(status.StopRegex)
+
 	switch status.Status {
 	case "ok":
 		return ServerStatusReady, nil
@@ -605,7 +676,7 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			slog.Warn("client connection closed before server finished loading, aborting load")
 			return fmt.Errorf("timed out waiting for llama runner to start: %w", ctx.Err())
 		case err := <-s.done:
-			return fmt.Errorf("llama runner process has terminated: %w", err)
+			return fmt.Errorf("%w: %w", ErrRunnerExited, err)
 		default:
 		}
 		if time.Now().After(stallTimer) {
@@ -621,7 +692,7 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			if s.status != nil && s.status.LastErrMsg != "" {
 				msg = s.status.LastErrMsg
 			}
-			return fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg)
+			return fmt.Errorf("llama runner process no longer running: %d %w", s.cmd.ProcessState.ExitCode(), statusError(msg))
 		}
 		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
 		defer cancel()
@@ -689,11 +760,14 @@ type ImageData struct {
 }
 
 type completion struct {
-	Content      string `json:"content"`
-	Model        string `json:"model"`
-	Prompt       string `json:"prompt"`
-	Stop         bool   `json:"stop"`
-	StoppedLimit bool   `json:"stopped_limit"`
+	Content        string `json:"content"`
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	Stop           bool   `json:"stop"`
+	StoppedLimit   bool   `json:"stopped_limit"`
+	StoppedContext bool   `json:"stopped_context"`
+
+	CompletionProbabilities []completionProbability `json:"completion_probabilities"`
 
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
@@ -703,11 +777,61 @@ type completion struct {
 	}
 }
 
+type completionProbability struct {
+	Content string `json:"content"`
+
+	// Prob is the probability of the token itself, which only the Go runner
+	// reports
+	Prob  *float64 `json:"prob"`
+	Probs []struct {
+		TokStr string  `json:"tok_str"`
+		Prob   float64 `json:"prob"`
+	} `json:"probs"`
+}
+
+// logprobs converts the probabilities reported by the runner into log
+// probabilities. The probability of a token the runner doesn't report is
+// taken from its alternatives and left unset if it isn't among them.
+func logprobs(probs []completionProbability) []api.TokenLogprob {
+	logprob := func(p float64) float64 {
+		return math.Log(max(p, math.SmallestNonzeroFloat64))
+	}
+
+	var out []api.TokenLogprob
+	for _, p := range probs {
+		lp := api.TokenLogprob{Token: p.Content}
+		if p.Prob != nil {
+			l := logprob(*p.Prob)
+			lp.Logprob = &l
+		}
+
+		for _, alt := range p.Probs {
+			l := logprob(alt.Prob)
+			if lp.Logprob == nil && alt.TokStr == p.Content {
+				lp.Logprob = &l
+			}
+
+			lp.TopLogprobs = append(lp.TopLogprobs, api.TopLogprob{Token: alt.TokStr, Logprob: l})
+		}
+
+		out = append(out, lp)
+	}
+
+	return out
+}
+
 type CompletionRequest struct {
-	Prompt  string
-	Format  string
-	Images  []ImageData
-	Options *api.Options
+	Prompt   string
+	Format   string
+	Images   []ImageData
+	Options  *api.Options
+	Logprobs int
+
+	// Grammar constrains sampling to a GBNF grammar and takes precedence over Format
+	Grammar string
+
+	// ContextShift disables shifting the context window when set to false
+	ContextShift *bool
 }
 
 type CompletionResponse struct {
@@ -718,6 +842,7 @@ type CompletionResponse struct {
 	PromptEvalDuration time.Duration
 	EvalCount          int
 	EvalDuration       time.Duration
+	Logprobs           []api.TokenLogprob
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
@@ -754,8 +879,17 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"penalize_nl":       req.Options.PenalizeNewline,
 		"seed":              req.Options.Seed,
 		"stop":              req.Options.Stop,
+		"stop_regex":        req.Options.StopRegex,
 		"image_data":        req.Images,
-		"cache_prompt":      true,
+		"cache_prompt":      envconfig.PromptCache(),
+	}
+
+	if req.Logprobs > 0 {
+		request["n_probs"] = req.Logprobs
+	}
+
+	if req.ContextShift != nil {
+		request["context_shift"] = *req.ContextShift
 	}
 
 	// Make sure the server is ready
@@ -766,7 +900,13 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	if req.Format == "json" {
+	if len(req.Options.StopRegex) > 0 && !s.stopRegex.Load() {
+		return ErrStopRegexUnsupported
+	}
+
+	if req.Grammar != "" {
+		request["grammar"] = req.Grammar
+	} else if req.Format == "json" {
 		request["grammar"] = jsonGrammar
 		if !strings.Contains(strings.ToLower(req.Prompt), "json") {
 			slog.Warn("Prompt does not specify that the LLM should response in JSON, but JSON format is expected. For best results specify that JSON is expected in the system prompt.")
@@ -791,6 +931,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 	res, err := http.DefaultClient.Do(serverReq)
 	if err != nil {
+		if s.hasExited() {
+			return fmt.Errorf("%w: POST predict: %v", ErrRunnerExited, err)
+		}
+
 		return fmt.Errorf("POST predict: %v", err)
 	}
 	defer res.Body.Close()
@@ -801,6 +945,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			return fmt.Errorf("failed reading llm error response: %w", err)
 		}
 		log.Printf("llm predict error: %s", bodyBytes)
+		if res.StatusCode == http.StatusBadRequest && strings.TrimSpace(string(bodyBytes)) == ErrInvalidGrammar.Error() {
+			return ErrInvalidGrammar
+		}
+
 		return fmt.Errorf("%s", bodyBytes)
 	}
 
@@ -849,13 +997,16 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 			if c.Content != "" {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Content:  c.Content,
+					Logprobs: logprobs(c.CompletionProbabilities),
 				})
 			}
 
 			if c.Stop {
 				doneReason := "stop"
-				if c.StoppedLimit {
+				if c.StoppedContext {
+					doneReason = "context_full"
+				} else if c.StoppedLimit {
 					doneReason = "length"
 				}
 
@@ -879,7 +1030,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			if s.status != nil && s.status.LastErrMsg != "" {
 				msg = s.status.LastErrMsg
 			}
-			return fmt.Errorf("an unknown error was encountered while running the model %s", msg)
+			return fmt.Errorf("%w: an unknown error was encountered while running the model %w", ErrRunnerExited, statusError(msg))
 		}
 
 		return fmt.Errorf("error reading llm response: %v", err)
@@ -946,6 +1097,79 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 	return e.Embedding, nil
 }
 
+// ErrNoCache is returned by SaveCache when the runner has no cache of the
+// prompt
+var ErrNoCache = errors.New("no cache")
+
+// ErrCacheUnsupported is returned when the runner can't save or restore
+// caches
+var ErrCacheUnsupported = errors.New("runner doesn't support saving caches")
+
+type CacheRequest struct {
+	Path   string `json:"path"`
+	Prompt string `json:"prompt,omitempty"`
+}
+
+// SaveCache saves the KV cache of the runner sharing the longest prefix with
+// prompt, up to that prefix, to a file at path
+func (s *llmServer) SaveCache(ctx context.Context, prompt, path string) error {
+	return s.cacheRequest(ctx, "/cache/save", CacheRequest{Path: path, Prompt: prompt})
+}
+
+// RestoreCache loads the KV cache saved by SaveCache at path into the runner
+func (s *llmServer) RestoreCache(ctx context.Context, path string) error {
+	return s.cacheRequest(ctx, "/cache/restore", CacheRequest{Path: path})
+}
+
+func (s *llmServer) cacheRequest(ctx context.Context, path string, req CacheRequest) error {
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		slog.Error("Failed to acquire semaphore", "error", err)
+		return err
+	}
+	defer s.sem.Release(1)
+
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return err
+	} else if status != ServerStatusReady {
+		return fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("error marshaling cache data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", s.port, path), bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("error creating cache request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("do cache request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading cache response: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && strings.TrimSpace(string(body)) == ErrNoCache.Error():
+		return ErrNoCache
+	case resp.StatusCode == http.StatusNotFound:
+		// runners other than the Go runner don't have the endpoint
+		return ErrCacheUnsupported
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("%s", bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
 type TokenizeRequest struct {
 	Content string `json:"content"`
 }
@@ -1085,6 +1309,21 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 	return decoded.Content, nil
 }
 
+// hasExited reports whether the runner process exits within a second, which
+// is how long it may take to be reaped after its connections are refused
+func (s *llmServer) hasExited() bool {
+	if s.exited == nil {
+		return false
+	}
+
+	select {
+	case <-s.exited:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
 func (s *llmServer) Close() error {
 	s.modelLock.Lock()
 	if s.model != nil {
@@ -1127,6 +1366,20 @@ func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	return 0
 }
 
+// EstimatedLayers returns the number of layers offloaded to GPUs and the total
+// number of layers in the model, including the output layer
+func (s *llmServer) EstimatedLayers() (gpuLayers, totalLayers int) {
+	totalLayers = int(s.totalLayers)
+	switch {
+	case len(s.gpus) == 0, s.gpus[0].Library == "cpu", s.options.NumGPU == 0:
+		return 0, totalLayers
+	case s.options.NumGPU < 0:
+		return min(s.estimate.Layers, totalLayers), totalLayers
+	default:
+		return min(s.options.NumGPU, totalLayers), totalLayers
+	}
+}
+
 func parseDurationMs(ms float64) time.Duration {
 	dur, err := time.ParseDuration(fmt.Sprintf("%fms", ms))
 	if err != nil {
@@ -0,0 +1,307 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+)
+
+// newFakeRunner starts a runner which treats each word of the prompt as a
+// token and generates tokens until the context of numCtx tokens is full. It
+// then shifts the context and keeps generating, or stops if context shifting
+// is disabled. Prompt tokens shared with the last prompt aren't evaluated
+// again when the prompt is cached. The decoded request is sent on the
+// returned channel.
+func newFakeRunner(t *testing.T, numCtx int) (*llmServer, chan map[string]any) {
+	t.Helper()
+
+	var cached []string
+	requests := make(chan map[string]any, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, `{"status":"ok"}`)
+		case "/completion":
+			var req map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			requests <- req
+
+			contextShift, ok := req["context_shift"].(bool)
+			if !ok {
+				contextShift = true
+			}
+
+			prompt := strings.Fields(req["prompt"].(string))
+
+			var numPast int
+			if cachePrompt, _ := req["cache_prompt"].(bool); cachePrompt {
+				for numPast < min(len(prompt), len(cached)) && prompt[numPast] == cached[numPast] {
+					numPast++
+				}
+
+				// leave one input to sample
+				numPast = min(numPast, len(prompt)-1)
+			}
+			cached = prompt
+
+			enc := json.NewEncoder(w)
+			timings := map[string]any{"prompt_n": len(prompt) - numPast}
+			n := len(prompt)
+			for predicted := 0; predicted < int(req["n_predict"].(float64)); predicted++ {
+				if n >= numCtx {
+					if !contextShift {
+						enc.Encode(map[string]any{"stop": true, "stopped_context": true, "timings": timings})
+						return
+					}
+
+					n /= 2
+				}
+
+				enc.Encode(map[string]any{"content": strconv.Itoa(predicted) + " "})
+				n++
+			}
+
+			enc.Encode(map[string]any{"stop": true, "stopped_limit": true, "timings": timings})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := api.DefaultOptions()
+	opts.NumCtx = numCtx
+	return &llmServer{
+		port:    p,
+		cmd:     &exec.Cmd{},
+		options: opts,
+		sem:     semaphore.NewWeighted(1),
+	}, requests
+}
+
+func TestCompletionContextShift(t *testing.T) {
+	complete := func(t *testing.T, s *llmServer, contextShift *bool) (CompletionResponse, int) {
+		t.Helper()
+
+		opts := api.DefaultOptions()
+		opts.NumPredict = 32
+
+		var done CompletionResponse
+		var n int
+		if err := s.Completion(context.Background(), CompletionRequest{
+			Prompt:       "one two three four",
+			Options:      &opts,
+			ContextShift: contextShift,
+		}, func(cr CompletionResponse) {
+			if cr.Done {
+				done = cr
+			} else {
+				n++
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return done, n
+	}
+
+	t.Run("default", func(t *testing.T) {
+		s, requests := newFakeRunner(t, 8)
+
+		done, n := complete(t, s, nil)
+		if _, ok := (<-requests)["context_shift"]; ok {
+			t.Error("expected context_shift to be omitted")
+		}
+
+		if done.DoneReason != "length" || n != 32 {
+			t.Errorf("expected 32 tokens and done reason length, got %d and %q", n, done.DoneReason)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s, requests := newFakeRunner(t, 8)
+
+		contextShift := false
+		done, n := complete(t, s, &contextShift)
+		if v, ok := (<-requests)["context_shift"]; !ok || v != false {
+			t.Errorf("expected context_shift false, got %v", v)
+		}
+
+		if done.DoneReason != "context_full" || n != 4 {
+			t.Errorf("expected 4 tokens and done reason context_full, got %d and %q", n, done.DoneReason)
+		}
+	})
+}
+
+func TestCompletionPromptCache(t *testing.T) {
+	complete := func(t *testing.T, s *llmServer, prompt string) int {
+		t.Helper()
+
+		opts := api.DefaultOptions()
+		opts.NumPredict = 1
+
+		var promptEvalCount int
+		if err := s.Completion(context.Background(), CompletionRequest{
+			Prompt:  prompt,
+			Options: &opts,
+		}, func(cr CompletionResponse) {
+			if cr.Done {
+				promptEvalCount = cr.PromptEvalCount
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return promptEvalCount
+	}
+
+	system := "you are a helpful assistant who answers questions about llamas "
+
+	t.Run("default", func(t *testing.T) {
+		s, requests := newFakeRunner(t, 64)
+
+		first := complete(t, s, system+"what do llamas eat")
+		if v := (<-requests)["cache_prompt"]; v != true {
+			t.Errorf("expected cache_prompt true, got %v", v)
+		}
+
+		second := complete(t, s, system+"where do llamas live")
+		<-requests
+
+		if first != 14 || second != 4 {
+			t.Errorf("expected the second prompt to only evaluate its suffix, got %d then %d prompt tokens", first, second)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_PROMPT_CACHE", "0")
+		s, requests := newFakeRunner(t, 64)
+
+		first := complete(t, s, system+"what do llamas eat")
+		if v := (<-requests)["cache_prompt"]; v != false {
+			t.Errorf("expected cache_prompt false, got %v", v)
+		}
+
+		second := complete(t, s, system+"where do llamas live")
+		<-requests
+
+		if first != 14 || second != 14 {
+			t.Errorf("expected both prompts to be evaluated in full, got %d then %d prompt tokens", first, second)
+		}
+	})
+}
+
+func TestLogprobs(t *testing.T) {
+	var probs []completionProbability
+	if err := json.Unmarshal([]byte(`[
+		{"content": "a", "prob": 0.5, "probs": [{"tok_str": "b", "prob": 0.6}]},
+		{"content": "b", "probs": [{"tok_str": "a", "prob": 0.6}, {"tok_str": "b", "prob": 0.2}]},
+		{"content": "c", "probs": [{"tok_str": "a", "prob": 0.6}]}
+	]`), &probs); err != nil {
+		t.Fatal(err)
+	}
+
+	lps := logprobs(probs)
+	if len(lps) != 3 {
+		t.Fatalf("expected 3 logprobs, got %d", len(lps))
+	}
+
+	// the probability of the token itself, then of it among the alternatives
+	for i, want := range []float64{0.5, 0.2} {
+		if lps[i].Logprob == nil || math.Abs(*lps[i].Logprob-math.Log(want)) > 1e-9 {
+			t.Errorf("%s: expected logprob %v, got %v", lps[i].Token, math.Log(want), lps[i].Logprob)
+		}
+	}
+
+	// a token which isn't among the alternatives has an unknown probability
+	if lps[2].Logprob != nil {
+		t.Errorf("expected no logprob for a token without a probability, got %v", *lps[2].Logprob)
+	}
+
+	if len(lps[2].TopLogprobs) != 1 || lps[2].TopLogprobs[0].Token != "a" {
+		t.Errorf("expected the alternatives to be kept, got %v", lps[2].TopLogprobs)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	err := fmt.Errorf("%w: %w", ErrRunnerExited, statusError("cudaMalloc failed: out of memory"))
+	if !errors.Is(err, ErrInsufficientMemory) {
+		t.Errorf("expected %v to be an insufficient memory error", err)
+	}
+
+	if err.Error() != "llama runner process has terminated: cudaMalloc failed: out of memory" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+
+	if err := statusError("error loading model"); errors.Is(err, ErrInsufficientMemory) {
+		t.Errorf("expected %v not to be an insufficient memory error", err)
+	}
+}
+
+func TestCompletionStopRegex(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		health string
+		err    error
+	}{
+		{"go runner", `{"status":"ok","stop_regex":true}`, nil},
+		{"other runner", `{"status":"ok","slots_idle":1}`, ErrStopRegexUnsupported},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/health":
+					fmt.Fprint(w, tt.health)
+				case "/completion":
+					fmt.Fprint(w, `{"stop":true,"stopped_word":true}`)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			t.Cleanup(ts.Close)
+
+			_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := &llmServer{port: p, cmd: &exec.Cmd{}, options: api.DefaultOptions(), sem: semaphore.NewWeighted(1)}
+			opts := api.DefaultOptions()
+			opts.StopRegex = []string{`\n\d`}
+			err = s.Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(CompletionResponse) {})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
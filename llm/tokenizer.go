@@ -0,0 +1,79 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/llama"
+)
+
+// Tokenizer converts between text and the tokens of a model.
+type Tokenizer interface {
+	Tokenize(ctx context.Context, content string) ([]int, error)
+	Detokenize(ctx context.Context, tokens []int) (string, error)
+}
+
+// Vocab tokenizes with the vocabulary of a model, loaded without its weights.
+type Vocab struct {
+	mu    sync.Mutex
+	model *llama.Model
+}
+
+// LoadVocab loads only the vocabulary of the model at modelPath. It must be
+// closed once it's no longer used.
+func LoadVocab(modelPath string) (*Vocab, error) {
+	f, err := os.Open(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// llama.cpp doesn't report why a model fails to load so check the
+	// vocabulary is there first
+	ggml, _, err := DecodeGGML(f, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := ggml.KV()["tokenizer.ggml.tokens"]; !ok {
+		return nil, fmt.Errorf("%s: model has no tokenizer", modelPath)
+	}
+
+	return &Vocab{
+		model: llama.LoadModelFromFile(modelPath, llama.ModelParams{VocabOnly: true}),
+	}, nil
+}
+
+func (v *Vocab) Tokenize(_ context.Context, content string) ([]int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.model.Tokenize(content, false, true)
+}
+
+func (v *Vocab) Detokenize(_ context.Context, tokens []int) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	n := v.model.NumVocab()
+
+	var sb strings.Builder
+	for _, token := range tokens {
+		if token < 0 || token >= n {
+			return "", fmt.Errorf("invalid token %d", token)
+		}
+
+		sb.WriteString(v.model.TokenToPiece(token))
+	}
+
+	return sb.String(), nil
+}
+
+func (v *Vocab) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	llama.FreeModel(v.model)
+	return nil
+}
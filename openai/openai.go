@@ -4,11 +4,13 @@ package openai
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -68,6 +70,9 @@ type ResponseFormat struct {
 type EmbedRequest struct {
 	Input any    `json:"input"`
 	Model string `json:"model"`
+
+	// EncodingFormat is "float", the default, or "base64"
+	EncodingFormat string `json:"encoding_format"`
 }
 
 type ChatCompletionRequest struct {
@@ -139,8 +144,10 @@ type CompletionChunk struct {
 }
 
 type ToolCall struct {
-	ID       string `json:"id"`
-	Type     string `json:"type"`
+	// Index is only set on tool calls streamed in chunks
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
 		Name      string `json:"name"`
 		Arguments string `json:"arguments"`
@@ -152,12 +159,24 @@ type Model struct {
 	Object  string `json:"object"`
 	Created int64  `json:"created"`
 	OwnedBy string `json:"owned_by"`
+
+	// Ollama is an extension with details of the model not in the OpenAI schema
+	Ollama *ModelDetails `json:"ollama,omitempty"`
+}
+
+type ModelDetails struct {
+	Family            string `json:"family,omitempty"`
+	ParameterSize     string `json:"parameter_size,omitempty"`
+	QuantizationLevel string `json:"quantization_level,omitempty"`
 }
 
 type Embedding struct {
-	Object    string    `json:"object"`
-	Embedding []float32 `json:"embedding"`
-	Index     int       `json:"index"`
+	Object string `json:"object"`
+
+	// Embedding is a []float32, or a string of the little endian float32s
+	// encoded in base64 for an encoding_format of "base64"
+	Embedding any `json:"embedding"`
+	Index     int `json:"index"`
 }
 
 type ListCompletion struct {
@@ -244,6 +263,24 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 }
 
 func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
+	// the final response repeats the complete tool calls, which have already
+	// been streamed as fragments
+	var toolCalls []ToolCall
+	if !r.Done {
+		for _, tc := range r.Message.ToolCalls {
+			var toolCall ToolCall
+			toolCall.Index = &tc.Index
+			if tc.Function.Name != "" {
+				toolCall.ID = toolCallId()
+				toolCall.Type = "function"
+				toolCall.Function.Name = tc.Function.Name
+			}
+
+			toolCall.Function.Arguments = tc.Function.PartialArguments
+			toolCalls = append(toolCalls, toolCall)
+		}
+	}
+
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
@@ -252,8 +289,11 @@ func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{{
 			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content},
+			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
 			FinishReason: func(reason string) *string {
+				if r.Done && len(r.Message.ToolCalls) > 0 {
+					reason = "tool_calls"
+				}
 				if len(reason) > 0 {
 					return &reason
 				}
@@ -316,6 +356,7 @@ func toListCompletion(r api.ListResponse) ListCompletion {
 			Object:  "model",
 			Created: m.ModifiedAt.Unix(),
 			OwnedBy: model.ParseName(m.Name).Namespace,
+			Ollama:  toModelDetails(m.Details),
 		})
 	}
 
@@ -325,13 +366,18 @@ func toListCompletion(r api.ListResponse) ListCompletion {
 	}
 }
 
-func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
+func toEmbeddingList(model string, r api.EmbedResponse, encodingFormat string) EmbeddingList {
 	if r.Embeddings != nil {
 		var data []Embedding
 		for i, e := range r.Embeddings {
+			var embedding any = e
+			if encodingFormat == "base64" {
+				embedding = encodeEmbedding(e)
+			}
+
 			data = append(data, Embedding{
 				Object:    "embedding",
-				Embedding: e,
+				Embedding: embedding,
 				Index:     i,
 			})
 		}
@@ -350,12 +396,35 @@ func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
 	return EmbeddingList{}
 }
 
+// encodeEmbedding encodes the little endian float32s of e in base64
+func encodeEmbedding(e []float32) string {
+	b := make([]byte, 0, 4*len(e))
+	for _, f := range e {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(f))
+	}
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
 func toModel(r api.ShowResponse, m string) Model {
 	return Model{
 		Id:      m,
 		Object:  "model",
 		Created: r.ModifiedAt.Unix(),
 		OwnedBy: model.ParseName(m).Namespace,
+		Ollama:  toModelDetails(r.Details),
+	}
+}
+
+func toModelDetails(d api.ModelDetails) *ModelDetails {
+	if d.Family == "" && d.ParameterSize == "" && d.QuantizationLevel == "" {
+		return nil
+	}
+
+	return &ModelDetails{
+		Family:            d.Family,
+		ParameterSize:     d.ParameterSize,
+		QuantizationLevel: d.QuantizationLevel,
 	}
 }
 
@@ -475,7 +544,7 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	var format string
+	var format api.Format
 	if r.ResponseFormat != nil && r.ResponseFormat.Type == "json_object" {
 		format = "json"
 	}
@@ -568,7 +637,8 @@ type RetrieveWriter struct {
 
 type EmbedWriter struct {
 	BaseWriter
-	model string
+	model          string
+	encodingFormat string
 }
 
 func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
@@ -578,8 +648,13 @@ func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
 		return 0, err
 	}
 
+	resp := NewError(http.StatusInternalServerError, serr.Error())
+	if serr.Code != "" {
+		resp.Error.Code = &serr.Code
+	}
+
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(http.StatusInternalServerError, serr.Error()))
+	err = json.NewEncoder(w.ResponseWriter).Encode(resp)
 	if err != nil {
 		return 0, err
 	}
@@ -744,7 +819,7 @@ func (w *EmbedWriter) writeResponse(data []byte) (int, error) {
 	}
 
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toEmbeddingList(w.model, embedResponse))
+	err = json.NewEncoder(w.ResponseWriter).Encode(toEmbeddingList(w.model, embedResponse, w.encodingFormat))
 	if err != nil {
 		return 0, err
 	}
@@ -817,6 +892,8 @@ func CompletionsMiddleware() gin.HandlerFunc {
 		}
 
 		c.Request.Body = io.NopCloser(&b)
+		// the writer translates the NDJSON responses of the handler
+		c.Request.Header.Set("Accept", "application/x-ndjson")
 
 		w := &CompleteWriter{
 			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
@@ -852,6 +929,13 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		switch req.EncodingFormat {
+		case "", "float", "base64":
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, fmt.Sprintf("invalid encoding_format %q, must be \"float\" or \"base64\"", req.EncodingFormat)))
+			return
+		}
+
 		var b bytes.Buffer
 		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input}); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
@@ -861,8 +945,9 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &EmbedWriter{
-			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
-			model:      req.Model,
+			BaseWriter:     BaseWriter{ResponseWriter: c.Writer},
+			model:          req.Model,
+			encodingFormat: req.EncodingFormat,
 		}
 
 		c.Writer = w
@@ -899,6 +984,8 @@ func ChatMiddleware() gin.HandlerFunc {
 		}
 
 		c.Request.Body = io.NopCloser(&b)
+		// the writer translates the NDJSON responses of the handler
+		c.Request.Header.Set("Accept", "application/x-ndjson")
 
 		w := &ChatWriter{
 			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
@@ -3,8 +3,11 @@ package openai
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -371,6 +374,20 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 				Model: "test-model",
 			},
 		},
+		{
+			name: "embed handler invalid encoding format",
+			body: `{
+				"input": "Hello",
+				"model": "test-model",
+				"encoding_format": "int8"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `invalid encoding_format "int8", must be "float" or "base64"`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "embed handler error forwarding",
 			body: `{
@@ -422,6 +439,89 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 	}
 }
 
+func TestEmbeddingsEncodingFormat(t *testing.T) {
+	embeddings := [][]float32{{0.1, -2.5, 3}, {math.MaxFloat32, 0, -0.125}}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(EmbeddingsMiddleware())
+	router.Handle(http.MethodPost, "/api/embed", func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: "test-model", Embeddings: embeddings, PromptEvalCount: 2})
+	})
+
+	embed := func(t *testing.T, body string) EmbeddingList {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "/api/embed", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body)
+		}
+
+		var list EmbeddingList
+		if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list.Data) != len(embeddings) {
+			t.Fatalf("expected %d embeddings, got %d", len(embeddings), len(list.Data))
+		}
+
+		return list
+	}
+
+	for _, format := range []string{"", "float"} {
+		t.Run("float "+format, func(t *testing.T) {
+			list := embed(t, fmt.Sprintf(`{"input": ["Hello", "World"], "model": "test-model", "encoding_format": %q}`, format))
+			for i, e := range list.Data {
+				vs, ok := e.Embedding.([]any)
+				if !ok {
+					t.Fatalf("expected an array, got %T", e.Embedding)
+				}
+
+				got := make([]float32, len(vs))
+				for j, v := range vs {
+					got[j] = float32(v.(float64))
+				}
+
+				if !reflect.DeepEqual(embeddings[i], got) {
+					t.Errorf("expected %v, got %v", embeddings[i], got)
+				}
+			}
+		})
+	}
+
+	t.Run("base64", func(t *testing.T) {
+		list := embed(t, `{"input": ["Hello", "World"], "model": "test-model", "encoding_format": "base64"}`)
+		for i, e := range list.Data {
+			s, ok := e.Embedding.(string)
+			if !ok {
+				t.Fatalf("expected a string, got %T", e.Embedding)
+			}
+
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]float32, len(b)/4)
+			if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(embeddings[i], got) {
+				t.Errorf("expected %v, got %v", embeddings[i], got)
+			}
+
+			if e.Index != i || e.Object != "embedding" {
+				t.Errorf("unexpected embedding %d: %+v", i, e)
+			}
+		}
+	})
+}
+
 func TestListMiddleware(t *testing.T) {
 	type testCase struct {
 		name     string
@@ -454,6 +554,57 @@ func TestListMiddleware(t *testing.T) {
 				]
 			}`,
 		},
+		{
+			name: "list handler with details",
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusOK, api.ListResponse{
+					Models: []api.ListModelResponse{
+						{
+							Name:       "jmorgan/test-model:q4_0",
+							ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
+							Details: api.ModelDetails{
+								Format:            "gguf",
+								Family:            "llama",
+								ParameterSize:     "8.0B",
+								QuantizationLevel: "Q4_0",
+							},
+						},
+						{
+							Name:       "registry.example.com/org/other:latest",
+							ModifiedAt: time.Unix(int64(1686935001), 0).UTC(),
+							Details: api.ModelDetails{
+								ParameterSize: "1.2B",
+							},
+						},
+					},
+				})
+			},
+			resp: `{
+				"object": "list",
+				"data": [
+					{
+						"id": "jmorgan/test-model:q4_0",
+						"object": "model",
+						"created": 1686935002,
+						"owned_by": "jmorgan",
+						"ollama": {
+							"family": "llama",
+							"parameter_size": "8.0B",
+							"quantization_level": "Q4_0"
+						}
+					},
+					{
+						"id": "registry.example.com/org/other:latest",
+						"object": "model",
+						"created": 1686935001,
+						"owned_by": "org",
+						"ollama": {
+							"parameter_size": "1.2B"
+						}
+					}
+				]
+			}`,
+		},
 		{
 			name: "list handler empty output",
 			endpoint: func(c *gin.Context) {
@@ -516,6 +667,30 @@ func TestRetrieveMiddleware(t *testing.T) {
 				"owned_by":"library"}
 			`,
 		},
+		{
+			name: "retrieve handler with details",
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusOK, api.ShowResponse{
+					ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
+					Details: api.ModelDetails{
+						Family:            "llama",
+						ParameterSize:     "8.0B",
+						QuantizationLevel: "Q4_0",
+					},
+				})
+			},
+			resp: `{
+				"id":"test-model",
+				"object":"model",
+				"created":1686935002,
+				"owned_by":"library",
+				"ollama": {
+					"family": "llama",
+					"parameter_size": "8.0B",
+					"quantization_level": "Q4_0"
+				}
+			}`,
+		},
 		{
 			name: "retrieve handler error forwarding",
 			endpoint: func(c *gin.Context) {
@@ -559,3 +734,72 @@ func TestRetrieveMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestChatMiddlewareStreamToolCalls(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(ChatMiddleware())
+	router.Handle(http.MethodPost, "/api/chat", func(c *gin.Context) {
+		for _, resp := range []api.ChatResponse{
+			{Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", PartialArguments: `{"location":`}}}}},
+			{Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{PartialArguments: ` "Paris"}`}}}}},
+			{
+				Message:    api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}}},
+				Done:       true,
+				DoneReason: "stop",
+			},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(bts)
+		}
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "stream": true}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var ids, names, arguments string
+	var finishReason string
+	for _, line := range strings.Split(resp.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range chunk.Choices[0].Delta.ToolCalls {
+			if tc.Index == nil || *tc.Index != 0 {
+				t.Errorf("expected index 0, got %v", tc.Index)
+			}
+
+			ids += tc.ID
+			names += tc.Function.Name
+			arguments += tc.Function.Arguments
+		}
+
+		if chunk.Choices[0].FinishReason != nil {
+			finishReason = *chunk.Choices[0].FinishReason
+		}
+	}
+
+	if !strings.HasPrefix(ids, "call_") || len(ids) != len("call_")+8 {
+		t.Errorf("expected a single tool call id, got %q", ids)
+	}
+
+	if names != "get_weather" {
+		t.Errorf("expected name %q, got %q", "get_weather", names)
+	}
+
+	if arguments != `{"location": "Paris"}` {
+		t.Errorf("expected arguments %q, got %q", `{"location": "Paris"}`, arguments)
+	}
+
+	if finishReason != "tool_calls" {
+		t.Errorf("expected finish reason %q, got %q", "tool_calls", finishReason)
+	}
+}
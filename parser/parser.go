@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -36,7 +38,7 @@ func (c Command) String() string {
 	switch c.Name {
 	case "model":
 		fmt.Fprintf(&sb, "FROM %s", c.Args)
-	case "license", "template", "system", "adapter":
+	case "license", "template", "system", "adapter", "merge":
 		fmt.Fprintf(&sb, "%s %s", strings.ToUpper(c.Name), quote(c.Args))
 	case "message":
 		role, message, _ := strings.Cut(c.Args, ": ")
@@ -60,11 +62,20 @@ const (
 )
 
 var (
-	errMissingFrom        = errors.New("no FROM line")
-	errInvalidMessageRole = errors.New("message role must be one of \"system\", \"user\", or \"assistant\"")
-	errInvalidCommand     = errors.New("command must be one of \"from\", \"license\", \"template\", \"system\", \"adapter\", \"parameter\", or \"message\"")
+	errMissingFrom          = errors.New("no FROM line")
+	errInvalidAdapterWeight = errors.New("adapter weight must be between 0 and 2")
+	errInvalidMessageRole   = errors.New("message role must be one of \"system\", \"user\", \"assistant\", or \"tool\"")
+	errInvalidMessageOrder  = errors.New("invalid message order")
+	errInvalidCommand       = errors.New("command must be one of \"from\", \"license\", \"template\", \"system\", \"adapter\", \"merge\", \"parameter\", or \"message\"")
+	errDuplicateMerge       = errors.New("file is merged more than once")
+	errInvalidMetadataKey   = errors.New("gguf metadata parameter must name a key, e.g. \"gguf.llama.context_length\"")
+	errFileOutsideDir       = errors.New("file is outside the Modelfile's directory")
 )
 
+// MetadataPrefix prefixes the names of parameters that override GGUF
+// metadata of the model, e.g. "PARAMETER gguf.llama.context_length 8192".
+const MetadataPrefix = "gguf."
+
 func ParseFile(r io.Reader) (*File, error) {
 	var cmd Command
 	var curr state
@@ -73,6 +84,12 @@ func ParseFile(r io.Reader) (*File, error) {
 
 	var f File
 
+	// line is the line of the rune being parsed and lines holds the line
+	// each command of f starts on
+	line, cmdLine := 1, 1
+	var lines []int
+	var newline bool
+
 	tr := unicode.BOMOverride(unicode.UTF8.NewDecoder())
 	br := bufio.NewReader(transform.NewReader(r, tr))
 
@@ -84,6 +101,11 @@ func ParseFile(r io.Reader) (*File, error) {
 			return nil, err
 		}
 
+		if newline {
+			line++
+		}
+		newline = r == '\n'
+
 		next, r, err := parseRuneForState(r, curr)
 		if errors.Is(err, io.ErrUnexpectedEOF) {
 			return nil, fmt.Errorf("%w: %s", err, b.String())
@@ -93,6 +115,10 @@ func ParseFile(r io.Reader) (*File, error) {
 
 		// process the state transition, some transitions need to be intercepted and redirected
 		if next != curr {
+			if curr == stateNil && next == stateName {
+				cmdLine = line
+			}
+
 			switch curr {
 			case stateName:
 				if !isValidCommand(b.String()) {
@@ -117,7 +143,7 @@ func ParseFile(r io.Reader) (*File, error) {
 				cmd.Name = b.String()
 			case stateMessage:
 				if !isValidMessageRole(b.String()) {
-					return nil, errInvalidMessageRole
+					return nil, fmt.Errorf("line %d: %w, got %q", cmdLine, errInvalidMessageRole, b.String())
 				}
 
 				role = b.String()
@@ -140,6 +166,7 @@ func ParseFile(r io.Reader) (*File, error) {
 
 				cmd.Args = s
 				f.Commands = append(f.Commands, cmd)
+				lines = append(lines, cmdLine)
 			}
 
 			b.Reset()
@@ -169,10 +196,38 @@ func ParseFile(r io.Reader) (*File, error) {
 
 		cmd.Args = s
 		f.Commands = append(f.Commands, cmd)
+		lines = append(lines, cmdLine)
 	default:
 		return nil, io.ErrUnexpectedEOF
 	}
 
+	for _, cmd := range f.Commands {
+		if cmd.Name == "adapter" {
+			if _, err := ParseAdapter(cmd.Args); err != nil {
+				return nil, err
+			}
+		} else if cmd.Name == MetadataPrefix {
+			return nil, errInvalidMetadataKey
+		}
+	}
+
+	if err := checkMessages(f.Commands, lines); err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]int)
+	for i, cmd := range f.Commands {
+		if cmd.Name != "merge" {
+			continue
+		}
+
+		if line, ok := merged[cmd.Args]; ok {
+			return nil, fmt.Errorf("line %d: %w: %q is also merged on line %d", lines[i], errDuplicateMerge, cmd.Args, line)
+		}
+
+		merged[cmd.Args] = lines[i]
+	}
+
 	for _, cmd := range f.Commands {
 		if cmd.Name == "model" {
 			return &f, nil
@@ -182,6 +237,166 @@ func ParseFile(r io.Reader) (*File, error) {
 	return nil, errMissingFrom
 }
 
+// checkMessages checks the MESSAGE commands of cmds, which start on lines,
+// form a conversation: user and assistant messages can't follow a message of
+// the same role and tool messages must follow an assistant or tool message.
+func checkMessages(cmds []Command, lines []int) error {
+	var prev string
+	for i, cmd := range cmds {
+		if cmd.Name != "message" {
+			continue
+		}
+
+		role, _, _ := strings.Cut(cmd.Args, ": ")
+		switch {
+		case (role == "user" || role == "assistant") && role == prev:
+			return fmt.Errorf("line %d: %w: %q message follows another %q message", lines[i], errInvalidMessageOrder, role, prev)
+		case role == "tool" && prev != "assistant" && prev != "tool":
+			return fmt.Errorf("line %d: %w: %q message must follow an \"assistant\" or \"tool\" message", lines[i], errInvalidMessageOrder, role)
+		}
+
+		prev = role
+	}
+
+	return nil
+}
+
+// Adapter is a LoRA adapter declared with ADAPTER and the weight it is
+// applied with.
+type Adapter struct {
+	Path   string
+	Weight float32
+}
+
+func (a Adapter) String() string {
+	if a.Weight == 1 {
+		return a.Path
+	}
+
+	return a.Path + " " + strconv.FormatFloat(float64(a.Weight), 'f', -1, 32)
+}
+
+// ParseAdapter parses the arguments of an ADAPTER command: a path optionally
+// followed by a weight in [0, 2]. The weight defaults to 1.
+func ParseAdapter(s string) (Adapter, error) {
+	a := Adapter{Path: s, Weight: 1}
+	if i := strings.LastIndexAny(s, " \t"); i >= 0 {
+		if w, err := strconv.ParseFloat(s[i+1:], 32); err == nil {
+			a.Path = strings.TrimSpace(s[:i])
+			a.Weight = float32(w)
+		}
+	}
+
+	if !(a.Weight >= 0 && a.Weight <= 2) {
+		return Adapter{}, fmt.Errorf("%w: %s", errInvalidAdapterWeight, s)
+	}
+
+	return a, nil
+}
+
+// Adapters returns the adapters declared in f in the order they appear.
+func (f File) Adapters() ([]Adapter, error) {
+	var adapters []Adapter
+	for _, cmd := range f.Commands {
+		if cmd.Name == "adapter" {
+			a, err := ParseAdapter(cmd.Args)
+			if err != nil {
+				return nil, err
+			}
+
+			adapters = append(adapters, a)
+		}
+	}
+
+	return adapters, nil
+}
+
+// Merges returns the files declared with MERGE in the order they appear. Their
+// tensors replace those of the same name in the model.
+func (f File) Merges() []string {
+	var merges []string
+	for _, cmd := range f.Commands {
+		if cmd.Name == "merge" {
+			merges = append(merges, cmd.Args)
+		}
+	}
+
+	return merges
+}
+
+// ReadFiles replaces the arguments of LICENSE, SYSTEM and TEMPLATE commands
+// which name an existing file with the contents of the file, without trailing
+// newlines, e.g. "LICENSE ./LICENSE.txt". Relative paths are relative to dir,
+// the directory of the Modelfile, and files outside of dir are rejected. Any
+// other argument is kept as inline text.
+func (f *File) ReadFiles(dir string) error {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+
+	for i, cmd := range f.Commands {
+		switch cmd.Name {
+		case "license", "system", "template":
+		default:
+			continue
+		}
+
+		if cmd.Args == "" || strings.ContainsAny(cmd.Args, "\r\n") {
+			continue
+		}
+
+		p := cmd.Args
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+
+		if fi, err := os.Stat(p); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		// resolve links so they can't point outside of dir either
+		p, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return err
+		}
+
+		if rel, err := filepath.Rel(root, p); err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("%s %s: %w", strings.ToUpper(cmd.Name), cmd.Args, errFileOutsideDir)
+		}
+
+		bts, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		f.Commands[i].Args = strings.TrimRight(string(bts), "\r\n")
+	}
+
+	return nil
+}
+
+// Metadata returns the GGUF metadata overrides declared in f by key. Later
+// declarations of a key replace earlier ones.
+func (f File) Metadata() map[string]string {
+	var metadata map[string]string
+	for _, cmd := range f.Commands {
+		if key, ok := strings.CutPrefix(cmd.Name, MetadataPrefix); ok {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+
+			metadata[key] = cmd.Args
+		}
+	}
+
+	return metadata
+}
+
 func parseRuneForState(r rune, cs state) (state, rune, error) {
 	switch cs {
 	case stateNil:
@@ -213,7 +428,7 @@ func parseRuneForState(r rune, cs state) (state, rune, error) {
 		}
 	case stateParameter:
 		switch {
-		case isAlpha(r), isNumber(r), r == '_':
+		case isAlpha(r), isNumber(r), r == '_', r == '.':
 			return stateParameter, r, nil
 		case isSpace(r):
 			return stateValue, 0, nil
@@ -291,12 +506,12 @@ func isNewline(r rune) bool {
 }
 
 func isValidMessageRole(role string) bool {
-	return role == "system" || role == "user" || role == "assistant"
+	return role == "system" || role == "user" || role == "assistant" || role == "tool"
 }
 
 func isValidCommand(cmd string) bool {
 	switch strings.ToLower(cmd) {
-	case "from", "license", "template", "system", "adapter", "parameter", "message":
+	case "from", "license", "template", "system", "adapter", "merge", "parameter", "message":
 		return true
 	default:
 		return false
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"unicode/utf16"
@@ -184,6 +186,175 @@ BADCOMMAND param1 value1
 	require.ErrorIs(t, err, errInvalidCommand)
 }
 
+func TestParseFileAdapters(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []Adapter
+		err      error
+	}{
+		{
+			`
+FROM foo
+ADAPTER ./a.gguf
+`,
+			[]Adapter{{Path: "./a.gguf", Weight: 1}},
+			nil,
+		},
+		{
+			`
+FROM foo
+ADAPTER ./a.gguf
+ADAPTER ./b.gguf
+`,
+			[]Adapter{{Path: "./a.gguf", Weight: 1}, {Path: "./b.gguf", Weight: 1}},
+			nil,
+		},
+		{
+			`
+FROM foo
+ADAPTER ./a.gguf 0.7
+ADAPTER ./b.gguf   1.5
+ADAPTER ./c.gguf 0
+ADAPTER ./d.gguf 2
+`,
+			[]Adapter{
+				{Path: "./a.gguf", Weight: 0.7},
+				{Path: "./b.gguf", Weight: 1.5},
+				{Path: "./c.gguf", Weight: 0},
+				{Path: "./d.gguf", Weight: 2},
+			},
+			nil,
+		},
+		{
+			`
+FROM foo
+ADAPTER ./my adapter.gguf
+`,
+			[]Adapter{{Path: "./my adapter.gguf", Weight: 1}},
+			nil,
+		},
+		{
+			`
+FROM foo
+ADAPTER ./a.gguf 2.5
+`,
+			nil,
+			errInvalidAdapterWeight,
+		},
+		{
+			`
+FROM foo
+ADAPTER ./a.gguf -0.5
+`,
+			nil,
+			errInvalidAdapterWeight,
+		},
+		{
+			`
+FROM foo
+ADAPTER ./a.gguf NaN
+`,
+			nil,
+			errInvalidAdapterWeight,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run("", func(t *testing.T) {
+			modelfile, err := ParseFile(strings.NewReader(c.input))
+			require.ErrorIs(t, err, c.err)
+			if err != nil {
+				return
+			}
+
+			adapters, err := modelfile.Adapters()
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, adapters)
+
+			for i, adapter := range adapters {
+				parsed, err := ParseAdapter(adapter.String())
+				require.NoError(t, err)
+				assert.Equal(t, adapters[i], parsed)
+			}
+		})
+	}
+}
+
+func TestParseFileMerges(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+		err      error
+	}{
+		{
+			`
+FROM ./base.gguf
+`,
+			nil,
+			nil,
+		},
+		{
+			`
+FROM ./base.gguf
+MERGE ./a.gguf
+`,
+			[]string{"./a.gguf"},
+			nil,
+		},
+		{
+			`
+FROM ./base.gguf
+MERGE ./a.gguf
+merge ./b.gguf
+ADAPTER ./c.gguf
+`,
+			[]string{"./a.gguf", "./b.gguf"},
+			nil,
+		},
+		{
+			`
+MERGE "./my layers.gguf"
+FROM ./base.gguf
+`,
+			[]string{"./my layers.gguf"},
+			nil,
+		},
+		{
+			`
+FROM ./base.gguf
+MERGE ./a.gguf
+MERGE ./a.gguf
+`,
+			nil,
+			errDuplicateMerge,
+		},
+		{
+			`
+MERGE ./a.gguf
+`,
+			nil,
+			errMissingFrom,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run("", func(t *testing.T) {
+			modelfile, err := ParseFile(strings.NewReader(c.input))
+			require.ErrorIs(t, err, c.err)
+			if err != nil {
+				return
+			}
+
+			assert.Equal(t, c.expected, modelfile.Merges())
+
+			// merges survive formatting the modelfile
+			parsed, err := ParseFile(strings.NewReader(modelfile.String()))
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, parsed.Merges())
+		})
+	}
+}
+
 func TestParseFileMessages(t *testing.T) {
 	cases := []struct {
 		input    string
@@ -275,6 +446,99 @@ MESSAGE system`,
 	}
 }
 
+func TestParseFileMessageOrder(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		err   error
+		msg   string
+	}{
+		{
+			"conversation",
+			`FROM foo
+MESSAGE system You are a file parser.
+MESSAGE user What's the weather?
+MESSAGE assistant I'll check.
+MESSAGE tool {"weather": "sunny"}
+MESSAGE tool {"temperature": 20}
+MESSAGE assistant It's sunny and 20 degrees.
+MESSAGE user Thanks!
+`,
+			nil,
+			"",
+		},
+		{
+			"system between turns",
+			`FROM foo
+MESSAGE user Hey there!
+MESSAGE system Answer briefly.
+MESSAGE user Hey there!
+`,
+			nil,
+			"",
+		},
+		{
+			"misspelled role",
+			`FROM foo
+
+# a greeting
+MESSAGE asistant hi
+`,
+			errInvalidMessageRole,
+			"line 4: " + errInvalidMessageRole.Error() + `, got "asistant"`,
+		},
+		{
+			"consecutive user",
+			`FROM foo
+MESSAGE user Hey there!
+MESSAGE user """
+Are you there?
+"""
+MESSAGE assistant Yes.
+`,
+			errInvalidMessageOrder,
+			`line 3: invalid message order: "user" message follows another "user" message`,
+		},
+		{
+			"consecutive assistant",
+			`FROM foo
+PARAMETER temperature 0
+MESSAGE user Hey there!
+MESSAGE assistant Hello!
+MESSAGE assistant How can I help?
+`,
+			errInvalidMessageOrder,
+			`line 5: invalid message order: "assistant" message follows another "assistant" message`,
+		},
+		{
+			"tool after user",
+			`FROM foo
+MESSAGE user What's the weather?
+MESSAGE tool {"weather": "sunny"}`,
+			errInvalidMessageOrder,
+			`line 3: invalid message order: "tool" message must follow an "assistant" or "tool" message`,
+		},
+		{
+			"tool first",
+			`FROM foo
+MESSAGE tool {"weather": "sunny"}
+`,
+			errInvalidMessageOrder,
+			`line 2: invalid message order: "tool" message must follow an "assistant" or "tool" message`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFile(strings.NewReader(tt.input))
+			require.ErrorIs(t, err, tt.err)
+			if tt.err != nil {
+				assert.EqualError(t, err, tt.msg)
+			}
+		})
+	}
+}
+
 func TestParseFileQuoted(t *testing.T) {
 	cases := []struct {
 		multiline string
@@ -490,6 +754,90 @@ func TestParseFileParameters(t *testing.T) {
 	}
 }
 
+func TestParseFileMetadata(t *testing.T) {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "FROM foo")
+	fmt.Fprintln(&b, "PARAMETER gguf.llama.context_length 8192")
+	fmt.Fprintln(&b, "PARAMETER gguf.general.name \"my model\"")
+	fmt.Fprintln(&b, "PARAMETER gguf.llama.context_length 16384")
+	fmt.Fprintln(&b, "PARAMETER num_ctx 4096")
+
+	modelfile, err := ParseFile(&b)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Command{
+		{Name: "model", Args: "foo"},
+		{Name: "gguf.llama.context_length", Args: "8192"},
+		{Name: "gguf.general.name", Args: "my model"},
+		{Name: "gguf.llama.context_length", Args: "16384"},
+		{Name: "num_ctx", Args: "4096"},
+	}, modelfile.Commands)
+
+	assert.Equal(t, map[string]string{
+		"llama.context_length": "16384",
+		"general.name":         "my model",
+	}, modelfile.Metadata())
+
+	_, err = ParseFile(strings.NewReader("FROM foo\nPARAMETER gguf. 1"))
+	assert.ErrorIs(t, err, errInvalidMetadataKey)
+}
+
+func TestParseFileReadFiles(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "model")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "prompts"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "LICENSE.txt"), []byte("Apache License\nVersion 2.0\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prompts", "system.txt"), []byte("You are Mario.\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644))
+
+	parse := func(t *testing.T, input string) *File {
+		t.Helper()
+		modelfile, err := ParseFile(strings.NewReader(input))
+		require.NoError(t, err)
+		return modelfile
+	}
+
+	t.Run("files", func(t *testing.T) {
+		modelfile := parse(t, "FROM foo\nLICENSE ./LICENSE.txt\nSYSTEM prompts/system.txt\nTEMPLATE \"{{ .Prompt }}\"")
+		require.NoError(t, modelfile.ReadFiles(dir))
+
+		assert.Equal(t, []Command{
+			{Name: "model", Args: "foo"},
+			{Name: "license", Args: "Apache License\nVersion 2.0"},
+			{Name: "system", Args: "You are Mario."},
+			{Name: "template", Args: "{{ .Prompt }}"},
+		}, modelfile.Commands)
+	})
+
+	t.Run("inline", func(t *testing.T) {
+		modelfile := parse(t, "FROM foo\nLICENSE MIT\nSYSTEM \"\"\"LICENSE.txt\nis not a path\"\"\"\nPARAMETER stop LICENSE.txt")
+		require.NoError(t, modelfile.ReadFiles(dir))
+
+		assert.Equal(t, []Command{
+			{Name: "model", Args: "foo"},
+			{Name: "license", Args: "MIT"},
+			{Name: "system", Args: "LICENSE.txt\nis not a path"},
+			{Name: "stop", Args: "LICENSE.txt"},
+		}, modelfile.Commands)
+	})
+
+	t.Run("traversal", func(t *testing.T) {
+		for _, arg := range []string{"../secret.txt", filepath.Join(root, "secret.txt")} {
+			modelfile := parse(t, fmt.Sprintf("FROM foo\nLICENSE %q", arg))
+			assert.ErrorIs(t, modelfile.ReadFiles(dir), errFileOutsideDir, arg)
+		}
+	})
+
+	t.Run("link", func(t *testing.T) {
+		if err := os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(dir, "link.txt")); err != nil {
+			t.Skip(err)
+		}
+
+		modelfile := parse(t, "FROM foo\nLICENSE link.txt")
+		assert.ErrorIs(t, modelfile.ReadFiles(dir), errFileOutsideDir)
+	})
+}
+
 func TestParseFileComments(t *testing.T) {
 	cases := []struct {
 		input    string
@@ -3,6 +3,7 @@ package progress
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +20,9 @@ type Bar struct {
 	initialValue int64
 	currentValue int64
 
+	// formatValue renders values, which are bytes unless set otherwise
+	formatValue func(int64) string
+
 	started time.Time
 	stopped time.Time
 
@@ -40,6 +44,7 @@ func NewBar(message string, maxValue, initialValue int64) *Bar {
 		currentValue: initialValue,
 		started:      time.Now(),
 		maxBuckets:   10,
+		formatValue:  format.HumanBytes,
 	}
 
 	if initialValue >= maxValue {
@@ -49,6 +54,17 @@ func NewBar(message string, maxValue, initialValue int64) *Bar {
 	return &b
 }
 
+// NewCountBar returns a Bar of values which are counts of items rather than
+// bytes
+func NewCountBar(message string, maxValue, initialValue int64) *Bar {
+	b := NewBar(message, maxValue, initialValue)
+	b.formatValue = func(v int64) string {
+		return strconv.FormatInt(v, 10)
+	}
+
+	return b
+}
+
 // formatDuration limits the rendering of a time.Duration to 2 units
 func formatDuration(d time.Duration) string {
 	switch {
@@ -87,16 +103,16 @@ func (b *Bar) String() string {
 	var suf strings.Builder
 	// max 13 characters: "999 MB/999 MB"
 	if b.stopped.IsZero() {
-		curValue := format.HumanBytes(b.currentValue)
+		curValue := b.formatValue(b.currentValue)
 		suf.WriteString(repeat(" ", 6-len(curValue)))
 		suf.WriteString(curValue)
 		suf.WriteString("/")
 
-		maxValue := format.HumanBytes(b.maxValue)
+		maxValue := b.formatValue(b.maxValue)
 		suf.WriteString(repeat(" ", 6-len(maxValue)))
 		suf.WriteString(maxValue)
 	} else {
-		maxValue := format.HumanBytes(b.maxValue)
+		maxValue := b.formatValue(b.maxValue)
 		suf.WriteString(repeat(" ", 6-len(maxValue)))
 		suf.WriteString(maxValue)
 		suf.WriteString(repeat(" ", 7))
@@ -106,7 +122,7 @@ func (b *Bar) String() string {
 	// max 10 characters: "  999 MB/s"
 	if b.stopped.IsZero() && rate > 0 {
 		suf.WriteString("  ")
-		humanRate := format.HumanBytes(int64(rate))
+		humanRate := b.formatValue(int64(rate))
 		suf.WriteString(repeat(" ", 6-len(humanRate)))
 		suf.WriteString(humanRate)
 		suf.WriteString("/s")
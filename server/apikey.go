@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Authenticator authenticates requests to the API
+type Authenticator interface {
+	Authenticate(r *http.Request) bool
+}
+
+// bearerAuthenticator accepts requests with any of its keys as a bearer
+// token. Several keys can be valid at once so they can be rotated.
+type bearerAuthenticator struct {
+	// hashes of the keys, so comparisons take the same time whatever the
+	// length of the token
+	keys [][sha256.Size]byte
+}
+
+func newBearerAuthenticator(keys []string) *bearerAuthenticator {
+	a := &bearerAuthenticator{}
+	for _, key := range keys {
+		a.keys = append(a.keys, sha256.Sum256([]byte(key)))
+	}
+
+	return a
+}
+
+func (a *bearerAuthenticator) Authenticate(r *http.Request) bool {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+
+	// compare every key so the time taken doesn't tell which one matched
+	var match int
+	for _, key := range a.keys {
+		match |= subtle.ConstantTimeCompare(hash[:], key[:])
+	}
+
+	return match == 1
+}
+
+// apiKeys returns the keys of OLLAMA_API_KEY, a comma separated list, and of
+// OLLAMA_API_KEYS_FILE, a file with one key per line
+func apiKeys() ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(envconfig.APIKey(), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if p := envconfig.APIKeysFile(); p != "" {
+		bts, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(bts))
+		for scanner.Scan() {
+			// blank lines and comments are skipped
+			if key := strings.TrimSpace(scanner.Text()); key != "" && !strings.HasPrefix(key, "#") {
+				keys = append(keys, key)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// apiAuthenticator returns the Authenticator of the API keys configured, or
+// nil if there are none. If the keys file can't be read no key is accepted
+// rather than leaving the API open.
+func apiAuthenticator() Authenticator {
+	if envconfig.APIKey() == "" && envconfig.APIKeysFile() == "" {
+		return nil
+	}
+
+	keys, err := apiKeys()
+	if err != nil {
+		slog.Error("couldn't read API keys, rejecting every request", "error", err)
+		return newBearerAuthenticator(nil)
+	}
+
+	if len(keys) == 0 {
+		slog.Warn("no API keys configured, rejecting every request")
+	}
+
+	return newBearerAuthenticator(keys)
+}
+
+// authExempt are the paths that don't need authentication so health checks
+// work without a key
+var authExempt = map[string]bool{
+	"/":       true,
+	"/health": true,
+	"/ready":  true,
+}
+
+// authMiddleware rejects requests auth doesn't authenticate with a 401. A nil
+// auth accepts every request.
+func authMiddleware(auth Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if auth == nil || authExempt[c.Request.URL.Path] || auth.Authenticate(c.Request) {
+			c.Next()
+			return
+		}
+
+		c.Header("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", "ollama"))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid API key", "code": api.ErrorCodeUnauthorized})
+	}
+}
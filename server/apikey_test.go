@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	p := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(p, []byte("# rotated in march\nfile-key\n\n  other-file-key  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_API_KEY", "old-key, new-key")
+	t.Setenv("OLLAMA_API_KEYS_FILE", p)
+
+	s := &Server{}
+	router := s.GenerateRoutes()
+
+	status := func(t *testing.T, path, authorization string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code == http.StatusUnauthorized {
+			if !strings.Contains(w.Body.String(), `"code":"unauthorized"`) {
+				t.Errorf("expected an unauthorized error, got %s", w.Body)
+			}
+
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate header")
+			}
+		}
+
+		return w.Code
+	}
+
+	cases := []struct {
+		name          string
+		authorization string
+		code          int
+	}{
+		{"valid", "Bearer new-key", http.StatusOK},
+		{"rotated", "Bearer old-key", http.StatusOK},
+		{"file", "Bearer file-key", http.StatusOK},
+		{"file trimmed", "Bearer other-file-key", http.StatusOK},
+		{"lowercase scheme", "bearer new-key", http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"invalid", "Bearer wrong-key", http.StatusUnauthorized},
+		{"prefix", "Bearer new", http.StatusUnauthorized},
+		{"comment", "Bearer # rotated in march", http.StatusUnauthorized},
+		{"basic", "Basic bmV3LWtleQ==", http.StatusUnauthorized},
+		{"no scheme", "new-key", http.StatusUnauthorized},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status(t, "/api/tags", tt.authorization); code != tt.code {
+				t.Errorf("expected status %d, got %d", tt.code, code)
+			}
+		})
+	}
+
+	t.Run("exempt", func(t *testing.T) {
+		for _, path := range []string{"/", "/health"} {
+			if code := status(t, path, ""); code != http.StatusOK {
+				t.Errorf("%s: expected status 200, got %d", path, code)
+			}
+		}
+
+		if code := status(t, "/ready", ""); code == http.StatusUnauthorized {
+			t.Errorf("/ready: expected no authentication, got %d", code)
+		}
+
+		if code := status(t, "/api/version", ""); code != http.StatusUnauthorized {
+			t.Errorf("/api/version: expected status 401, got %d", code)
+		}
+	})
+}
+
+func TestAPIKeysDisabled(t *testing.T) {
+	t.Setenv("OLLAMA_API_KEY", "")
+	t.Setenv("OLLAMA_API_KEYS_FILE", "")
+	if auth := apiAuthenticator(); auth != nil {
+		t.Fatalf("expected no authentication, got %T", auth)
+	}
+
+	// a keys file that can't be read rejects every request
+	t.Setenv("OLLAMA_API_KEYS_FILE", filepath.Join(t.TempDir(), "missing"))
+	auth := apiAuthenticator()
+	if auth == nil {
+		t.Fatal("expected authentication")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	r.Header.Set("Authorization", "Bearer key")
+	if auth.Authenticate(r) {
+		t.Error("expected every token to be rejected")
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
@@ -50,24 +51,32 @@ func (r registryChallenge) URL() (*url.URL, error) {
 	return redirectURL, nil
 }
 
-func getAuthorizationToken(ctx context.Context, challenge registryChallenge) (string, error) {
+// getAuthorizationToken returns a token for the challenge of a registry. The
+// token is requested with the registry's credentials in regOpts if there are
+// any, otherwise it's signed with the Ollama key.
+func getAuthorizationToken(ctx context.Context, challenge registryChallenge, regOpts *registryOptions) (string, error) {
 	redirectURL, err := challenge.URL()
 	if err != nil {
 		return "", err
 	}
 
-	sha256sum := sha256.Sum256(nil)
-	data := []byte(fmt.Sprintf("%s,%s,%s", http.MethodGet, redirectURL.String(), base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(sha256sum[:])))))
-
 	headers := make(http.Header)
-	signature, err := auth.Sign(ctx, data)
-	if err != nil {
-		return "", err
-	}
+	opts := &registryOptions{}
+	if regOpts.Username != "" && regOpts.Password != "" {
+		opts.Username, opts.Password = regOpts.Username, regOpts.Password
+	} else {
+		sha256sum := sha256.Sum256(nil)
+		data := []byte(fmt.Sprintf("%s,%s,%s", http.MethodGet, redirectURL.String(), base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(sha256sum[:])))))
+
+		signature, err := auth.Sign(ctx, data)
+		if err != nil {
+			return "", err
+		}
 
-	headers.Add("Authorization", signature)
+		headers.Add("Authorization", signature)
+	}
 
-	response, err := makeRequest(ctx, http.MethodGet, redirectURL, headers, nil, &registryOptions{})
+	response, err := makeRequest(ctx, http.MethodGet, redirectURL, headers, nil, opts)
 	if err != nil {
 		return "", err
 	}
@@ -86,10 +95,15 @@ func getAuthorizationToken(ctx context.Context, challenge registryChallenge) (st
 		}
 	}
 
-	var token api.TokenResponse
+	var token struct {
+		api.TokenResponse
+		// AccessToken is the OAuth 2 name of Token some registries use
+		AccessToken string `json:"access_token"`
+	}
+
 	if err := json.Unmarshal(body, &token); err != nil {
 		return "", err
 	}
 
-	return token.Token, nil
+	return cmp.Or(token.Token, token.AccessToken), nil
 }
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+var errBlobDigestMismatch = errors.New("blob doesn't match its digest")
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Digest string
+	Size   int64
+}
+
+// BlobStore stores the blobs of models by digest, e.g. "sha256:<hex>". Get
+// and Stat of a missing blob return an error wrapping [fs.ErrNotExist] and
+// deleting a missing blob isn't an error. Digests which aren't sha256
+// digests are rejected with [ErrInvalidDigestFormat].
+type BlobStore interface {
+	Get(ctx context.Context, digest string) (io.ReadCloser, error)
+	// Put stores the blob read from r, which must match digest
+	Put(ctx context.Context, digest string, r io.Reader) error
+	Stat(ctx context.Context, digest string) (BlobInfo, error)
+	Delete(ctx context.Context, digest string) error
+	// List returns every stored blob sorted by digest
+	List(ctx context.Context) ([]BlobInfo, error)
+}
+
+// blobDigest matches the digests of blobs
+var blobDigest = regexp.MustCompile("^sha256:[0-9a-f]{64}$")
+
+// checkDigest returns digest in the canonical "sha256:<hex>" form, or
+// ErrInvalidDigestFormat if it isn't a sha256 digest
+func checkDigest(digest string) (string, error) {
+	digest = strings.ToLower(strings.Replace(digest, "-", ":", 1))
+	if !blobDigest.MatchString(digest) {
+		return "", ErrInvalidDigestFormat
+	}
+
+	return digest, nil
+}
+
+// blobStores holds the blob store of the models directory. It's shared by
+// every caller, and reopened only if OLLAMA_STORAGE or the models directory
+// changes.
+var blobStores struct {
+	sync.Mutex
+	spec, dir string
+	store     *blobCache
+}
+
+// blobStore returns the blob store of OLLAMA_STORAGE for the blobs directory
+func blobStore() (*blobCache, error) {
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return nil, err
+	}
+
+	spec := envconfig.Storage()
+
+	blobStores.Lock()
+	defer blobStores.Unlock()
+
+	if blobStores.store != nil && blobStores.spec == spec && blobStores.dir == dir {
+		return blobStores.store, nil
+	}
+
+	store := &blobCache{local: &fsBlobStore{dir: dir}}
+	if spec != "" && spec != "fs" {
+		if store.remote, err = openBlobStore(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	blobStores.spec, blobStores.dir, blobStores.store = spec, dir, store
+	return store, nil
+}
+
+// openBlobStore returns the blob store of spec: "fs", the default, for the
+// blobs directory of the models directory or "s3://bucket/prefix" for an S3
+// bucket
+func openBlobStore(spec string) (BlobStore, error) {
+	switch {
+	case spec == "" || spec == "fs":
+		dir, err := GetBlobsPath("")
+		if err != nil {
+			return nil, err
+		}
+
+		return &fsBlobStore{dir: dir}, nil
+	case strings.HasPrefix(spec, "s3://"):
+		return newS3BlobStore(spec)
+	default:
+		return nil, fmt.Errorf("invalid OLLAMA_STORAGE %q, must be \"fs\" or \"s3://bucket/prefix\"", spec)
+	}
+}
+
+// blobCache is the blob store of models. Blobs are kept in the blobs
+// directory, where runners load them from, and in the remote store if
+// OLLAMA_STORAGE is one. The blobs directory then acts as a cache of the
+// remote store: blobs are fetched from it when they're missing.
+type blobCache struct {
+	local *fsBlobStore
+	// remote is nil unless OLLAMA_STORAGE is a remote store
+	remote BlobStore
+}
+
+func (c *blobCache) Get(ctx context.Context, digest string) (io.ReadCloser, error) {
+	return c.Open(ctx, digest)
+}
+
+func (c *blobCache) Put(ctx context.Context, digest string, r io.Reader) error {
+	if err := c.local.Put(ctx, digest, r); err != nil {
+		return err
+	}
+
+	return c.push(ctx, digest)
+}
+
+func (c *blobCache) Stat(ctx context.Context, digest string) (BlobInfo, error) {
+	p, err := c.path(digest)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) && c.remote != nil {
+		return c.remote.Stat(ctx, digest)
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+
+	return BlobInfo{Digest: strings.Replace(fi.Name(), "-", ":", 1), Size: fi.Size()}, nil
+}
+
+func (c *blobCache) Delete(ctx context.Context, digest string) error {
+	if err := c.local.Delete(ctx, digest); err != nil {
+		return err
+	}
+
+	if c.remote != nil {
+		return c.remote.Delete(ctx, digest)
+	}
+
+	return nil
+}
+
+func (c *blobCache) List(ctx context.Context) ([]BlobInfo, error) {
+	blobs, err := c.local.List(ctx)
+	if err != nil || c.remote == nil {
+		return blobs, err
+	}
+
+	remote, err := c.remote.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs = append(blobs, remote...)
+	slices.SortFunc(blobs, func(a, b BlobInfo) int { return strings.Compare(a.Digest, b.Digest) })
+	return slices.CompactFunc(blobs, func(a, b BlobInfo) bool { return a.Digest == b.Digest }), nil
+}
+
+// Cached returns the blobs in the blobs directory
+func (c *blobCache) Cached(ctx context.Context) ([]BlobInfo, error) {
+	return c.local.List(ctx)
+}
+
+// Evict removes the blob of digest from the blobs directory. Unlike Delete
+// it's kept in the remote store, which may be shared by other servers whose
+// models still use it.
+func (c *blobCache) Evict(ctx context.Context, digest string) error {
+	return c.local.Delete(ctx, digest)
+}
+
+// Create stores the blob read from r, whose digest is only known once it's
+// read. It reports whether the blob wasn't already stored.
+func (c *blobCache) Create(ctx context.Context, r io.Reader) (_ BlobInfo, created bool, _ error) {
+	temp, err := os.CreateTemp(c.local.dir, "sha256-")
+	if err != nil {
+		return BlobInfo{}, false, err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	sha256sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(temp, sha256sum), r)
+	if err != nil {
+		return BlobInfo{}, false, err
+	}
+
+	if err := temp.Close(); err != nil {
+		return BlobInfo{}, false, err
+	}
+
+	info := BlobInfo{Digest: fmt.Sprintf("sha256:%x", sha256sum.Sum(nil)), Size: n}
+	p, err := c.local.path(info.Digest)
+	if err != nil {
+		return BlobInfo{}, false, err
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		created = true
+		if err := os.Chmod(temp.Name(), 0o644); err != nil {
+			return BlobInfo{}, false, err
+		}
+
+		if err := os.Rename(temp.Name(), p); err != nil {
+			return BlobInfo{}, false, err
+		}
+	}
+
+	return info, created, c.push(ctx, info.Digest)
+}
+
+// Open opens the blob of digest in the blobs directory, fetching it from the
+// remote store if it's missing
+func (c *blobCache) Open(ctx context.Context, digest string) (*os.File, error) {
+	p, err := c.File(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+// File returns the path of the blob of digest in the blobs directory,
+// fetching it from the remote store if it's missing
+func (c *blobCache) File(ctx context.Context, digest string) (string, error) {
+	p, err := c.path(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(p); err == nil || c.remote == nil {
+		return p, nil
+	}
+
+	r, err := c.remote.Get(ctx, digest)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	return p, c.local.Put(ctx, digest, r)
+}
+
+// path returns the path of the blob of digest in the models directories. It's
+// in the blobs directory unless another models directory has it.
+func (c *blobCache) path(digest string) (string, error) {
+	p, err := c.local.path(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if fp, ok := findModelsFile(filepath.Join("blobs", filepath.Base(p))); ok {
+		return fp, nil
+	}
+
+	return p, nil
+}
+
+// push copies the blob of digest in the blobs directory to the remote store
+// unless it's already there
+func (c *blobCache) push(ctx context.Context, digest string) error {
+	if c.remote == nil {
+		return nil
+	}
+
+	if _, err := c.remote.Stat(ctx, digest); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	p, err := c.path(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.remote.Put(ctx, digest, f)
+}
+
+// fsBlobStore stores blobs as files in dir named after their digests, e.g.
+// "sha256-<hex>"
+type fsBlobStore struct {
+	dir string
+}
+
+func (s *fsBlobStore) path(digest string) (string, error) {
+	digest, err := checkDigest(digest)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.dir, strings.Replace(digest, ":", "-", 1)), nil
+}
+
+func (s *fsBlobStore) Get(_ context.Context, digest string) (io.ReadCloser, error) {
+	p, err := s.path(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+func (s *fsBlobStore) Put(_ context.Context, digest string, r io.Reader) error {
+	p, err := s.path(digest)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(s.dir, "sha256-")
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	sha256sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(temp, sha256sum), r); err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("sha256-%x", sha256sum.Sum(nil)); got != filepath.Base(p) {
+		return fmt.Errorf("%w: %s", errBlobDigestMismatch, digest)
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(temp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), p)
+}
+
+func (s *fsBlobStore) Stat(_ context.Context, digest string) (BlobInfo, error) {
+	p, err := s.path(digest)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	return BlobInfo{Digest: strings.Replace(fi.Name(), "-", ":", 1), Size: fi.Size()}, nil
+}
+
+func (s *fsBlobStore) Delete(_ context.Context, digest string) error {
+	p, err := s.path(digest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *fsBlobStore) List(context.Context) ([]BlobInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []BlobInfo
+	for _, entry := range entries {
+		// skip partial downloads and anything else that isn't a blob
+		digest := strings.Replace(entry.Name(), "-", ":", 1)
+		if !entry.Type().IsRegular() || !blobDigest.MatchString(digest) {
+			continue
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		blobs = append(blobs, BlobInfo{Digest: digest, Size: fi.Size()})
+	}
+
+	return blobs, nil
+}
+
+// memoryBlobStore stores blobs in memory. The zero value is ready to use.
+type memoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (s *memoryBlobStore) Get(_ context.Context, digest string) (io.ReadCloser, error) {
+	digest, err := checkDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blobs[digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", digest, fs.ErrNotExist)
+	}
+
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memoryBlobStore) Put(_ context.Context, digest string, r io.Reader) error {
+	digest, err := checkDigest(digest)
+	if err != nil {
+		return err
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("sha256:%x", sha256.Sum256(b)); got != digest {
+		return fmt.Errorf("%w: %s", errBlobDigestMismatch, digest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blobs == nil {
+		s.blobs = make(map[string][]byte)
+	}
+
+	s.blobs[digest] = b
+	return nil
+}
+
+func (s *memoryBlobStore) Stat(_ context.Context, digest string) (BlobInfo, error) {
+	digest, err := checkDigest(digest)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blobs[digest]
+	if !ok {
+		return BlobInfo{}, fmt.Errorf("blob %s: %w", digest, fs.ErrNotExist)
+	}
+
+	return BlobInfo{Digest: digest, Size: int64(len(b))}, nil
+}
+
+func (s *memoryBlobStore) Delete(_ context.Context, digest string) error {
+	digest, err := checkDigest(digest)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, digest)
+	return nil
+}
+
+func (s *memoryBlobStore) List(context.Context) ([]BlobInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blobs := make([]BlobInfo, 0, len(s.blobs))
+	for digest, b := range s.blobs {
+		blobs = append(blobs, BlobInfo{Digest: digest, Size: int64(len(b))})
+	}
+
+	slices.SortFunc(blobs, func(a, b BlobInfo) int { return strings.Compare(a.Digest, b.Digest) })
+	return blobs, nil
+}
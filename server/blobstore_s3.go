@@ -0,0 +1,346 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// s3BlobStore stores blobs as objects named after their digests, e.g.
+// "<prefix>/sha256-<hex>", in an S3 bucket or an S3 compatible service. It's
+// configured with the usual AWS environment variables: AWS_REGION,
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and, for S3
+// compatible services, AWS_ENDPOINT_URL.
+type s3BlobStore struct {
+	client *http.Client
+
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	// now is the time requests are signed at
+	now func() time.Time
+}
+
+// s3Client sends the requests of S3 blob stores. Connecting and waiting for
+// a response time out, but the transfer of a body doesn't since uploading or
+// downloading a large blob can take a long time.
+var s3Client = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   8,
+	},
+}
+
+// newS3BlobStore returns the store of spec, "s3://bucket/prefix"
+func newS3BlobStore(spec string) (*s3BlobStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OLLAMA_STORAGE %q: %w", spec, err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid OLLAMA_STORAGE %q, missing bucket", spec)
+	}
+
+	region := cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint, err := url.Parse(cmp.Or(os.Getenv("AWS_ENDPOINT_URL"), fmt.Sprintf("https://s3.%s.amazonaws.com", region)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL: %w", err)
+	}
+
+	return &s3BlobStore{
+		client:       s3Client,
+		endpoint:     endpoint,
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		now:          time.Now,
+	}, nil
+}
+
+func (s *s3BlobStore) key(digest string) (string, error) {
+	digest, err := checkDigest(digest)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(s.prefix, strings.Replace(digest, ":", "-", 1)), nil
+}
+
+// do sends a request for key, or the bucket if key is empty, and returns the
+// response if its status is 2xx. payloadHash is the hex sha256 of body.
+func (s *s3BlobStore) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := s.endpoint.JoinPath(s.bucket, key)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, key, fs.ErrNotExist)
+	}
+
+	var s3err struct {
+		Code    string
+		Message string
+	}
+
+	if err := xml.NewDecoder(resp.Body).Decode(&s3err); err != nil || s3err.Code == "" {
+		return nil, fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+	}
+
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, s3err.Code, s3err.Message)
+}
+
+// sign signs req with AWS Signature Version 4
+func (s *s3BlobStore) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	datetime := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", datetime)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	if s.accessKey == "" {
+		// anonymous access to a public bucket
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + datetime + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.accessKey, scope, signedHeaders, hmacSHA256(key, stringToSign)))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// emptyPayloadHash is the hex sha256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *s3BlobStore) Get(ctx context.Context, digest string) (io.ReadCloser, error) {
+	key, err := s.key(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, digest string, r io.Reader) error {
+	key, err := s.key(digest)
+	if err != nil {
+		return err
+	}
+
+	// the blob is spooled to a file to check its digest, which is also the
+	// payload hash, and its size before it's uploaded
+	temp, err := os.CreateTemp("", "ollama-blob-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	sha256sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, sha256sum), r)
+	if err != nil {
+		return err
+	}
+
+	payloadHash := hex.EncodeToString(sha256sum.Sum(nil))
+	if "sha256-"+payloadHash != path.Base(key) {
+		return fmt.Errorf("%w: %s", errBlobDigestMismatch, digest)
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, key, nil, temp, size, payloadHash)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, digest string) (BlobInfo, error) {
+	key, err := s.key(digest)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+
+	return BlobInfo{Digest: strings.Replace(path.Base(key), "-", ":", 1), Size: resp.ContentLength}, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, digest string) error {
+	key, err := s.key(digest)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, emptyPayloadHash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *s3BlobStore) List(ctx context.Context) ([]BlobInfo, error) {
+	prefix := "sha256-"
+	if s.prefix != "" {
+		prefix = s.prefix + "/" + prefix
+	}
+
+	var blobs []BlobInfo
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			// skip anything else under prefix, e.g. "sha256-<hex>/other"
+			digest := "sha256:" + strings.TrimPrefix(object.Key, prefix)
+			if blobDigest.MatchString(digest) {
+				blobs = append(blobs, BlobInfo{Digest: digest, Size: object.Size})
+			}
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+
+		token = result.NextContinuationToken
+	}
+
+	slices.SortFunc(blobs, func(a, b BlobInfo) int { return strings.Compare(a.Digest, b.Digest) })
+	return blobs, nil
+}
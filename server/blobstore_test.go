@@ -0,0 +1,495 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// fakeS3 serves a bucket from memory for s3BlobStore
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.objects == nil {
+		f.objects = make(map[string][]byte)
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if fmt.Sprintf("%x", sha256.Sum256(b)) != r.Header.Get("X-Amz-Content-Sha256") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>")
+			return
+		}
+
+		f.objects[key] = b
+	case http.MethodGet, http.MethodHead:
+		if key == "" {
+			type object struct {
+				Key  string
+				Size int64
+			}
+
+			var result struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []object
+			}
+
+			for k, b := range f.objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					result.Contents = append(result.Contents, object{Key: k, Size: int64(len(b))})
+				}
+			}
+
+			xml.NewEncoder(w).Encode(result)
+			return
+		}
+
+		b, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3(t *testing.T) *fakeS3 {
+	t.Helper()
+
+	var f fakeS3
+	srv := httptest.NewServer(&f)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	return &f
+}
+
+func TestBlobStore(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		open func(t *testing.T) BlobStore
+	}{
+		{"memory", func(t *testing.T) BlobStore { return &memoryBlobStore{} }},
+		{"fs", func(t *testing.T) BlobStore { return &fsBlobStore{dir: t.TempDir()} }},
+		{"cache", func(t *testing.T) BlobStore {
+			return &blobCache{local: &fsBlobStore{dir: t.TempDir()}, remote: &memoryBlobStore{}}
+		}},
+		{"s3", func(t *testing.T) BlobStore {
+			newTestS3(t)
+			s, err := newS3BlobStore("s3://bucket/models")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return s
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testBlobStore(t, tt.open(t))
+		})
+	}
+}
+
+func testBlobStore(t *testing.T, s BlobStore) {
+	ctx := context.Background()
+
+	blob := func(s string) (string, []byte) {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s))), []byte(s)
+	}
+
+	a, aBlob := blob("a")
+	b, bBlob := blob("bb")
+
+	if _, err := s.Stat(ctx, a); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing blob to not exist, got %v", err)
+	}
+
+	if _, err := s.Get(ctx, a); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing blob to not exist, got %v", err)
+	}
+
+	if err := s.Put(ctx, a, bytes.NewReader(bBlob)); !errors.Is(err, errBlobDigestMismatch) {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+
+	for _, digest := range []string{"", "sha256:abc", "md5:" + a[7:], "../" + a} {
+		if _, err := s.Stat(ctx, digest); !errors.Is(err, ErrInvalidDigestFormat) {
+			t.Errorf("expected invalid digest %q to be rejected, got %v", digest, err)
+		}
+	}
+
+	if err := s.Put(ctx, a, bytes.NewReader(aBlob)); err != nil {
+		t.Fatal(err)
+	}
+
+	// digests in the form of blob file names are accepted too
+	if err := s.Put(ctx, strings.Replace(b, ":", "-", 1), bytes.NewReader(bBlob)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, aBlob) {
+		t.Errorf("expected %q, got %q", aBlob, got)
+	}
+
+	info, err := s.Stat(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info != (BlobInfo{Digest: b, Size: 2}) {
+		t.Errorf("unexpected blob info %+v", info)
+	}
+
+	blobs, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BlobInfo{{Digest: a, Size: 1}, {Digest: b, Size: 2}}
+	slices.SortFunc(want, func(a, b BlobInfo) int { return strings.Compare(a.Digest, b.Digest) })
+	if !slices.Equal(blobs, want) {
+		t.Errorf("expected %v, got %v", want, blobs)
+	}
+
+	if err := s.Delete(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, a); err != nil {
+		t.Errorf("expected deleting a missing blob to succeed, got %v", err)
+	}
+
+	if _, err := s.Stat(ctx, a); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a deleted blob to not exist, got %v", err)
+	}
+
+	blobs, err = s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(blobs, []BlobInfo{{Digest: b, Size: 2}}) {
+		t.Errorf("expected only %s, got %v", b, blobs)
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	ctx := context.Background()
+	remote := &memoryBlobStore{}
+	c := &blobCache{local: &fsBlobStore{dir: t.TempDir()}, remote: remote}
+
+	info, created, err := c.Create(ctx, strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !created || info.Size != 1 {
+		t.Errorf("expected a new blob of 1 byte, got %+v created %t", info, created)
+	}
+
+	if _, created, err := c.Create(ctx, strings.NewReader("a")); err != nil || created {
+		t.Errorf("expected the blob to exist, got created %t: %v", created, err)
+	}
+
+	if _, err := remote.Stat(ctx, info.Digest); err != nil {
+		t.Errorf("expected the blob to be stored remotely, got %v", err)
+	}
+
+	// evicted blobs stay in the remote store and are fetched again
+	if err := c.Evict(ctx, info.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	if cached, err := c.Cached(ctx); err != nil || len(cached) > 0 {
+		t.Errorf("expected no cached blobs, got %v: %v", cached, err)
+	}
+
+	p, err := c.File(ctx, info.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(p); err != nil || string(b) != "a" {
+		t.Errorf("expected the blob to be fetched, got %q: %v", b, err)
+	}
+}
+
+func TestOpenBlobStore(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	cases := map[string]string{
+		"":                 "*server.fsBlobStore",
+		"fs":               "*server.fsBlobStore",
+		"s3://bucket":      "*server.s3BlobStore",
+		"s3://bucket/a/b/": "*server.s3BlobStore",
+	}
+
+	for spec, want := range cases {
+		s, err := openBlobStore(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+			continue
+		}
+
+		if got := fmt.Sprintf("%T", s); got != want {
+			t.Errorf("%q: expected %s, got %s", spec, want, got)
+		}
+	}
+
+	for _, spec := range []string{"gs://bucket", "s3://", "/tmp/models"} {
+		if _, err := openBlobStore(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}
+
+func TestS3BlobStorage(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	t.Setenv("OLLAMA_STORAGE", "s3://bucket/models")
+	bucket := newTestS3(t)
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nSYSTEM hello", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	local, err := os.ReadDir(filepath.Join(p, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket.mu.Lock()
+	for _, blob := range local {
+		if _, ok := bucket.objects["models/"+blob.Name()]; !ok {
+			t.Errorf("expected %s in the bucket", blob.Name())
+		}
+	}
+	bucket.mu.Unlock()
+
+	// blobs missing from the blobs directory are fetched from the bucket
+	if err := os.RemoveAll(filepath.Join(p, "blobs")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.System != "hello" {
+		t.Errorf("expected system %q, got %q", "hello", m.System)
+	}
+
+	if _, err := os.Stat(m.ModelPath); err != nil {
+		t.Errorf("expected the model to be fetched, got %v", err)
+	}
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Name: "test"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// other servers may use the bucket so only the cached blobs are removed
+	cached, err := os.ReadDir(filepath.Join(p, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cached) > 0 {
+		t.Errorf("expected the blobs directory to be empty, got %d blobs", len(cached))
+	}
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	if len(bucket.objects) != len(local) {
+		t.Errorf("expected the bucket to keep %d objects, got %d", len(local), len(bucket.objects))
+	}
+}
+
+func TestBlobStoreShared(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_STORAGE", "s3://bucket")
+
+	a, err := blobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := blobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a != b {
+		t.Error("expected the blob store to be opened once")
+	}
+
+	if s3, ok := a.remote.(*s3BlobStore); !ok || s3.client != s3Client {
+		t.Errorf("expected an s3 store with the shared client, got %T", a.remote)
+	}
+
+	t.Setenv("OLLAMA_STORAGE", "fs")
+	c, err := blobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c == a || c.remote != nil {
+		t.Errorf("expected a local store once OLLAMA_STORAGE changed, got %+v", c)
+	}
+}
+
+func TestS3RemoteOnlyBlobs(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	t.Setenv("OLLAMA_STORAGE", "s3://bucket/models")
+	newTestS3(t)
+
+	registry, registryURL := newFakeUploadRegistry(t, nil, nil)
+
+	blob := bytes.Repeat([]byte("ollama"), 1024)
+	layer, err := NewLayer(bytes.NewReader(blob), "application/vnd.ollama.image.model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := NewLayer(strings.NewReader(`{"model_format":"gguf"}`), "application/vnd.docker.container.image.v1+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := registryURL.Host + "/library/test:latest"
+	if err := WriteManifest(model.ParseName(name), config, []Layer{layer}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blobs are now only in the bucket
+	if err := os.RemoveAll(filepath.Join(p, "blobs")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	router := s.GenerateRoutes()
+
+	do := func(t *testing.T, method, path string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+		return w
+	}
+
+	t.Run("head", func(t *testing.T) {
+		w := do(t, http.MethodHead, "/api/blobs/"+layer.Digest, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if got, want := w.Header().Get("Content-Length"), fmt.Sprint(len(blob)); got != want {
+			t.Errorf("expected Content-Length %s, got %s", want, got)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		// a blob the bucket has doesn't need to be uploaded again
+		if w := do(t, http.MethodPost, "/api/blobs/"+layer.Digest, nil); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		w := do(t, http.MethodGet, "/api/blobs/"+layer.Digest, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if !bytes.Equal(w.Body.Bytes(), blob) {
+			t.Error("expected the blob from the bucket")
+		}
+	})
+
+	t.Run("push", func(t *testing.T) {
+		if err := os.RemoveAll(filepath.Join(p, "blobs")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := PushModel(context.Background(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); err != nil {
+			t.Fatal(err)
+		}
+
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		if !bytes.Equal(registry.uploaded[layer.Digest], blob) {
+			t.Errorf("expected %s to be pushed from the bucket", layer.Digest)
+		}
+	})
+}
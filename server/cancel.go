@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// inflightRequests tracks the cancel functions of in-flight requests by their
+// client supplied request ID. The zero value is ready to use.
+type inflightRequests struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// add registers cancel for id. It returns a function that removes the
+// registration or false if id is already in use.
+func (r *inflightRequests) add(id string, cancel context.CancelFunc) (func(), bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.cancels[id]; ok {
+		return nil, false
+	}
+
+	if r.cancels == nil {
+		r.cancels = make(map[string]context.CancelFunc)
+	}
+
+	r.cancels[id] = cancel
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.cancels, id)
+	}, true
+}
+
+// cancel cancels the request with id, reporting whether it was in flight
+func (r *inflightRequests) cancel(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the request removes itself once it returns
+	cancel, ok := r.cancels[id]
+	if ok {
+		cancel()
+	}
+
+	return ok
+}
+
+// trackRequest derives the context of a generate or chat request. It is
+// cancelled when the client disconnects, when the handler calls the returned
+// function or, if the request has an ID, when it is cancelled by ID. It
+// responds with an error and returns false if the ID is already in use.
+func (s *Server) trackRequest(c *gin.Context, id string) (context.Context, func(), bool) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	if id == "" {
+		return ctx, cancel, true
+	}
+
+	remove, ok := s.requests.add(id, cancel)
+	if !ok {
+		cancel()
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("request id %q is already in use", id), "code": api.ErrorCodeRequestConflict})
+		return nil, nil, false
+	}
+
+	return ctx, func() {
+		remove()
+		cancel()
+	}, true
+}
+
+func (s *Server) CancelHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !s.requests.cancel(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("request %q not found", id), "code": api.ErrorCodeRequestNotFound})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMinSize is the smallest response body worth compressing
+const compressMinSize = 1024
+
+// compressWriter buffers the response body so it can be compressed once the
+// handler returns
+type compressWriter struct {
+	gin.ResponseWriter
+	b bytes.Buffer
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	return w.b.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.b.WriteString(s)
+}
+
+// compressMiddleware compresses responses with gzip or zstd, as negotiated by
+// the Accept-Encoding header. It buffers the whole response so it must only be
+// used for endpoints that don't stream.
+func compressMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		c.Header("Vary", "Accept-Encoding")
+		if w.b.Len() < compressMinSize {
+			w.ResponseWriter.Write(w.b.Bytes())
+			return
+		}
+
+		var zw io.WriteCloser
+		switch encoding {
+		case "zstd":
+			zw, _ = zstd.NewWriter(w.ResponseWriter)
+		case "gzip":
+			zw = gzip.NewWriter(w.ResponseWriter)
+		}
+
+		c.Header("Content-Encoding", encoding)
+		c.Writer.Header().Del("Content-Length")
+		if _, err := zw.Write(w.b.Bytes()); err != nil {
+			c.Error(err)
+		}
+
+		if err := zw.Close(); err != nil {
+			c.Error(err)
+		}
+	}
+}
+
+// negotiateEncoding returns the supported encoding the Accept-Encoding header
+// prefers, or an empty string if it accepts neither
+func negotiateEncoding(header string) string {
+	var encoding string
+	var weight float64
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "zstd" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+
+			q = f
+		}
+
+		// zstd is preferred when both are accepted equally
+		if q > weight || (q == weight && name == "zstd") {
+			encoding, weight = name, q
+		}
+	}
+
+	if weight <= 0 {
+		return ""
+	}
+
+	return encoding
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestCompressMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var models []api.ListModelResponse
+	for i := range 32 {
+		models = append(models, api.ListModelResponse{
+			Name:       fmt.Sprintf("model-%d:latest", i),
+			Model:      fmt.Sprintf("model-%d:latest", i),
+			ModifiedAt: time.Unix(1686935002, 0).UTC(),
+			Size:       int64(i) << 30,
+			Digest:     fmt.Sprintf("%064d", i),
+		})
+	}
+
+	r := gin.New()
+	r.GET("/large", compressMiddleware(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.ListResponse{Models: models})
+	})
+	r.GET("/small", compressMiddleware(), func(c *gin.Context) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	})
+
+	get := func(t *testing.T, path, acceptEncoding string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	check := func(t *testing.T, body io.Reader) {
+		t.Helper()
+
+		var resp api.ListResponse
+		if err := json.NewDecoder(body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Models, models); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	}
+
+	t.Run("gzip", func(t *testing.T) {
+		w := get(t, "/large", "gzip")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Fatalf("expected gzip encoding, got %q", encoding)
+		}
+
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, zr)
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		w := get(t, "/large", "gzip, zstd")
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "zstd" {
+			t.Fatalf("expected zstd encoding, got %q", encoding)
+		}
+
+		zr, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+
+		check(t, zr)
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		w := get(t, "/large", "")
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			t.Fatalf("expected no encoding, got %q", encoding)
+		}
+
+		check(t, w.Body)
+	})
+
+	t.Run("small", func(t *testing.T) {
+		w := get(t, "/small", "gzip")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			t.Fatalf("expected no encoding, got %q", encoding)
+		}
+
+		if body := w.Body.String(); body != `{"error":"not found"}` {
+			t.Errorf("unexpected body %q", body)
+		}
+	})
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                       "",
+		"identity":               "",
+		"gzip":                   "gzip",
+		"GZIP":                   "gzip",
+		"deflate, gzip;q=1.0, *": "gzip",
+		"gzip, zstd":             "zstd",
+		"zstd;q=0.5, gzip":       "gzip",
+		"gzip;q=0":               "",
+		"br, zstd;q=0.1":         "zstd",
+		"gzip;q=nope":            "",
+	}
+
+	for header, want := range cases {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("%q: expected %q, got %q", header, want, got)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// dockerConfig is the part of a docker config.json with the credentials of
+// registries
+type dockerConfig struct {
+	Auths map[string]struct {
+		// Auth is "username:password" in base64
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+
+	// CredsStore is the credential helper of every registry and CredHelpers
+	// the credential helpers of specific registries
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// registryCredentials returns the credentials of the registry host from the
+// docker style config file of OLLAMA_REGISTRY_AUTH, looking them up with a
+// credential helper if one is configured for host. It returns empty
+// credentials if there are none.
+func registryCredentials(ctx context.Context, host string) (username, password string) {
+	p := envconfig.RegistryAuth()
+	if p == "" {
+		return "", ""
+	}
+
+	bts, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ""
+	} else if err != nil {
+		slog.Warn("couldn't read registry credentials", "path", p, "error", err)
+		return "", ""
+	}
+
+	var config dockerConfig
+	if err := json.Unmarshal(bts, &config); err != nil {
+		slog.Warn("couldn't parse registry credentials", "path", p, "error", err)
+		return "", ""
+	}
+
+	for key, auth := range config.Auths {
+		if registryKeyHost(key) != host {
+			continue
+		}
+
+		if auth.Auth != "" {
+			bts, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				slog.Warn("invalid registry credentials", "registry", key, "error", err)
+				return "", ""
+			}
+
+			username, password, _ = strings.Cut(string(bts), ":")
+			return username, password
+		}
+
+		if auth.Username != "" {
+			return auth.Username, auth.Password
+		}
+	}
+
+	for key, helper := range config.CredHelpers {
+		if registryKeyHost(key) == host {
+			return credentialHelper(ctx, helper, host)
+		}
+	}
+
+	if config.CredsStore != "" {
+		return credentialHelper(ctx, config.CredsStore, host)
+	}
+
+	return "", ""
+}
+
+// registryKeyHost returns the host of a key of a docker config, which may be a
+// URL such as "https://index.docker.io/v1/"
+func registryKeyHost(key string) string {
+	if _, rest, ok := strings.Cut(key, "://"); ok {
+		key = rest
+	}
+
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
+
+// credentialHelper returns the credentials of host from the docker credential
+// helper docker-credential-<helper>
+func credentialHelper(ctx context.Context, helper, host string) (username, password string) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		// helpers fail for registries they have no credentials for
+		slog.Debug("credential helper failed", "helper", helper, "registry", host, "error", err, "stderr", strings.TrimSpace(stderr.String()))
+		return "", ""
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+
+	if err := json.Unmarshal(out, &creds); err != nil {
+		slog.Warn("invalid credential helper output", "helper", helper, "error", err)
+		return "", ""
+	}
+
+	return creds.Username, creds.Secret
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestRegistryCredentials(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("OLLAMA_REGISTRY_AUTH", p)
+
+	config := map[string]any{
+		"auths": map[string]any{
+			"registry.corp.com":          map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte("alice:s3cr:et"))},
+			"https://localhost:5000/v1/": map[string]string{"username": "bob", "password": "hunter2"},
+		},
+		"credHelpers": map[string]string{"helped.corp.com": "test"},
+	}
+
+	bts, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, bts, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "windows" {
+		bin := t.TempDir()
+		helper := "#!/bin/sh\nread host\necho \"{\\\"Username\\\": \\\"carol\\\", \\\"Secret\\\": \\\"$host\\\"}\"\n"
+		if err := os.WriteFile(filepath.Join(bin, "docker-credential-test"), []byte(helper), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+
+	cases := []struct {
+		host               string
+		username, password string
+	}{
+		{"registry.corp.com", "alice", "s3cr:et"},
+		{"localhost:5000", "bob", "hunter2"},
+		{"localhost", "", ""},
+		{"other.corp.com", "", ""},
+	}
+
+	if runtime.GOOS != "windows" {
+		cases = append(cases, struct {
+			host               string
+			username, password string
+		}{"helped.corp.com", "carol", "helped.corp.com"})
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.host, func(t *testing.T) {
+			username, password := registryCredentials(context.Background(), tt.host)
+			if username != tt.username || password != tt.password {
+				t.Errorf("expected %q %q, got %q %q", tt.username, tt.password, username, password)
+			}
+		})
+	}
+
+	t.Run("missing config", func(t *testing.T) {
+		t.Setenv("OLLAMA_REGISTRY_AUTH", filepath.Join(t.TempDir(), "missing.json"))
+		if username, _ := registryCredentials(context.Background(), "registry.corp.com"); username != "" {
+			t.Errorf("expected no credentials, got %q", username)
+		}
+	})
+}
+
+func TestRegistryAuthorization(t *testing.T) {
+	var tokenAuth string
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// a registry with token authentication
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenAuth = r.Header.Get("Authorization")
+		if username, password, ok := r.BasicAuth(); !ok || username != "alice" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Query().Get("scope") != "repository:ns/model:pull" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprint(w, `{"access_token": "token"}`)
+	})
+
+	mux.HandleFunc("/v2/ns/model/manifests/tag", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:ns/model:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, "{}")
+	})
+
+	// a registry with basic authentication
+	mux.HandleFunc("/v2/ns/basic/manifests/tag", func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "alice" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, "{}")
+	})
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("OLLAMA_REGISTRY_AUTH", p)
+	if err := os.WriteFile(p, []byte(fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, u.Host, base64.StdEncoding.EncodeToString([]byte("alice:secret")))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repo := range []string{"model", "basic"} {
+		t.Run(repo, func(t *testing.T) {
+			mp := ParseModelPath(fmt.Sprintf("http://%s/ns/%s:tag", u.Host, repo))
+			regOpts := &registryOptions{Insecure: true}
+			regOpts.credentials(context.Background(), mp)
+
+			resp, err := makeRequestWithRetry(context.Background(), http.MethodGet, mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag), nil, nil, regOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")); tokenAuth != want {
+		t.Errorf("expected the token to be requested with %q, got %q", want, tokenAuth)
+	}
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		mp := ParseModelPath(fmt.Sprintf("http://%s/ns/basic:tag", u.Host))
+		regOpts := &registryOptions{Insecure: true, Username: "alice", Password: "wrong"}
+
+		_, err := makeRequestWithRetry(context.Background(), http.MethodGet, mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag), nil, nil, regOpts)
+		if !errors.Is(err, errUnauthorized) {
+			t.Errorf("expected %v, got %v", errUnauthorized, err)
+		}
+	})
+}
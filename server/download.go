@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -13,6 +14,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -49,6 +51,9 @@ type blobDownload struct {
 	done       chan struct{}
 	err        error
 	references atomic.Int32
+
+	// resumed is set when the download continues from existing partial files
+	resumed bool
 }
 
 type blobDownloadPart struct {
@@ -141,6 +146,18 @@ func (b *blobDownload) Prepare(ctx context.Context, requestURL *url.URL, opts *r
 		b.Parts = append(b.Parts, part)
 	}
 
+	if len(b.Parts) > 0 {
+		slices.SortFunc(b.Parts, func(i, j *blobDownloadPart) int { return cmp.Compare(i.N, j.N) })
+		if err := b.checkParts(); err != nil {
+			slog.Info(fmt.Sprintf("%s partial download is inconsistent, restarting: %v", b.Digest[7:19], err))
+			if err := b.removeParts(); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.resumed = b.Completed.Load() > 0
+
 	if len(b.Parts) == 0 {
 		resp, err := makeRequestWithRetry(ctx, http.MethodHead, requestURL, nil, nil, opts)
 		if err != nil {
@@ -176,6 +193,58 @@ func (b *blobDownload) Prepare(ctx context.Context, requestURL *url.URL, opts *r
 	return nil
 }
 
+// checkParts verifies the parts read from disk describe a contiguous download
+// backed by a partial file of the expected size
+func (b *blobDownload) checkParts() error {
+	var offset, completed int64
+	for i, part := range b.Parts {
+		switch {
+		case part.N != i:
+			return fmt.Errorf("missing part %d", i)
+		case part.Offset != offset:
+			return fmt.Errorf("part %d starts at %d, want %d", part.N, part.Offset, offset)
+		case part.Completed.Load() < 0, part.Completed.Load() > part.Size:
+			return fmt.Errorf("part %d has invalid progress %d", part.N, part.Completed.Load())
+		}
+
+		offset += part.Size
+		completed += part.Completed.Load()
+	}
+
+	if completed > 0 {
+		fi, err := os.Stat(b.Name + "-partial")
+		if err != nil {
+			return err
+		}
+
+		if fi.Size() != b.Total {
+			return fmt.Errorf("partial file is %d bytes, want %d", fi.Size(), b.Total)
+		}
+	}
+
+	return nil
+}
+
+// removeParts deletes any partial files and resets progress so the blob is
+// downloaded from scratch
+func (b *blobDownload) removeParts() error {
+	partFilePaths, err := filepath.Glob(b.Name + "-partial*")
+	if err != nil {
+		return err
+	}
+
+	for _, partFilePath := range partFilePaths {
+		if err := os.Remove(partFilePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	b.Parts = nil
+	b.Total = 0
+	b.Completed.Store(0)
+	return nil
+}
+
 func (b *blobDownload) Run(ctx context.Context, requestURL *url.URL, opts *registryOptions) {
 	defer close(b.done)
 	b.err = b.run(ctx, requestURL, opts)
@@ -209,7 +278,6 @@ func newBackoff(maxBackoff time.Duration) func(ctx context.Context) error {
 
 func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *registryOptions) error {
 	defer blobDownloadManager.Delete(b.Digest)
-	ctx, b.CancelFunc = context.WithCancel(ctx)
 
 	file, err := os.OpenFile(b.Name+"-partial", os.O_CREATE|os.O_RDWR, 0o644)
 	if err != nil {
@@ -278,7 +346,7 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 			var err error
 			for try := 0; try < maxRetries; try++ {
 				w := io.NewOffsetWriter(file, part.StartsAt())
-				err = b.downloadChunk(inner, directURL, w, part)
+				err = b.downloadChunk(inner, directURL, w, part, opts)
 				switch {
 				case errors.Is(err, context.Canceled), errors.Is(err, syscall.ENOSPC):
 					// return immediately if the context is canceled or the device is out of space
@@ -322,7 +390,7 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 	return nil
 }
 
-func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w io.Writer, part *blobDownloadPart) error {
+func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w io.Writer, part *blobDownloadPart, opts *registryOptions) error {
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
@@ -330,12 +398,20 @@ func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w
 			return err
 		}
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.StartsAt(), part.StopsAt()-1))
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := (&http.Client{Transport: opts.transport()}).Do(req)
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
 
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+		case resp.StatusCode == http.StatusOK && part.StartsAt() == 0:
+			// the range was ignored but the body still starts where this part does
+		default:
+			return fmt.Errorf("unexpected status code %d for range %d-%d", resp.StatusCode, part.StartsAt(), part.StopsAt()-1)
+		}
+
 		n, err := io.CopyN(w, io.TeeReader(resp.Body, part), part.Size-part.Completed.Load())
 		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, io.ErrUnexpectedEOF) {
 			// rollback progress
@@ -465,7 +541,13 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 		return false, err
 	}
 
-	fi, err := os.Stat(fp)
+	store, err := blobStore()
+	if err != nil {
+		return false, err
+	}
+
+	// a blob in the blob store doesn't need to be downloaded again
+	info, err := store.Stat(ctx, opts.digest)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
 	case err != nil:
@@ -474,26 +556,60 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 		opts.fn(api.ProgressResponse{
 			Status:    fmt.Sprintf("pulling %s", opts.digest[7:19]),
 			Digest:    opts.digest,
-			Total:     fi.Size(),
-			Completed: fi.Size(),
+			Total:     info.Size,
+			Completed: info.Size,
 		})
 
 		return true, nil
 	}
 
-	data, ok := blobDownloadManager.LoadOrStore(opts.digest, &blobDownload{Name: fp, Digest: opts.digest})
+	// the download is shared by every pull of the blob so it outlives the
+	// context of this one and is canceled once no pull waits for it, such as
+	// when the other downloads of each pull failed
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	data, ok := blobDownloadManager.LoadOrStore(opts.digest, &blobDownload{Name: fp, Digest: opts.digest, CancelFunc: cancel})
 	download := data.(*blobDownload)
-	if !ok {
-		requestURL := opts.mp.BaseURL()
-		requestURL = requestURL.JoinPath("v2", opts.mp.GetNamespaceRepository(), "blobs", opts.digest)
-		if err := download.Prepare(ctx, requestURL, opts.regOpts); err != nil {
+	if ok {
+		cancel()
+	} else {
+		var requestURL *url.URL
+		var regOpts *registryOptions
+		if err := fromRegistry(ctx, opts.mp, opts.regOpts, func(baseURL *url.URL, o *registryOptions) error {
+			requestURL = baseURL.JoinPath("v2", opts.mp.GetNamespaceRepository(), "blobs", opts.digest)
+			regOpts = o
+			return download.Prepare(ctx, requestURL, regOpts)
+		}); err != nil {
 			blobDownloadManager.Delete(opts.digest)
+			cancel()
 			return false, err
 		}
 
-		//nolint:contextcheck
-		go download.Run(context.Background(), requestURL, opts.regOpts)
+		go download.Run(runCtx, requestURL, regOpts)
+	}
+
+	if err := download.Wait(ctx, opts.fn); err != nil {
+		return false, err
+	}
+
+	// a resumed download may have been stitched together from stale partial
+	// data so verify it and fall back to a clean download on mismatch
+	if !ok && download.resumed {
+		if err := verifyBlob(opts.digest); errors.Is(err, errDigestMismatch) {
+			slog.Info(fmt.Sprintf("%s resumed download is corrupt, downloading again: %v", opts.digest[7:19], err))
+			if err := store.Evict(ctx, opts.digest); err != nil {
+				return false, err
+			}
+
+			return downloadBlob(ctx, opts)
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	// the blob was downloaded to the blobs directory
+	if err := store.push(ctx, opts.digest); err != nil {
+		return false, err
 	}
 
-	return false, download.Wait(ctx, opts.fn)
+	return false, nil
 }
@@ -0,0 +1,645 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// fakeBlobRegistry serves blobs by digest, redirecting blob requests to a
+// different hostname as the registry does, and records requested ranges and
+// the number of simultaneous blob requests
+type fakeBlobRegistry struct {
+	blobs map[string][]byte
+
+	// manifest, if set, is served for every tag with its digest in the
+	// Docker-Content-Digest header, or manifestDigest if that's set, unless
+	// noManifestDigest is set. Requests with the manifest's digest in
+	// If-None-Match get a 304, counted by notModified.
+	manifest         []byte
+	manifestDigest   string
+	noManifestDigest bool
+	notModified      int
+
+	// delay holds each blob request open to make overlapping requests observable
+	delay time.Duration
+
+	// missingDelay holds requests for blobs which aren't served open
+	missingDelay time.Duration
+
+	mu        sync.Mutex
+	ranges    []string
+	active    int
+	maxActive int
+}
+
+func (r *fakeBlobRegistry) requestedRanges() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ranges
+}
+
+func newFakeBlobRegistry(t *testing.T, blobs ...[]byte) (*fakeBlobRegistry, *url.URL) {
+	t.Helper()
+
+	r := &fakeBlobRegistry{blobs: make(map[string][]byte)}
+	for _, blob := range blobs {
+		r.blobs[fmt.Sprintf("sha256:%x", sha256.Sum256(blob))] = blob
+	}
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.ranges = append(r.ranges, req.Header.Get("Range"))
+		r.active++
+		r.maxActive = max(r.maxActive, r.active)
+		r.mu.Unlock()
+
+		defer func() {
+			r.mu.Lock()
+			r.active--
+			r.mu.Unlock()
+		}()
+
+		select {
+		case <-time.After(r.delay):
+		case <-req.Context().Done():
+			return
+		}
+
+		blob, ok := r.blobs[path.Base(req.URL.Path)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(blob)))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(blob[start : end+1])
+	}))
+	t.Cleanup(storage.Close)
+
+	// localhost and 127.0.0.1 are different hostnames so the blob redirect
+	// is treated as a direct URL
+	storageURL, err := url.Parse(storage.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageURL.Host = "localhost:" + storageURL.Port()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/manifests/") && r.manifest != nil {
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(r.manifest))
+			if !r.noManifestDigest {
+				w.Header().Set("Docker-Content-Digest", cmp.Or(r.manifestDigest, digest))
+			}
+			w.Header().Set("ETag", `"`+digest+`"`)
+			if req.Header.Get("If-None-Match") == `"`+digest+`"` {
+				r.mu.Lock()
+				r.notModified++
+				r.mu.Unlock()
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			w.Write(r.manifest)
+			return
+		}
+
+		digest := path.Base(req.URL.Path)
+		blob, ok := r.blobs[digest]
+		if !strings.Contains(req.URL.Path, "/blobs/") || !ok {
+			time.Sleep(r.missingDelay)
+			http.NotFound(w, req)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodHead:
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		case http.MethodGet:
+			http.Redirect(w, req, storageURL.JoinPath("blobs", digest).String(), http.StatusTemporaryRedirect)
+		}
+	}))
+	t.Cleanup(registry.Close)
+
+	registryURL, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, registryURL
+}
+
+func TestDownloadBlobResume(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	half := int64(len(blob) / 2)
+
+	// writePartial fabricates an interrupted download with the first half of
+	// the blob committed
+	writePartial := func(t *testing.T, data []byte) string {
+		t.Helper()
+
+		fp, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		partial := make([]byte, len(blob))
+		copy(partial, data[:half])
+		if err := os.WriteFile(fp+"-partial", partial, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		part, err := json.Marshal(jsonBlobDownloadPart{N: 0, Offset: 0, Size: int64(len(blob)), Completed: half})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(fp+"-partial-0", part, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return fp
+	}
+
+	download := func(t *testing.T, registryURL *url.URL) {
+		t.Helper()
+
+		if _, err := downloadBlob(context.Background(), downloadOpts{
+			mp:      ModelPath{ProtocolScheme: "http", Registry: registryURL.Host, Namespace: "library", Repository: "test"},
+			digest:  digest,
+			regOpts: &registryOptions{Insecure: true},
+			fn:      func(api.ProgressResponse) {},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T, fp string) {
+		t.Helper()
+
+		bts, err := os.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(bts, blob) {
+			t.Fatal("downloaded blob does not match")
+		}
+
+		if partials, _ := filepath.Glob(fp + "-partial*"); len(partials) > 0 {
+			t.Fatalf("expected partial files to be removed, got %v", partials)
+		}
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		registry, registryURL := newFakeBlobRegistry(t, blob)
+
+		fp := writePartial(t, blob)
+		download(t, registryURL)
+		check(t, fp)
+
+		want := fmt.Sprintf("bytes=%d-%d", half, len(blob)-1)
+		if ranges := registry.requestedRanges(); len(ranges) != 1 || ranges[0] != want {
+			t.Errorf("expected a single request for %q, got %v", want, ranges)
+		}
+	})
+
+	t.Run("corrupt partial", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		registry, registryURL := newFakeBlobRegistry(t, blob)
+
+		fp := writePartial(t, bytes.Repeat([]byte{'x'}, len(blob)))
+		download(t, registryURL)
+		check(t, fp)
+
+		ranges := registry.requestedRanges()
+		if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=0-%d", len(blob)-1) {
+			t.Errorf("expected a resumed request followed by a full request, got %v", ranges)
+		}
+	})
+
+	t.Run("inconsistent partial", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		registry, registryURL := newFakeBlobRegistry(t, blob)
+
+		fp := writePartial(t, blob)
+		if err := os.Truncate(fp+"-partial", half); err != nil {
+			t.Fatal(err)
+		}
+
+		download(t, registryURL)
+		check(t, fp)
+
+		if ranges := registry.requestedRanges(); len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=0-%d", len(blob)-1) {
+			t.Errorf("expected a single full request, got %v", ranges)
+		}
+	})
+}
+
+func TestDownloadBlobsConcurrency(t *testing.T) {
+	var blobs [][]byte
+	var layers []Layer
+	for i := range 4 {
+		blob := bytes.Repeat([]byte{byte('a' + i)}, 1024)
+		blobs = append(blobs, blob)
+		layers = append(layers, Layer{Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(blob)), Size: int64(len(blob))})
+	}
+
+	for _, limit := range []int{1, 2} {
+		t.Run(strconv.Itoa(limit), func(t *testing.T) {
+			t.Setenv("OLLAMA_MODELS", t.TempDir())
+			t.Setenv("OLLAMA_MAX_PULL_CONCURRENCY", strconv.Itoa(limit))
+
+			registry, registryURL := newFakeBlobRegistry(t, blobs...)
+			registry.delay = 100 * time.Millisecond
+
+			var completed sync.Map
+			skipVerify, err := downloadBlobs(context.Background(),
+				ModelPath{ProtocolScheme: "http", Registry: registryURL.Host, Namespace: "library", Repository: "test"},
+				layers,
+				&registryOptions{Insecure: true},
+				func(resp api.ProgressResponse) {
+					completed.Store(resp.Digest, resp.Completed)
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			registry.mu.Lock()
+			maxActive := registry.maxActive
+			registry.mu.Unlock()
+
+			if maxActive > limit {
+				t.Errorf("expected at most %d simultaneous requests, got %d", limit, maxActive)
+			}
+
+			if limit > 1 && maxActive < 2 {
+				t.Errorf("expected concurrent requests, got %d", maxActive)
+			}
+
+			for i, layer := range layers {
+				if skipVerify[layer.Digest] {
+					t.Errorf("layer %d: expected a download, got a cache hit", i)
+				}
+
+				fp, err := GetBlobsPath(layer.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if bts, err := os.ReadFile(fp); err != nil || !bytes.Equal(bts, blobs[i]) {
+					t.Errorf("layer %d: blob does not match: %v", i, err)
+				}
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		_, registryURL := newFakeBlobRegistry(t, blobs[:2]...)
+
+		missing := Layer{Digest: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))}
+		_, err := downloadBlobs(context.Background(),
+			ModelPath{ProtocolScheme: "http", Registry: registryURL.Host, Namespace: "library", Repository: "test"},
+			append([]Layer{missing}, layers[:2]...),
+			&registryOptions{Insecure: true},
+			func(api.ProgressResponse) {})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected not exist error, got %v", err)
+		}
+	})
+
+	t.Run("error cancels downloads", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		registry, registryURL := newFakeBlobRegistry(t, blobs[0])
+
+		// the download of the blob is held open until the missing blob fails
+		registry.delay = time.Minute
+		registry.missingDelay = 100 * time.Millisecond
+
+		missing := Layer{Digest: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))}
+		_, err := downloadBlobs(context.Background(),
+			ModelPath{ProtocolScheme: "http", Registry: registryURL.Host, Namespace: "library", Repository: "test"},
+			[]Layer{layers[0], missing},
+			&registryOptions{Insecure: true},
+			func(api.ProgressResponse) {})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected not exist error, got %v", err)
+		}
+
+		// a download is removed from the manager once it stops
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, ok := blobDownloadManager.Load(layers[0].Digest); !ok {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatal("expected the download of the other blob to be canceled")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		fp, err := GetBlobsPath(layers[0].Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(fp); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the canceled blob not to be written, got %v", err)
+		}
+	})
+}
+
+func TestPullModelMirrors(t *testing.T) {
+	config := []byte(`{"model_format":"gguf"}`)
+	blob := bytes.Repeat([]byte("mirrored"), 1024)
+
+	manifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		Config:        Layer{MediaType: "application/vnd.docker.container.image.v1+json", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(config)), Size: int64(len(config))},
+		Layers:        []Layer{{MediaType: "application/vnd.ollama.image.model", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(blob)), Size: int64(len(blob))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusBadGateway)
+	}))
+	t.Cleanup(failing.Close)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	pull := func(t *testing.T, mirrors ...string) error {
+		t.Helper()
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		t.Setenv("OLLAMA_REGISTRY_MIRRORS", strings.Join(mirrors, ","))
+		return PullModel(context.Background(), "test", &registryOptions{}, func(api.ProgressResponse) {})
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		registry, registryURL := newFakeBlobRegistry(t, config, blob)
+		registry.manifest = manifest
+
+		if err := pull(t, failing.URL, closed.URL, registryURL.String()); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, digest := range []string{fmt.Sprintf("sha256:%x", sha256.Sum256(config)), fmt.Sprintf("sha256:%x", sha256.Sum256(blob))} {
+			if err := verifyBlob(digest); err != nil {
+				t.Errorf("%s: %v", digest, err)
+			}
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("test")); err != nil {
+			t.Errorf("expected manifest to be written: %v", err)
+		}
+	})
+
+	t.Run("corrupt blob", func(t *testing.T) {
+		registry, registryURL := newFakeBlobRegistry(t, config, blob)
+		registry.manifest = manifest
+		registry.blobs[fmt.Sprintf("sha256:%x", sha256.Sum256(blob))] = bytes.Repeat([]byte("tampered"), 1024)
+
+		if err := pull(t, registryURL.String()); !errors.Is(err, errDigestMismatch) {
+			t.Errorf("expected digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("corrupt manifest", func(t *testing.T) {
+		registry, registryURL := newFakeBlobRegistry(t, config, blob)
+		registry.manifest = manifest
+		registry.manifestDigest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+
+		if err := pull(t, registryURL.String()); !errors.Is(err, errDigestMismatch) {
+			t.Errorf("expected digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("mirror without digest", func(t *testing.T) {
+		tampered, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+			Config:        Layer{MediaType: "application/vnd.docker.container.image.v1+json", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(config)), Size: int64(len(config))},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		registry, registryURL := newFakeBlobRegistry(t, config, blob)
+		registry.manifest = manifest
+
+		t.Run("registry unreachable", func(t *testing.T) {
+			routeDefaultRegistry(t, nil)
+
+			mirror, mirrorURL := newFakeBlobRegistry(t, config, blob)
+			mirror.manifest = tampered
+			mirror.noManifestDigest = true
+
+			// the unverified manifest of the first mirror is skipped
+			if err := pull(t, mirrorURL.String(), registryURL.String()); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := ParseNamedManifest(model.ParseName("test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(m.Layers) != 1 {
+				t.Errorf("expected the manifest of the second mirror, got %d layers", len(m.Layers))
+			}
+		})
+
+		t.Run("registry reachable", func(t *testing.T) {
+			routeDefaultRegistry(t, registryURL)
+
+			mirror, mirrorURL := newFakeBlobRegistry(t, config, blob)
+			mirror.manifest = manifest
+			mirror.noManifestDigest = true
+
+			if err := pull(t, mirrorURL.String()); err != nil {
+				t.Fatal(err)
+			}
+
+			mirror.manifest = tampered
+			if err := pull(t, mirrorURL.String()); !errors.Is(err, errDigestMismatch) {
+				t.Errorf("expected digest mismatch, got %v", err)
+			}
+		})
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, registryURL := newFakeBlobRegistry(t)
+
+		// a mirror that doesn't have the model is authoritative
+		if err := pull(t, registryURL.String()); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected not exist error, got %v", err)
+		}
+	})
+}
+
+// routeDefaultRegistry sends requests for the default registry to u, or fails
+// them if u is nil
+func routeDefaultRegistry(t *testing.T, u *url.URL) {
+	t.Helper()
+
+	transport := http.DefaultTransport
+	t.Cleanup(func() { http.DefaultTransport = transport })
+
+	http.DefaultTransport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Hostname() == DefaultRegistry {
+			if u == nil {
+				return nil, errors.New("registry unreachable")
+			}
+
+			req = req.Clone(req.Context())
+			req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		}
+
+		return transport.RoundTrip(req)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestPullModelUpToDate(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	config := []byte(`{"model_format":"gguf"}`)
+	blob := bytes.Repeat([]byte("current"), 1024)
+	newConfig := []byte(`{"model_format":"gguf","model_family":"llama"}`)
+
+	newManifest := func(config []byte) []byte {
+		t.Helper()
+		bts, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+			Config:        Layer{MediaType: "application/vnd.docker.container.image.v1+json", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(config)), Size: int64(len(config))},
+			Layers:        []Layer{{MediaType: "application/vnd.ollama.image.model", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(blob)), Size: int64(len(blob))}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return bts
+	}
+
+	registry, registryURL := newFakeBlobRegistry(t, config, blob, newConfig)
+	registry.manifest = newManifest(config)
+	t.Setenv("OLLAMA_REGISTRY_MIRRORS", registryURL.String())
+
+	pull := func(t *testing.T) []string {
+		t.Helper()
+		var statuses []string
+		if err := PullModel(context.Background(), "test", &registryOptions{}, func(resp api.ProgressResponse) {
+			if len(statuses) == 0 || statuses[len(statuses)-1] != resp.Status {
+				statuses = append(statuses, resp.Status)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return statuses
+	}
+
+	pull(t)
+	if registry.notModified != 0 {
+		t.Fatalf("expected the first pull to fetch the manifest, got %d not modified", registry.notModified)
+	}
+
+	t.Run("not modified", func(t *testing.T) {
+		requests := len(registry.requestedRanges())
+		statuses := pull(t)
+		if registry.notModified != 1 {
+			t.Errorf("expected a not modified manifest, got %d", registry.notModified)
+		}
+
+		if n := len(registry.requestedRanges()); n != requests {
+			t.Errorf("expected no blob requests, got %d", n-requests)
+		}
+
+		if want := []string{"pulling manifest", "manifest is up to date", "success"}; !slices.Equal(statuses, want) {
+			t.Errorf("expected statuses %v, got %v", want, statuses)
+		}
+	})
+
+	t.Run("missing blob", func(t *testing.T) {
+		fp, err := GetBlobsPath(fmt.Sprintf("sha256:%x", sha256.Sum256(blob)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Remove(fp); err != nil {
+			t.Fatal(err)
+		}
+
+		notModified := registry.notModified
+		pull(t)
+		if registry.notModified != notModified {
+			t.Error("expected the manifest to be fetched again")
+		}
+
+		if err := verifyBlob(fmt.Sprintf("sha256:%x", sha256.Sum256(blob))); err != nil {
+			t.Errorf("expected the blob to be downloaded again: %v", err)
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		registry.manifest = newManifest(newConfig)
+		notModified := registry.notModified
+
+		pull(t)
+		if registry.notModified != notModified {
+			t.Error("expected the changed manifest to be fetched")
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := fmt.Sprintf("sha256:%x", sha256.Sum256(newConfig)); m.Config.Digest != want {
+			t.Errorf("expected config %s, got %s", want, m.Config.Digest)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// eventBufferSize is the number of events a subscriber may fall behind by
+// before it is dropped
+const eventBufferSize = 64
+
+// eventBroker fans out scheduler events to subscribers. Publishing never
+// blocks: a subscriber whose buffer is full is dropped and its channel closed.
+// The zero value is ready to use.
+type eventBroker struct {
+	mu     sync.Mutex
+	subs   map[chan api.EventResponse]struct{}
+	closed bool
+}
+
+// subscribe registers a new subscriber. The returned function unsubscribes
+// and must be called once the subscriber is done.
+func (b *eventBroker) subscribe() (<-chan api.EventResponse, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs == nil {
+		b.subs = make(map[chan api.EventResponse]struct{})
+	}
+
+	ch := make(chan api.EventResponse, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBroker) publish(typ, model string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := api.EventResponse{Type: typ, Model: model, Timestamp: time.Now()}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("dropping slow event subscriber")
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close closes the channels of all subscribers and of any that subscribe
+// later so their streams end, e.g. when the server shuts down
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestEventBroker(t *testing.T) {
+	var b eventBroker
+
+	fast, unsubscribeFast := b.subscribe()
+	defer unsubscribeFast()
+
+	slow, unsubscribeSlow := b.subscribe()
+	defer unsubscribeSlow()
+
+	for i := range eventBufferSize + 1 {
+		b.publish("load", fmt.Sprintf("model-%d", i))
+
+		// drain the fast subscriber so only the slow one falls behind
+		if e := <-fast; e.Model != fmt.Sprintf("model-%d", i) {
+			t.Fatalf("expected model-%d, got %s", i, e.Model)
+		}
+	}
+
+	var n int
+	for range slow {
+		n++
+	}
+
+	if n != eventBufferSize {
+		t.Errorf("expected %d buffered events before the slow subscriber was dropped, got %d", eventBufferSize, n)
+	}
+
+	b.publish("unload", "model")
+	if e, ok := <-fast; !ok || e.Type != "unload" {
+		t.Errorf("expected fast subscriber to receive unload, got %v", e)
+	}
+}
+
+func TestEventBrokerClose(t *testing.T) {
+	var b eventBroker
+
+	ch, unsubscribe := b.subscribe()
+	defer unsubscribe()
+
+	b.close()
+	if _, ok := <-ch; ok {
+		t.Error("expected subscriber channel to be closed")
+	}
+
+	late, unsubscribeLate := b.subscribe()
+	defer unsubscribeLate()
+
+	if _, ok := <-late; ok {
+		t.Error("expected late subscriber channel to be closed")
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockLlm
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     gpu.GetGPUInfo,
+			getCpuFn:     gpu.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+		},
+	}
+	s.sched.loadFn = s.sched.load
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	r := gin.New()
+	r.GET("/api/events", s.EventsHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer reqCancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, ts.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected content type text/event-stream, got %s", ct)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runnerCtx, runnerCancel := context.WithCancel(ctx)
+	defer runnerCancel()
+
+	successCh, errCh := s.sched.GetRunner(runnerCtx, m, api.DefaultOptions(), nil, 0)
+	select {
+	case <-successCh:
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+
+	var types []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+
+		var e api.EventResponse
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Model != m.ShortName {
+			t.Errorf("expected model %s, got %s", m.ShortName, e.Model)
+		}
+
+		if e.Timestamp.IsZero() {
+			t.Error("expected a timestamp")
+		}
+
+		types = append(types, e.Type)
+		if e.Type == "load" {
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading events: %v (received %v)", err, types)
+	}
+
+	if len(types) != 2 || types[0] != "queued" || types[1] != "load" {
+		t.Errorf("expected queued and load events, got %v", types)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+// HealthHandler reports that the server is up. It succeeds as soon as the
+// server is listening, whether or not it's ready to serve models.
+func (s *Server) HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyHandler reports whether the server is ready to serve models, which is
+// once GPUs have been discovered while the models directory is writable
+func (s *Server) ReadyHandler(c *gin.Context) {
+	if !s.discovered.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "discovering GPUs", "code": api.ErrorCodeNotReady})
+		return
+	}
+
+	if err := checkModelsWritable(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("models directory is not writable: %v", err), "code": api.ErrorCodeNotReady})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// discoverGPUs discovers the GPUs models can be loaded on and marks the
+// server ready. Discovery logs any problems with the GPUs it finds.
+func (s *Server) discoverGPUs() {
+	gpus := gpu.GetGPUInfo()
+	gpus.LogDetails()
+	s.discovered.Store(true)
+}
+
+// checkModelsWritable creates and removes a file in the blobs directory to
+// check models can be pulled and created
+func checkModelsWritable() error {
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(blobs, ".ready-*")
+	if err != nil {
+		return err
+	}
+
+	f.Close()
+	return os.Remove(f.Name())
+}
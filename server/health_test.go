@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthAndReady(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := &Server{}
+	router := s.GenerateRoutes()
+
+	status := func(t *testing.T, method, path string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	t.Run("before discovery", func(t *testing.T) {
+		if code := status(t, http.MethodGet, "/health"); code != http.StatusOK {
+			t.Errorf("expected /health status 200, got %d", code)
+		}
+
+		if code := status(t, http.MethodGet, "/ready"); code != http.StatusServiceUnavailable {
+			t.Errorf("expected /ready status 503, got %d", code)
+		}
+	})
+
+	s.discovered.Store(true)
+
+	t.Run("after discovery", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			if code := status(t, method, "/health"); code != http.StatusOK {
+				t.Errorf("%s: expected /health status 200, got %d", method, code)
+			}
+
+			if code := status(t, method, "/ready"); code != http.StatusOK {
+				t.Errorf("%s: expected /ready status 200, got %d", method, code)
+			}
+		}
+	})
+
+	t.Run("models not writable", func(t *testing.T) {
+		// a file in place of the models directory can't be written to, even by root
+		p := filepath.Join(t.TempDir(), "models")
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("OLLAMA_MODELS", p)
+
+		if code := status(t, http.MethodGet, "/health"); code != http.StatusOK {
+			t.Errorf("expected /health status 200, got %d", code)
+		}
+
+		if code := status(t, http.MethodGet, "/ready"); code != http.StatusServiceUnavailable {
+			t.Errorf("expected /ready status 503, got %d", code)
+		}
+	})
+}
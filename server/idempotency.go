@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// idempotencyGrace is how long the result of an operation is kept after it
+// completes for requests retried with the same Idempotency-Key
+const idempotencyGrace = 10 * time.Minute
+
+// operation is a create, pull or push started with an Idempotency-Key. Its
+// latest responses are kept so requests with the same key follow the
+// operation instead of starting another.
+type operation struct {
+	request [sha256.Size]byte
+
+	mu sync.Mutex
+	// responses are the latest progress response and, once the operation
+	// completes, its result. n counts every response added.
+	responses []any
+	n         int
+	done      time.Time
+	// changed is closed and replaced whenever a response is added or the
+	// operation completes
+	changed chan struct{}
+}
+
+// operations keeps operations by Idempotency-Key until idempotencyGrace after
+// they complete. The zero value is ready to use.
+type operations struct {
+	mu  sync.Mutex
+	ops map[string]*operation
+
+	// ctx is the context of every operation, cancelled by cancelAll
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// start returns the operation of key, starting it with fn if there isn't one.
+// It reports whether the operation was started with a different request.
+func (o *operations) start(key string, request [sha256.Size]byte, fn func(ctx context.Context, ch chan<- any)) (*operation, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.expire(time.Now())
+
+	if op, ok := o.ops[key]; ok {
+		return op, op.request == request
+	}
+
+	if o.ops == nil {
+		o.ops = make(map[string]*operation)
+	}
+
+	if o.ctx == nil {
+		o.ctx, o.cancel = context.WithCancel(context.Background())
+	}
+
+	op := &operation{request: request, changed: make(chan struct{})}
+	o.ops[key] = op
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		// the operation outlives the request that started it so retries
+		// can pick it up, but not the server
+		fn(o.ctx, ch)
+	}()
+
+	go func() {
+		for resp := range ch {
+			op.add(resp)
+		}
+
+		op.finish()
+
+		// nothing may start another operation to expire this one
+		time.AfterFunc(idempotencyGrace, func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			o.expire(time.Now())
+		})
+	}()
+
+	return op, true
+}
+
+// cancelAll cancels every operation
+func (o *operations) cancelAll() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.cancel != nil {
+		o.cancel()
+	}
+}
+
+// expire removes the operations completed over idempotencyGrace ago. It's
+// guarded by mu.
+func (o *operations) expire(now time.Time) {
+	for key, op := range o.ops {
+		op.mu.Lock()
+		done := op.done
+		op.mu.Unlock()
+
+		if !done.IsZero() && now.Sub(done) >= idempotencyGrace {
+			delete(o.ops, key)
+		}
+	}
+}
+
+func (op *operation) add(resp any) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if len(op.responses) < 2 {
+		op.responses = append(op.responses, resp)
+	} else {
+		op.responses[0], op.responses[1] = op.responses[1], resp
+	}
+
+	op.n++
+	close(op.changed)
+	op.changed = make(chan struct{})
+}
+
+func (op *operation) finish() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.done = time.Now()
+	close(op.changed)
+}
+
+// follow returns a channel of the responses of op, from the latest one kept,
+// which is closed when op completes or ctx is done. Responses added faster
+// than they're received are skipped but for the latest.
+func (op *operation) follow(ctx context.Context) chan any {
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		for i := 0; ; i++ {
+			op.mu.Lock()
+			for i >= op.n && op.done.IsZero() {
+				changed := op.changed
+				op.mu.Unlock()
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+				}
+
+				op.mu.Lock()
+			}
+
+			if i >= op.n {
+				op.mu.Unlock()
+				return
+			}
+
+			first := op.n - len(op.responses)
+			i = max(i, first)
+			resp := op.responses[i-first]
+			op.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- resp:
+			}
+		}
+	}()
+
+	return ch
+}
+
+// runOperation runs fn in the background and returns the channel of its
+// responses. Requests with an Idempotency-Key header share one operation per
+// key: a retried or concurrent request with the key follows the responses of
+// the operation already started, or returns its result once it's complete,
+// instead of starting another. Reusing a key for a different request aborts
+// c and returns false.
+func (s *Server) runOperation(c *gin.Context, req any, fn func(ctx context.Context, ch chan<- any)) (chan any, bool) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+			fn(c.Request.Context(), ch)
+		}()
+
+		return ch, true
+	}
+
+	bts, err := json.Marshal(req)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": api.ErrorCodeInternal})
+		return nil, false
+	}
+
+	op, ok := s.operations.start(key, sha256.Sum256(append([]byte(c.FullPath()+"\n"), bts...)), fn)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request", "code": api.ErrorCodeRequestConflict})
+		return nil, false
+	}
+
+	return op.follow(c.Request.Context()), true
+}
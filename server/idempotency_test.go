@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestRunOperation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+	var runs atomic.Int32
+	release := make(chan struct{})
+
+	r := gin.New()
+	r.POST("/op", func(c *gin.Context) {
+		var req map[string]any
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		ch, ok := s.runOperation(c, req, func(ctx context.Context, ch chan<- any) {
+			n := runs.Add(1)
+			ch <- api.ProgressResponse{Status: "started"}
+			<-release
+			ch <- api.ProgressResponse{Status: fmt.Sprintf("success %d", n)}
+		})
+		if !ok {
+			return
+		}
+
+		streamResponse(c, ch)
+	})
+
+	do := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/op", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+
+		w := NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.ResponseRecorder
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		responses := make([]*httptest.ResponseRecorder, 2)
+		for i := range responses {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				responses[i] = do("a", `{"name": "test"}`)
+			}()
+		}
+
+		// let both requests start before the operation completes
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if n := runs.Load(); n != 1 {
+			t.Fatalf("expected 1 operation, got %d", n)
+		}
+
+		want := "{\"status\":\"started\"}\n{\"status\":\"success 1\"}\n"
+		for _, w := range responses {
+			if w.Code != http.StatusOK || w.Body.String() != want {
+				t.Errorf("expected %q, got %d %q", want, w.Code, w.Body)
+			}
+		}
+	})
+
+	t.Run("retried", func(t *testing.T) {
+		w := do("a", `{"name": "test"}`)
+		if w.Body.String() != "{\"status\":\"started\"}\n{\"status\":\"success 1\"}\n" {
+			t.Errorf("expected the responses of the first operation, got %q", w.Body)
+		}
+
+		if n := runs.Load(); n != 1 {
+			t.Errorf("expected 1 operation, got %d", n)
+		}
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		w := do("a", `{"name": "other"}`)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status 422, got %d", w.Code)
+		}
+
+		var resp api.StatusError
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != api.ErrorCodeRequestConflict {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeRequestConflict, resp.Code)
+		}
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		do("b", `{"name": "test"}`)
+		if n := runs.Load(); n != 2 {
+			t.Errorf("expected 2 operations, got %d", n)
+		}
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		do("", `{"name": "test"}`)
+		do("", `{"name": "test"}`)
+		if n := runs.Load(); n != 4 {
+			t.Errorf("expected 4 operations, got %d", n)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s.operations.mu.Lock()
+		op := s.operations.ops["a"]
+		s.operations.mu.Unlock()
+
+		op.mu.Lock()
+		op.done = op.done.Add(-idempotencyGrace)
+		op.mu.Unlock()
+
+		do("a", `{"name": "other"}`)
+		if n := runs.Load(); n != 5 {
+			t.Errorf("expected the key to start another operation once expired, got %d operations", n)
+		}
+	})
+}
+
+func TestCreateIdempotencyKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+	router := s.GenerateRoutes()
+
+	body, err := json.Marshal(api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(t *testing.T, key string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/create", strings.NewReader(string(body)))
+		r.Header.Set("Idempotency-Key", key)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	manifest := filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test", "latest")
+
+	create(t, "key")
+	if err := os.Remove(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// a retry returns the result of the first create without creating again
+	create(t, "key")
+	if _, err := os.Stat(manifest); !os.IsNotExist(err) {
+		t.Errorf("expected the retry not to create the model again, got %v", err)
+	}
+
+	create(t, "other")
+	if _, err := os.Stat(manifest); err != nil {
+		t.Errorf("expected another key to create the model, got %v", err)
+	}
+}
+
+func TestOperationKeepsLatestResponses(t *testing.T) {
+	var o operations
+	op, _ := o.start("a", [32]byte{}, func(ctx context.Context, ch chan<- any) {
+		for i := range 100 {
+			ch <- api.ProgressResponse{Status: "pulling", Completed: int64(i)}
+		}
+
+		ch <- api.ProgressResponse{Status: "success"}
+	})
+
+	var got []any
+	for resp := range op.follow(context.Background()) {
+		got = append(got, resp)
+	}
+
+	if n := len(got); n == 0 || fmt.Sprint(got[n-1]) != fmt.Sprint(api.ProgressResponse{Status: "success"}) {
+		t.Fatalf("expected the responses to end with success, got %v", got)
+	}
+
+	op.mu.Lock()
+	kept := len(op.responses)
+	op.mu.Unlock()
+
+	if kept != 2 {
+		t.Errorf("expected 2 responses kept, got %d", kept)
+	}
+
+	// a retry once the operation is complete gets the latest progress and
+	// the result
+	got = nil
+	for resp := range op.follow(context.Background()) {
+		got = append(got, resp)
+	}
+
+	want := []any{api.ProgressResponse{Status: "pulling", Completed: 99}, api.ProgressResponse{Status: "success"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestOperationsCancelAll(t *testing.T) {
+	var o operations
+	op, _ := o.start("a", [32]byte{}, func(ctx context.Context, ch chan<- any) {
+		<-ctx.Done()
+		ch <- gin.H{"error": ctx.Err().Error()}
+	})
+
+	o.cancelAll()
+
+	select {
+	case resp := <-op.follow(context.Background()):
+		if resp.(gin.H)["error"] != context.Canceled.Error() {
+			t.Errorf("expected the operation to be cancelled, got %v", resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the operation to be cancelled")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"cmp"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -13,6 +14,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"os"
@@ -21,6 +23,11 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/auth"
@@ -38,34 +45,62 @@ import (
 var (
 	errCapabilities         = errors.New("does not support")
 	errCapabilityCompletion = errors.New("completion")
+	errCapabilityVision     = errors.New("vision")
 	errCapabilityTools      = errors.New("tools")
+	errCapabilityEmbedding  = errors.New("embedding")
 	errCapabilityInsert     = errors.New("insert")
+	errCapabilityThinking   = errors.New("thinking")
 )
 
 type Capability string
 
 const (
 	CapabilityCompletion = Capability("completion")
+	CapabilityVision     = Capability("vision")
 	CapabilityTools      = Capability("tools")
+	CapabilityEmbedding  = Capability("embedding")
 	CapabilityInsert     = Capability("insert")
+	CapabilityThinking   = Capability("thinking")
 )
 
+// capabilityErrors are the errors of missing capabilities
+var capabilityErrors = map[Capability]error{
+	CapabilityCompletion: errCapabilityCompletion,
+	CapabilityVision:     errCapabilityVision,
+	CapabilityTools:      errCapabilityTools,
+	CapabilityEmbedding:  errCapabilityEmbedding,
+	CapabilityInsert:     errCapabilityInsert,
+	CapabilityThinking:   errCapabilityThinking,
+}
+
 type registryOptions struct {
 	Insecure bool
 	Username string
 	Password string
 	Token    string
 
+	// Mirrors are tried in order before the registry when pulling
+	Mirrors []*url.URL
+	mirror  bool
+
 	CheckRedirect func(req *http.Request, via []*http.Request) error
 }
 
+// credentials sets the credentials of the registry of mp, unless it's the
+// default registry which authenticates requests with the Ollama key
+func (r *registryOptions) credentials(ctx context.Context, mp ModelPath) {
+	if mp.Registry != DefaultRegistry && r.Username == "" {
+		r.Username, r.Password = registryCredentials(ctx, mp.Registry)
+	}
+}
+
 type Model struct {
 	Name           string `json:"name"`
 	Config         ConfigV2
 	ShortName      string
 	ModelPath      string
 	ParentModel    string
-	AdapterPaths   []string
+	Adapters       []llm.Adapter
 	ProjectorPaths []string
 	System         string
 	License        []string
@@ -76,43 +111,92 @@ type Model struct {
 	Template *template.Template
 }
 
+// Capabilities returns the capabilities of the model derived from the
+// metadata of its GGUF, its projectors and its template. A model that
+// can't be decoded is assumed to generate completions.
+func (m *Model) Capabilities() []Capability {
+	var embedding, vision, fim bool
+	kv, err := m.kv()
+	if err != nil {
+		slog.Error("couldn't decode ggml", "error", err)
+	} else {
+		_, embedding = kv[fmt.Sprintf("%s.pooling_type", kv.Architecture())]
+		_, vision = kv[fmt.Sprintf("%s.vision.block_count", kv.Architecture())]
+		_, fim = fimTokens(kv)
+	}
+
+	var vars []string
+	if m.Template != nil {
+		vars = m.Template.Vars()
+	}
+
+	var caps []Capability
+	if !embedding {
+		caps = append(caps, CapabilityCompletion)
+	}
+
+	if vision || len(m.ProjectorPaths) > 0 {
+		caps = append(caps, CapabilityVision)
+	}
+
+	if slices.Contains(vars, "tools") {
+		caps = append(caps, CapabilityTools)
+	}
+
+	if embedding {
+		caps = append(caps, CapabilityEmbedding)
+	}
+
+	if slices.Contains(vars, "suffix") || fim {
+		caps = append(caps, CapabilityInsert)
+	}
+
+	if m.Template != nil {
+		if open, _ := m.Template.ThinkingTags(); open != "" {
+			caps = append(caps, CapabilityThinking)
+		}
+	}
+
+	return caps
+}
+
+// kv returns the metadata of the model's GGUF
+func (m *Model) kv() (llm.KV, error) {
+	f, err := os.Open(m.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// TODO(mxyng): decode the GGML into model to avoid doing this multiple times
+	ggml, _, err := llm.DecodeGGML(f, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return ggml.KV(), nil
+}
+
 // CheckCapabilities checks if the model has the specified capabilities returning an error describing
 // any missing or unknown capabilities
 func (m *Model) CheckCapabilities(caps ...Capability) error {
-	var errs []error
-	for _, cap := range caps {
-		switch cap {
-		case CapabilityCompletion:
-			f, err := os.Open(m.ModelPath)
-			if err != nil {
-				slog.Error("couldn't open model file", "error", err)
-				continue
-			}
-			defer f.Close()
+	if len(caps) == 0 {
+		return nil
+	}
 
-			// TODO(mxyng): decode the GGML into model to avoid doing this multiple times
-			ggml, _, err := llm.DecodeGGML(f, 0)
-			if err != nil {
-				slog.Error("couldn't decode ggml", "error", err)
-				continue
-			}
+	available := m.Capabilities()
 
-			if _, ok := ggml.KV()[fmt.Sprintf("%s.pooling_type", ggml.KV().Architecture())]; ok {
-				errs = append(errs, errCapabilityCompletion)
-			}
-		case CapabilityTools:
-			if !slices.Contains(m.Template.Vars(), "tools") {
-				errs = append(errs, errCapabilityTools)
-			}
-		case CapabilityInsert:
-			vars := m.Template.Vars()
-			if !slices.Contains(vars, "suffix") {
-				errs = append(errs, errCapabilityInsert)
-			}
-		default:
+	var errs []error
+	for _, cap := range caps {
+		err, ok := capabilityErrors[cap]
+		if !ok {
 			slog.Error("unknown capability", "capability", cap)
 			return fmt.Errorf("unknown capability: %s", cap)
 		}
+
+		if !slices.Contains(available, cap) {
+			errs = append(errs, err)
+		}
 	}
 
 	if err := errors.Join(errs...); err != nil {
@@ -130,10 +214,10 @@ func (m *Model) String() string {
 		Args: m.ModelPath,
 	})
 
-	for _, adapter := range m.AdapterPaths {
+	for _, adapter := range m.Adapters {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "adapter",
-			Args: adapter,
+			Args: parser.Adapter(adapter).String(),
 		})
 	}
 
@@ -216,7 +300,7 @@ func GetManifest(mp ModelPath) (*Manifest, string, error) {
 		return nil, "", err
 	}
 
-	f, err := os.Open(fp)
+	f, err := openManifest(fp)
 	if err != nil {
 		return nil, "", err
 	}
@@ -246,13 +330,13 @@ func GetModel(name string) (*Model, error) {
 		Template:  template.DefaultTemplate,
 	}
 
-	if manifest.Config.Digest != "" {
-		filename, err := GetBlobsPath(manifest.Config.Digest)
-		if err != nil {
-			return nil, err
-		}
+	store, err := blobStore()
+	if err != nil {
+		return nil, err
+	}
 
-		configFile, err := os.Open(filename)
+	if manifest.Config.Digest != "" {
+		configFile, err := store.Open(context.Background(), manifest.Config.Digest)
 		if err != nil {
 			return nil, err
 		}
@@ -264,7 +348,8 @@ func GetModel(name string) (*Model, error) {
 	}
 
 	for _, layer := range manifest.Layers {
-		filename, err := GetBlobsPath(layer.Digest)
+		// runners load blobs from the blobs directory
+		filename, err := store.File(context.Background(), layer.Digest)
 		if err != nil {
 			return nil, err
 		}
@@ -278,7 +363,12 @@ func GetModel(name string) (*Model, error) {
 			// TODO: remove this warning in a future version
 			slog.Info("WARNING: model contains embeddings, but embeddings in modelfiles have been deprecated and will be ignored.")
 		case "application/vnd.ollama.image.adapter":
-			model.AdapterPaths = append(model.AdapterPaths, filename)
+			adapter := llm.Adapter{Path: filename, Weight: 1}
+			if layer.Weight != nil {
+				adapter.Weight = *layer.Weight
+			}
+
+			model.Adapters = append(model.Adapters, adapter)
 		case "application/vnd.ollama.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
 		case "application/vnd.ollama.image.prompt",
@@ -357,7 +447,15 @@ func realpath(rel, from string) string {
 	return abspath
 }
 
-func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantization string, modelfile *parser.File, fn func(resp api.ProgressResponse)) (err error) {
+// CreateModel creates the model name from modelfile. A dry run plans the layers
+// of the model, reporting them in the final progress response, without
+// writing anything to the blob store.
+func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantization string, modelfile *parser.File, dryRun bool, fn func(resp api.ProgressResponse)) (err error) {
+	newLayer := NewLayer
+	if dryRun {
+		newLayer = planLayer
+	}
+
 	config := ConfigV2{
 		OS:           "linux",
 		Architecture: "amd64",
@@ -371,26 +469,41 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 	var layers []Layer
 	var baseLayers []*layerGGML
+	metadata, patched := modelfile.Metadata(), false
+	merges, merged := modelfile.Merges(), false
 	for _, c := range modelfile.Commands {
 		mediatype := fmt.Sprintf("application/vnd.ollama.image.%s", c.Name)
 		command := c.Name
 
 		switch command {
 		case "model", "adapter":
-			if name := model.ParseName(c.Args); name.IsValid() && command == "model" {
-				baseLayers, err = parseFromModel(ctx, name, fn)
+			args, weight := c.Args, float32(1)
+			if command == "adapter" {
+				adapter, err := parser.ParseAdapter(c.Args)
+				if err != nil {
+					return err
+				}
+
+				args, weight = adapter.Path, adapter.Weight
+			}
+
+			// adapters are layered on the base model so keep the base layers
+			// for converting later adapters
+			var ls []*layerGGML
+			if name := model.ParseName(args); name.IsValid() && command == "model" {
+				ls, err = parseFromModel(ctx, name, dryRun, fn)
+				if err != nil {
+					return err
+				}
+			} else if strings.HasPrefix(args, "@") {
+				digest := strings.TrimPrefix(args, "@")
+				store, err := blobStore()
 				if err != nil {
 					return err
 				}
-			} else if strings.HasPrefix(c.Args, "@") {
-				digest := strings.TrimPrefix(c.Args, "@")
-				if ib, ok := intermediateBlobs[digest]; ok {
-					p, err := GetBlobsPath(ib)
-					if err != nil {
-						return err
-					}
 
-					if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+				if ib, ok := intermediateBlobs[digest]; ok {
+					if _, err := store.Stat(ctx, ib); errors.Is(err, os.ErrNotExist) {
 						// pass
 					} else if err != nil {
 						return err
@@ -400,25 +513,20 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 					}
 				}
 
-				blobpath, err := GetBlobsPath(digest)
-				if err != nil {
-					return err
-				}
-
-				blob, err := os.Open(blobpath)
+				blob, err := store.Open(ctx, digest)
 				if err != nil {
 					return err
 				}
 				defer blob.Close()
 
-				baseLayers, err = parseFromFile(ctx, command, baseLayers, blob, digest, fn)
+				ls, err = parseFromFile(ctx, command, baseLayers, blob, digest, dryRun, fn)
 				if err != nil {
 					return err
 				}
-			} else if file, err := os.Open(realpath(modelFileDir, c.Args)); err == nil {
+			} else if file, err := os.Open(realpath(modelFileDir, args)); err == nil {
 				defer file.Close()
 
-				baseLayers, err = parseFromFile(ctx, command, baseLayers, file, "", fn)
+				ls, err = parseFromFile(ctx, command, baseLayers, file, "", dryRun, fn)
 				if err != nil {
 					return err
 				}
@@ -426,7 +534,29 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 				return fmt.Errorf("invalid model reference: %s", c.Args)
 			}
 
-			for _, baseLayer := range baseLayers {
+			if command == "model" {
+				baseLayers = ls
+			}
+
+			for _, baseLayer := range ls {
+				if baseLayer.MediaType == "application/vnd.ollama.image.adapter" && command == "adapter" && weight != 1 {
+					baseLayer.Weight = &weight
+				}
+
+				// tensors are merged before quantizing since they must be
+				// of the type of the model's
+				if len(merges) > 0 &&
+					command == "model" &&
+					baseLayer.MediaType == "application/vnd.ollama.image.model" &&
+					baseLayer.GGML != nil &&
+					baseLayer.GGML.Name() == "gguf" {
+					if err := mergeLayers(baseLayer, merges, modelFileDir, dryRun, fn); err != nil {
+						return err
+					}
+
+					merged = true
+				}
+
 				if quantization != "" &&
 					baseLayer.MediaType == "application/vnd.ollama.image.model" &&
 					baseLayer.GGML != nil &&
@@ -438,11 +568,24 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 					ft := baseLayer.GGML.KV().FileType()
 					if !slices.Contains([]string{"F16", "F32"}, ft.String()) {
-						return errors.New("quantization is only supported for F16 and F32 models")
+						return fmt.Errorf("%w: cannot quantize a %s model, quantization is only supported for F16 and F32 models", errBadQuantization, ft)
+					} else if want != ft && dryRun {
+						// the quantized layer isn't known until it's quantized
+						// so plan it with the size of the unquantized layer
+						baseLayer.Layer = Layer{
+							MediaType: baseLayer.MediaType,
+							Size:      baseLayer.Size,
+							status:    fmt.Sprintf("quantizing %s model to %s", ft, quantization),
+						}
 					} else if want != ft {
 						fn(api.ProgressResponse{Status: fmt.Sprintf("quantizing %s model to %s", ft, quantization)})
 
-						blob, err := GetBlobsPath(baseLayer.Digest)
+						store, err := blobStore()
+						if err != nil {
+							return err
+						}
+
+						blob, err := store.File(ctx, baseLayer.Digest)
 						if err != nil {
 							return err
 						}
@@ -454,7 +597,13 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 						defer temp.Close()
 						defer os.Remove(temp.Name())
 
-						if err := llama.Quantize(blob, temp.Name(), uint32(want)); err != nil {
+						if err := llama.Quantize(blob, temp.Name(), uint32(want), func(tensor, total int) {
+							fn(api.ProgressResponse{
+								Status:    fmt.Sprintf("quantizing tensor %d/%d", tensor, total),
+								Total:     int64(total),
+								Completed: int64(tensor),
+							})
+						}); err != nil {
 							return err
 						}
 
@@ -477,6 +626,18 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 					}
 				}
 
+				if len(metadata) > 0 &&
+					command == "model" &&
+					baseLayer.MediaType == "application/vnd.ollama.image.model" &&
+					baseLayer.GGML != nil &&
+					baseLayer.GGML.Name() == "gguf" {
+					if err := overrideMetadata(baseLayer, metadata, dryRun, fn); err != nil {
+						return err
+					}
+
+					patched = true
+				}
+
 				if baseLayer.GGML != nil {
 					config.ModelFormat = cmp.Or(config.ModelFormat, baseLayer.GGML.Name())
 					config.ModelFamily = cmp.Or(config.ModelFamily, baseLayer.GGML.KV().Architecture())
@@ -489,12 +650,17 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			}
 		case "license", "template", "system":
 			if c.Name == "template" {
-				if _, err := template.Parse(c.Args); err != nil {
+				tmpl, err := template.Parse(c.Args)
+				if err != nil {
+					return fmt.Errorf("%w: %s", errBadTemplate, err)
+				}
+
+				if err := tmpl.Validate(); err != nil {
 					return fmt.Errorf("%w: %s", errBadTemplate, err)
 				}
 			}
 
-			if c.Name != "license" {
+			if c.Name != "license" && !dryRun {
 				// replace
 				layers = slices.DeleteFunc(layers, func(layer Layer) bool {
 					if layer.MediaType != mediatype {
@@ -510,7 +676,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			}
 
 			blob := strings.NewReader(c.Args)
-			layer, err := NewLayer(blob, mediatype)
+			layer, err := newLayer(blob, mediatype)
 			if err != nil {
 				return err
 			}
@@ -523,7 +689,14 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			}
 
 			messages = append(messages, &api.Message{Role: role, Content: content})
+		case "merge":
+			// merged into the model layer above
 		default:
+			if strings.HasPrefix(c.Name, parser.MetadataPrefix) {
+				// applied to the model layer above
+				continue
+			}
+
 			ps, err := api.FormatParams(map[string][]string{c.Name: {c.Args}})
 			if err != nil {
 				return err
@@ -541,6 +714,14 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		}
 	}
 
+	if len(metadata) > 0 && !patched {
+		return fmt.Errorf("%w: overriding metadata requires a gguf model", errBadMetadata)
+	}
+
+	if len(merges) > 0 && !merged {
+		return fmt.Errorf("%w: merging tensors requires a gguf model", llm.ErrMergeConflict)
+	}
+
 	var err2 error
 	layers = slices.DeleteFunc(layers, func(layer Layer) bool {
 		switch layer.MediaType {
@@ -588,7 +769,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			return err
 		}
 
-		layer, err := NewLayer(&b, "application/vnd.ollama.image.messages")
+		layer, err := newLayer(&b, "application/vnd.ollama.image.messages")
 		if err != nil {
 			return err
 		}
@@ -602,7 +783,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			return err
 		}
 
-		layer, err := NewLayer(&b, "application/vnd.ollama.image.params")
+		layer, err := newLayer(&b, "application/vnd.ollama.image.params")
 		if err != nil {
 			return err
 		}
@@ -622,7 +803,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		return err
 	}
 
-	configLayer, err := NewLayer(&b, "application/vnd.docker.container.image.v1+json")
+	configLayer, err := newLayer(&b, "application/vnd.docker.container.image.v1+json")
 	if err != nil {
 		return err
 	}
@@ -633,6 +814,21 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		}
 	}
 
+	if dryRun {
+		var planned []api.PlannedLayer
+		for _, layer := range append(layers, configLayer) {
+			planned = append(planned, api.PlannedLayer{
+				MediaType: layer.MediaType,
+				Digest:    layer.Digest,
+				Size:      layer.Size,
+				From:      layer.From,
+			})
+		}
+
+		fn(api.ProgressResponse{Status: "success", Layers: planned})
+		return nil
+	}
+
 	old, _ := ParseNamedManifest(name)
 
 	fn(api.ProgressResponse{Status: "writing manifest"})
@@ -650,7 +846,11 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 	return nil
 }
 
-func CopyModel(src, dst model.Name) error {
+// CopyModel copies the manifest of src to dst. Layers are shared by digest
+// so only the manifest is written, after checking each layer's blob exists.
+// The manifest is written atomically so a cancelled copy leaves no trace of
+// dst.
+func CopyModel(ctx context.Context, src, dst model.Name, fn func(api.ProgressResponse)) error {
 	if !dst.IsFullyQualified() {
 		return model.Unqualified(dst)
 	}
@@ -659,6 +859,7 @@ func CopyModel(src, dst model.Name) error {
 	}
 
 	if src.Filepath() == dst.Filepath() {
+		fn(api.ProgressResponse{Status: "success"})
 		return nil
 	}
 
@@ -672,21 +873,77 @@ func CopyModel(src, dst model.Name) error {
 		return err
 	}
 
-	srcpath := filepath.Join(manifests, src.Filepath())
-	srcfile, err := os.Open(srcpath)
+	srcpath, ok := findModelsFile(filepath.Join("manifests", src.Filepath()))
+	if !ok {
+		srcpath = filepath.Join(manifests, src.Filepath())
+	}
+
+	// copy the bytes of the manifest so its digest is unchanged
+	bts, err := os.ReadFile(srcpath)
 	if err != nil {
 		return err
 	}
-	defer srcfile.Close()
 
-	dstfile, err := os.Create(dstpath)
+	var m Manifest
+	if err := json.Unmarshal(bts, &m); err != nil {
+		return err
+	}
+
+	store, err := blobStore()
 	if err != nil {
 		return err
 	}
-	defer dstfile.Close()
 
-	_, err = io.Copy(dstfile, srcfile)
-	return err
+	for _, layer := range append(m.Layers, m.Config) {
+		if layer.Digest == "" {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := store.Stat(ctx, layer.Digest); err != nil {
+			return fmt.Errorf("layer %s of %s: %v", layer.Digest, src.DisplayShortest(), err)
+		}
+
+		fn(api.ProgressResponse{
+			Status:    fmt.Sprintf("copying %s", layer.Digest[7:19]),
+			Digest:    layer.Digest,
+			Total:     layer.Size,
+			Completed: layer.Size,
+		})
+	}
+
+	fn(api.ProgressResponse{Status: "writing manifest"})
+
+	// the temporary file is outside of the directories manifests are read
+	// from until it's renamed into place
+	temp, err := os.CreateTemp(manifests, ".copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	if _, err := temp.Write(bts); err != nil {
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), dstpath); err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "success"})
+	return nil
 }
 
 func deleteUnusedLayers(deleteMap map[string]struct{}) error {
@@ -703,16 +960,16 @@ func deleteUnusedLayers(deleteMap map[string]struct{}) error {
 		delete(deleteMap, manifest.Config.Digest)
 	}
 
-	// only delete the files which are still in the deleteMap
+	store, err := blobStore()
+	if err != nil {
+		return err
+	}
+
+	// only delete the files which are still in the deleteMap. Blobs are kept
+	// in a remote store since other servers' manifests may use them.
 	for k := range deleteMap {
-		fp, err := GetBlobsPath(k)
-		if err != nil {
-			slog.Info(fmt.Sprintf("couldn't get file path for '%s': %v", k, err))
-			continue
-		}
-		if err := os.Remove(fp); err != nil {
-			slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", fp, err))
-			continue
+		if err := store.Evict(context.Background(), k); err != nil {
+			slog.Info(fmt.Sprintf("couldn't remove blob '%s': %v", k, err))
 		}
 	}
 
@@ -763,6 +1020,58 @@ func PruneLayers() error {
 	return nil
 }
 
+// PruneBlobs removes blobs from the models directory that no manifest
+// references. They're kept in a remote blob store, which other servers may
+// share. Blobs with digests in keep are never removed. It returns the
+// removed blobs or, if dryRun is set, the blobs it would remove. Partial
+// downloads are left alone since they may belong to a pull in progress.
+func PruneBlobs(keep map[string]struct{}, dryRun bool) ([]api.PrunedBlob, error) {
+	store, err := blobStore()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := store.Cached(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	manifests, err := Manifests()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]struct{})
+	for _, m := range manifests {
+		for _, layer := range m.Layers {
+			referenced[layer.Digest] = struct{}{}
+		}
+
+		referenced[m.Config.Digest] = struct{}{}
+	}
+
+	var pruned []api.PrunedBlob
+	for _, blob := range blobs {
+		if _, ok := referenced[blob.Digest]; ok {
+			continue
+		}
+
+		if _, ok := keep[blob.Digest]; ok {
+			continue
+		}
+
+		if !dryRun {
+			if err := store.Evict(context.Background(), blob.Digest); err != nil {
+				return nil, err
+			}
+		}
+
+		pruned = append(pruned, api.PrunedBlob{Digest: blob.Digest, Size: blob.Size})
+	}
+
+	return pruned, nil
+}
+
 func PruneDirectory(path string) error {
 	info, err := os.Lstat(path)
 	if err != nil {
@@ -804,6 +1113,8 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return errors.New("insecure protocol http")
 	}
 
+	regOpts.credentials(ctx, mp)
+
 	manifest, _, err := GetManifest(mp)
 	if err != nil {
 		fn(api.ProgressResponse{Status: "couldn't retrieve manifest"})
@@ -850,7 +1161,7 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	// build deleteMap to prune unused layers
 	deleteMap := make(map[string]struct{})
-	manifest, _, err := GetManifest(mp)
+	manifest, digest, err := GetManifest(mp)
 	if errors.Is(err, os.ErrNotExist) {
 		// noop
 	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -868,11 +1179,23 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return errors.New("insecure protocol http")
 	}
 
+	regOpts.Mirrors = registryMirrors(mp)
+	regOpts.credentials(ctx, mp)
+
 	fn(api.ProgressResponse{Status: "pulling manifest"})
 
-	manifest, err = pullModelManifest(ctx, mp, regOpts)
-	if err != nil {
-		return fmt.Errorf("pull model manifest: %s", err)
+	// a manifest the registry still has is up to date if its blobs are too
+	if manifest == nil || !manifestBlobsExist(manifest) {
+		digest = ""
+	}
+
+	manifest, manifestJSON, err := pullModelManifest(ctx, mp, regOpts, digest)
+	if errors.Is(err, errManifestNotModified) {
+		fn(api.ProgressResponse{Status: "manifest is up to date"})
+		fn(api.ProgressResponse{Status: "success"})
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("pull model manifest: %w", err)
 	}
 
 	var layers []Layer
@@ -881,18 +1204,12 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		layers = append(layers, manifest.Config)
 	}
 
-	skipVerify := make(map[string]bool)
+	skipVerify, err := downloadBlobs(ctx, mp, layers, regOpts, fn)
+	if err != nil {
+		return err
+	}
+
 	for _, layer := range layers {
-		cacheHit, err := downloadBlob(ctx, downloadOpts{
-			mp:      mp,
-			digest:  layer.Digest,
-			regOpts: regOpts,
-			fn:      fn,
-		})
-		if err != nil {
-			return err
-		}
-		skipVerify[layer.Digest] = cacheHit
 		delete(deleteMap, layer.Digest)
 	}
 	delete(deleteMap, manifest.Config.Digest)
@@ -905,13 +1222,11 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		if err := verifyBlob(layer.Digest); err != nil {
 			if errors.Is(err, errDigestMismatch) {
 				// something went wrong, delete the blob
-				fp, err := GetBlobsPath(layer.Digest)
-				if err != nil {
+				if store, err := blobStore(); err != nil {
 					return err
-				}
-				if err := os.Remove(fp); err != nil {
+				} else if err := store.Evict(ctx, layer.Digest); err != nil {
 					// log this, but return the original error
-					slog.Info(fmt.Sprintf("couldn't remove file with digest mismatch '%s': %v", fp, err))
+					slog.Info(fmt.Sprintf("couldn't remove blob with digest mismatch '%s': %v", layer.Digest, err))
 				}
 			}
 			return err
@@ -920,12 +1235,8 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	fn(api.ProgressResponse{Status: "writing manifest"})
 
-	manifestJSON, err := json.Marshal(manifest)
-	if err != nil {
-		return err
-	}
-
-	fp, err := mp.GetManifestPath()
+	// write the manifest as served so its digest matches the registry's
+	fp, err := mp.writableManifestPath()
 	if err != nil {
 		return err
 	}
@@ -951,23 +1262,158 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	return nil
 }
 
-func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*Manifest, error) {
+// downloadBlobs downloads layers concurrently, at most OLLAMA_MAX_PULL_CONCURRENCY
+// at a time, and reports which were already present. The first error cancels
+// the remaining downloads and is returned.
+func downloadBlobs(ctx context.Context, mp ModelPath, layers []Layer, regOpts *registryOptions, fn func(api.ProgressResponse)) (map[string]bool, error) {
+	var mu sync.Mutex
+	skipVerify := make(map[string]bool)
+
+	// progress is reported from every worker so serialize calls to fn
+	progress := func(resp api.ProgressResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn(resp)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(int(max(envconfig.MaxPullConcurrency(), 1)))
+	for _, layer := range layers {
+		g.Go(func() error {
+			// registry options hold the auth token which is refreshed per request
+			opts := *regOpts
+			cacheHit, err := downloadBlob(ctx, downloadOpts{
+				mp:      mp,
+				digest:  layer.Digest,
+				regOpts: &opts,
+				fn:      progress,
+			})
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			skipVerify[layer.Digest] = cacheHit
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return skipVerify, nil
+}
+
+// errManifestNotModified is returned by pullModelManifest when the manifest
+// in the registry has the digest of the local one
+var errManifestNotModified = errors.New("manifest not modified")
+
+// pullModelManifest returns the manifest of mp in the registry and its JSON.
+// If digest, the hex digest of the local manifest, is set, the manifest is
+// requested only if it doesn't match.
+func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions, digest string) (*Manifest, []byte, error) {
+	registryOpts := regOpts
+
+	var m Manifest
+	var bts []byte
+	if err := fromRegistry(ctx, mp, regOpts, func(baseURL *url.URL, regOpts *registryOptions) error {
+		requestURL := baseURL.JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+
+		headers := make(http.Header)
+		headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+		if digest != "" {
+			headers.Set("If-None-Match", `"sha256:`+digest+`"`)
+		}
+
+		resp, err := makeRequestWithRetry(ctx, http.MethodGet, requestURL, headers, nil, regOpts)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			return errManifestNotModified
+		}
+
+		bts, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		// blobs are verified against the manifest's digests so make sure
+		// the mirror didn't change the manifest itself, asking the registry
+		// for the digest if the mirror doesn't send it
+		if regOpts.mirror {
+			want := resp.Header.Get("Docker-Content-Digest")
+			if want == "" {
+				if want, err = registryManifestDigest(ctx, mp, registryOpts); err != nil {
+					return fmt.Errorf("%w: manifest from %s: %w", errManifestUnverified, baseURL.Redacted(), err)
+				}
+			}
+
+			if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(bts)); actual != want {
+				return fmt.Errorf("%w: manifest from %s: want %s, got %s", errDigestMismatch, baseURL.Redacted(), want, actual)
+			}
+		}
+
+		return json.Unmarshal(bts, &m)
+	}); errors.Is(err, os.ErrNotExist) {
+		return nil, nil, manifestNotFoundError{err}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return &m, bts, nil
+}
+
+// errManifestUnverified is returned by pullModelManifest when a mirror
+// doesn't send the digest of the manifest and the registry can't be asked
+// for it
+var errManifestUnverified = errors.New("manifest digest unknown")
+
+// registryManifestDigest returns the digest of the manifest of mp in its
+// registry, bypassing mirrors
+func registryManifestDigest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (string, error) {
 	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
 
 	headers := make(http.Header)
 	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-	resp, err := makeRequestWithRetry(ctx, http.MethodGet, requestURL, headers, nil, regOpts)
+	resp, err := makeRequestWithRetry(ctx, http.MethodHead, requestURL, headers, nil, regOpts)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
 
-	var m Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return nil, err
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.New("registry didn't send the manifest digest")
+	}
+
+	return digest, nil
+}
+
+// manifestBlobsExist reports whether the blobs of the layers and config of m
+// are in the blob store
+func manifestBlobsExist(m *Manifest) bool {
+	store, err := blobStore()
+	if err != nil {
+		return false
+	}
+
+	layers := m.Layers
+	if m.Config.Digest != "" {
+		layers = append(slices.Clip(layers), m.Config)
 	}
 
-	return &m, err
+	for _, layer := range layers {
+		if _, err := store.Stat(context.Background(), layer.Digest); err != nil {
+			return false
+		}
+	}
+
+	return true
 }
 
 // GetSHA256Digest returns the SHA256 hash of a given buffer and returns it, and the size of buffer
@@ -1012,10 +1458,20 @@ func getTokenSubject(token string) string {
 	return fmt.Sprintf("%s", sub)
 }
 
+// registryError is an error response from a registry
+type registryError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *registryError) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
+
 func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.ReadSeeker, regOpts *registryOptions) (*http.Response, error) {
 	anonymous := true // access will default to anonymous if no user is found associated with the public key
 	for range 2 {
-		resp, err := makeRequest(ctx, method, requestURL, headers, body, regOpts)
+		resp, err := makeRequestWithBackoff(ctx, method, requestURL, headers, body, regOpts)
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
 				slog.Info(fmt.Sprintf("request failed: %v", err))
@@ -1028,9 +1484,14 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 		case resp.StatusCode == http.StatusUnauthorized:
 			resp.Body.Close()
 
+			// registries with basic authentication reject the credentials as is
+			if authenticate := resp.Header.Get("www-authenticate"); strings.HasPrefix(strings.ToLower(authenticate), "basic") {
+				return nil, errUnauthorized
+			}
+
 			// Handle authentication error with one retry
 			challenge := parseRegistryChallenge(resp.Header.Get("www-authenticate"))
-			token, err := getAuthorizationToken(ctx, challenge)
+			token, err := getAuthorizationToken(ctx, challenge, regOpts)
 			if err != nil {
 				return nil, err
 			}
@@ -1049,15 +1510,15 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 			defer resp.Body.Close()
 			responseBody, err := io.ReadAll(resp.Body)
 			if err != nil {
-				return nil, fmt.Errorf("%d: %s", resp.StatusCode, err)
+				return nil, &registryError{StatusCode: resp.StatusCode, Message: err.Error()}
 			}
-			return nil, fmt.Errorf("%d: %s", resp.StatusCode, responseBody)
+			return nil, &registryError{StatusCode: resp.StatusCode, Message: string(responseBody)}
 		default:
 			return resp, nil
 		}
 	}
 
-	if anonymous {
+	if anonymous && regOpts.Username == "" {
 		// no user is associated with the public key, and the request requires non-anonymous access
 		pubKey, nestedErr := auth.GetPublicKey()
 		if nestedErr != nil {
@@ -1070,8 +1531,99 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 	return nil, errUnauthorized
 }
 
+var (
+	// retryBaseDelay is the delay before the first retry of a rate limited
+	// request, doubled for each further retry up to retryMaxDelay
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+
+	// retryMaxElapsed is how long a request is retried for in total
+	retryMaxElapsed = 2 * time.Minute
+)
+
+// makeRequestWithBackoff makes a request, retrying up to OLLAMA_PULL_RETRIES
+// attempts while the registry responds that it's rate limiting or temporarily
+// unavailable. Retries wait with exponential backoff and full jitter, or as
+// long as the Retry-After header says, until retryMaxElapsed has passed.
+func makeRequestWithBackoff(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.ReadSeeker, regOpts *registryOptions) (*http.Response, error) {
+	start := time.Now()
+	attempts := max(envconfig.PullRetries(), 1)
+	for attempt := uint(1); ; attempt++ {
+		resp, err := makeRequest(ctx, method, requestURL, headers, body, regOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		if attempt >= attempts || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+			return resp, nil
+		}
+
+		delay := retryDelay(attempt, resp.Header.Get("Retry-After"))
+		if time.Since(start)+delay > retryMaxElapsed {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		slog.Info("registry request failed, retrying", "url", requestURL.Redacted(), "status", resp.Status, "attempt", attempt, "delay", delay)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying after attempt. A
+// Retry-After header in seconds or as an HTTP date takes precedence over the
+// exponential backoff.
+func retryDelay(attempt uint, retryAfter string) time.Duration {
+	if n, err := strconv.Atoi(retryAfter); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	d := retryMaxDelay
+	if shift := attempt - 1; shift < 32 {
+		d = min(retryBaseDelay<<shift, retryMaxDelay)
+	}
+
+	// full jitter spreads out clients that were rate limited at the same time
+	return time.Duration(rand.Int64N(int64(d) + 1))
+}
+
+// insecureTransport is the transport of requests with registryOptions.Insecure
+// which doesn't verify the certificates of registries. It's separate from the
+// default transport so only those requests skip verification.
+var insecureTransport = sync.OnceValue(func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	return t
+})
+
+// plainHTTPHosts are the hosts of insecure registries known to not speak TLS
+var plainHTTPHosts sync.Map
+
+// transport returns the transport of requests to a registry with r
+func (r *registryOptions) transport() http.RoundTripper {
+	if r != nil && r.Insecure {
+		return insecureTransport()
+	}
+
+	return http.DefaultTransport
+}
+
 func makeRequest(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.Reader, regOpts *registryOptions) (*http.Response, error) {
-	if requestURL.Scheme != "http" && regOpts != nil && regOpts.Insecure {
+	if _, ok := plainHTTPHosts.Load(requestURL.Host); ok && requestURL.Scheme != "http" && regOpts != nil && regOpts.Insecure {
 		requestURL.Scheme = "http"
 	}
 
@@ -1105,8 +1657,14 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 
 	resp, err := (&http.Client{
 		CheckRedirect: regOpts.CheckRedirect,
+		Transport:     regOpts.transport(),
 	}).Do(req)
-	if err != nil {
+	if errors.Is(err, http.ErrSchemeMismatch) && regOpts.Insecure {
+		// the handshake failed before the body was read so it can be sent
+		// again over http
+		plainHTTPHosts.Store(requestURL.Host, true)
+		return makeRequest(ctx, method, requestURL, headers, body, regOpts)
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -1149,12 +1707,12 @@ func parseRegistryChallenge(authStr string) registryChallenge {
 var errDigestMismatch = errors.New("digest mismatch, file must be downloaded again")
 
 func verifyBlob(digest string) error {
-	fp, err := GetBlobsPath(digest)
+	store, err := blobStore()
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Open(fp)
+	f, err := store.Get(context.Background(), digest)
 	if err != nil {
 		return err
 	}
@@ -1167,3 +1725,86 @@ func verifyBlob(digest string) error {
 
 	return nil
 }
+
+var errModelCorrupted = errors.New("model is corrupted, pull it again")
+
+// verifiedBlobs caches the size and modification time of blobs that matched
+// their digests so unchanged blobs aren't hashed on every load
+var verifiedBlobs = struct {
+	sync.Mutex
+	m map[string]blobStat
+}{m: make(map[string]blobStat)}
+
+// verifyingBlobs groups the checks of blobs by path
+var verifyingBlobs singleflight.Group
+
+type blobStat struct {
+	size    int64
+	modTime time.Time
+}
+
+// verifyBlobs checks that the blobs the runner loads for the model match their
+// digests. Verification is skipped if OLLAMA_SKIP_VERIFY is set.
+func (m *Model) verifyBlobs() error {
+	if envconfig.SkipVerify() {
+		return nil
+	}
+
+	paths := []string{m.ModelPath}
+	for _, adapter := range m.Adapters {
+		paths = append(paths, adapter.Path)
+	}
+	paths = append(paths, m.ProjectorPaths...)
+
+	for _, p := range paths {
+		if err := verifyBlobPath(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyBlobPath checks that the blob at p matches the digest it's named
+// after. Files that aren't named after a digest aren't checked.
+func verifyBlobPath(p string) error {
+	digest, ok := strings.CutPrefix(filepath.Base(p), "sha256-")
+	if !ok {
+		return nil
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	stat := blobStat{size: fi.Size(), modTime: fi.ModTime()}
+
+	verifiedBlobs.Lock()
+	verified := verifiedBlobs.m[p] == stat
+	verifiedBlobs.Unlock()
+	if verified {
+		return nil
+	}
+
+	// concurrent requests for a blob share one check
+	_, err, _ = verifyingBlobs.Do(p, func() (any, error) {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+
+		fileDigest, _ := GetSHA256Digest(f)
+		f.Close()
+		if fileDigest != "sha256:"+digest {
+			return nil, fmt.Errorf("%w: blob sha256:%s does not match its digest", errModelCorrupted, digest)
+		}
+
+		verifiedBlobs.Lock()
+		verifiedBlobs.m[p] = stat
+		verifiedBlobs.Unlock()
+		return nil, nil
+	})
+
+	return err
+}
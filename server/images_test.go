@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMakeRequestWithRetryBackoff(t *testing.T) {
+	retryBaseDelay, retryMaxDelay = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { retryBaseDelay, retryMaxDelay = time.Second, 30*time.Second })
+
+	// newRegistry returns a registry that fails the first n requests with status
+	newRegistry := func(t *testing.T, n int32, status int, retryAfter string) (*url.URL, *atomic.Int32) {
+		t.Helper()
+
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) <= n {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(status)
+				return
+			}
+
+			w.Write([]byte("ok"))
+		}))
+		t.Cleanup(srv.Close)
+
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return u, &requests
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		u, requests := newRegistry(t, 2, http.StatusTooManyRequests, "")
+
+		resp, err := makeRequestWithRetry(context.Background(), http.MethodGet, u, nil, nil, &registryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %d", resp.StatusCode)
+		}
+
+		if n := requests.Load(); n != 3 {
+			t.Errorf("expected 3 requests, got %d", n)
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		u, requests := newRegistry(t, 1, http.StatusServiceUnavailable, "0")
+
+		resp, err := makeRequestWithRetry(context.Background(), http.MethodGet, u, nil, nil, &registryOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if n := requests.Load(); n != 2 {
+			t.Errorf("expected 2 requests, got %d", n)
+		}
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		t.Setenv("OLLAMA_PULL_RETRIES", "2")
+		u, requests := newRegistry(t, 5, http.StatusTooManyRequests, "")
+
+		_, err := makeRequestWithRetry(context.Background(), http.MethodGet, u, nil, nil, &registryOptions{})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+
+		if n := requests.Load(); n != 2 {
+			t.Errorf("expected 2 requests, got %d", n)
+		}
+	})
+
+	t.Run("max elapsed", func(t *testing.T) {
+		u, requests := newRegistry(t, 5, http.StatusTooManyRequests, "3600")
+
+		start := time.Now()
+		if _, err := makeRequestWithRetry(context.Background(), http.MethodGet, u, nil, nil, &registryOptions{}); err == nil {
+			t.Fatal("expected an error")
+		}
+
+		if time.Since(start) > time.Second {
+			t.Errorf("expected a Retry-After beyond the max elapsed time to fail immediately, took %s", time.Since(start))
+		}
+
+		if n := requests.Load(); n != 1 {
+			t.Errorf("expected 1 request, got %d", n)
+		}
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		u, requests := newRegistry(t, 1, http.StatusInternalServerError, "")
+
+		if _, err := makeRequestWithRetry(context.Background(), http.MethodGet, u, nil, nil, &registryOptions{}); err == nil {
+			t.Fatal("expected an error")
+		}
+
+		if n := requests.Load(); n != 1 {
+			t.Errorf("expected 1 request, got %d", n)
+		}
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	if d := retryDelay(1, "7"); d != 7*time.Second {
+		t.Errorf("expected Retry-After seconds to be honored, got %s", d)
+	}
+
+	if d := retryDelay(1, time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d < 58*time.Second || d > time.Minute {
+		t.Errorf("expected Retry-After date to be honored, got %s", d)
+	}
+
+	for attempt := uint(1); attempt < 100; attempt++ {
+		want := min(retryBaseDelay<<min(attempt-1, 31), retryMaxDelay)
+		if d := retryDelay(attempt, ""); d < 0 || d > want {
+			t.Errorf("attempt %d: expected a delay up to %s, got %s", attempt, want, d)
+		}
+	}
+}
+
+func TestMakeRequestInsecure(t *testing.T) {
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer tlsSrv.Close()
+
+	plainSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer plainSrv.Close()
+
+	get := func(t *testing.T, rawURL string, insecure bool) error {
+		t.Helper()
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := makeRequest(context.Background(), http.MethodGet, u, nil, nil, &registryOptions{Insecure: insecure})
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+
+	var certErr *tls.CertificateVerificationError
+	if err := get(t, tlsSrv.URL, false); !errors.As(err, &certErr) {
+		t.Errorf("expected the self-signed certificate to be rejected, got %v", err)
+	}
+
+	if err := get(t, tlsSrv.URL, true); err != nil {
+		t.Errorf("expected an insecure request to skip verification, got %v", err)
+	}
+
+	// the flag only applies to the request it's set for
+	if err := get(t, tlsSrv.URL, false); !errors.As(err, &certErr) {
+		t.Errorf("expected the certificate to be verified again, got %v", err)
+	}
+
+	// insecure registries that don't speak TLS are used over http
+	plainURL := strings.Replace(plainSrv.URL, "http://", "https://", 1)
+	if err := get(t, plainURL, true); err != nil {
+		t.Errorf("expected an insecure request to fall back to http, got %v", err)
+	}
+
+	if err := get(t, plainURL, false); !errors.Is(err, http.ErrSchemeMismatch) {
+		t.Errorf("expected a secure request to require TLS, got %v", err)
+	}
+}
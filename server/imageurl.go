@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+)
+
+var (
+	errBadImageURL   = errors.New("invalid image url")
+	errImageTooLarge = errors.New("image too large")
+	errNotImage      = errors.New("not an image")
+)
+
+// imageURL is an entry of a request's images given by reference instead of
+// base64 encoded data
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+// imageURLMiddleware replaces images given by URL in the images of generate
+// requests and chat messages with the data of the image. http and https URLs
+// and file URLs in OLLAMA_IMAGE_DIR are supported and images are limited to
+// OLLAMA_MAX_IMAGE_SIZE.
+func imageURLMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// most requests inline their images so skip decoding them
+		if !bytes.Contains(body, []byte(`"url"`)) {
+			c.Next()
+			return
+		}
+
+		body, err = resolveImageURLs(c.Request.Context(), body, envconfig.MaxImageSize())
+		switch {
+		case errors.Is(err, errImageTooLarge):
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+		c.Next()
+	}
+}
+
+// resolveImageURLs returns body with the images given by URL in its "images"
+// and the "images" of its "messages" replaced by their data. Malformed
+// bodies are returned unchanged for the handler to reject.
+func resolveImageURLs(ctx context.Context, body []byte, maxSize uint64) ([]byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return body, nil
+	}
+
+	changed, err := resolveImages(ctx, req, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw, ok := req["messages"]; ok {
+		var msgs []map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &msgs); err != nil {
+			return body, nil
+		}
+
+		var changedMessages bool
+		for _, msg := range msgs {
+			ok, err := resolveImages(ctx, msg, maxSize)
+			if err != nil {
+				return nil, err
+			}
+
+			changedMessages = changedMessages || ok
+		}
+
+		if changedMessages {
+			if req["messages"], err = json.Marshal(msgs); err != nil {
+				return nil, err
+			}
+
+			changed = true
+		}
+	}
+
+	if !changed {
+		return body, nil
+	}
+
+	return json.Marshal(req)
+}
+
+// resolveImages replaces the images given by URL in the "images" of v and
+// reports whether any were replaced
+func resolveImages(ctx context.Context, v map[string]json.RawMessage, maxSize uint64) (bool, error) {
+	raw, ok := v["images"]
+	if !ok {
+		return false, nil
+	}
+
+	var images []json.RawMessage
+	if err := json.Unmarshal(raw, &images); err != nil {
+		return false, nil
+	}
+
+	var changed bool
+	for i, image := range images {
+		if !bytes.HasPrefix(bytes.TrimSpace(image), []byte("{")) {
+			continue
+		}
+
+		var ref imageURL
+		if err := json.Unmarshal(image, &ref); err != nil {
+			return false, fmt.Errorf("%w: %w", errBadImageURL, err)
+		}
+
+		data, err := fetchImage(ctx, ref.URL, maxSize)
+		if err != nil {
+			return false, err
+		}
+
+		if images[i], err = json.Marshal(data); err != nil {
+			return false, err
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	var err error
+	v["images"], err = json.Marshal(images)
+	return true, err
+}
+
+// imageClient fetches images given by http and https URL. It only connects
+// to public addresses so requests can't reach hosts internal to the server's
+// network. It doesn't use proxies since only the address of the proxy could
+// be checked then.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+
+				ip, err := netip.ParseAddr(host)
+				if err != nil {
+					return err
+				}
+
+				if ip = ip.Unmap(); ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+					return fmt.Errorf("%w: %s is not a public address", errBadImageURL, host)
+				}
+
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+}
+
+// errImageFile is the only error of images given by file URL which can't be
+// read so requests can't probe the server's filesystem
+var errImageFile = fmt.Errorf("%w: file not found or not allowed", errBadImageURL)
+
+// openImageFile opens the image u refers to, which must be a regular file in
+// OLLAMA_IMAGE_DIR
+func openImageFile(u *url.URL) (*os.File, error) {
+	root := envconfig.ImageDir()
+	if root == "" || (u.Host != "" && u.Host != "localhost") {
+		return nil, errImageFile
+	}
+
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, errImageFile
+	}
+
+	p := u.Path
+	if runtime.GOOS == "windows" {
+		// file:///C:/path/to/image.png
+		p = strings.TrimPrefix(p, "/")
+	}
+
+	// resolve links so the file they point to must also be in root
+	p, err = filepath.EvalSymlinks(filepath.FromSlash(p))
+	if err != nil {
+		return nil, errImageFile
+	}
+
+	if rel, err := filepath.Rel(root, p); err != nil || !filepath.IsLocal(rel) {
+		return nil, errImageFile
+	}
+
+	// opening a FIFO or device could block or never end
+	if fi, err := os.Lstat(p); err != nil || !fi.Mode().IsRegular() {
+		return nil, errImageFile
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, errImageFile
+	}
+
+	return f, nil
+}
+
+// fetchImage reads the image at rawURL, which must be a file URL of an image
+// in OLLAMA_IMAGE_DIR or an http or https URL, no larger than maxSize
+func fetchImage(ctx context.Context, rawURL string, maxSize uint64) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadImageURL, err)
+	}
+
+	var r io.ReadCloser
+	switch u.Scheme {
+	case "file":
+		f, err := openImageFile(u)
+		if err != nil {
+			return nil, err
+		}
+
+		r = f
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadImageURL, err)
+		}
+
+		resp, err := imageClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadImageURL, err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: %s: %s", errBadImageURL, rawURL, resp.Status)
+		}
+
+		r = resp.Body
+	default:
+		return nil, fmt.Errorf("%w: unsupported scheme %q", errBadImageURL, u.Scheme)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(min(maxSize, math.MaxInt64-1))+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadImageURL, err)
+	}
+
+	if uint64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: %s is larger than %s", errImageTooLarge, rawURL, format.HumanBytes2(maxSize))
+	}
+
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return nil, fmt.Errorf("%w: %s", errNotImage, rawURL)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestImageURLMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 56)...)
+
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_IMAGE_DIR", dir)
+
+	p := filepath.Join(dir, "image.png")
+	if err := os.WriteFile(p, png, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "secret.png")
+	if err := os.WriteFile(outside, png, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	toURL := func(p string) string {
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(p)}).String()
+	}
+
+	fileURL := toURL(p)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Write(png)
+		case "/page.html":
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	// the test server listens on a loopback address which imageClient refuses
+	client := imageClient
+	imageClient = s.Client()
+	t.Cleanup(func() { imageClient = client })
+
+	r := gin.New()
+	r.POST("/api/generate", imageURLMiddleware(), func(c *gin.Context) {
+		var req api.GenerateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, req.Images)
+	})
+	r.POST("/api/chat", imageURLMiddleware(), func(c *gin.Context) {
+		var req api.ChatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var images []api.ImageData
+		for _, msg := range req.Messages {
+			images = append(images, msg.Images...)
+		}
+
+		c.JSON(http.StatusOK, images)
+	})
+
+	post := func(t *testing.T, path, body string) ([]api.ImageData, *httptest.ResponseRecorder) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body)))
+
+		var images []api.ImageData
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &images); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return images, w
+	}
+
+	check := func(t *testing.T, images []api.ImageData, w *httptest.ResponseRecorder, want ...[]byte) {
+		t.Helper()
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if len(images) != len(want) {
+			t.Fatalf("expected %d images, got %d", len(want), len(images))
+		}
+
+		for i := range want {
+			if !bytes.Equal(images[i], want[i]) {
+				t.Errorf("image %d: expected %q, got %q", i, want[i], images[i])
+			}
+		}
+	}
+
+	t.Run("file", func(t *testing.T) {
+		images, w := post(t, "/api/generate", fmt.Sprintf(`{"model":"test","images":[{"url":%q}]}`, fileURL))
+		check(t, images, w, png)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		images, w := post(t, "/api/generate", fmt.Sprintf(`{"model":"test","images":[{"url":%q}]}`, s.URL+"/image.png"))
+		check(t, images, w, png)
+	})
+
+	t.Run("inline and chat", func(t *testing.T) {
+		inline, err := json.Marshal(api.ImageData("inline"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		images, w := post(t, "/api/chat", fmt.Sprintf(`{"model":"test","messages":[{"role":"user","content":"what's in the url?","images":[%s,{"url":%q}]}]}`, inline, s.URL+"/image.png"))
+		check(t, images, w, []byte("inline"), png)
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_IMAGE_SIZE", "32B")
+
+		for _, u := range []string{fileURL, s.URL + "/image.png"} {
+			_, w := post(t, "/api/generate", fmt.Sprintf(`{"model":"test","images":[{"url":%q}]}`, u))
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s: expected status 413, got %d: %s", u, w.Code, w.Body)
+			}
+		}
+	})
+
+	t.Run("file disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_IMAGE_DIR", "")
+		_, w := post(t, "/api/generate", fmt.Sprintf(`{"model":"test","images":[{"url":%q}]}`, fileURL))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("file errors", func(t *testing.T) {
+		link := filepath.Join(dir, "link.png")
+		if err := os.Symlink(outside, link); err != nil {
+			t.Skip(err)
+		}
+
+		urls := map[string]string{
+			"outside":   toURL(outside),
+			"traversal": toURL(filepath.Join(dir, "..", filepath.Base(filepath.Dir(outside)), "secret.png")),
+			"symlink":   toURL(link),
+			"missing":   toURL(filepath.Join(dir, "missing.png")),
+			"directory": toURL(dir),
+		}
+
+		for name, u := range urls {
+			_, w := post(t, "/api/generate", fmt.Sprintf(`{"model":"test","images":[{"url":%q}]}`, u))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d: %s", name, w.Code, w.Body)
+			}
+
+			// the error doesn't tell files which exist from those which don't
+			if !strings.Contains(w.Body.String(), errImageFile.Error()) {
+				t.Errorf("%s: expected %q, got %s", name, errImageFile, w.Body)
+			}
+		}
+	})
+
+	t.Run("private address", func(t *testing.T) {
+		imageClient = client
+		defer func() { imageClient = s.Client() }()
+
+		_, err := fetchImage(context.Background(), s.URL+"/image.png", 1024)
+		if !errors.Is(err, errBadImageURL) || !strings.Contains(err.Error(), "not a public address") {
+			t.Errorf("expected a loopback address to be refused, got %v", err)
+		}
+	})
+
+	for name, u := range map[string]string{
+		"unsupported scheme": "ftp://example.com/image.png",
+		"data":               "data:image/png;base64,iVBORw0KGgo=",
+		"not found":          s.URL + "/missing.png",
+		"not an image":       s.URL + "/page.html",
+		"remote file":        "file://example.com/image.png",
+		"empty":              "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, w := post(t, "/api/generate", fmt.Sprintf(`{"model":"test","images":[{"url":%q}]}`, u))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body)
+			}
+
+			var resp struct {
+				Code string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code != api.ErrorCodeInvalidRequest {
+				t.Errorf("expected code %q, got %s", api.ErrorCodeInvalidRequest, w.Body)
+			}
+		})
+	}
+}
+
+func TestImageClientProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		http.Error(w, "unexpected request", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	t.Setenv("HTTPS_PROXY", proxy.URL)
+	t.Setenv("NO_PROXY", "")
+
+	// the environment is only read once by http.ProxyFromEnvironment
+	if transport, ok := imageClient.Transport.(*http.Transport); !ok || transport.Proxy != nil {
+		t.Fatal("expected imageClient not to use a proxy")
+	}
+
+	// the address of the image is checked rather than the proxy's
+	_, err := fetchImage(context.Background(), "http://169.254.169.254/image.png", 1024)
+	if !errors.Is(err, errBadImageURL) || !strings.Contains(err.Error(), "169.254.169.254 is not a public address") {
+		t.Errorf("expected the image's address to be refused, got %v", err)
+	}
+
+	if n := proxied.Load(); n != 0 {
+		t.Errorf("expected no requests through the proxy, got %d", n)
+	}
+}
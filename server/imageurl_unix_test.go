@@ -0,0 +1,28 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestImageURLFIFO(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_IMAGE_DIR", dir)
+
+	fifo := filepath.Join(dir, "fifo.png")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// opening a FIFO without a writer would block
+	u := (&url.URL{Scheme: "file", Path: filepath.ToSlash(fifo)}).String()
+	if _, err := fetchImage(context.Background(), u, 1024); !errors.Is(err, errImageFile) {
+		t.Errorf("expected %v, got %v", errImageFile, err)
+	}
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 )
 
 type Layer struct {
@@ -13,55 +15,85 @@ type Layer struct {
 	Digest    string `json:"digest"`
 	Size      int64  `json:"size"`
 	From      string `json:"from,omitempty"`
-	status    string
+
+	// Weight is the weight an adapter layer is applied with. A nil weight
+	// applies the adapter at full strength.
+	Weight *float32 `json:"weight,omitempty"`
+
+	status string
+
+	// content is the content of a planned layer, which isn't in the blob
+	// store
+	content []byte
 }
 
+// planContentSize is the largest planned layer whose content is kept so it
+// can still be opened, e.g. to merge its parameters
+const planContentSize = 1 << 20
+
 func NewLayer(r io.Reader, mediatype string) (Layer, error) {
-	blobs, err := GetBlobsPath("")
+	store, err := blobStore()
 	if err != nil {
 		return Layer{}, err
 	}
 
-	temp, err := os.CreateTemp(blobs, "sha256-")
+	info, created, err := store.Create(context.Background(), r)
 	if err != nil {
 		return Layer{}, err
 	}
-	defer temp.Close()
-	defer os.Remove(temp.Name())
 
-	sha256sum := sha256.New()
-	n, err := io.Copy(io.MultiWriter(temp, sha256sum), r)
-	if err != nil {
+	status := "using existing layer"
+	if created {
+		status = "creating new layer"
+	}
+
+	return Layer{
+		MediaType: mediatype,
+		Digest:    info.Digest,
+		Size:      info.Size,
+		status:    fmt.Sprintf("%s %s", status, info.Digest),
+	}, nil
+}
+
+// planLayer returns the layer NewLayer would create from r without writing
+// anything to the blob store
+func planLayer(r io.Reader, mediatype string) (Layer, error) {
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, planContentSize+1); err != nil && !errors.Is(err, io.EOF) {
 		return Layer{}, err
 	}
 
-	if err := temp.Close(); err != nil {
+	sha256sum := sha256.New()
+	n, err := io.Copy(sha256sum, io.MultiReader(bytes.NewReader(b.Bytes()), r))
+	if err != nil {
 		return Layer{}, err
 	}
 
 	digest := fmt.Sprintf("sha256:%x", sha256sum.Sum(nil))
-	blob, err := GetBlobsPath(digest)
+	store, err := blobStore()
 	if err != nil {
 		return Layer{}, err
 	}
 
 	status := "using existing layer"
-	if _, err := os.Stat(blob); err != nil {
+	if _, err := store.Stat(context.Background(), digest); errors.Is(err, fs.ErrNotExist) {
 		status = "creating new layer"
-		if err := os.Rename(temp.Name(), blob); err != nil {
-			return Layer{}, err
-		}
-		if err := os.Chmod(blob, 0o644); err != nil {
-			return Layer{}, err
-		}
+	} else if err != nil {
+		return Layer{}, err
 	}
 
-	return Layer{
+	layer := Layer{
 		MediaType: mediatype,
 		Digest:    digest,
 		Size:      n,
 		status:    fmt.Sprintf("%s %s", status, digest),
-	}, nil
+	}
+
+	if n <= planContentSize {
+		layer.content = b.Bytes()
+	}
+
+	return layer, nil
 }
 
 func NewLayerFromLayer(digest, mediatype, from string) (Layer, error) {
@@ -69,12 +101,12 @@ func NewLayerFromLayer(digest, mediatype, from string) (Layer, error) {
 		return Layer{}, errors.New("creating new layer from layer with empty digest")
 	}
 
-	blob, err := GetBlobsPath(digest)
+	store, err := blobStore()
 	if err != nil {
 		return Layer{}, err
 	}
 
-	fi, err := os.Stat(blob)
+	info, err := store.Stat(context.Background(), digest)
 	if err != nil {
 		return Layer{}, err
 	}
@@ -82,23 +114,27 @@ func NewLayerFromLayer(digest, mediatype, from string) (Layer, error) {
 	return Layer{
 		MediaType: mediatype,
 		Digest:    digest,
-		Size:      fi.Size(),
+		Size:      info.Size,
 		From:      from,
 		status:    fmt.Sprintf("using existing layer %s", digest),
 	}, nil
 }
 
 func (l *Layer) Open() (io.ReadSeekCloser, error) {
+	if l.content != nil {
+		return nopCloser{bytes.NewReader(l.content)}, nil
+	}
+
 	if l.Digest == "" {
 		return nil, errors.New("opening layer with empty digest")
 	}
 
-	blob, err := GetBlobsPath(l.Digest)
+	store, err := blobStore()
 	if err != nil {
 		return nil, err
 	}
 
-	return os.Open(blob)
+	return store.Open(context.Background(), l.Digest)
 }
 
 func (l *Layer) Remove() error {
@@ -120,10 +156,19 @@ func (l *Layer) Remove() error {
 		}
 	}
 
-	blob, err := GetBlobsPath(l.Digest)
+	store, err := blobStore()
 	if err != nil {
 		return err
 	}
 
-	return os.Remove(blob)
+	// other servers may use the blob from a remote store too
+	return store.Evict(context.Background(), l.Digest)
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
 }
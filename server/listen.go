@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Listen listens on the TCP address of host or, if its scheme is "unix", on
+// a Unix socket at its path with the permissions of OLLAMA_SOCKET_MODE
+func Listen(host *url.URL) (net.Listener, error) {
+	if host.Scheme != "unix" {
+		return net.Listen("tcp", host.Host)
+	}
+
+	if host.Path == "" {
+		return nil, errors.New("missing unix socket path")
+	}
+
+	// remove a socket left by a server that didn't shut down cleanly
+	if fi, err := os.Lstat(host.Path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", host.Path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", host.Path)
+		}
+
+		if err := os.Remove(host.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", host.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(host.Path, envconfig.SocketMode()); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/version"
+)
+
+func TestListenUnix(t *testing.T) {
+	t.Setenv("OLLAMA_SOCKET_MODE", "0600")
+
+	// socket paths are limited to around 100 bytes so avoid t.TempDir
+	dir, err := os.MkdirTemp("", "ollama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	host := &url.URL{Scheme: "unix", Path: filepath.Join(dir, "ollama.sock")}
+	ln, err := Listen(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(host.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0o600 {
+			t.Errorf("expected a socket with mode 0600, got %s", fi.Mode())
+		}
+	}
+
+	if _, err := Listen(host); err == nil {
+		t.Error("expected an error listening on a socket in use")
+	}
+
+	s := &Server{addr: ln.Addr()}
+	srv := newHTTPServer(s.GenerateRoutes())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	client := api.NewClient(host, http.DefaultClient)
+	v, err := client.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != version.Version {
+		t.Errorf("expected version %q, got %q", version.Version, v)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatal(err)
+	}
+
+	// a socket left by a server that didn't shut down cleanly is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: host.Path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err = Listen(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
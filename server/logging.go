@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// newLogHandler returns the handler of server logs written to w in the
+// format of OLLAMA_LOG_FORMAT at the level of OLLAMA_LOG_LEVEL
+func newLogHandler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level:     envconfig.LogLevel(),
+		AddSource: true,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.SourceKey {
+				source := attr.Value.Any().(*slog.Source)
+				source.File = filepath.Base(source.File)
+			}
+
+			return attr
+		},
+	}
+
+	if envconfig.LogFormat() == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+
+	return slog.NewTextHandler(w, opts)
+}
+
+// logSampleHeader overrides OLLAMA_LOG_SAMPLE for a request, e.g. 1 to log
+// the prompt of a request while others are sampled
+const logSampleHeader = "X-Ollama-Log-Sample"
+
+// logSampled reports whether the prompt and options of a request are logged
+// given r, a random number in [0, 1). A fraction of requests is logged, that
+// of the request's header if it's valid and OLLAMA_LOG_SAMPLE otherwise.
+func logSampled(header string, r float64) bool {
+	fraction := envconfig.LogSample()
+	if header != "" {
+		if f, err := strconv.ParseFloat(header, 64); err == nil && f >= 0 && f <= 1 {
+			fraction = f
+		}
+	}
+
+	return r < fraction
+}
+
+// requestLogMiddleware logs each request with slog. Text logs keep gin's
+// request log instead.
+func requestLogMiddleware() gin.HandlerFunc {
+	if envconfig.LogFormat() != "json" {
+		return gin.Logger()
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		var body *prefixReader
+		if c.Request.Body != nil {
+			body = &prefixReader{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+		}
+
+		c.Next()
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+			"client", c.ClientIP(),
+		}
+
+		if body != nil {
+			if name := requestModel(body.prefix.Bytes()); name != "" {
+				attrs = append(attrs, "model", name)
+			}
+		}
+
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+
+		slog.Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// prefixReadSize is how much of a request body is kept to find its model
+const prefixReadSize = 4 << 10
+
+// prefixReader keeps the first prefixReadSize bytes read from a request body
+type prefixReader struct {
+	io.ReadCloser
+	prefix bytes.Buffer
+}
+
+func (r *prefixReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if room := prefixReadSize - r.prefix.Len(); room > 0 {
+		r.prefix.Write(p[:min(n, room)])
+	}
+
+	return n, err
+}
+
+// requestModel returns the top level "model" or "name" of a JSON request
+// body, which may be truncated
+func requestModel(body []byte) string {
+	d := json.NewDecoder(bytes.NewReader(body))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return ""
+	}
+
+	var name string
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			break
+		}
+
+		var value json.RawMessage
+		if err := d.Decode(&value); err != nil {
+			break
+		}
+
+		switch key {
+		case "model":
+			var s string
+			if json.Unmarshal(value, &s) == nil && s != "" {
+				return s
+			}
+		case "name":
+			_ = json.Unmarshal(value, &name)
+		}
+	}
+
+	return name
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestModel(t *testing.T) {
+	cases := map[string]string{
+		`{"model":"llama3","prompt":"hi"}`:                         "llama3",
+		`{"prompt":"hi","options":{"model":"x"},"model":"llama3"}`: "llama3",
+		`{"name":"llama3"}`:                                        "llama3",
+		`{"name":"old","model":"llama3"}`:                          "llama3",
+		`{"prompt":"a truncated bo`:                                "",
+		`{"model":"llama3","prompt":"a truncated bo`:               "llama3",
+		`["model"]`: "",
+		``:          "",
+	}
+
+	for body, want := range cases {
+		if got := requestModel([]byte(body)); got != want {
+			t.Errorf("%s: expected %q, got %q", body, want, got)
+		}
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_LOG_FORMAT", "json")
+	t.Setenv("OLLAMA_LOG_LEVEL", "debug")
+
+	var b bytes.Buffer
+	logger := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&b)))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+
+	r := gin.New()
+	r.Use(requestLogMiddleware())
+	r.POST("/api/generate", func(c *gin.Context) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		slog.Debug("generating", "model", req.Model)
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model":"llama3","prompt":"hi"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(&b)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("expected a JSON log line, got %q: %v", scanner.Text(), err)
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d", len(lines))
+	}
+
+	if lines[0]["level"] != "DEBUG" || lines[0]["msg"] != "generating" {
+		t.Errorf("unexpected handler log %v", lines[0])
+	}
+
+	if source, ok := lines[0]["source"].(map[string]any); !ok || source["file"] != "logging_test.go" {
+		t.Errorf("expected the source file to be trimmed, got %v", lines[0]["source"])
+	}
+
+	request := lines[1]
+	if request["msg"] != "request" || request["level"] != "INFO" {
+		t.Errorf("unexpected request log %v", request)
+	}
+
+	for key, want := range map[string]any{
+		"method": "POST",
+		"path":   "/api/generate",
+		"status": float64(http.StatusOK),
+		"model":  "llama3",
+	} {
+		if request[key] != want {
+			t.Errorf("expected %s %v, got %v", key, want, request[key])
+		}
+	}
+
+	if _, ok := request["latency"].(float64); !ok {
+		t.Errorf("expected a latency, got %v", request["latency"])
+	}
+}
+
+func TestLogSampled(t *testing.T) {
+	cases := []struct {
+		name   string
+		env    string
+		header string
+		r      float64
+		want   bool
+	}{
+		{name: "default", r: 0.99, want: true},
+		{name: "none", env: "0", r: 0, want: false},
+		{name: "all", env: "1", r: 0.99, want: true},
+		{name: "below fraction", env: "0.25", r: 0.2, want: true},
+		{name: "at fraction", env: "0.25", r: 0.25, want: false},
+		{name: "above fraction", env: "0.25", r: 0.3, want: false},
+		{name: "header override", env: "0", header: "1", r: 0.5, want: true},
+		{name: "header disables", env: "1", header: "0", r: 0, want: false},
+		{name: "header fraction", env: "1", header: "0.5", r: 0.6, want: false},
+		{name: "invalid header", env: "0.25", header: "2", r: 0.2, want: true},
+		{name: "unparsable header", env: "0", header: "always", r: 0, want: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_LOG_SAMPLE", tt.env)
+			if got := logSampled(tt.header, tt.r); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -14,6 +14,36 @@ import (
 	"github.com/ollama/ollama/types/model"
 )
 
+// errManifestNotFound is matched by errors returned when a model has no
+// manifest. These errors also wrap the underlying [os.ErrNotExist].
+var errManifestNotFound = errors.New("manifest not found")
+
+type manifestNotFoundError struct {
+	err error
+}
+
+func (e manifestNotFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e manifestNotFoundError) Unwrap() error {
+	return e.err
+}
+
+func (e manifestNotFoundError) Is(target error) bool {
+	return target == errManifestNotFound
+}
+
+// openManifest opens the manifest file at p
+func openManifest(p string) (*os.File, error) {
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, manifestNotFoundError{err}
+	}
+
+	return f, err
+}
+
 type Manifest struct {
 	SchemaVersion int     `json:"schemaVersion"`
 	MediaType     string  `json:"mediaType"`
@@ -38,12 +68,14 @@ func (m *Manifest) Remove() error {
 		return err
 	}
 
-	manifests, err := GetManifestPath()
-	if err != nil {
-		return err
+	// prune the manifests directory the manifest was removed from
+	for _, manifests := range GetManifestPaths() {
+		if rel, err := filepath.Rel(manifests, m.filepath); err == nil && filepath.IsLocal(rel) {
+			return PruneDirectory(manifests)
+		}
 	}
 
-	return PruneDirectory(manifests)
+	return nil
 }
 
 func (m *Manifest) RemoveLayers() error {
@@ -65,15 +97,18 @@ func ParseNamedManifest(n model.Name) (*Manifest, error) {
 		return nil, model.Unqualified(n)
 	}
 
-	manifests, err := GetManifestPath()
-	if err != nil {
-		return nil, err
-	}
+	p, ok := findModelsFile(filepath.Join("manifests", n.Filepath()))
+	if !ok {
+		manifests, err := GetManifestPath()
+		if err != nil {
+			return nil, err
+		}
 
-	p := filepath.Join(manifests, n.Filepath())
+		p = filepath.Join(manifests, n.Filepath())
+	}
 
 	var m Manifest
-	f, err := os.Open(p)
+	f, err := openManifest(p)
 	if err != nil {
 		return nil, err
 	}
@@ -123,23 +158,30 @@ func WriteManifest(name model.Name, config Layer, layers []Layer) error {
 	return json.NewEncoder(f).Encode(m)
 }
 
+// Manifests returns the manifests of all models directories. A model in an
+// earlier directory shadows one of the same name in a later directory.
 func Manifests() (map[model.Name]*Manifest, error) {
-	manifests, err := GetManifestPath()
-	if err != nil {
-		return nil, err
+	ms := make(map[model.Name]*Manifest)
+	for _, manifests := range GetManifestPaths() {
+		if err := readManifests(manifests, ms); err != nil {
+			return nil, err
+		}
 	}
 
+	return ms, nil
+}
+
+func readManifests(manifests string, ms map[model.Name]*Manifest) error {
 	// TODO(mxyng): use something less brittle
 	matches, err := filepath.Glob(filepath.Join(manifests, "*", "*", "*", "*"))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	ms := make(map[model.Name]*Manifest)
 	for _, match := range matches {
 		fi, err := os.Stat(match)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if !fi.IsDir() {
@@ -155,17 +197,21 @@ func Manifests() (map[model.Name]*Manifest, error) {
 				continue
 			}
 
+			if _, ok := ms[n]; ok {
+				continue
+			}
+
 			m, err := ParseNamedManifest(n)
 			if syntax := &(json.SyntaxError{}); errors.As(err, &syntax) {
 				slog.Warn("bad manifest", "name", n, "error", err)
 				continue
 			} else if err != nil {
-				return nil, fmt.Errorf("%s: %w", n, err)
+				return fmt.Errorf("%s: %w", n, err)
 			}
 
 			ms[n] = m
 		}
 	}
 
-	return ms, nil
+	return nil
 }
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/ollama/ollama/llm"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ollama_requests_total",
+		Help: "Number of HTTP requests by method, route and status.",
+	}, []string{"method", "path", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ollama_request_duration_seconds",
+		Help:    "Duration of HTTP requests by method and route.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"method", "path"})
+
+	generatedTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ollama_generated_tokens_total",
+		Help: "Number of tokens generated by model.",
+	}, []string{"model"})
+
+	generationRate = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ollama_generation_tokens_per_second",
+		Help:    "Rate of token generation of completed requests by model.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"model"})
+)
+
+// metricsMiddleware counts each request and observes its duration by the
+// route it matched
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		path := c.FullPath()
+		if path == "" {
+			path = "unmatched"
+		}
+
+		requestsTotal.WithLabelValues(c.Request.Method, path, strconv.Itoa(c.Writer.Status())).Inc()
+		requestDuration.WithLabelValues(c.Request.Method, path).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeCompletion records the generation stats of the final response of a
+// completion of model
+func observeCompletion(model string, cr llm.CompletionResponse) {
+	if !cr.Done || cr.EvalCount == 0 {
+		return
+	}
+
+	generatedTokens.WithLabelValues(model).Add(float64(cr.EvalCount))
+	if cr.EvalDuration > 0 {
+		generationRate.WithLabelValues(model).Observe(float64(cr.EvalCount) / cr.EvalDuration.Seconds())
+	}
+}
+
+// schedulerCollector collects the state of a scheduler when metrics are
+// scraped
+type schedulerCollector struct {
+	sched *Scheduler
+
+	queueDepth   *prometheus.Desc
+	loadedModels *prometheus.Desc
+	vram         *prometheus.Desc
+}
+
+func newSchedulerCollector(sched *Scheduler) *schedulerCollector {
+	return &schedulerCollector{
+		sched:        sched,
+		queueDepth:   prometheus.NewDesc("ollama_queue_depth", "Number of requests waiting to be scheduled.", nil, nil),
+		loadedModels: prometheus.NewDesc("ollama_loaded_models", "Number of loaded model runners.", nil, nil),
+		vram:         prometheus.NewDesc("ollama_vram_bytes", "Estimated VRAM used by the runners of each loaded model.", []string{"model"}, nil),
+	}
+}
+
+func (c *schedulerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queueDepth
+	ch <- c.loadedModels
+	ch <- c.vram
+}
+
+func (c *schedulerCollector) Collect(ch chan<- prometheus.Metric) {
+	var loaded int
+	vram := make(map[string]uint64)
+	if c.sched != nil {
+		c.sched.loadedMu.Lock()
+		for _, runner := range c.sched.loaded {
+			name := runner.modelPath
+			if runner.model != nil {
+				name = runner.model.ShortName
+			}
+
+			loaded++
+			vram[name] += runner.estimatedVRAM
+		}
+		c.sched.loadedMu.Unlock()
+	}
+
+	var depth int
+	if c.sched != nil {
+		depth = c.sched.queueDepth()
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(c.loadedModels, prometheus.GaugeValue, float64(loaded))
+	for name, bytes := range vram {
+		ch <- prometheus.MustNewConstMetric(c.vram, prometheus.GaugeValue, float64(bytes), name)
+	}
+}
+
+// metricsHandler serves the metrics of the default registry along with the
+// scheduler state of s in the Prometheus text format
+func (s *Server) metricsHandler() gin.HandlerFunc {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newSchedulerCollector(s.sched))
+
+	h := promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{})
+	return gin.WrapH(h)
+}
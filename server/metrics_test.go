@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:      "Hi!",
+			Done:         true,
+			DoneReason:   "stop",
+			EvalCount:    10,
+			EvalDuration: time.Second,
+		},
+	}
+
+	s := &Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      getCpuFn,
+			getCpuFn:      getCpuFn,
+			reschedDelay:  250 * time.Millisecond,
+		},
+	}
+
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		runner := &runnerRef{llama: &mock, model: req.model, modelPath: req.model.ModelPath, estimatedVRAM: 1024}
+		s.sched.loadedMu.Lock()
+		s.sched.loaded[req.model.ModelPath] = runner
+		s.sched.loadedMu.Unlock()
+		req.successCh <- runner
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []llm.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:     "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", bin),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	do := func(t *testing.T, router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_METRICS", "")
+		if w := do(t, s.GenerateRoutes(), http.MethodGet, "/metrics", ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("scrape", func(t *testing.T) {
+		t.Setenv("OLLAMA_METRICS", "1")
+		router := s.GenerateRoutes()
+
+		if w := do(t, router, http.MethodPost, "/api/generate", `{"model": "test", "prompt": "Hello!", "stream": false}`); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		w := do(t, router, http.MethodGet, "/metrics", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		body := w.Body.String()
+		for _, want := range []string{
+			`ollama_requests_total{method="POST",path="/api/generate",status="200"}`,
+			`ollama_request_duration_seconds_bucket{method="POST",path="/api/generate"`,
+			`ollama_generated_tokens_total{model="test:latest"}`,
+			`ollama_generation_tokens_per_second_bucket{model="test:latest"`,
+			`ollama_queue_depth 0`,
+			`ollama_loaded_models 1`,
+			`ollama_vram_bytes{model="test:latest"} 1024`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("expected %s in metrics", want)
+			}
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// registryMirrors returns the mirrors configured in OLLAMA_REGISTRY_MIRRORS.
+// Only models from the default registry are pulled through mirrors.
+func registryMirrors(mp ModelPath) []*url.URL {
+	if mp.Registry != DefaultRegistry {
+		return nil
+	}
+
+	var mirrors []*url.URL
+	for _, s := range envconfig.RegistryMirrors() {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			slog.Warn("ignoring invalid registry mirror", "mirror", s, "error", err)
+			continue
+		}
+
+		mirrors = append(mirrors, u)
+	}
+
+	return mirrors
+}
+
+// fromRegistry calls fn with the base URL and options of each mirror in
+// regOpts in turn, then the registry of mp, until one doesn't fail with a
+// connection or server error, or with a manifest that can't be verified.
+// Mirrors get their own options so credentials and tokens for the registry
+// are never sent to them.
+func fromRegistry(ctx context.Context, mp ModelPath, regOpts *registryOptions, fn func(*url.URL, *registryOptions) error) error {
+	for _, mirror := range regOpts.Mirrors {
+		baseURL := *mirror
+		baseURL.User = nil
+
+		opts := &registryOptions{CheckRedirect: regOpts.CheckRedirect, mirror: true}
+		if mirror.User != nil {
+			opts.Username = mirror.User.Username()
+			opts.Password, _ = mirror.User.Password()
+		}
+
+		err := fn(&baseURL, opts)
+		if err == nil || ctx.Err() != nil || !registryUnavailable(err) && !errors.Is(err, errManifestUnverified) {
+			return err
+		}
+
+		slog.Warn("registry mirror unavailable, trying next", "mirror", baseURL.Redacted(), "error", err)
+	}
+
+	return fn(mp.BaseURL(), regOpts)
+}
+
+// registryUnavailable reports whether err means the registry couldn't be
+// reached or failed to handle the request, as opposed to rejecting it
+func registryUnavailable(err error) bool {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return true
+	}
+
+	var rerr *registryError
+	return errors.As(err, &rerr) && rerr.StatusCode >= http.StatusInternalServerError
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
@@ -30,9 +31,176 @@ type layerGGML struct {
 	*llm.GGML
 }
 
-func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+// overrideMetadata replaces a GGUF model layer with a copy whose metadata is
+// patched with overrides
+func overrideMetadata(layer *layerGGML, overrides map[string]string, dryRun bool, fn func(api.ProgressResponse)) error {
+	kv, err := layer.GGML.KV().ParseOverrides(overrides)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadMetadata, err)
+	}
+
+	if dryRun {
+		// the patched layer isn't known until it's written so plan it with
+		// the size of the original layer
+		layer.Layer = Layer{
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+			status:    "overriding gguf metadata",
+		}
+		return nil
+	}
+
+	fn(api.ProgressResponse{Status: "overriding gguf metadata"})
+
+	store, err := blobStore()
+	if err != nil {
+		return err
+	}
+
+	blob, err := store.Open(context.Background(), layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(blobs, "gguf-")
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	if err := llm.PatchGGUF(temp, blob, kv); err != nil {
+		return err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	patched, err := NewLayer(temp, layer.MediaType)
+	if err != nil {
+		return err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ggml, _, err := llm.DecodeGGML(temp, 0)
+	if err != nil {
+		return err
+	}
+
+	layer.Layer = patched
+	layer.GGML = ggml
+	return nil
+}
+
+// mergeLayers replaces the tensors of the model layer with the tensors of the
+// same name in the GGUF files merges, which are blobs ("@<digest>") or paths
+// relative to the directory of the Modelfile.
+func mergeLayers(layer *layerGGML, merges []string, modelFileDir string, dryRun bool, fn func(api.ProgressResponse)) error {
+	store, err := blobStore()
+	if err != nil {
+		return err
+	}
+
+	overlays := make([]llm.Overlay, 0, len(merges))
+	for _, m := range merges {
+		p := realpath(modelFileDir, m)
+		if digest, ok := strings.CutPrefix(m, "@"); ok {
+			if p, err = store.File(context.Background(), digest); err != nil {
+				return fmt.Errorf("invalid merge reference: %s: %w", m, err)
+			}
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("invalid merge reference: %s: %w", m, err)
+		}
+		defer f.Close()
+
+		overlays = append(overlays, llm.Overlay{Name: m, ReadSeeker: f})
+	}
+
+	blob, err := store.Open(context.Background(), layer.Digest)
+	if errors.Is(err, os.ErrNotExist) && dryRun {
+		// a model that isn't in the blob store yet can't be checked
+		blob = nil
+	} else if err != nil {
+		return err
+	}
+
+	if dryRun {
+		if blob != nil {
+			defer blob.Close()
+			if err := llm.CheckMerge(blob, overlays); err != nil {
+				return err
+			}
+		}
+
+		// merging keeps the size of the model
+		layer.Layer = Layer{
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+			status:    "merging tensors",
+		}
+		return nil
+	}
+	defer blob.Close()
+
+	fn(api.ProgressResponse{Status: "merging tensors"})
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(blobs, "gguf-")
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	if err := llm.MergeGGUF(temp, blob, overlays); err != nil {
+		return err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	merged, err := NewLayer(temp, layer.MediaType)
+	if err != nil {
+		return err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ggml, _, err := llm.DecodeGGML(temp, 0)
+	if err != nil {
+		return err
+	}
+
+	layer.Layer = merged
+	layer.GGML = ggml
+	return nil
+}
+
+func parseFromModel(ctx context.Context, name model.Name, dryRun bool, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
 	m, err := ParseNamedManifest(name)
 	switch {
+	case errors.Is(err, os.ErrNotExist) && dryRun:
+		return nil, fmt.Errorf("model %q not found, pull it first", name.DisplayShortest())
 	case errors.Is(err, os.ErrNotExist):
 		if err := PullModel(ctx, name.String(), &registryOptions{}, fn); err != nil {
 			return nil, err
@@ -46,6 +214,11 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 		return nil, err
 	}
 
+	store, err := blobStore()
+	if err != nil {
+		return nil, err
+	}
+
 	for _, layer := range m.Layers {
 		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, name.DisplayShortest())
 		if err != nil {
@@ -56,12 +229,7 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 		case "application/vnd.ollama.image.model",
 			"application/vnd.ollama.image.projector",
 			"application/vnd.ollama.image.adapter":
-			blobpath, err := GetBlobsPath(layer.Digest)
-			if err != nil {
-				return nil, err
-			}
-
-			blob, err := os.Open(blobpath)
+			blob, err := store.Open(ctx, layer.Digest)
 			if err != nil {
 				return nil, err
 			}
@@ -81,7 +249,7 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	return layers, nil
 }
 
-func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML, f *os.File, digest string, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML, f *os.File, digest string, dryRun bool, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
@@ -92,16 +260,62 @@ func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML
 		return nil, err
 	}
 
-	p, err := os.MkdirTemp(filepath.Dir(f.Name()), "")
+	// a dry run converts outside of the blob store
+	dir := filepath.Dir(f.Name())
+	if dryRun {
+		dir = ""
+	}
+
+	p, err := os.MkdirTemp(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(p)
+
+	layer, err := convertLayer(command, baseLayers, convert.NewZipReader(r, p, 32<<20), p, dryRun, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		intermediateBlobs[digest] = layer.Digest
+	}
+
+	return detectChatTemplate([]*layerGGML{layer}, dryRun)
+}
+
+// parseFromDir converts the safetensors or pytorch model or adapter in dir
+func parseFromDir(_ context.Context, command string, baseLayers []*layerGGML, dir string, dryRun bool, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	// a dry run converts outside of the blob store
+	var temp string
+	if !dryRun {
+		temp, err = GetBlobsPath("")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := os.MkdirTemp(temp, "")
 	if err != nil {
 		return nil, err
 	}
 	defer os.RemoveAll(p)
 
+	layer, err := convertLayer(command, baseLayers, os.DirFS(dir), p, dryRun, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return detectChatTemplate([]*layerGGML{layer}, dryRun)
+}
+
+// convertLayer converts the model or adapter in fsys to a GGUF layer, writing
+// temporary files to dir
+func convertLayer(command string, baseLayers []*layerGGML, fsys fs.FS, dir string, dryRun bool, fn func(api.ProgressResponse)) (*layerGGML, error) {
 	fn(api.ProgressResponse{Status: "converting model"})
 	// TODO(mxyng): this should write directly into a layer
 	// e.g. NewLayer(arch.Reader(), "application/vnd.ollama.image.model")
-	t, err := os.CreateTemp(p, "fp16")
+	t, err := os.CreateTemp(dir, "fp16")
 	if err != nil {
 		return nil, err
 	}
@@ -124,12 +338,12 @@ func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML
 			return nil, fmt.Errorf("no base model specified for the adapter")
 		}
 
-		if err := convert.ConvertAdapter(convert.NewZipReader(r, p, 32<<20), t, baseModel.KV()); err != nil {
+		if err := convert.ConvertAdapter(fsys, t, baseModel.KV()); err != nil {
 			return nil, err
 		}
 		layerType = "application/vnd.ollama.image.adapter"
 	case "model":
-		if err := convert.ConvertModel(convert.NewZipReader(r, p, 32<<20), t); err != nil {
+		if err := convert.ConvertModel(fsys, t); err != nil {
 			return nil, err
 		}
 		layerType = "application/vnd.ollama.image.model"
@@ -139,29 +353,38 @@ func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML
 		return nil, err
 	}
 
-	layer, err := NewLayer(t, layerType)
+	newLayer := NewLayer
+	if dryRun {
+		newLayer = planLayer
+	}
+
+	layer, err := newLayer(t, layerType)
 	if err != nil {
 		return nil, err
 	}
 
-	bin, err := layer.Open()
-	if err != nil {
+	if _, err := t.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
-	defer bin.Close()
 
-	ggml, _, err := llm.DecodeGGML(bin, 0)
+	ggml, _, err := llm.DecodeGGML(t, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	layers = append(layers, &layerGGML{layer, ggml})
-
-	intermediateBlobs[digest] = layer.Digest
-	return detectChatTemplate(layers)
+	return &layerGGML{layer, ggml}, nil
 }
 
-func parseFromFile(ctx context.Context, command string, baseLayers []*layerGGML, file *os.File, digest string, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+func parseFromFile(ctx context.Context, command string, baseLayers []*layerGGML, file *os.File, digest string, dryRun bool, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		return parseFromDir(ctx, command, baseLayers, file.Name(), dryRun, fn)
+	}
+
 	sr := io.NewSectionReader(file, 0, 512)
 	contentType, err := detectContentType(sr)
 	if err != nil {
@@ -172,14 +395,14 @@ func parseFromFile(ctx context.Context, command string, baseLayers []*layerGGML,
 	case "gguf", "ggla":
 		// noop
 	case "application/zip":
-		return parseFromZipFile(ctx, command, baseLayers, file, digest, fn)
+		return parseFromZipFile(ctx, command, baseLayers, file, digest, dryRun, fn)
 	default:
 		return nil, fmt.Errorf("unsupported content type: %s", contentType)
 	}
 
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, err
+	newLayer := NewLayer
+	if dryRun {
+		newLayer = planLayer
 	}
 
 	var offset int64
@@ -208,7 +431,7 @@ func parseFromFile(ctx context.Context, command string, baseLayers []*layerGGML,
 
 		// Fallback to creating layer from file copy (either NewLayerFromLayer failed, or digest empty/n != stat.Size())
 		if layer.Digest == "" {
-			layer, err = NewLayer(io.NewSectionReader(file, offset, n), mediatype)
+			layer, err = newLayer(io.NewSectionReader(file, offset, n), mediatype)
 			if err != nil {
 				return nil, err
 			}
@@ -218,16 +441,21 @@ func parseFromFile(ctx context.Context, command string, baseLayers []*layerGGML,
 		offset = n
 	}
 
-	return detectChatTemplate(layers)
+	return detectChatTemplate(layers, dryRun)
 }
 
-func detectChatTemplate(layers []*layerGGML) ([]*layerGGML, error) {
+func detectChatTemplate(layers []*layerGGML, dryRun bool) ([]*layerGGML, error) {
+	newLayer := NewLayer
+	if dryRun {
+		newLayer = planLayer
+	}
+
 	for _, layer := range layers {
 		if s := layer.GGML.KV().ChatTemplate(); s != "" {
 			if t, err := template.Named(s); err != nil {
 				slog.Debug("template detection", "error", err)
 			} else {
-				layer, err := NewLayer(t.Reader(), "application/vnd.ollama.image.template")
+				layer, err := newLayer(t.Reader(), "application/vnd.ollama.image.template")
 				if err != nil {
 					return nil, err
 				}
@@ -241,7 +469,7 @@ func detectChatTemplate(layers []*layerGGML) ([]*layerGGML, error) {
 						return nil, err
 					}
 
-					layer, err := NewLayer(&b, "application/vnd.ollama.image.params")
+					layer, err := newLayer(&b, "application/vnd.ollama.image.params")
 					if err != nil {
 						return nil, err
 					}
@@ -296,9 +524,22 @@ func parseObjects(s string) []map[string]any {
 	return objs
 }
 
-// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
-// mxyng: this only really works if the input contains tool calls in some JSON format
-func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+// toolCallFormat returns the keys of the name and arguments fields of a tool
+// call in the template, and the text the template renders before its tool calls
+func (m *Model) toolCallFormat() (prefix, name, arguments string, ok bool) {
+	toolCalls := map[string][]api.ToolCall{
+		"ToolCalls": {
+			{
+				Function: api.ToolCallFunction{
+					Name: "@@name@@",
+					Arguments: api.ToolCallFunctionArguments{
+						"@@argument@@": 1,
+					},
+				},
+			},
+		},
+	}
+
 	// create a subtree from the node that ranges over .ToolCalls
 	tmpl := m.Template.Subtree(func(n parse.Node) bool {
 		if t, ok := n.(*parse.RangeNode); ok {
@@ -309,32 +550,20 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	})
 
 	if tmpl == nil {
-		return nil, false
+		return "", "", "", false
 	}
 
 	var b bytes.Buffer
-	if err := tmpl.Execute(&b, map[string][]api.ToolCall{
-		"ToolCalls": {
-			{
-				Function: api.ToolCallFunction{
-					Name: "@@name@@",
-					Arguments: api.ToolCallFunctionArguments{
-						"@@argument@@": 1,
-					},
-				},
-			},
-		},
-	}); err != nil {
-		return nil, false
+	if err := tmpl.Execute(&b, toolCalls); err != nil {
+		return "", "", "", false
 	}
 
 	templateObjects := parseObjects(b.String())
 	if len(templateObjects) == 0 {
-		return nil, false
+		return "", "", "", false
 	}
 
 	// find the keys that correspond to the name and arguments fields
-	var name, arguments string
 	for k, v := range templateObjects[0] {
 		switch v.(type) {
 		case string:
@@ -345,6 +574,38 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	}
 
 	if name == "" || arguments == "" {
+		return "", "", "", false
+	}
+
+	// text in the conditional around the range precedes the tool calls
+	var sb strings.Builder
+	if t := m.Template.Subtree(func(n parse.Node) bool {
+		if t, ok := n.(*parse.IfNode); ok {
+			return slices.Contains(template.Identifiers(t.Pipe), "ToolCalls")
+		}
+
+		return false
+	}); t != nil {
+		for _, n := range t.Tree.Root.Nodes[0].(*parse.IfNode).List.Nodes {
+			text, ok := n.(*parse.TextNode)
+			if !ok {
+				break
+			}
+
+			sb.Write(text.Text)
+		}
+	}
+
+	sb.WriteString(b.String())
+	prefix, _, _ = strings.Cut(sb.String(), "{")
+	return strings.TrimSpace(prefix), name, arguments, true
+}
+
+// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
+// mxyng: this only really works if the input contains tool calls in some JSON format
+func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+	_, name, arguments, ok := m.toolCallFormat()
+	if !ok {
 		return nil, false
 	}
 
@@ -392,3 +653,56 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 
 	return toolCalls, len(toolCalls) > 0
 }
+
+// fimTokenKeys are the metadata keys of the prefix, suffix and middle tokens
+// of models trained to fill in the middle, as named by newer and older
+// conversions
+var fimTokenKeys = [][3]string{
+	{"tokenizer.ggml.fim_pre_token_id", "tokenizer.ggml.fim_suf_token_id", "tokenizer.ggml.fim_mid_token_id"},
+	{"tokenizer.ggml.prefix_token_id", "tokenizer.ggml.suffix_token_id", "tokenizer.ggml.middle_token_id"},
+}
+
+// fimTokens returns the prefix, suffix and middle tokens of kv
+func fimTokens(kv llm.KV) ([3]int, bool) {
+	for _, keys := range fimTokenKeys {
+		var tokens [3]int
+		n := 0
+		for i, key := range keys {
+			if id, ok := kv[key].(uint32); ok {
+				tokens[i] = int(id)
+				n++
+			}
+		}
+
+		if n == len(keys) {
+			return tokens, true
+		}
+	}
+
+	return [3]int{}, false
+}
+
+// fimTemplate returns a template that inserts between a prompt and suffix
+// with the fill-in-the-middle tokens of the model, for templates that don't
+// handle a suffix themselves. The text of the tokens is detokenized by t.
+func (m *Model) fimTemplate(ctx context.Context, t llm.Tokenizer) (*template.Template, error) {
+	kv, err := m.kv()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, ok := fimTokens(kv)
+	if !ok {
+		return nil, fmt.Errorf("%w %w", errCapabilities, errCapabilityInsert)
+	}
+
+	var pieces [3]string
+	for i, token := range tokens {
+		if pieces[i], err = t.Detokenize(ctx, []int{token}); err != nil {
+			return nil, err
+		}
+	}
+
+	// the tokens are quoted so they're never parsed as actions
+	return template.Parse(fmt.Sprintf("{{ %q }}{{ .Prompt }}{{ %q }}{{ .Suffix }}{{ %q }}", pieces[0], pieces[1], pieces[2]))
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/ollama/ollama/envconfig"
 )
@@ -57,7 +58,11 @@ func ParseModelPath(name string) ModelPath {
 		mp.Namespace = parts[1]
 		mp.Repository = parts[2]
 	case 2:
-		mp.Namespace = parts[0]
+		if found || isRegistryHost(parts[0]) {
+			mp.Registry = parts[0]
+		} else {
+			mp.Namespace = parts[0]
+		}
 		mp.Repository = parts[1]
 	case 1:
 		mp.Repository = parts[0]
@@ -71,6 +76,13 @@ func ParseModelPath(name string) ModelPath {
 	return mp
 }
 
+// isRegistryHost reports whether the first part of a two part name without a
+// scheme is a registry host rather than a namespace, e.g.
+// "registry.example.com/model" or "localhost:5000/model"
+func isRegistryHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
 var errModelPathInvalid = errors.New("invalid model path")
 
 func (mp ModelPath) GetNamespaceRepository() string {
@@ -91,10 +103,26 @@ func (mp ModelPath) GetShortTagname() string {
 	return fmt.Sprintf("%s/%s/%s:%s", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
 }
 
-// GetManifestPath returns the path to the manifest file for the given model path, it is up to the caller to create the directory if it does not exist.
+// GetManifestPath returns the path of the manifest in the first models
+// directory containing it, or in the writable models directory otherwise
 func (mp ModelPath) GetManifestPath() (string, error) {
 	if p := filepath.Join(mp.Registry, mp.Namespace, mp.Repository, mp.Tag); filepath.IsLocal(p) {
-		return filepath.Join(envconfig.Models(), "manifests", p), nil
+		rel := filepath.Join("manifests", p)
+		if fp, ok := findModelsFile(rel); ok {
+			return fp, nil
+		}
+
+		return filepath.Join(modelsDir(), rel), nil
+	}
+
+	return "", errModelPathInvalid
+}
+
+// writableManifestPath returns the path of the manifest in the writable models
+// directory, regardless of where an existing copy is stored
+func (mp ModelPath) writableManifestPath() (string, error) {
+	if p := filepath.Join(mp.Registry, mp.Namespace, mp.Repository, mp.Tag); filepath.IsLocal(p) {
+		return filepath.Join(modelsDir(), "manifests", p), nil
 	}
 
 	return "", errModelPathInvalid
@@ -107,8 +135,66 @@ func (mp ModelPath) BaseURL() *url.URL {
 	}
 }
 
+// writableModelsDir caches the directory modelsDir resolves for the value of
+// OLLAMA_MODELS it was resolved for
+var writableModelsDir struct {
+	sync.Mutex
+	models, dir string
+}
+
+// modelsDir returns the first writable directory in OLLAMA_MODELS, where new
+// manifests and blobs are written. If none are writable the first directory
+// is returned so writes report the underlying error. The directory is
+// resolved once for each value of OLLAMA_MODELS.
+func modelsDir() string {
+	writableModelsDir.Lock()
+	defer writableModelsDir.Unlock()
+
+	models := envconfig.Var("OLLAMA_MODELS")
+	if writableModelsDir.dir == "" || writableModelsDir.models != models {
+		writableModelsDir.models, writableModelsDir.dir = models, resolveModelsDir(envconfig.ModelsPaths())
+	}
+
+	return writableModelsDir.dir
+}
+
+// resolveModelsDir returns the first of paths which can be created and
+// written to, or the first of paths if none can
+func resolveModelsDir(paths []string) string {
+	for _, p := range paths {
+		if err := os.MkdirAll(p, 0o755); err != nil {
+			continue
+		}
+
+		f, err := os.CreateTemp(p, ".ollama-")
+		if err != nil {
+			continue
+		}
+
+		f.Close()
+		os.Remove(f.Name())
+		return p
+	}
+
+	return paths[0]
+}
+
+// findModelsFile returns the first existing file rel in OLLAMA_MODELS
+// directories, searched in order
+func findModelsFile(rel string) (string, bool) {
+	for _, p := range envconfig.ModelsPaths() {
+		fp := filepath.Join(p, rel)
+		if _, err := os.Stat(fp); err == nil {
+			return fp, true
+		}
+	}
+
+	return "", false
+}
+
+// GetManifestPath returns the manifests directory of the writable models directory
 func GetManifestPath() (string, error) {
-	path := filepath.Join(envconfig.Models(), "manifests")
+	path := filepath.Join(modelsDir(), "manifests")
 	if err := os.MkdirAll(path, 0o755); err != nil {
 		return "", err
 	}
@@ -116,6 +202,20 @@ func GetManifestPath() (string, error) {
 	return path, nil
 }
 
+// GetManifestPaths returns the existing manifests directories of all models
+// directories in search order
+func GetManifestPaths() []string {
+	var paths []string
+	for _, p := range envconfig.ModelsPaths() {
+		path := filepath.Join(p, "manifests")
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
 func GetBlobsPath(digest string) (string, error) {
 	// only accept actual sha256 digests
 	pattern := "^sha256[:-][0-9a-fA-F]{64}$"
@@ -126,7 +226,13 @@ func GetBlobsPath(digest string) (string, error) {
 	}
 
 	digest = strings.ReplaceAll(digest, ":", "-")
-	path := filepath.Join(envconfig.Models(), "blobs", digest)
+	if digest != "" {
+		if fp, ok := findModelsFile(filepath.Join("blobs", digest)); ok {
+			return fp, nil
+		}
+	}
+
+	path := filepath.Join(modelsDir(), "blobs", digest)
 	dirPath := filepath.Dir(path)
 	if digest == "" {
 		dirPath = path
@@ -4,10 +4,14 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/types/model"
 )
 
 func TestGetBlobsPath(t *testing.T) {
@@ -110,6 +114,39 @@ func TestParseModelPath(t *testing.T) {
 				Tag:            "tag",
 			},
 		},
+		{
+			"registry with port",
+			"registry.corp.com:5000/ns/repo:tag",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       "registry.corp.com:5000",
+				Namespace:      "ns",
+				Repository:     "repo",
+				Tag:            "tag",
+			},
+		},
+		{
+			"registry without namespace",
+			"registry.corp.com/repo:tag",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       "registry.corp.com",
+				Namespace:      DefaultNamespace,
+				Repository:     "repo",
+				Tag:            "tag",
+			},
+		},
+		{
+			"localhost without namespace",
+			"http://localhost/repo",
+			ModelPath{
+				ProtocolScheme: "http",
+				Registry:       "localhost",
+				Namespace:      DefaultNamespace,
+				Repository:     "repo",
+				Tag:            DefaultTag,
+			},
+		},
 		{
 			"no registry",
 			"ns/repo:tag",
@@ -162,3 +199,113 @@ func TestInsecureModelpath(t *testing.T) {
 		t.Errorf("expected error: %v", err)
 	}
 }
+
+func TestModelsPaths(t *testing.T) {
+	const digest = "sha256-456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+
+	touch := func(t *testing.T, p string) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte("{}"), 0o644))
+	}
+
+	setModels := func(t *testing.T, dirs ...string) {
+		t.Helper()
+		t.Setenv("OLLAMA_MODELS", strings.Join(dirs, string(filepath.ListSeparator)))
+	}
+
+	t.Run("resolution order", func(t *testing.T) {
+		first, second := t.TempDir(), t.TempDir()
+		setModels(t, first, second)
+
+		touch(t, filepath.Join(second, "blobs", digest))
+		got, err := GetBlobsPath(digest)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(second, "blobs", digest), got)
+
+		touch(t, filepath.Join(first, "blobs", digest))
+		got, err = GetBlobsPath(digest)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(first, "blobs", digest), got)
+	})
+
+	t.Run("missing directories", func(t *testing.T) {
+		dir := t.TempDir()
+		missing := filepath.Join(dir, "missing")
+		second := t.TempDir()
+		setModels(t, missing, second)
+
+		touch(t, filepath.Join(second, "blobs", digest))
+		got, err := GetBlobsPath(digest)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(second, "blobs", digest), got)
+
+		// a missing directory which can be created is used for writes
+		got, err = GetBlobsPath("")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(missing, "blobs"), got)
+	})
+
+	t.Run("unwritable directories", func(t *testing.T) {
+		// a directory beneath a regular file can never be created
+		file := filepath.Join(t.TempDir(), "file")
+		touch(t, file)
+
+		second := t.TempDir()
+		setModels(t, filepath.Join(file, "models"), second)
+
+		got, err := GetBlobsPath("")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(second, "blobs"), got)
+	})
+
+	t.Run("resolved once", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "models")
+		setModels(t, dir)
+		assert.Equal(t, dir, modelsDir())
+
+		// reads don't probe the directory again so it isn't recreated
+		require.NoError(t, os.Remove(dir))
+		_, err := ParseModelPath("test").GetManifestPath()
+		require.NoError(t, err)
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err), "expected %s not to be recreated, got %v", dir, err)
+	})
+
+	t.Run("write to first", func(t *testing.T) {
+		first, second := t.TempDir(), t.TempDir()
+		setModels(t, first, second)
+
+		touch(t, filepath.Join(second, "manifests", "registry.ollama.ai", "library", "base", "latest"))
+		touch(t, filepath.Join(second, "manifests", "registry.ollama.ai", "library", "shadowed", "latest"))
+
+		require.NoError(t, WriteManifest(model.ParseName("tuned"), Layer{}, nil))
+		require.NoError(t, WriteManifest(model.ParseName("shadowed"), Layer{}, nil))
+
+		_, err := os.Stat(filepath.Join(first, "manifests", "registry.ollama.ai", "library", "tuned", "latest"))
+		require.NoError(t, err)
+
+		ms, err := Manifests()
+		require.NoError(t, err)
+
+		var names []string
+		for n, m := range ms {
+			names = append(names, n.DisplayShortest())
+			if n.DisplayShortest() == "shadowed:latest" {
+				assert.True(t, strings.HasPrefix(m.filepath, first), "expected %s to be read from %s", m.filepath, first)
+			}
+		}
+
+		slices.Sort(names)
+		assert.Equal(t, []string{"base:latest", "shadowed:latest", "tuned:latest"}, names)
+
+		mp := ParseModelPath("base")
+		fp, err := mp.GetManifestPath()
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(second, "manifests", "registry.ollama.ai", "library", "base", "latest"), fp)
+
+		fp, err = mp.writableManifestPath()
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(first, "manifests", "registry.ollama.ai", "library", "base", "latest"), fp)
+	})
+}
@@ -3,22 +3,31 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
 )
 
+var errPromptTooLong = errors.New("prompt too long")
+
 type tokenizeFunc func(context.Context, string) ([]int, error)
 
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
-// chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
+// If truncate is set, chatPrompt truncates any messages that exceed the context window of the model, making sure to
+// always include 1) the latest message and 2) system messages
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, truncate bool) (prompt string, images []llm.ImageData, _ error) {
 	var system []api.Message
 	// always include the last message
 	n := len(msgs) - 1
+	if !truncate {
+		n = 0
+	}
+
 	// in reverse, find all messages that fit into context window
 	for i := n - 1; i >= 0; i-- {
 		system = make([]api.Message, 0)
@@ -72,3 +81,34 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 
 	return b.String(), images, nil
 }
+
+// checkPromptLength returns an error if prompt has more tokens than
+// OLLAMA_MAX_PROMPT_TOKENS or, if it won't be truncated, the context length
+func checkPromptLength(ctx context.Context, tokenize tokenizeFunc, prompt string, numCtx int, truncate bool) error {
+	maxTokens := int(envconfig.MaxPromptTokens())
+
+	limit := maxTokens
+	if !truncate && (limit == 0 || numCtx < limit) {
+		limit = numCtx
+	}
+
+	// tokens are at least a byte long, plus a possible BOS token, so only
+	// prompts with at least limit bytes are worth tokenizing
+	if limit <= 0 || len(prompt) < limit {
+		return nil
+	}
+
+	tokens, err := tokenize(ctx, prompt)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case maxTokens > 0 && len(tokens) > maxTokens:
+		return fmt.Errorf("%w: %d tokens exceeds the maximum of %d set by OLLAMA_MAX_PROMPT_TOKENS", errPromptTooLong, len(tokens), maxTokens)
+	case !truncate && len(tokens) > numCtx:
+		return fmt.Errorf("%w: %d tokens exceeds the context length of %d", errPromptTooLong, len(tokens), numCtx)
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -184,7 +185,7 @@ func TestChatPrompt(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
 			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
-			prompt, images, err := chatPrompt(context.TODO(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil)
+			prompt, images, err := chatPrompt(context.TODO(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil, true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -209,3 +210,52 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckPromptLength(t *testing.T) {
+	cases := []struct {
+		name      string
+		prompt    string
+		numCtx    int
+		truncate  bool
+		maxTokens string
+		err       string
+	}{
+		{name: "fits", prompt: "one two three", numCtx: 4},
+		{name: "truncated", prompt: "one two three four five", numCtx: 4, truncate: true},
+		{name: "exceeds context", prompt: "one two three four five", numCtx: 4, err: "prompt too long: 5 tokens exceeds the context length of 4"},
+		{name: "exact context", prompt: "one two three four", numCtx: 4},
+		{name: "under maximum", prompt: "one two three", numCtx: 8, truncate: true, maxTokens: "3"},
+		{name: "exceeds maximum", prompt: "one two three four", numCtx: 8, truncate: true, maxTokens: "3", err: "prompt too long: 4 tokens exceeds the maximum of 3 set by OLLAMA_MAX_PROMPT_TOKENS"},
+		{name: "maximum over context", prompt: "one two three four five", numCtx: 4, maxTokens: "16", err: "prompt too long: 5 tokens exceeds the context length of 4"},
+		{name: "maximum under context", prompt: "one two three four five", numCtx: 8, maxTokens: "4", err: "prompt too long: 5 tokens exceeds the maximum of 4 set by OLLAMA_MAX_PROMPT_TOKENS"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_MAX_PROMPT_TOKENS", tt.maxTokens)
+
+			err := checkPromptLength(context.TODO(), mockRunner{}.Tokenize, tt.prompt, tt.numCtx, tt.truncate)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, errPromptTooLong) || err.Error() != tt.err {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("short prompts aren't tokenized", func(t *testing.T) {
+		tokenize := func(context.Context, string) ([]int, error) {
+			t.Fatal("unexpected tokenize")
+			return nil, nil
+		}
+
+		if err := checkPromptLength(context.TODO(), tokenize, "one two", 8, false); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
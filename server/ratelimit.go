@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/types/model"
+)
+
+// rateLimiter is a token bucket and a count of running requests per model.
+// Each bucket holds up to the model's Requests tokens and refills at
+// Requests per Per. Models without a limit are never limited.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  map[string]envconfig.RateLimit
+	buckets map[string]*tokenBucket
+	running map[string]uint
+
+	now func() time.Time
+}
+
+var (
+	errRateLimit        = errors.New("rate limit exceeded")
+	errConcurrencyLimit = errors.New("concurrency limit exceeded")
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limits map[string]envconfig.RateLimit) *rateLimiter {
+	l := &rateLimiter{
+		limits:  make(map[string]envconfig.RateLimit, len(limits)),
+		buckets: make(map[string]*tokenBucket),
+		running: make(map[string]uint),
+		now:     time.Now,
+	}
+
+	for name, limit := range limits {
+		l.limits[rateLimitKey(name)] = limit
+	}
+
+	return l
+}
+
+// rateLimitKey returns the name limits are keyed by so "llama3" and
+// "llama3:latest" share a limit
+func rateLimitKey(name string) string {
+	if n := model.ParseName(name); n.IsValid() {
+		return n.DisplayShortest()
+	}
+
+	return name
+}
+
+// acquire starts a request for name. It takes a token from the bucket of
+// name and counts the request as running until release is called. If the
+// request exceeds a limit of name it returns the limit's error and how long
+// to wait before retrying.
+func (l *rateLimiter) acquire(name string) (release func(), wait time.Duration, err error) {
+	key := rateLimitKey(name)
+	limit, ok := l.limits[key]
+	if !ok {
+		return func() {}, 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// requests rejected for concurrency don't use up the rate limit. How
+	// long running requests take is unknown so retry after a second.
+	if limit.Concurrent > 0 && l.running[key] >= limit.Concurrent {
+		return nil, time.Second, errConcurrencyLimit
+	}
+
+	if limit.Requests > 0 {
+		now := l.now()
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(limit.Requests), last: now}
+			l.buckets[key] = b
+		}
+
+		rate := float64(limit.Requests) / limit.Per.Seconds()
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, float64(limit.Requests))
+		b.last = now
+
+		if b.tokens < 1 {
+			return nil, time.Duration((1 - b.tokens) / rate * float64(time.Second)), errRateLimit
+		}
+
+		b.tokens--
+	}
+
+	l.running[key]++
+	return sync.OnceFunc(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.running[key]--
+	}), 0, nil
+}
+
+// rateLimitMiddleware rejects requests for a model that exceed its limits in
+// OLLAMA_MODEL_RATE_LIMIT with 429 Too Many Requests. Requests are running
+// until the handlers after it return.
+func rateLimitMiddleware(l *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(l.limits) == 0 {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// malformed requests are left for the handler to reject
+		var req struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(body, &req)
+
+		release, wait, err := l.acquire(req.Model)
+		if err != nil {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("%s for model %q", err, req.Model), "code": api.ErrorCodeRateLimited})
+			return
+		}
+		defer release()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(map[string]envconfig.RateLimit{"llama3": {Requests: 2, Per: time.Second}})
+	l.now = func() time.Time { return now }
+
+	// requests are released right away so only the rate is limited
+	allow := func(name string) (time.Duration, bool) {
+		release, wait, err := l.acquire(name)
+		if err != nil {
+			if !errors.Is(err, errRateLimit) {
+				t.Fatalf("expected a rate limit error, got %v", err)
+			}
+
+			return wait, false
+		}
+
+		release()
+		return 0, true
+	}
+
+	for i := range 2 {
+		if _, ok := allow("llama3"); !ok {
+			t.Fatalf("request %d: expected to be allowed", i)
+		}
+	}
+
+	wait, ok := allow("llama3:latest")
+	if ok {
+		t.Fatal("expected a burst beyond the limit to be rejected")
+	}
+
+	if wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("expected to wait up to 500ms, got %s", wait)
+	}
+
+	// other models aren't limited
+	for range 10 {
+		if _, ok := allow("mistral"); !ok {
+			t.Fatal("expected a model without a limit to be allowed")
+		}
+	}
+
+	now = now.Add(wait)
+	if _, ok := allow("llama3"); !ok {
+		t.Error("expected a request to be allowed once a token is refilled")
+	}
+
+	if _, ok := allow("llama3"); ok {
+		t.Error("expected the bucket to be empty again")
+	}
+
+	// tokens don't accumulate beyond the burst
+	now = now.Add(time.Hour)
+	for i := range 3 {
+		if _, ok := allow("llama3"); ok != (i < 2) {
+			t.Errorf("request %d after an hour: expected allowed %t, got %t", i, i < 2, ok)
+		}
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := newRateLimiter(map[string]envconfig.RateLimit{"llama3": {Requests: 3, Per: time.Hour, Concurrent: 2}})
+
+	var releases []func()
+	for i := range 2 {
+		release, _, err := l.acquire("llama3")
+		if err != nil {
+			t.Fatalf("request %d: expected to be allowed, got %v", i, err)
+		}
+
+		releases = append(releases, release)
+	}
+
+	release, wait, err := l.acquire("llama3:latest")
+	if !errors.Is(err, errConcurrencyLimit) || release != nil {
+		t.Fatalf("expected a concurrency limit error, got %v", err)
+	}
+
+	if wait != time.Second {
+		t.Errorf("expected to wait a second, got %s", wait)
+	}
+
+	// releasing more than once doesn't free more requests
+	releases[0]()
+	releases[0]()
+
+	release, _, err = l.acquire("llama3")
+	if err != nil {
+		t.Fatalf("expected a request to be allowed once another finished, got %v", err)
+	}
+	defer release()
+
+	if _, _, err := l.acquire("llama3"); !errors.Is(err, errConcurrencyLimit) {
+		t.Errorf("expected a concurrency limit error, got %v", err)
+	}
+
+	// the rejected requests didn't take tokens
+	releases[1]()
+	if _, _, err := l.acquire("llama3"); !errors.Is(err, errRateLimit) {
+		t.Errorf("expected a rate limit error after 3 requests, got %v", err)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	l := newRateLimiter(map[string]envconfig.RateLimit{"llama3": {Requests: 3, Per: time.Minute}})
+
+	r := gin.New()
+	r.POST("/api/generate", rateLimitMiddleware(l), func(c *gin.Context) {
+		var req api.GenerateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		c.String(http.StatusOK, req.Model)
+	})
+
+	generate := func(model string) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.GenerateRequest{Model: model}); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate", &b))
+		return w
+	}
+
+	for i := range 3 {
+		w := generate("llama3")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, w.Code)
+		}
+
+		// the handler still reads the body
+		if body, _ := io.ReadAll(w.Body); string(body) != "llama3" {
+			t.Errorf("request %d: expected the handler to read the model, got %q", i, body)
+		}
+	}
+
+	w := generate("llama3")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "20" {
+		t.Errorf("expected Retry-After 20, got %q", retryAfter)
+	}
+
+	if body := w.Body.String(); body != `{"code":"rate_limited","error":"rate limit exceeded for model \"llama3\""}` {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	if w := generate("mistral"); w.Code != http.StatusOK {
+		t.Errorf("expected other models to be allowed, got %d", w.Code)
+	}
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	l := newRateLimiter(map[string]envconfig.RateLimit{"llama3": {Concurrent: 1}})
+
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	r := gin.New()
+	r.POST("/api/generate", rateLimitMiddleware(l), func(c *gin.Context) {
+		started <- struct{}{}
+		<-unblock
+		c.Status(http.StatusOK)
+	})
+
+	generate := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model":"llama3"}`)))
+		return w
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- generate() }()
+	<-started
+
+	w := generate()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 while a request is running, got %d", w.Code)
+	}
+
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("expected Retry-After 1, got %q", retryAfter)
+	}
+
+	if body := w.Body.String(); body != `{"code":"rate_limited","error":"concurrency limit exceeded for model \"llama3\""}` {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	close(unblock)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	// the finished request's slot is free again
+	if w := generate(); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 once the running request finished, got %d", w.Code)
+	}
+}
@@ -9,26 +9,37 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/build"
+	"github.com/ollama/ollama/convert"
 	"github.com/ollama/ollama/envconfig"
-	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/parser"
@@ -44,6 +55,18 @@ var mode string = gin.DebugMode
 type Server struct {
 	addr  net.Addr
 	sched *Scheduler
+
+	requests inflightRequests
+	active   activeRequests
+
+	// discovered is set once GPUs are discovered at startup
+	discovered atomic.Bool
+
+	sessions chatSessions
+
+	// operations are the creates, pulls and pushes started with an
+	// Idempotency-Key
+	operations operations
 }
 
 func init() {
@@ -59,45 +82,135 @@ func init() {
 }
 
 var (
-	errRequired    = errors.New("is required")
-	errBadTemplate = errors.New("template error")
+	errRequired        = errors.New("is required")
+	errBadTemplate     = errors.New("template error")
+	errBadQuantization = errors.New("invalid quantization")
+	errInvalidOption   = errors.New("invalid option")
+	errBadMetadata     = errors.New("invalid gguf metadata")
 )
 
+// parseFormat parses a request format which is either empty, the string "json",
+// or a JSON schema object. Schemas are converted to a grammar.
+func parseFormat(f api.Format) (format, grammar string, err error) {
+	switch {
+	case f == "":
+		return "", "", nil
+	case f == "json":
+		return "json", "", nil
+	case f.IsSchema():
+		g, err := llama.SchemaToGrammar([]byte(f))
+		if err != nil {
+			return "", "", fmt.Errorf("%w in format", err)
+		}
+
+		return "", string(g), nil
+	default:
+		return "", "", fmt.Errorf("invalid format: %q; expected \"json\" or a JSON schema object", f)
+	}
+}
+
+// checkGrammar checks the grammar of a request, which can't be blank or be
+// combined with a format
+func checkGrammar(grammar string, format bool) error {
+	switch {
+	case grammar == "":
+		return nil
+	case strings.TrimSpace(grammar) == "":
+		return errors.New("grammar must not be empty")
+	case format:
+		return errors.New("format and grammar cannot both be set")
+	default:
+		return nil
+	}
+}
+
 func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
+	// the defaults of the environment are under the model's parameters which
+	// are under the request's options
 	opts := api.DefaultOptions()
+	if err := opts.FromMap(envconfig.DefaultOptions()); err != nil {
+		return api.Options{}, err
+	}
+
 	if err := opts.FromMap(model.Options); err != nil {
 		return api.Options{}, err
 	}
 
 	if err := opts.FromMap(requestOpts); err != nil {
-		return api.Options{}, err
+		return api.Options{}, fmt.Errorf("%w: %w", errInvalidOption, err)
+	}
+
+	for name, p := range map[string]float32{"min_p": opts.MinP, "typical_p": opts.TypicalP} {
+		if p < 0 || p > 1 {
+			return api.Options{}, fmt.Errorf("%w %q: must be between 0 and 1", errInvalidOption, name)
+		}
+	}
+
+	for _, pattern := range opts.StopRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return api.Options{}, fmt.Errorf("%w \"stop_regex\": %w", errInvalidOption, err)
+		}
+
+		// a pattern that matches an empty string could stop anywhere
+		if re.MatchString("") {
+			return api.Options{}, fmt.Errorf("%w \"stop_regex\": %q matches an empty string", errInvalidOption, pattern)
+		}
 	}
 
 	return opts, nil
 }
 
-// scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
-// It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+// resolveModel returns the model name and the options it would be loaded with
+// for a request with requestOpts, after checking it has caps and its blobs
+// are intact.
+func resolveModel(name string, caps []Capability, requestOpts map[string]any) (*Model, api.Options, error) {
 	if name == "" {
-		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
+		return nil, api.Options{}, fmt.Errorf("model %w", errRequired)
 	}
 
 	model, err := GetModel(name)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, api.Options{}, err
 	}
 
 	if err := model.CheckCapabilities(caps...); err != nil {
-		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
+		return nil, api.Options{}, fmt.Errorf("%s %w", name, err)
+	}
+
+	if err := model.verifyBlobs(); err != nil {
+		return nil, api.Options{}, err
 	}
 
 	opts, err := modelOptions(model, requestOpts)
+	if err != nil {
+		return nil, api.Options{}, err
+	}
+
+	// a context past what the model was trained on silently degrades its
+	// output, and a larger context reloads the model for nothing
+	n, err := trainedContextLength(model.ModelPath)
+	if err != nil {
+		return nil, api.Options{}, err
+	}
+
+	if n > 0 && uint64(opts.NumCtx) > n && !envconfig.AllowContextOverflow() {
+		slog.Warn("num_ctx exceeds the context length the model was trained with, clamping", "model", name, "num_ctx", opts.NumCtx, "context_length", n)
+		opts.NumCtx = int(n)
+	}
+
+	return model, opts, nil
+}
+
+// scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
+// It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration, priority int) (llm.LlamaServer, *Model, *api.Options, error) {
+	model, opts, err := resolveModel(name, caps, requestOpts)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
+	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive, priority)
 	var runner *runnerRef
 	select {
 	case runner = <-runnerCh:
@@ -105,31 +218,133 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 		return nil, nil, nil, err
 	}
 
+	// choose the seed here rather than leave it to the runner so it can be
+	// returned with the response. The runner picks its own for 0xFFFFFFFF.
+	if opts.Seed < 0 {
+		opts.Seed = int(rand.Uint32N(math.MaxUint32))
+	}
+
 	return runner.llama, model, &opts, nil
 }
 
+// runeBuffer holds back the incomplete UTF-8 character at the end of the
+// content of completion responses until the rest of it arrives, so that
+// streamed responses never split a character.
+type runeBuffer struct {
+	content  string
+	logprobs []api.TokenLogprob
+}
+
+// add prepends whatever is held back to cr and holds back its incomplete
+// trailing character, if any. It reports false if nothing is left of cr to
+// respond with. What is still held back when cr is done is returned as is.
+func (b *runeBuffer) add(cr *llm.CompletionResponse) bool {
+	content := b.content + cr.Content
+	cr.Logprobs = append(b.logprobs, cr.Logprobs...)
+	b.content, b.logprobs = "", nil
+
+	if !cr.Done {
+		n := incompleteSuffix(content)
+		content, b.content = content[:len(content)-n], content[len(content)-n:]
+		if content == "" && cr.Content != "" {
+			b.logprobs = cr.Logprobs
+			return false
+		}
+	}
+
+	cr.Content = content
+	return true
+}
+
+// incompleteSuffix returns the length of the incomplete UTF-8 character at the
+// end of s
+func incompleteSuffix(s string) int {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if utf8.FullRuneInString(s[i:]) {
+				return 0
+			}
+
+			return len(s) - i
+		}
+	}
+
+	return 0
+}
+
+// completion runs req on the runner *r of m. If the runner crashes before
+// responding, m is reloaded into *r and req retried once unless the runner
+// has crashed repeatedly.
+func (s *Server) completion(ctx context.Context, r *llm.LlamaServer, m *Model, keepAlive *api.Duration, priority int, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	respond := fn
+	var pending runeBuffer
+	fn = func(cr llm.CompletionResponse) {
+		if !pending.add(&cr) {
+			return
+		}
+
+		observeCompletion(m.ShortName, cr)
+		respond(cr)
+	}
+
+	var responded bool
+	err := (*r).Completion(ctx, req, func(cr llm.CompletionResponse) {
+		responded = true
+		fn(cr)
+	})
+	if !errors.Is(err, llm.ErrRunnerExited) || responded || !s.sched.runnerCrashed(m, *r, err) {
+		return err
+	}
+
+	slog.Info("retrying request after llama runner exited", "model", m.ShortName)
+	runnerCh, errCh := s.sched.GetRunner(ctx, m, *req.Options, keepAlive, priority)
+	select {
+	case runner := <-runnerCh:
+		*r = runner.llama
+	case err := <-errCh:
+		return err
+	}
+
+	err = (*r).Completion(ctx, req, fn)
+	if errors.Is(err, llm.ErrRunnerExited) {
+		s.sched.runnerCrashed(m, *r, err)
+	}
+
+	return err
+}
+
 func (s *Server) GenerateHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 	var req api.GenerateRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
+	unload := req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0
+	if req.Load != nil {
+		if req.Prompt != "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "load requires an empty prompt", "code": api.ErrorCodeInvalidRequest})
+			return
+		}
+
+		unload = !*req.Load
+	}
+
 	// expire the runner
-	if req.Prompt == "" && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+	if req.Prompt == "" && unload {
 		model, err := GetModel(req.Model)
 		if err != nil {
 			switch {
-			case os.IsNotExist(err):
-				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			case errors.Is(err, os.ErrNotExist):
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model), "code": api.ErrorCodeModelNotFound})
 			case err.Error() == "invalid model name":
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 			}
 			return
 		}
@@ -145,11 +360,24 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
-	if req.Format != "" && req.Format != "json" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be empty or \"json\""})
+	format, grammar, err := parseFormat(req.Format)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	if err := checkGrammar(req.Grammar, format != "" || grammar != ""); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if req.Grammar != "" {
+		grammar = req.Grammar
+	}
+
+	if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context", "code": api.ErrorCodeInvalidRequest})
 		return
-	} else if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
+	} else if req.Logprobs < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "logprobs must be a non-negative integer", "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
@@ -158,9 +386,29 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		caps = append(caps, CapabilityInsert)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	if len(req.Images) > 0 {
+		caps = append(caps, CapabilityVision)
+	}
+
+	if req.Think != nil && *req.Think {
+		caps = append(caps, CapabilityThinking)
+	}
+
+	ctx, done, ok := s.trackRequest(c, req.RequestID)
+	if !ok {
+		return
+	}
+	defer done()
+
+	r, m, opts, err := s.scheduleRunner(ctx, req.Model, caps, req.Options, req.KeepAlive, req.Priority)
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model), "code": api.ErrorCodeUnsupported})
+		return
+	} else if errors.Is(err, errCapabilityVision) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support images", req.Model), "code": api.ErrorCodeUnsupported})
+		return
+	} else if errors.Is(err, errCapabilityThinking) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support thinking", req.Model), "code": api.ErrorCodeUnsupported})
 		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
@@ -190,7 +438,18 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		if req.Template != "" {
 			tmpl, err = template.Parse(req.Template)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+				return
+			}
+		}
+
+		if req.Suffix != "" && !slices.Contains(tmpl.Vars(), "suffix") {
+			tmpl, err = m.fimTemplate(ctx, r)
+			if errors.Is(err, errCapabilities) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s %s", req.Model, err), "code": errorCode(err)})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 				return
 			}
 		}
@@ -220,34 +479,51 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 		var b bytes.Buffer
 		if req.Context != nil {
-			s, err := r.Detokenize(c.Request.Context(), req.Context)
+			s, err := r.Detokenize(ctx, req.Context)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 				return
 			}
 			b.WriteString(s)
 		}
 
 		if err := tmpl.Execute(&b, values); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 			return
 		}
 
 		prompt = b.String()
 	}
 
-	slog.Debug("generate request", "prompt", prompt, "images", images)
+	if err := checkPromptLength(ctx, r.Tokenize, prompt, opts.NumCtx, req.Truncate == nil || *req.Truncate); errors.Is(err, errPromptTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	if logSampled(c.GetHeader(logSampleHeader), rand.Float64()) {
+		slog.Debug("generate request", "prompt", prompt, "images", images, "options", opts)
+	}
+
+	thinking := m.thinking(prompt, req.Think)
+
+	stats := newStreamStats(req.StreamStats && (req.Stream == nil || *req.Stream), checkpointStart, checkpointLoaded)
 
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		if err := s.completion(ctx, &r, m, req.KeepAlive, req.Priority, llm.CompletionRequest{
+			Prompt:       prompt,
+			Images:       images,
+			Format:       format,
+			Grammar:      grammar,
+			Options:      opts,
+			Logprobs:     req.Logprobs,
+			ContextShift: req.ContextShift,
 		}, func(cr llm.CompletionResponse) {
 			res := api.GenerateResponse{
 				Model:      req.Model,
@@ -255,6 +531,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				Response:   cr.Content,
 				Done:       cr.Done,
 				DoneReason: cr.DoneReason,
+				Logprobs:   cr.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
@@ -263,18 +540,34 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				},
 			}
 
+			if thinking != nil {
+				res.Thinking, res.Response = thinking.add(cr.Content)
+				if cr.Done {
+					t, c := thinking.done()
+					res.Thinking, res.Response = res.Thinking+t, res.Response+c
+				}
+
+				if !*req.Think {
+					res.Thinking = ""
+				}
+			}
+
 			if _, err := sb.WriteString(cr.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
+				ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
 			}
 
 			if cr.Done {
+				res.Seed = &opts.Seed
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				if req.DebugRender {
+					res.RenderedPrompt = prompt
+				}
 
 				if !req.Raw {
-					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
+					tokens, err := r.Tokenize(ctx, prompt+sb.String())
 					if err != nil {
-						ch <- gin.H{"error": err.Error()}
+						ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
 						return
 					}
 					res.Context = tokens
@@ -282,18 +575,33 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 
 			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+
+			if m, ok := stats.add(cr); ok {
+				ch <- api.GenerateResponse{
+					Model:     req.Model,
+					CreatedAt: time.Now().UTC(),
+					Metrics:   m,
+				}
+			}
+		}); errors.Is(err, llm.ErrInvalidGrammar) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest, "code": api.ErrorCodeInvalidRequest}
+		} else if errors.Is(err, llm.ErrStopRegexUnsupported) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest, "code": api.ErrorCodeUnsupported}
+		} else if err != nil {
+			ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
-		var sb strings.Builder
+		var sb, tb strings.Builder
+		var logprobs []api.TokenLogprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(t.Response)
+				tb.WriteString(t.Thinking)
+				logprobs = append(logprobs, t.Logprobs...)
 				r = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -301,15 +609,23 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 					msg = "unexpected error format in response"
 				}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				status, ok := t["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				code, _ := t["code"].(string)
+				c.JSON(status, gin.H{"error": msg, "code": cmp.Or(code, api.ErrorCodeInternal)})
 				return
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response", "code": api.ErrorCodeInternal})
 				return
 			}
 		}
 
 		r.Response = sb.String()
+		r.Thinking = tb.String()
+		r.Logprobs = logprobs
 		c.JSON(http.StatusOK, r)
 		return
 	}
@@ -317,24 +633,167 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// GenerateBatchHandler generates completions of independent prompts with one
+// model. The prompts are sent to the runner at once so it decodes them
+// together in batches, up to its number of parallel requests at a time. An
+// error of one prompt is reported in its result rather than for the batch.
+func (s *Server) GenerateBatchHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.GenerateBatchRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	if len(req.Requests) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "requests are required", "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	ctx := c.Request.Context()
+	r, m, opts, err := s.scheduleRunner(ctx, req.Model, []Capability{CapabilityCompletion}, req.Options, req.KeepAlive, 0)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model), "code": api.ErrorCodeUnsupported})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	var g errgroup.Group
+	results := make([]api.GenerateBatchResult, len(req.Requests))
+	for i, item := range req.Requests {
+		g.Go(func() error {
+			result, err := s.generateBatchItem(ctx, r, m, opts, req, item)
+			if err != nil {
+				result = api.GenerateBatchResult{Error: err.Error(), Code: errorCode(err)}
+				if errors.Is(err, errInvalidOption) {
+					result.Code = api.ErrorCodeInvalidRequest
+				}
+			}
+
+			results[i] = result
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+
+	c.JSON(http.StatusOK, api.GenerateBatchResponse{
+		Model:         req.Model,
+		CreatedAt:     time.Now().UTC(),
+		Responses:     results,
+		TotalDuration: time.Since(checkpointStart),
+		LoadDuration:  checkpointLoaded.Sub(checkpointStart),
+	})
+}
+
+// generateBatchItem generates the completion of item of req with r, a runner
+// of m scheduled for req with scheduled
+func (s *Server) generateBatchItem(ctx context.Context, r llm.LlamaServer, m *Model, scheduled *api.Options, req api.GenerateBatchRequest, item api.GenerateBatchItem) (api.GenerateBatchResult, error) {
+	// the runner is shared by the items so it's loaded with the options of
+	// the batch only
+	keys := make([]string, 0, len(item.Options))
+	for key := range item.Options {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if isRunnerOption(key) {
+			return api.GenerateBatchResult{}, fmt.Errorf("%w %q: only the options of the batch can set it", errInvalidOption, key)
+		}
+	}
+
+	requestOpts := maps.Clone(req.Options)
+	if requestOpts == nil {
+		requestOpts = make(map[string]any)
+	}
+	maps.Copy(requestOpts, item.Options)
+
+	opts, err := modelOptions(m, requestOpts)
+	if err != nil {
+		return api.GenerateBatchResult{}, err
+	}
+	opts.Runner = scheduled.Runner
+
+	if item.Prompt == "" {
+		return api.GenerateBatchResult{}, fmt.Errorf("%w: prompt is required", errInvalidOption)
+	}
+
+	var msgs []api.Message
+	if item.System != "" {
+		msgs = append(msgs, api.Message{Role: "system", Content: item.System})
+	} else if m.System != "" {
+		msgs = append(msgs, api.Message{Role: "system", Content: m.System})
+	}
+	msgs = append(msgs, m.Messages...)
+	msgs = append(msgs, api.Message{Role: "user", Content: item.Prompt})
+
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, template.Values{Messages: msgs}); err != nil {
+		return api.GenerateBatchResult{}, err
+	}
+	prompt := b.String()
+
+	if err := checkPromptLength(ctx, r.Tokenize, prompt, opts.NumCtx, true); err != nil {
+		return api.GenerateBatchResult{}, err
+	}
+
+	var result api.GenerateBatchResult
+	var sb strings.Builder
+	if err := s.completion(ctx, &r, m, req.KeepAlive, 0, llm.CompletionRequest{
+		Prompt:  prompt,
+		Options: &opts,
+	}, func(cr llm.CompletionResponse) {
+		sb.WriteString(cr.Content)
+		if cr.Done {
+			result.DoneReason = cr.DoneReason
+			result.PromptEvalCount = cr.PromptEvalCount
+			result.PromptEvalDuration = cr.PromptEvalDuration
+			result.EvalCount = cr.EvalCount
+			result.EvalDuration = cr.EvalDuration
+		}
+	}); err != nil {
+		return api.GenerateBatchResult{}, err
+	}
+
+	result.Response = sb.String()
+	return result, nil
+}
+
+// isRunnerOption reports whether the option name is one of api.Runner, which
+// take effect when a model is loaded
+func isRunnerOption(name string) bool {
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[api.Runner]()) {
+		if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *Server) EmbedHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 	var req api.EmbedRequest
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
-	truncate := true
-
-	if req.Truncate != nil && !*req.Truncate {
-		truncate = false
-	}
+	truncate := req.Truncate == nil || *req.Truncate
+	normalized := req.Normalize == nil || *req.Normalize
 
 	var input []string
 
@@ -346,19 +805,19 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	case []any:
 		for _, v := range i {
 			if _, ok := v.(string); !ok {
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type", "code": api.ErrorCodeInvalidRequest})
 				return
 			}
 			input = append(input, v.(string))
 		}
 	default:
 		if req.Input != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type", "code": api.ErrorCodeInvalidRequest})
 			return
 		}
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive, 0)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -373,7 +832,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 
 	kvData, err := getKVData(m.ModelPath, false)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	}
 
@@ -381,21 +840,21 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	for i, s := range input {
 		tokens, err := r.Tokenize(c.Request.Context(), s)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 			return
 		}
 
 		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
 		if len(tokens) > ctxLen {
 			if !truncate {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("input length exceeds maximum context length: input %d is %d tokens but the context length is %d", i, len(tokens), ctxLen), "code": api.ErrorCodeContextExceeded})
 				return
 			}
 
 			tokens = tokens[:ctxLen]
 			s, err = r.Detokenize(c.Request.Context(), tokens)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 				return
 			}
 		}
@@ -405,33 +864,85 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		input[i] = s
 	}
 
-	var g errgroup.Group
-	embeddings := make([][]float32, len(input))
-	for i, text := range input {
-		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
-			if err != nil {
-				return err
-			}
-			embeddings[i] = normalize(embedding)
-			return nil
-		})
+	// embed embeds the inputs concurrently, calling progress after each
+	embed := func(progress func() error) ([][]float32, error) {
+		var g errgroup.Group
+		embeddings := make([][]float32, len(input))
+		for i, text := range input {
+			g.Go(func() error {
+				embedding, err := r.Embedding(c.Request.Context(), text)
+				if err != nil {
+					return err
+				}
+				if normalized {
+					embedding = normalize(embedding)
+				}
+				embeddings[i] = embedding
+				return progress()
+			})
+		}
+
+		if err := g.Wait(); err != nil {
+			slog.Error("embedding generation failed", "error", err)
+			return nil, fmt.Errorf("failed to generate embeddings: %w", err)
+		}
+
+		return embeddings, nil
 	}
 
-	if err := g.Wait(); err != nil {
-		slog.Error("embedding generation failed", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embeddings: %v", err)})
-		return
+	response := func(embeddings [][]float32) api.EmbedResponse {
+		return api.EmbedResponse{
+			Model:           req.Model,
+			Embeddings:      embeddings,
+			TotalDuration:   time.Since(checkpointStart),
+			LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+			PromptEvalCount: count,
+		}
 	}
 
-	resp := api.EmbedResponse{
-		Model:           req.Model,
-		Embeddings:      embeddings,
-		TotalDuration:   time.Since(checkpointStart),
-		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
-		PromptEvalCount: count,
+	if req.Stream == nil || !*req.Stream {
+		embeddings, err := embed(func() error { return nil })
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, response(embeddings))
+		return
 	}
-	c.JSON(http.StatusOK, resp)
+
+	// streamed requests report each embedded input before the embeddings
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+
+		var mu sync.Mutex
+		var embedded int
+		embeddings, err := embed(func() error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			embedded++
+			select {
+			case ch <- api.ProgressResponse{Status: fmt.Sprintf("embedded %d/%d", embedded, len(input)), Completed: int64(embedded), Total: int64(len(input))}:
+				return nil
+			case <-c.Request.Context().Done():
+				return c.Request.Context().Err()
+			}
+		})
+
+		var resp any = response(embeddings)
+		if err != nil {
+			resp = gin.H{"error": err.Error(), "code": errorCode(err)}
+		}
+
+		select {
+		case ch <- resp:
+		case <-c.Request.Context().Done():
+		}
+	}()
+
+	streamResponse(c, ch)
 }
 
 func normalize(vec []float32) []float32 {
@@ -451,17 +962,222 @@ func normalize(vec []float32) []float32 {
 	return vec
 }
 
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	t, release, err := s.tokenizer(req.Model)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+	defer release()
+
+	tokens, err := t.Tokenize(c.Request.Context(), req.Prompt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	if tokens == nil {
+		tokens = []int{}
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Tokens: tokens, Count: len(tokens)})
+}
+
+// RenderHandler renders the prompt of a chat as ChatHandler would, without
+// truncating it, and returns it without loading the model
+func (s *Server) RenderHandler(c *gin.Context) {
+	var req api.RenderRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	if req.Model == "" && req.Template == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model or template is required", "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	tools, err := validateTools(req.Tools)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	m := &Model{}
+	if req.Model != "" {
+		m, err = GetModel(req.Model)
+		if err != nil {
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model), "code": api.ErrorCodeModelNotFound})
+			case err.Error() == "invalid model name":
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+			}
+			return
+		}
+	}
+
+	tmpl := m.Template
+	if req.Template != "" {
+		if tmpl, err = template.Parse(req.Template); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+			return
+		}
+	}
+
+	msgs := append(slices.Clone(m.Messages), req.Messages...)
+	if system := cmp.Or(req.System, m.System); (len(req.Messages) == 0 || req.Messages[0].Role != "system") && system != "" {
+		msgs = append([]api.Message{{Role: "system", Content: system}}, msgs...)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, template.Values{Messages: msgs, Tools: tools}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.RenderResponse{Prompt: b.String()})
+}
+
+// EstimateHandler predicts how a model would be loaded given the memory free
+// now without loading it. Models that would have to be unloaded to make room
+// for it aren't accounted for.
+func (s *Server) EstimateHandler(c *gin.Context) {
+	var req api.EstimateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	// the options as a request would decode them from JSON
+	requestOpts := map[string]any{}
+	for k, v := range map[string]*int{"num_ctx": req.NumCtx, "num_gpu": req.NumGPU, "num_batch": req.NumBatch} {
+		if v != nil {
+			requestOpts[k] = float64(*v)
+		}
+	}
+
+	m, opts, err := resolveModel(req.Model, nil, requestOpts)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	ggml, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	gpus, estimate, numCtx := s.sched.estimate(m, ggml, opts)
+	totalLayers := int(ggml.KV().BlockCount()) + 1
+	resp := api.EstimateResponse{
+		Model:         req.Model,
+		Library:       gpus[0].Library,
+		Size:          int64(estimate.TotalSize),
+		SizeVRAM:      int64(estimate.VRAMSize),
+		SizeRAM:       int64(estimate.TotalSize - estimate.VRAMSize),
+		ContextLength: numCtx,
+		GPULayers:     min(estimate.Layers, totalLayers),
+		CPULayers:     totalLayers - min(estimate.Layers, totalLayers),
+	}
+
+	if estimate.Layers > 0 {
+		for i, g := range gpus {
+			resp.GPUs = append(resp.GPUs, api.EstimateGPU{
+				ID:          g.ID,
+				Name:        g.Name,
+				Library:     g.Library,
+				Size:        int64(estimate.GPUSizes[i]),
+				FreeMemory:  int64(g.FreeMemory),
+				TotalMemory: int64(g.TotalMemory),
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	t, release, err := s.tokenizer(req.Model)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+	defer release()
+
+	prompt, err := t.Detokenize(c.Request.Context(), req.Tokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Prompt: prompt})
+}
+
+// tokenizer returns a runner of the model if one is loaded, which release
+// frees for the scheduler to unload. Otherwise only the vocabulary of the
+// model is loaded, which release frees.
+func (s *Server) tokenizer(name string) (t llm.Tokenizer, release func(), err error) {
+	if name == "" {
+		return nil, nil, fmt.Errorf("model %w", errRequired)
+	}
+
+	m, err := GetModel(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a reference keeps the runner loaded until it's released
+	if runner, llama := s.sched.acquireLoaded(m.ModelPath); runner != nil {
+		return llama, func() { s.sched.release(runner) }, nil
+	}
+
+	vocab, err := llm.LoadVocab(m.ModelPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return vocab, func() { vocab.Close() }, nil
+}
+
 func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	var req api.EmbeddingRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive, 0)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -476,7 +1192,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
 	if err != nil {
 		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding", "code": api.ErrorCodeInternal})
 		return
 	}
 
@@ -496,27 +1212,25 @@ func (s *Server) PullHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	name := model.ParseName(cmp.Or(req.Model, req.Name))
 	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name", "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	if err := checkNameExists(name); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
+	ch, ok := s.runOperation(c, req, func(ctx context.Context, ch chan<- any) {
 		fn := func(r api.ProgressResponse) {
 			ch <- r
 		}
@@ -525,13 +1239,13 @@ func (s *Server) PullHandler(c *gin.Context) {
 			Insecure: req.Insecure,
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
 		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
 		}
-	}()
+	})
+	if !ok {
+		return
+	}
 
 	if req.Stream != nil && !*req.Stream {
 		waitForStream(c, ch)
@@ -546,10 +1260,10 @@ func (s *Server) PushHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
@@ -559,13 +1273,11 @@ func (s *Server) PushHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required", "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
+	ch, ok := s.runOperation(c, req, func(ctx context.Context, ch chan<- any) {
 		fn := func(r api.ProgressResponse) {
 			ch <- r
 		}
@@ -574,13 +1286,13 @@ func (s *Server) PushHandler(c *gin.Context) {
 			Insecure: req.Insecure,
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
 		if err := PushModel(ctx, model, regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
 		}
-	}()
+	})
+	if !ok {
+		return
+	}
 
 	if req.Stream != nil && !*req.Stream {
 		waitForStream(c, ch)
@@ -608,26 +1320,26 @@ func checkNameExists(name model.Name) error {
 func (s *Server) CreateHandler(c *gin.Context) {
 	var r api.CreateRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	name := model.ParseName(cmp.Or(r.Model, r.Name))
 	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg, "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	if err := checkNameExists(name); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	if r.Path == "" && r.Modelfile == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required", "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
@@ -635,7 +1347,7 @@ func (s *Server) CreateHandler(c *gin.Context) {
 	if r.Path != "" && r.Modelfile == "" {
 		f, err := os.Open(r.Path)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err)})
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err), "code": api.ErrorCodeInvalidRequest})
 			return
 		}
 		defer f.Close()
@@ -645,27 +1357,37 @@ func (s *Server) CreateHandler(c *gin.Context) {
 
 	f, err := parser.ParseFile(sr)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
+	if r.Path != "" && r.Modelfile == "" {
+		if err := f.ReadFiles(filepath.Dir(r.Path)); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+			return
+		}
+	}
+
+	quantization := strings.ToUpper(cmp.Or(r.Quantize, r.Quantization))
+	if quantization != "" && !slices.Contains(llm.QuantizationTypes(), quantization) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported quantization type %q, valid types are %s", cmp.Or(r.Quantize, r.Quantization), strings.Join(llm.QuantizationTypes(), ", ")), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	ch, ok := s.runOperation(c, r, func(ctx context.Context, ch chan<- any) {
 		fn := func(resp api.ProgressResponse) {
 			ch <- resp
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
-		quantization := cmp.Or(r.Quantize, r.Quantization)
-		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); errors.Is(err, errBadTemplate) {
-			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+		if err := CreateModel(ctx, name, filepath.Dir(r.Path), quantization, f, r.DryRun, fn); errors.Is(err, errBadTemplate) || errors.Is(err, errBadQuantization) || errors.Is(err, errBadMetadata) || errors.Is(err, llm.ErrMergeConflict) || errors.Is(err, convert.ErrUnsupportedArchitecture) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest, "code": api.ErrorCodeInvalidRequest}
 		} else if err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
 		}
-	}()
+	})
+	if !ok {
+		return
+	}
 
 	if r.Stream != nil && !*r.Stream {
 		waitForStream(c, ch)
@@ -678,39 +1400,90 @@ func (s *Server) CreateHandler(c *gin.Context) {
 func (s *Server) DeleteHandler(c *gin.Context) {
 	var r api.DeleteRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	n := model.ParseName(cmp.Or(r.Model, r.Name))
 	if !n.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name)), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	m, err := ParseNamedManifest(n)
 	if err != nil {
 		switch {
-		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		case errors.Is(err, os.ErrNotExist):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name)), "code": api.ErrorCodeModelNotFound})
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		}
 		return
 	}
 
 	if err := m.Remove(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	}
 
 	if err := m.RemoveLayers(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+}
+
+func (s *Server) PruneHandler(c *gin.Context) {
+	var r api.PruneRequest
+	if err := c.ShouldBindJSON(&r); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	pruned, err := PruneBlobs(s.loadedBlobs(), r.DryRun)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	}
+
+	resp := api.PruneResponse{Blobs: pruned}
+	for _, blob := range pruned {
+		resp.Size += blob.Size
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// loadedBlobs returns the digests of the blobs used by loaded models, which
+// may no longer be referenced by a manifest if the model was since removed
+func (s *Server) loadedBlobs() map[string]struct{} {
+	s.sched.loadedMu.Lock()
+	defer s.sched.loadedMu.Unlock()
+
+	blobs := make(map[string]struct{})
+	add := func(path string) {
+		if path != "" {
+			blobs[strings.Replace(filepath.Base(path), "-", ":", 1)] = struct{}{}
+		}
+	}
+
+	for _, runner := range s.sched.loaded {
+		add(runner.modelPath)
+		if runner.model != nil {
+			add(runner.model.ModelPath)
+			for _, adapter := range runner.model.Adapters {
+				add(adapter.Path)
+			}
+
+			for _, projector := range runner.model.ProjectorPaths {
+				add(projector)
+			}
+		}
+	}
+
+	return blobs
 }
 
 func (s *Server) ShowHandler(c *gin.Context) {
@@ -718,10 +1491,10 @@ func (s *Server) ShowHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
@@ -730,19 +1503,19 @@ func (s *Server) ShowHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		req.Model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required", "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
 	resp, err := GetModelInfo(req)
 	if err != nil {
 		switch {
-		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		case errors.Is(err, os.ErrNotExist):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model), "code": api.ErrorCodeModelNotFound})
 		case err.Error() == "invalid model name":
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		}
 		return
 	}
@@ -793,6 +1566,10 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		ModifiedAt: manifest.fi.ModTime(),
 	}
 
+	for _, cap := range m.Capabilities() {
+		resp.Capabilities = append(resp.Capabilities, string(cap))
+	}
+
 	var params []string
 	cs := 30
 	for k, v := range m.Options {
@@ -836,9 +1613,47 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		resp.ProjectorInfo = projectorData
 	}
 
+	if req.ShowTemplate || req.ShowParameters || req.ShowSystem {
+		sections := &api.ShowResponse{ModelInfo: resp.ModelInfo}
+		if req.ShowTemplate {
+			sections.Template = resp.Template
+		}
+
+		if req.ShowParameters {
+			sections.Parameters = resp.Parameters
+		}
+
+		if req.ShowSystem {
+			sections.System = resp.System
+		}
+
+		return sections, nil
+	}
+
 	return resp, nil
 }
 
+// trainedContextLengths caches the context lengths models were trained with
+// by the path of their blob, which never changes
+var trainedContextLengths sync.Map
+
+// trainedContextLength returns the context length the model at path was
+// trained with, or 0 if its metadata doesn't say
+func trainedContextLength(path string) (uint64, error) {
+	if n, ok := trainedContextLengths.Load(path); ok {
+		return n.(uint64), nil
+	}
+
+	kv, err := getKVData(path, false)
+	if err != nil {
+		return 0, err
+	}
+
+	n := kv.ContextLength()
+	trainedContextLengths.Store(path, n)
+	return n, nil
+}
+
 func getKVData(digest string, verbose bool) (llm.KV, error) {
 	maxArraySize := 0
 	if verbose {
@@ -865,10 +1680,13 @@ func getKVData(digest string, verbose bool) (llm.KV, error) {
 func (s *Server) ListHandler(c *gin.Context) {
 	ms, err := Manifests()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	}
 
+	// models can be filtered by the family and quantization of their GGUF
+	family, quantization := c.Query("family"), c.Query("quantization")
+
 	models := []api.ListModelResponse{}
 	for n, m := range ms {
 		var cf ConfigV2
@@ -887,6 +1705,16 @@ func (s *Server) ListHandler(c *gin.Context) {
 			}
 		}
 
+		if family != "" && !strings.EqualFold(cf.ModelFamily, family) && !slices.ContainsFunc(cf.ModelFamilies, func(f string) bool {
+			return strings.EqualFold(f, family)
+		}) {
+			continue
+		}
+
+		if quantization != "" && !strings.EqualFold(cf.FileType, quantization) {
+			continue
+		}
+
 		// tag should never be masked
 		models = append(models, api.ListModelResponse{
 			Model:      n.DisplayShortest(),
@@ -915,65 +1743,175 @@ func (s *Server) ListHandler(c *gin.Context) {
 func (s *Server) CopyHandler(c *gin.Context) {
 	var r api.CopyRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
-	src := model.ParseName(r.Source)
-	if !src.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", r.Source)})
+	src, dst, ok := copyNames(c, r.Source, r.Destination)
+	if !ok {
 		return
 	}
 
-	dst := model.ParseName(r.Destination)
-	if !dst.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
+	if r.Stream == nil || !*r.Stream {
+		if err := CopyModel(c.Request.Context(), src, dst, func(api.ProgressResponse) {}); errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source), "code": api.ErrorCodeModelNotFound})
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		}
+
 		return
 	}
 
-	if err := checkNameExists(dst); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(r api.ProgressResponse) {
+			ch <- r
+		}
+
+		if err := CopyModel(c.Request.Context(), src, dst, fn); errors.Is(err, os.ErrNotExist) {
+			ch <- gin.H{"error": fmt.Sprintf("model %q not found", r.Source), "code": api.ErrorCodeModelNotFound}
+		} else if err != nil {
+			ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
+		}
+	}()
+
+	streamResponse(c, ch)
+}
+
+// AliasHandler gives an existing model another name. The alias shares the
+// model's layers so deleting either keeps the layers the other needs.
+func (s *Server) AliasHandler(c *gin.Context) {
+	var r api.AliasRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	src, dst, ok := copyNames(c, r.Source, r.Destination)
+	if !ok {
 		return
 	}
 
-	if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
+	if err := CopyModel(c.Request.Context(), src, dst, func(api.ProgressResponse) {}); errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source), "code": api.ErrorCodeModelNotFound})
 	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+	}
+}
+
+// copyNames parses the source and destination of a copy or alias request,
+// aborting the request if either is invalid
+func copyNames(c *gin.Context, source, destination string) (src, dst model.Name, ok bool) {
+	src = model.ParseName(source)
+	if !src.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", source), "code": api.ErrorCodeInvalidRequest})
+		return src, dst, false
+	}
+
+	dst = model.ParseName(destination)
+	if !dst.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", destination), "code": api.ErrorCodeInvalidRequest})
+		return src, dst, false
 	}
+
+	if err := checkNameExists(dst); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return src, dst, false
+	}
+
+	return src, dst, true
 }
 
 func (s *Server) HeadBlobHandler(c *gin.Context) {
-	path, err := GetBlobsPath(c.Param("digest"))
+	store, err := blobStore()
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	}
 
-	if _, err := os.Stat(path); err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+	info, err := store.Stat(c.Request.Context(), c.Param("digest"))
+	switch {
+	case errors.Is(err, ErrInvalidDigestFormat):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	case errors.Is(err, os.ErrNotExist):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest")), "code": api.ErrorCodeBlobNotFound})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	}
 
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
 	c.Status(http.StatusOK)
 }
 
-func (s *Server) CreateBlobHandler(c *gin.Context) {
-	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
-		p, err := GetBlobsPath(ib)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+// GetBlobHandler serves the blob of a digest after checking it matches the
+// digest, unless OLLAMA_SKIP_VERIFY is set. Range requests are supported but
+// don't verify the blob themselves.
+func (s *Server) GetBlobHandler(c *gin.Context) {
+	digest := c.Param("digest")
+	store, err := blobStore()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	f, err := store.Open(c.Request.Context(), digest)
+	switch {
+	case errors.Is(err, ErrInvalidDigestFormat):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	case errors.Is(err, os.ErrNotExist):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", digest), "code": api.ErrorCodeBlobNotFound})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	// hashing the whole blob to send part of it, e.g. to resume a download,
+	// could take longer than sending it. Clients check the digest of the
+	// whole blob once they have it instead.
+	if !envconfig.SkipVerify() && c.GetHeader("Range") == "" {
+		if err := verifyBlobPath(f.Name()); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 			return
 		}
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("ETag", strconv.Quote(digest))
+	http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), f)
+}
+
+func (s *Server) CreateBlobHandler(c *gin.Context) {
+	store, err := blobStore()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
 
-		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
+		if _, err := store.Stat(c.Request.Context(), ib); errors.Is(err, os.ErrNotExist) {
 			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
 			delete(intermediateBlobs, c.Param("digest"))
 		} else if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 			return
 		} else {
 			c.Status(http.StatusOK)
@@ -981,18 +1919,17 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 		}
 	}
 
-	path, err := GetBlobsPath(c.Param("digest"))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	_, err = os.Stat(path)
+	// a blob the remote store has is as good as a local one: it's fetched
+	// when it's used
+	_, err = store.Stat(c.Request.Context(), c.Param("digest"))
 	switch {
+	case errors.Is(err, ErrInvalidDigestFormat):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
 	case errors.Is(err, os.ErrNotExist):
 		// noop
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	default:
 		c.Status(http.StatusOK)
@@ -1001,12 +1938,12 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 
 	layer, err := NewLayer(c.Request.Body, "")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
 	}
 
 	if layer.Digest != c.Param("digest") {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
@@ -1061,7 +1998,8 @@ func allowedHost(host string) bool {
 
 func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if addr == nil {
+		// browsers can't reach a unix socket so requests to it can't be rebound
+		if addr == nil || addr.Network() == "unix" {
 			c.Next()
 			return
 		}
@@ -1108,68 +2046,144 @@ func (s *Server) GenerateRoutes() http.Handler {
 	}
 	config.AllowOrigins = envconfig.Origins()
 
-	r := gin.Default()
+	r := gin.New()
 	r.Use(
+		requestLogMiddleware(),
+		gin.Recovery(),
 		cors.New(config),
 		allowedHostsMiddleware(s.addr),
+		authMiddleware(apiAuthenticator()),
+		s.activeMiddleware(),
 	)
 
+	if envconfig.Metrics() {
+		r.Use(metricsMiddleware())
+		r.GET("/metrics", s.metricsHandler())
+	}
+
+	rateLimit := rateLimitMiddleware(newRateLimiter(envconfig.ModelRateLimits()))
+
+	// set once every route is registered
+	var versionResponse api.VersionResponse
+
 	r.POST("/api/pull", s.PullHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.POST("/api/generate", rateLimit, imageURLMiddleware(), s.GenerateHandler)
+	r.POST("/api/generate/batch", rateLimit, s.GenerateBatchHandler)
+	r.DELETE("/api/generate/:id", s.CancelHandler)
+	r.POST("/api/chat", rateLimit, imageURLMiddleware(), s.ChatHandler)
+	r.POST("/api/embed", rateLimit, s.EmbedHandler)
+	r.POST("/api/embeddings", rateLimit, s.EmbeddingsHandler)
+	r.POST("/api/tokenize", s.TokenizeHandler)
+	r.POST("/api/detokenize", s.DetokenizeHandler)
+	r.POST("/api/render", s.RenderHandler)
+	r.POST("/api/estimate", s.EstimateHandler)
+	r.POST("/api/cache/save", s.SaveCacheHandler)
+	r.POST("/api/cache/restore", s.RestoreCacheHandler)
 	r.POST("/api/create", s.CreateHandler)
 	r.POST("/api/push", s.PushHandler)
 	r.POST("/api/copy", s.CopyHandler)
+	r.POST("/api/alias", s.AliasHandler)
 	r.DELETE("/api/delete", s.DeleteHandler)
-	r.POST("/api/show", s.ShowHandler)
+	r.POST("/api/prune", s.PruneHandler)
+	r.POST("/api/show", compressMiddleware(), s.ShowHandler)
 	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
-	r.GET("/api/ps", s.PsHandler)
+	r.GET("/api/blobs/:digest", s.GetBlobHandler)
+	r.GET("/api/ps", compressMiddleware(), s.PsHandler)
+	r.POST("/api/reload", s.ReloadHandler)
+	r.GET("/api/events", s.EventsHandler)
 
 	// Compatibility endpoints
-	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
-	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
-	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
-	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
-	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+	r.POST("/v1/chat/completions", openai.ChatMiddleware(), rateLimit, s.ChatHandler)
+	r.POST("/v1/completions", openai.CompletionsMiddleware(), rateLimit, s.GenerateHandler)
+	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), rateLimit, s.EmbedHandler)
+	r.GET("/v1/models", compressMiddleware(), openai.ListMiddleware(), s.ListHandler)
+	r.GET("/v1/models/:model", compressMiddleware(), openai.RetrieveMiddleware(), s.ShowHandler)
 
 	for _, method := range []string{http.MethodGet, http.MethodHead} {
 		r.Handle(method, "/", func(c *gin.Context) {
 			c.String(http.StatusOK, "Ollama is running")
 		})
 
-		r.Handle(method, "/api/tags", s.ListHandler)
+		r.Handle(method, "/health", s.HealthHandler)
+		r.Handle(method, "/ready", s.ReadyHandler)
+
+		r.Handle(method, "/api/tags", compressMiddleware(), s.ListHandler)
 		r.Handle(method, "/api/version", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"version": version.Version})
+			c.JSON(http.StatusOK, versionResponse)
 		})
 	}
 
+	versionResponse = api.VersionResponse{
+		Version:      version.Version,
+		APIVersion:   apiVersion,
+		Capabilities: apiCapabilities(r.Routes()),
+	}
+
 	return r
 }
 
-func Serve(ln net.Listener) error {
-	level := slog.LevelInfo
-	if envconfig.Debug() {
-		level = slog.LevelDebug
+// apiVersion is the semantic version of the API. The minor version is
+// bumped with new capabilities and the major version with breaking changes.
+const apiVersion = "1.0.0"
+
+// apiFeatures are the capabilities of the API which aren't routes of their
+// own
+var apiFeatures = []string{
+	"image_urls",
+	"logprobs",
+	"stop_regex",
+	"stream_stats",
+	"structured_outputs",
+	"thinking",
+	"tools",
+}
+
+// apiCapabilities returns the sorted capabilities of the API given its
+// routes: the first path element of each /api route, "openai" for the
+// OpenAI compatible /v1 routes and the apiFeatures
+func apiCapabilities(routes gin.RoutesInfo) []string {
+	capabilities := slices.Clone(apiFeatures)
+	for _, route := range routes {
+		if name, ok := strings.CutPrefix(route.Path, "/api/"); ok {
+			name, _, _ = strings.Cut(name, "/")
+			capabilities = append(capabilities, name)
+		} else if strings.HasPrefix(route.Path, "/v1/") {
+			capabilities = append(capabilities, "openai")
+		}
 	}
 
-	slog.Info("server config", "env", envconfig.Values())
-	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level:     level,
-		AddSource: true,
-		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
-			if attr.Key == slog.SourceKey {
-				source := attr.Value.Any().(*slog.Source)
-				source.File = filepath.Base(source.File)
-			}
+	slices.Sort(capabilities)
+	return slices.Compact(capabilities)
+}
 
-			return attr
-		},
-	})
+// newHTTPServer returns a server for handler that accepts both HTTP/1.1 and
+// HTTP/2 without TLS (h2c), with timeouts from the environment
+func newHTTPServer(handler http.Handler) *http.Server {
+	h2s := &http2.Server{IdleTimeout: envconfig.HTTPIdleTimeout()}
+	srv := &http.Server{
+		Handler:     h2c.NewHandler(handler, h2s),
+		ReadTimeout: envconfig.HTTPReadTimeout(),
+		IdleTimeout: envconfig.HTTPIdleTimeout(),
+	}
+
+	// let Shutdown tell HTTP/2 clients to stop sending new requests
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		slog.Warn("failed to configure http2 server", "error", err)
+	}
 
-	slog.SetDefault(slog.New(handler))
+	return srv
+}
+
+func Serve(ln net.Listener) error {
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr)))
+	slog.Info("server config", "env", envconfig.Values())
+
+	// fail before anything else if the certificate can't be served
+	certs, err := tlsReloader()
+	if err != nil {
+		return err
+	}
 
 	blobsDir, err := GetBlobsPath("")
 	if err != nil {
@@ -1203,24 +2217,42 @@ func Serve(ln net.Listener) error {
 	http.Handle("/", s.GenerateRoutes())
 
 	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
-	srvr := &http.Server{
-		// Use http.DefaultServeMux so we get net/http/pprof for
-		// free.
-		//
-		// TODO(bmizerany): Decide if we want to make this
-		// configurable so it is not exposed by default, or allow
-		// users to bind it to a different port. This was a quick
-		// and easy way to get pprof, but it may not be the best
-		// way.
-		Handler: nil,
-	}
-
-	// listen for a ctrl+c and stop any loaded llm
+	// Use http.DefaultServeMux so we get net/http/pprof for
+	// free.
+	//
+	// TODO(bmizerany): Decide if we want to make this
+	// configurable so it is not exposed by default, or allow
+	// users to bind it to a different port. This was a quick
+	// and easy way to get pprof, but it may not be the best
+	// way.
+	srvr := newHTTPServer(http.DefaultServeMux)
+	if certs != nil {
+		configureTLS(srvr, certs)
+	}
+
+	// listen for a ctrl+c, drain in-flight requests and stop any loaded llm
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-signals
-		srvr.Close()
+		timeout := envconfig.ShutdownTimeout()
+		slog.Info("shutting down, waiting for in-flight requests", "timeout", timeout)
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+		// a second signal stops waiting
+		go func() {
+			select {
+			case <-signals:
+			case <-shutdownCtx.Done():
+			}
+			cancel()
+		}()
+
+		if err := s.shutdown(shutdownCtx, srvr); err != nil {
+			slog.Warn("in-flight requests did not finish, cancelling them", "error", err)
+		}
+		cancel()
+
 		schedDone()
 		sched.unloadAllRunners()
 		runners.Cleanup(build.EmbedFS)
@@ -1234,11 +2266,15 @@ func Serve(ln net.Listener) error {
 	s.sched.Run(schedCtx)
 
 	// At startup we retrieve GPU information so we can get log messages before loading a model
-	// This will log warnings to the log in case we have problems with detected GPUs
-	gpus := gpu.GetGPUInfo()
-	gpus.LogDetails()
+	// This will log warnings to the log in case we have problems with detected GPUs. Discovery
+	// runs in the background so /health answers while /ready waits for it.
+	go s.discoverGPUs()
 
-	err = srvr.Serve(ln)
+	if certs != nil {
+		err = srvr.ServeTLS(ln, "", "")
+	} else {
+		err = srvr.Serve(ln)
+	}
 	// If server is closed from the signal handler, wait for the ctx to be done
 	// otherwise error out quickly
 	if !errors.Is(err, http.ErrServerClosed) {
@@ -1262,25 +2298,51 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 			if !ok {
 				status = http.StatusInternalServerError
 			}
+			code, _ := r["code"].(string)
 			if errorMsg, ok := r["error"].(string); ok {
-				c.JSON(status, gin.H{"error": errorMsg})
+				c.JSON(status, gin.H{"error": errorMsg, "code": cmp.Or(code, api.ErrorCodeInternal)})
 				return
 			} else {
-				c.JSON(status, gin.H{"error": "unexpected error format in progress response"})
+				c.JSON(status, gin.H{"error": "unexpected error format in progress response", "code": api.ErrorCodeInternal})
 				return
 			}
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected progress response"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected progress response", "code": api.ErrorCodeInternal})
 			return
 		}
 	}
-	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response", "code": api.ErrorCodeInternal})
 }
 
+// streamResponse writes the values of ch as NDJSON or, for clients that
+// accept text/event-stream, as the data of server-sent events
 func streamResponse(c *gin.Context, ch chan any) {
-	c.Header("Content-Type", "application/x-ndjson")
+	sse := strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+
+	// an error sent before any response is returned with its status, if it
+	// has one, instead of being streamed
+	val, ok := <-ch
+	if h, isError := val.(gin.H); ok && isError {
+		if status, ok := h["status"].(int); ok {
+			delete(h, "status")
+			c.JSON(status, h)
+			return
+		}
+	}
+
+	first := true
 	c.Stream(func(w io.Writer) bool {
-		val, ok := <-ch
+		if !first {
+			val, ok = <-ch
+		}
+
+		first = false
 		if !ok {
 			return false
 		}
@@ -1291,8 +2353,13 @@ func streamResponse(c *gin.Context, ch chan any) {
 			return false
 		}
 
-		// Delineate chunks with new-line delimiter
-		bts = append(bts, '\n')
+		if sse {
+			bts = append(append([]byte("data: "), bts...), '\n', '\n')
+		} else {
+			// Delineate chunks with new-line delimiter
+			bts = append(bts, '\n')
+		}
+
 		if _, err := w.Write(bts); err != nil {
 			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
 			return false
@@ -1302,37 +2369,40 @@ func streamResponse(c *gin.Context, ch chan any) {
 	})
 }
 
-func (s *Server) PsHandler(c *gin.Context) {
-	models := []api.ProcessModelResponse{}
+// EventsHandler streams scheduler events to the client as server-sent events
+// until the client disconnects or falls too far behind.
+func (s *Server) EventsHandler(c *gin.Context) {
+	ch, unsubscribe := s.sched.events.subscribe()
+	defer unsubscribe()
 
-	for _, v := range s.sched.loaded {
-		model := v.model
-		modelDetails := api.ModelDetails{
-			Format:            model.Config.ModelFormat,
-			Family:            model.Config.ModelFamily,
-			Families:          model.Config.ModelFamilies,
-			ParameterSize:     model.Config.ModelType,
-			QuantizationLevel: model.Config.FileType,
-		}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
 
-		mr := api.ProcessModelResponse{
-			Model:     model.ShortName,
-			Name:      model.ShortName,
-			Size:      int64(v.estimatedTotal),
-			SizeVRAM:  int64(v.estimatedVRAM),
-			Digest:    model.Digest,
-			Details:   modelDetails,
-			ExpiresAt: v.expiresAt,
-		}
-		// The scheduler waits to set expiresAt, so if a model is loading it's
-		// possible that it will be set to the unix epoch. For those cases, just
-		// calculate the time w/ the sessionDuration instead.
-		var epoch time.Time
-		if v.expiresAt == epoch {
-			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
+	// send the headers now so clients know they are subscribed
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return false
+			}
+
+			c.SSEvent(e.Type, e)
+			return true
+		case <-c.Request.Context().Done():
+			return false
 		}
+	})
+}
+
+func (s *Server) PsHandler(c *gin.Context) {
+	models := []api.ProcessModelResponse{}
 
-		models = append(models, mr)
+	for _, v := range s.sched.loaded {
+		models = append(models, processModel(v))
 	}
 
 	slices.SortStableFunc(models, func(i, j api.ProcessModelResponse) int {
@@ -1343,15 +2413,100 @@ func (s *Server) PsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
 }
 
+// processModel describes the loaded runner v
+func processModel(v *runnerRef) api.ProcessModelResponse {
+	model := v.model
+	modelDetails := api.ModelDetails{
+		Format:            model.Config.ModelFormat,
+		Family:            model.Config.ModelFamily,
+		Families:          model.Config.ModelFamilies,
+		ParameterSize:     model.Config.ModelType,
+		QuantizationLevel: model.Config.FileType,
+	}
+
+	mr := api.ProcessModelResponse{
+		Model:     model.ShortName,
+		Name:      model.ShortName,
+		Size:      int64(v.estimatedTotal),
+		SizeVRAM:  int64(v.estimatedVRAM),
+		Digest:    model.Digest,
+		Details:   modelDetails,
+		ExpiresAt: v.expiresAt,
+		GPULayers: v.gpuLayers,
+		CPULayers: v.totalLayers - v.gpuLayers,
+		Replica:   v.replica,
+	}
+	if v.Options != nil {
+		// the runner's context is split between its parallel requests
+		mr.ContextLength = v.Options.NumCtx / max(v.numParallel, 1)
+	}
+	// The scheduler waits to set expiresAt, so if a model is loading it's
+	// possible that it will be set to the unix epoch. For those cases, just
+	// calculate the time w/ the sessionDuration instead.
+	var epoch time.Time
+	if v.expiresAt == epoch {
+		mr.ExpiresAt = time.Now().Add(v.sessionDuration)
+	}
+
+	return mr
+}
+
+// ReloadHandler unloads the runner of a model, once its requests complete,
+// and loads the model again with its current manifest and parameters
+func (s *Server) ReloadHandler(c *gin.Context) {
+	var req api.ReloadRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	if req.Model == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required", "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	model, err := GetModel(req.Model)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	if err := model.verifyBlobs(); err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	opts, err := modelOptions(model, nil)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	// canceling the context releases the runner to expire after keep_alive
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	runnerCh, errCh := s.sched.ReloadRunner(ctx, model, opts, req.KeepAlive)
+	select {
+	case runner := <-runnerCh:
+		c.JSON(http.StatusOK, processModel(runner))
+	case err := <-errCh:
+		handleScheduleError(c, req.Model, err)
+	}
+}
+
 func (s *Server) ChatHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 
 	var req api.ChatRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 		return
 	}
 
@@ -1360,12 +2515,12 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		model, err := GetModel(req.Model)
 		if err != nil {
 			switch {
-			case os.IsNotExist(err):
-				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			case errors.Is(err, os.ErrNotExist):
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model), "code": api.ErrorCodeModelNotFound})
 			case err.Error() == "invalid model name":
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
 			}
 			return
 		}
@@ -1381,14 +2536,58 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	format, grammar, err := parseFormat(req.Format)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	if err := checkGrammar(req.Grammar, format != "" || grammar != ""); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if req.Grammar != "" {
+		grammar = req.Grammar
+	}
+
+	if req.Tools, err = validateTools(req.Tools); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
 	caps := []Capability{CapabilityCompletion}
 	if len(req.Tools) > 0 {
 		caps = append(caps, CapabilityTools)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	if slices.ContainsFunc(req.Messages, func(m api.Message) bool { return len(m.Images) > 0 }) {
+		caps = append(caps, CapabilityVision)
+	}
+
+	if req.Think != nil && *req.Think {
+		caps = append(caps, CapabilityThinking)
+	}
+
+	name := model.ParseName(req.Model).String()
+	sessionID, history, ok := s.chatSession(c, req, name)
+	if !ok {
+		return
+	}
+
+	ctx, done, ok := s.trackRequest(c, req.RequestID)
+	if !ok {
+		return
+	}
+	defer done()
+
+	r, m, opts, err := s.scheduleRunner(ctx, req.Model, caps, req.Options, req.KeepAlive, req.Priority)
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model), "code": api.ErrorCodeUnsupported})
+		return
+	} else if errors.Is(err, errCapabilityVision) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support images", req.Model), "code": api.ErrorCodeUnsupported})
+		return
+	} else if errors.Is(err, errCapabilityThinking) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support thinking", req.Model), "code": api.ErrorCodeUnsupported})
 		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
@@ -1408,26 +2607,58 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	msgs := append(m.Messages, req.Messages...)
-	if req.Messages[0].Role != "system" && m.System != "" {
-		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+	// sessions keep the messages sent by the client, including its system
+	// message, without those of the model
+	messages := append(history, req.Messages...)
+	if sessionID != "" && req.System != "" && messages[0].Role != "system" {
+		messages = append([]api.Message{{Role: "system", Content: req.System}}, messages...)
+	}
+
+	msgs := append(m.Messages, messages...)
+	if system := cmp.Or(req.System, m.System); messages[0].Role != "system" && system != "" {
+		msgs = append([]api.Message{{Role: "system", Content: system}}, msgs...)
 	}
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools)
+	truncate := req.Truncate == nil || *req.Truncate
+	prompt, images, err := chatPrompt(ctx, m, r.Tokenize, opts, msgs, req.Tools, truncate)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	if err := checkPromptLength(ctx, r.Tokenize, prompt, opts.NumCtx, truncate); errors.Is(err, errPromptTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": errorCode(err)})
 		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	if logSampled(c.GetHeader(logSampleHeader), rand.Float64()) {
+		slog.Debug("chat request", "images", len(images), "prompt", prompt, "options", opts)
 	}
 
-	slog.Debug("chat request", "images", len(images), "prompt", prompt)
+	thinking := m.thinking(prompt, req.Think)
+
+	stats := newStreamStats(req.StreamStats && (req.Stream == nil || *req.Stream), checkpointStart, checkpointLoaded)
+
+	// streamed tool calls are sent as they are generated
+	var tools *toolCallStreamer
+	if len(req.Tools) > 0 && (req.Stream == nil || *req.Stream) {
+		tools = m.newToolCallStreamer()
+	}
 
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+
+		// content is the whole response to keep in the session
+		var content strings.Builder
+		if err := s.completion(ctx, &r, m, req.KeepAlive, req.Priority, llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
-			Format:  req.Format,
+			Format:  format,
+			Grammar: grammar,
 			Options: opts,
 		}, func(r llm.CompletionResponse) {
 			res := api.ChatResponse{
@@ -1444,24 +2675,90 @@ func (s *Server) ChatHandler(c *gin.Context) {
 				},
 			}
 
+			if thinking != nil {
+				res.Message.Thinking, res.Message.Content = thinking.add(r.Content)
+				if r.Done {
+					t, c := thinking.done()
+					res.Message.Thinking, res.Message.Content = res.Message.Thinking+t, res.Message.Content+c
+				}
+
+				if !*req.Think {
+					res.Message.Thinking = ""
+				}
+
+				// the rest of the response only sees the content
+				r.Content = res.Message.Content
+			}
+
+			if tools != nil {
+				res.Message.Content, res.Message.ToolCalls = tools.add(r.Content)
+				if r.Done {
+					if len(res.Message.ToolCalls) > 0 {
+						// send the last fragments before the complete tool calls
+						ch <- api.ChatResponse{
+							Model:     req.Model,
+							CreatedAt: time.Now().UTC(),
+							Message:   api.Message{Role: "assistant", ToolCalls: res.Message.ToolCalls},
+						}
+					}
+
+					content, toolCalls := tools.done()
+					res.Message.Content += content
+					res.Message.ToolCalls = toolCalls
+				}
+			}
+
 			if r.Done {
+				res.Seed = &opts.Seed
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				if req.DebugRender {
+					res.RenderedPrompt = prompt
+				}
+			}
+
+			if sessionID != "" {
+				content.WriteString(r.Content)
+				if r.Done {
+					reply := api.Message{Role: "assistant", Content: content.String()}
+					if len(req.Tools) > 0 {
+						if toolCalls, ok := m.parseToolCalls(reply.Content); ok {
+							reply = api.Message{Role: "assistant", ToolCalls: toolCalls}
+						}
+					}
+
+					s.sessions.put(sessionID, name, append(slices.Clip(messages), reply))
+					res.SessionID = sessionID
+				}
 			}
 
 			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+
+			if m, ok := stats.add(r); ok {
+				ch <- api.ChatResponse{
+					Model:     req.Model,
+					CreatedAt: time.Now().UTC(),
+					Message:   api.Message{Role: "assistant"},
+					Metrics:   m,
+				}
+			}
+		}); errors.Is(err, llm.ErrInvalidGrammar) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest, "code": api.ErrorCodeInvalidRequest}
+		} else if errors.Is(err, llm.ErrStopRegexUnsupported) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest, "code": api.ErrorCodeUnsupported}
+		} else if err != nil {
+			ch <- gin.H{"error": err.Error(), "code": errorCode(err)}
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
-		var sb strings.Builder
+		var sb, tb strings.Builder
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sb.WriteString(t.Message.Content)
+				tb.WriteString(t.Message.Thinking)
 				resp = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -1469,15 +2766,22 @@ func (s *Server) ChatHandler(c *gin.Context) {
 					msg = "unexpected error format in response"
 				}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				status, ok := t["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				code, _ := t["code"].(string)
+				c.JSON(status, gin.H{"error": msg, "code": cmp.Or(code, api.ErrorCodeInternal)})
 				return
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response", "code": api.ErrorCodeInternal})
 				return
 			}
 		}
 
 		resp.Message.Content = sb.String()
+		resp.Message.Thinking = tb.String()
 
 		if len(req.Tools) > 0 {
 			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
@@ -1493,17 +2797,89 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// streamStatsInterval is the number of generated tokens between stats frames
+const streamStatsInterval = 16
+
+// streamStats tracks generation progress so intermediate stats frames can be
+// emitted while streaming. A nil *streamStats never emits frames.
+type streamStats struct {
+	start, loaded, first time.Time
+
+	count int
+}
+
+func newStreamStats(enabled bool, start, loaded time.Time) *streamStats {
+	if !enabled {
+		return nil
+	}
+
+	return &streamStats{start: start, loaded: loaded}
+}
+
+// add records a completion response and returns the current metrics when a
+// stats frame is due
+func (s *streamStats) add(cr llm.CompletionResponse) (api.Metrics, bool) {
+	if s == nil || cr.Done || cr.Content == "" {
+		return api.Metrics{}, false
+	}
+
+	now := time.Now()
+	if s.count == 0 {
+		s.first = now
+	}
+
+	s.count++
+	if s.count%streamStatsInterval != 0 {
+		return api.Metrics{}, false
+	}
+
+	return api.Metrics{
+		TotalDuration:      now.Sub(s.start),
+		LoadDuration:       s.loaded.Sub(s.start),
+		PromptEvalDuration: s.first.Sub(s.loaded),
+		EvalCount:          s.count,
+		EvalDuration:       now.Sub(s.first),
+	}, true
+}
+
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errCapabilities):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeUnsupported})
+	case errors.Is(err, errRequired), errors.Is(err, errInvalidOption):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
 	case errors.Is(err, context.Canceled):
-		c.JSON(499, gin.H{"error": "request canceled"})
+		c.JSON(499, gin.H{"error": "request canceled", "code": api.ErrorCodeRequestCanceled})
 	case errors.Is(err, ErrMaxQueue):
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "code": api.ErrorCodeServerBusy})
 	case errors.Is(err, os.ErrNotExist):
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name), "code": api.ErrorCodeModelNotFound})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+	}
+}
+
+// errorCode returns the api error code of an error which isn't caused by an
+// invalid request
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return api.ErrorCodeRequestCanceled
+	case errors.Is(err, errManifestNotFound):
+		return api.ErrorCodeModelNotFound
+	case errors.Is(err, errUnauthorized):
+		return api.ErrorCodeUnauthorized
+	case errors.Is(err, errModelCorrupted):
+		return api.ErrorCodeModelCorrupted
+	case errors.Is(err, errCapabilities), errors.Is(err, llm.ErrStopRegexUnsupported):
+		return api.ErrorCodeUnsupported
+	case errors.Is(err, ErrMaxQueue):
+		return api.ErrorCodeServerBusy
+	case errors.Is(err, errPromptTooLong):
+		return api.ErrorCodeContextExceeded
+	case errors.Is(err, llm.ErrInsufficientMemory):
+		return api.ErrorCodeOutOfMemory
 	default:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return api.ErrorCodeInternal
 	}
 }
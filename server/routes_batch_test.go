@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// mockBatchRunner echoes prompts and fails those containing "fail"
+type mockBatchRunner struct {
+	mockRunner
+
+	mu      sync.Mutex
+	prompts []string
+	options []api.Options
+}
+
+func (m *mockBatchRunner) Completion(_ context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	m.mu.Lock()
+	m.prompts = append(m.prompts, r.Prompt)
+	m.options = append(m.options, *r.Options)
+	m.mu.Unlock()
+
+	if strings.Contains(r.Prompt, "fail") {
+		return errors.New("decode failed")
+	}
+
+	fn(llm.CompletionResponse{Content: "re: "})
+	fn(llm.CompletionResponse{Content: r.Prompt, Done: true, DoneReason: "stop", EvalCount: 2})
+	return nil
+}
+
+func TestGenerateBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockBatchRunner
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     gpu.GetGPUInfo,
+			getCpuFn:     gpu.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"{{ range .Messages }}{{ .Content }}{{ end }}\"", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	t.Run("mixed results", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{
+			Model: "test",
+			Requests: []api.GenerateBatchItem{
+				{Prompt: "hello"},
+				{Prompt: "please fail"},
+				{Prompt: "bad option", Options: map[string]any{"min_p": 2}},
+				{Prompt: "world", System: "be brief. "},
+				{},
+			},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.GenerateBatchResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "test" {
+			t.Errorf("expected model %q, got %q", "test", resp.Model)
+		}
+
+		var results []api.GenerateBatchResult
+		for _, r := range resp.Responses {
+			// keep the error codes and the start of the messages
+			r.Error, _, _ = strings.Cut(r.Error, ":")
+			results = append(results, r)
+		}
+
+		expect := []api.GenerateBatchResult{
+			{Response: "re: hello", DoneReason: "stop", EvalCount: 2},
+			{Error: "decode failed", Code: api.ErrorCodeInternal},
+			{Error: "invalid option \"min_p\"", Code: api.ErrorCodeInvalidRequest},
+			{Response: "re: be brief. world", DoneReason: "stop", EvalCount: 2},
+			{Error: "invalid option", Code: api.ErrorCodeInvalidRequest},
+		}
+
+		if diff := cmp.Diff(expect, results); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// only the valid items reach the runner
+		if len(mock.prompts) != 3 {
+			t.Errorf("expected 3 completions, got %d: %v", len(mock.prompts), mock.prompts)
+		}
+	})
+
+	t.Run("batch options", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{
+			Model:    "test",
+			Options:  map[string]any{"min_p": 0.5},
+			Requests: []api.GenerateBatchItem{{Prompt: "hello"}, {Prompt: "world", Options: map[string]any{"min_p": 2}}},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.GenerateBatchResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Responses) != 2 {
+			t.Fatalf("expected 2 responses, got %d", len(resp.Responses))
+		}
+
+		if resp.Responses[0].Error != "" || resp.Responses[0].Response != "re: hello" {
+			t.Errorf("expected the first item to succeed, got %+v", resp.Responses[0])
+		}
+
+		if resp.Responses[1].Code != api.ErrorCodeInvalidRequest {
+			t.Errorf("expected the item option to override the batch option, got %+v", resp.Responses[1])
+		}
+	})
+
+	t.Run("runner options", func(t *testing.T) {
+		mock.mu.Lock()
+		mock.options = nil
+		mock.mu.Unlock()
+
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{
+			Model:   "test",
+			Options: map[string]any{"num_ctx": 4096},
+			Requests: []api.GenerateBatchItem{
+				{Prompt: "hello"},
+				{Prompt: "world", Options: map[string]any{"num_ctx": 1024}},
+				{Prompt: "threads", Options: map[string]any{"temperature": 0.5, "num_thread": 2}},
+			},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.GenerateBatchResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Responses) != 3 {
+			t.Fatalf("expected 3 responses, got %d", len(resp.Responses))
+		}
+
+		if resp.Responses[0].Error != "" {
+			t.Errorf("expected the first item to succeed, got %+v", resp.Responses[0])
+		}
+
+		// options the runner is loaded with can't be set per item
+		for i, key := range map[int]string{1: "num_ctx", 2: "num_thread"} {
+			if r := resp.Responses[i]; r.Code != api.ErrorCodeInvalidRequest || !strings.Contains(r.Error, key) {
+				t.Errorf("expected item %d to be rejected for %s, got %+v", i, key, r)
+			}
+		}
+
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		if len(mock.options) != 1 || mock.options[0].NumCtx != 4096 {
+			t.Errorf("expected one completion with the batch's num_ctx, got %+v", mock.options)
+		}
+	})
+
+	t.Run("invalid batch options", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{
+			Model:    "test",
+			Options:  map[string]any{"min_p": 2},
+			Requests: []api.GenerateBatchItem{{Prompt: "hello"}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{Model: "test"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.GenerateBatchHandler, api.GenerateBatchRequest{
+			Model:    "missing",
+			Requests: []api.GenerateBatchItem{{Prompt: "hello"}},
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", w.Code, w.Body)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestGetBlob(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := &Server{}
+	router := s.GenerateRoutes()
+
+	do := func(t *testing.T, method, path string, body []byte, header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for k, v := range header {
+			r.Header[k] = v
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	blob := bytes.Repeat([]byte("ollama"), 1024)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	if w := do(t, http.MethodPost, "/api/blobs/"+digest, blob, nil); w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body)
+	}
+
+	missing := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))
+
+	// errorCode returns the code of a JSON error response
+	errorCode := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		t.Helper()
+		var resp struct {
+			Code string `json:"code"`
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Code
+	}
+
+	t.Run("get", func(t *testing.T) {
+		w := do(t, http.MethodGet, "/api/blobs/"+digest, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if !bytes.Equal(w.Body.Bytes(), blob) {
+			t.Error("expected the blob as the body")
+		}
+
+		if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(blob)) {
+			t.Errorf("expected content length %d, got %q", len(blob), got)
+		}
+
+		if got := w.Header().Get("Content-Type"); got != "application/octet-stream" {
+			t.Errorf("expected content type application/octet-stream, got %q", got)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		w := do(t, http.MethodGet, "/api/blobs/"+digest, nil, http.Header{"Range": {"bytes=6-11"}})
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("expected status 206, got %d: %s", w.Code, w.Body)
+		}
+
+		if got := w.Body.String(); got != "ollama" {
+			t.Errorf("expected %q, got %q", "ollama", got)
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		w := do(t, http.MethodHead, "/api/blobs/"+digest, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(blob)) {
+			t.Errorf("expected content length %d, got %q", len(blob), got)
+		}
+
+		if w.Body.Len() != 0 {
+			t.Errorf("expected no body, got %d bytes", w.Body.Len())
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		w := do(t, http.MethodGet, "/api/blobs/"+missing, nil, nil)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", w.Code)
+		}
+
+		if code := errorCode(t, w); code != api.ErrorCodeBlobNotFound {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeBlobNotFound, code)
+		}
+
+		if w := do(t, http.MethodHead, "/api/blobs/"+missing, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected HEAD status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid digest", func(t *testing.T) {
+		if w := do(t, http.MethodGet, "/api/blobs/sha256:invalid", nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("verified once", func(t *testing.T) {
+		p, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a blob changed without changing its size or modification time
+		// isn't hashed again
+		changed := bytes.ToUpper(blob)
+		if err := os.WriteFile(p, changed, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := do(t, http.MethodGet, "/api/blobs/"+digest, nil, nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), changed) {
+			t.Errorf("expected the blob without verifying it again, got %d", w.Code)
+		}
+
+		if err := os.WriteFile(p, blob, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		p, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, []byte("corrupted"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		w := do(t, http.MethodGet, "/api/blobs/"+digest, nil, nil)
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", w.Code)
+		}
+
+		if code := errorCode(t, w); code != api.ErrorCodeModelCorrupted {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeModelCorrupted, code)
+		}
+
+		t.Setenv("OLLAMA_SKIP_VERIFY", "1")
+		if w := do(t, http.MethodGet, "/api/blobs/"+digest, nil, nil); w.Code != http.StatusOK || w.Body.String() != "corrupted" {
+			t.Errorf("expected the unverified blob with status 200, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("range of an unverified blob", func(t *testing.T) {
+		// the blob is still corrupted, but only whole blobs are verified
+		w := do(t, http.MethodGet, "/api/blobs/"+digest, nil, http.Header{"Range": {"bytes=0-3"}})
+		if w.Code != http.StatusPartialContent || w.Body.String() != "corr" {
+			t.Errorf("expected status 206 with %q, got %d: %s", "corr", w.Code, w.Body)
+		}
+
+		if w := do(t, http.MethodGet, "/api/blobs/"+digest, nil, nil); w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500 for the whole blob, got %d", w.Code)
+		}
+	})
+}
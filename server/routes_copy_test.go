@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestCopy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, nil, nil)),
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	src, err := ParseNamedManifest(model.ParseName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		stream := true
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "test", Destination: "test-copy", Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var statuses []string
+		var completed int64
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.ProgressResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			statuses = append(statuses, resp.Status)
+			completed += resp.Completed
+		}
+
+		if len(statuses) != len(src.Layers)+3 {
+			t.Fatalf("expected progress for each layer, got %v", statuses)
+		}
+
+		if !strings.HasPrefix(statuses[0], "copying ") || statuses[len(statuses)-2] != "writing manifest" || statuses[len(statuses)-1] != "success" {
+			t.Errorf("unexpected statuses %v", statuses)
+		}
+
+		if completed != src.Size() {
+			t.Errorf("expected %d bytes to be reported, got %d", src.Size(), completed)
+		}
+
+		dst, err := ParseNamedManifest(model.ParseName("test-copy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dst.digest != src.digest {
+			t.Errorf("expected the copy to have digest %s, got %s", src.digest, dst.digest)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		stream := true
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "missing", Destination: "missing-copy", Stream: &stream})
+		if body := strings.TrimSpace(w.Body.String()); body != `{"code":"model_not_found","error":"model \"missing\" not found"}` {
+			t.Errorf("unexpected body %s", body)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var statuses []string
+		err := CopyModel(ctx, model.ParseName("test"), model.ParseName("test-cancelled"), func(resp api.ProgressResponse) {
+			statuses = append(statuses, resp.Status)
+			// cancel once the first layer is copied
+			cancel()
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context canceled, got %v", err)
+		}
+
+		if len(statuses) != 1 {
+			t.Errorf("expected the copy to stop after the first layer, got %v", statuses)
+		}
+
+		if _, err := os.Stat(filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test-cancelled", "latest")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no destination manifest, got %v", err)
+		}
+
+		if temps, _ := filepath.Glob(filepath.Join(p, "manifests", ".copy-*")); len(temps) > 0 {
+			t.Errorf("expected temporary files to be removed, got %v", temps)
+		}
+
+		ms, err := Manifests()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := ms[model.ParseName("test-cancelled")]; ok {
+			t.Error("expected the cancelled copy not to be listed")
+		}
+	})
+
+	t.Run("cancel writing manifest", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		err := CopyModel(ctx, model.ParseName("test"), model.ParseName("test-cancelled"), func(resp api.ProgressResponse) {
+			if resp.Status == "writing manifest" {
+				cancel()
+			}
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context canceled, got %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test-cancelled", "latest")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no destination manifest, got %v", err)
+		}
+
+		if temps, _ := filepath.Glob(filepath.Join(p, "manifests", ".copy-*")); len(temps) > 0 {
+			t.Errorf("expected temporary files to be removed, got %v", temps)
+		}
+	})
+
+	t.Run("missing layer", func(t *testing.T) {
+		blob, err := GetBlobsPath(src.Layers[0].Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts, err := os.ReadFile(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Remove(blob); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.WriteFile(blob, bts, 0o644) })
+
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "test", Destination: "test-broken"})
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status code 500, actual %d: %s", w.Code, w.Body)
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("test-broken")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no manifest for a copy with missing layers, got %v", err)
+		}
+	})
+}
+
+func TestAlias(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "myorg/model:latest",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, nil, nil)),
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	blobs, err := filepath.Glob(filepath.Join(p, "blobs", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = createRequest(t, s.AliasHandler, api.AliasRequest{Source: "myorg/model:latest", Destination: "myorg/model:prod"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+	}
+
+	src, err := ParseNamedManifest(model.ParseName("myorg/model:latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias, err := ParseNamedManifest(model.ParseName("myorg/model:prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alias.digest != src.digest {
+		t.Errorf("expected the alias to reference the same layers, got manifest digests %s and %s", src.digest, alias.digest)
+	}
+
+	// no blobs are added for the alias
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), blobs)
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "myorg/model:latest"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	// the alias still references every blob
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), blobs)
+
+	if _, err := GetModel("myorg/model:prod"); err != nil {
+		t.Errorf("expected the alias to be usable after deleting the source, got %v", err)
+	}
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "myorg/model:prod"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{})
+
+	t.Run("not found", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Source: "missing", Destination: "missing-alias"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Source: "myorg/model:prod", Destination: "bad name"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code 400, actual %d", w.Code)
+		}
+	})
+}
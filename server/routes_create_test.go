@@ -1,22 +1,28 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"cmp"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	gocmp "github.com/google/go-cmp/cmp"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
 )
 
 var stream bool = false
@@ -66,6 +72,7 @@ func createRequest(t *testing.T, fn func(*gin.Context), body any) *httptest.Resp
 	}
 
 	c.Request = &http.Request{
+		URL:  &url.URL{},
 		Body: io.NopCloser(&b),
 	}
 
@@ -522,6 +529,22 @@ func TestCreateTemplateSystem(t *testing.T) {
 			t.Fatalf("expected status code 400, actual %d", w.Code)
 		}
 	})
+
+	t.Run("template with undefined variable", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"{{ .System }}\n{{ .Input }}\"\"\"", createBinFile(t, nil, nil)),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), `line 2: undefined variable \".Input\"`) {
+			t.Errorf("unexpected error: %s", w.Body.String())
+		}
+	})
 }
 
 func TestCreateLicenses(t *testing.T) {
@@ -616,3 +639,560 @@ func TestCreateDetectTemplate(t *testing.T) {
 		})
 	})
 }
+
+func TestCreateQuantize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+
+	bin := func(t *testing.T, fileType uint32) string {
+		t.Helper()
+		return createBinFile(t, llm.KV{
+			"general.architecture":                   "llama",
+			"general.file_type":                      fileType,
+			"llama.block_count":                      uint32(1),
+			"llama.feed_forward_length":              uint32(32),
+			"llama.attention.layer_norm_rms_epsilon": float32(1e-5),
+			"llama.context_length":                   uint32(8192),
+			"llama.embedding_length":                 uint32(4096),
+			"llama.attention.head_count":             uint32(32),
+			"llama.attention.head_count_kv":          uint32(8),
+			"tokenizer.ggml.tokens":                  []string{""},
+			"tokenizer.ggml.scores":                  []float32{0},
+			"tokenizer.ggml.token_type":              []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{32}, Kind: 1, WriterTo: bytes.NewReader(make([]byte, 64))},
+			{Name: "blk.0.attn_v.weight", Shape: []uint64{32}, Kind: 1, WriterTo: bytes.NewReader(make([]byte, 64))},
+			{Name: "output.weight", Shape: []uint64{32}, Kind: 1, WriterTo: bytes.NewReader(make([]byte, 64))},
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s", bin(t, 1)),
+			Quantize:  "q8_0",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Config.FileType != "Q8_0" {
+			t.Errorf("expected file type Q8_0, actual %s", m.Config.FileType)
+		}
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		stream := true
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s", bin(t, 1)),
+			Quantize:  "q8_0",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		var frames []api.ProgressResponse
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.ProgressResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.HasPrefix(resp.Status, "quantizing tensor ") {
+				frames = append(frames, resp)
+			}
+		}
+
+		if len(frames) != 3 {
+			t.Fatalf("expected progress for 3 tensors, got %v", frames)
+		}
+
+		for i, frame := range frames {
+			if want := fmt.Sprintf("quantizing tensor %d/3", i+1); frame.Status != want {
+				t.Errorf("expected status %q, got %q", want, frame.Status)
+			}
+
+			if frame.Total != 3 || frame.Completed != int64(i+1) {
+				t.Errorf("expected %d/3 tensors completed, got %d/%d", i+1, frame.Completed, frame.Total)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s", bin(t, 1)),
+			Quantize:  "q4_x",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), `unsupported quantization type \"q4_x\"`) ||
+			!strings.Contains(w.Body.String(), "Q4_K_M") {
+			t.Errorf("unexpected error: %s", w.Body.String())
+		}
+	})
+
+	t.Run("already quantized", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s", bin(t, 2)),
+			Quantize:  "q4_K_M",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "cannot quantize a Q4_0 model") {
+			t.Errorf("unexpected error: %s", w.Body.String())
+		}
+	})
+}
+
+func TestCreateDryRun(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	modelfile := fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}\nSYSTEM You are a helpful assistant.\nPARAMETER temperature 0.5", createBinFile(t, nil, nil))
+
+	plan := func(t *testing.T, modelfile string) []api.PlannedLayer {
+		t.Helper()
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: modelfile,
+			DryRun:    true,
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ProgressResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Layers
+	}
+
+	layers := plan(t, modelfile)
+
+	var mediatypes []string
+	for _, layer := range layers {
+		mediatypes = append(mediatypes, layer.MediaType)
+	}
+
+	if diff := gocmp.Diff(mediatypes, []string{
+		"application/vnd.ollama.image.model",
+		"application/vnd.ollama.image.template",
+		"application/vnd.ollama.image.system",
+		"application/vnd.ollama.image.params",
+		"application/vnd.docker.container.image.v1+json",
+	}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), nil)
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), nil)
+
+	t.Run("matches create", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: modelfile,
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var created []api.PlannedLayer
+		for _, layer := range append(m.Layers, m.Config) {
+			created = append(created, api.PlannedLayer{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+		}
+
+		if diff := gocmp.Diff(layers, created); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("from model", func(t *testing.T) {
+		blobs, err := filepath.Glob(filepath.Join(p, "blobs", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layers := plan(t, "FROM test\nPARAMETER top_k 10")
+		if len(layers) != 5 {
+			t.Fatalf("expected 5 layers, got %d", len(layers))
+		}
+
+		for _, layer := range layers[:3] {
+			if layer.From != "test:latest" {
+				t.Errorf("%s: expected layer from test:latest, got %q", layer.MediaType, layer.From)
+			}
+		}
+
+		// the merged parameters are a new layer
+		if layers[3].MediaType != "application/vnd.ollama.image.params" || layers[3].From != "" {
+			t.Errorf("unexpected parameters layer %v", layers[3])
+		}
+
+		checkFileExists(t, filepath.Join(p, "blobs", "*"), blobs)
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test2",
+			Modelfile: "FROM missing",
+			DryRun:    true,
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code 500, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "pull it first") {
+			t.Errorf("unexpected error: %s", w.Body.String())
+		}
+	})
+}
+
+func TestCreateFromSafetensors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	safetensorsDir := func(t *testing.T, architecture string) string {
+		t.Helper()
+
+		dir := t.TempDir()
+		header, err := json.Marshal(map[string]any{
+			"model.embed_tokens.weight": map[string]any{"dtype": "F32", "shape": []int{2, 4}, "data_offsets": []int{0, 32}},
+			"model.norm.weight":         map[string]any{"dtype": "F32", "shape": []int{4}, "data_offsets": []int{32, 48}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := binary.Write(&b, binary.LittleEndian, int64(len(header))); err != nil {
+			t.Fatal(err)
+		}
+
+		b.Write(header)
+		b.Write(make([]byte, 48))
+
+		for name, content := range map[string][]byte{
+			"model.safetensors": b.Bytes(),
+			"config.json":       []byte(fmt.Sprintf(`{"architectures": [%q], "vocab_size": 2, "hidden_size": 4, "num_hidden_layers": 1, "num_attention_heads": 1}`, architecture)),
+			"tokenizer.json":    []byte(`{"model": {"vocab": {"a": 0, "b": 1}}}`),
+		} {
+			if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return dir
+	}
+
+	t.Run("llama", func(t *testing.T) {
+		p := t.TempDir()
+		t.Setenv("OLLAMA_MODELS", p)
+		var s Server
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s", safetensorsDir(t, "LlamaForCausalLM")),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(m.ModelPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		ggml, _, err := llm.DecodeGGML(f, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ggml.Name() != "gguf" {
+			t.Errorf("expected gguf, actual %s", ggml.Name())
+		}
+
+		if arch := ggml.KV().Architecture(); arch != "llama" {
+			t.Errorf("expected llama architecture, actual %s", arch)
+		}
+
+		// only the converted model and the config are written
+		blobs, err := filepath.Glob(filepath.Join(p, "blobs", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(blobs) != 2 {
+			t.Errorf("expected 2 blobs, actual %v", blobs)
+		}
+	})
+
+	t.Run("unsupported architecture", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		var s Server
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s", safetensorsDir(t, "GPT2LMHeadModel")),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), `unsupported architecture \"GPT2LMHeadModel\"`) {
+			t.Errorf("unexpected error: %s", w.Body.String())
+		}
+	})
+}
+
+func TestCreateMetadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture": "llama",
+		"llama.context_length": uint32(2048),
+	}, []llm.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nPARAMETER gguf.llama.context_length 16384\nPARAMETER gguf.general.description patched\nPARAMETER temperature 0.5", bin),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	w = createRequest(t, s.ShowHandler, api.ShowRequest{Name: "test"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := resp.ModelInfo["llama.context_length"]; n != float64(16384) {
+		t.Errorf("expected llama.context_length 16384, got %v", n)
+	}
+
+	if description := resp.ModelInfo["general.description"]; description != "patched" {
+		t.Errorf("expected general.description patched, got %v", description)
+	}
+
+	if strings.Contains(resp.Parameters, "gguf") || !strings.Contains(resp.Parameters, "temperature") {
+		t.Errorf("expected only model parameters, got %q", resp.Parameters)
+	}
+
+	for _, tt := range []struct {
+		modelfile, err string
+	}{
+		{"PARAMETER gguf.llama.unknown 1", `invalid gguf metadata: unknown gguf key "llama.unknown"`},
+		{"PARAMETER gguf.llama.context_length long", `invalid gguf metadata: invalid value for gguf key "llama.context_length": strconv.ParseUint: parsing "long": invalid syntax`},
+	} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test2",
+			Modelfile: fmt.Sprintf("FROM %s\n%s", bin, tt.modelfile),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status code 400, actual %d", tt.modelfile, w.Code)
+		}
+
+		var resp struct{ Error string }
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Error != tt.err {
+			t.Errorf("%s: expected error %q, got %q", tt.modelfile, tt.err, resp.Error)
+		}
+	}
+}
+
+func TestCreateMerge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	tensor := func(name string, b byte) llm.Tensor {
+		return llm.Tensor{Name: name, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{b}, 32))}
+	}
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture": "llama",
+		"llama.context_length": uint32(2048),
+	}, []llm.Tensor{
+		tensor("token_embd.weight", 0),
+		tensor("blk.0.attn_q.weight", 0),
+		tensor("blk.1.attn_q.weight", 0),
+		tensor("output.weight", 0),
+	})
+
+	a := createBinFile(t, llm.KV{"general.architecture": "llama"}, []llm.Tensor{tensor("blk.0.attn_q.weight", 1)})
+	b := createBinFile(t, llm.KV{}, []llm.Tensor{tensor("blk.1.attn_q.weight", 2), tensor("output.weight", 3)})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nMERGE %s\nMERGE %s", bin, a, b),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(m.ModelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ggml, _, err := llm.DecodeGGML(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if arch := ggml.KV().Architecture(); arch != "llama" {
+		t.Errorf("expected architecture llama, got %q", arch)
+	}
+
+	want := map[string]byte{
+		"token_embd.weight":   0,
+		"blk.0.attn_q.weight": 1,
+		"blk.1.attn_q.weight": 2,
+		"output.weight":       3,
+	}
+
+	for _, tensor := range ggml.Tensors().Items {
+		data := make([]byte, tensor.Size())
+		if _, err := f.ReadAt(data, int64(ggml.Tensors().Offset+tensor.Offset)); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, bytes.Repeat([]byte{want[tensor.Name]}, len(data))) {
+			t.Errorf("%s: expected the data of the %d overlay, got %v", tensor.Name, want[tensor.Name], data)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		tensors []llm.Tensor
+		kv      llm.KV
+		err     string
+	}{
+		{
+			name:    "unknown tensor",
+			tensors: []llm.Tensor{tensor("blk.9.attn_q.weight", 1)},
+			err:     `tensor "blk.9.attn_q.weight" isn't in the model`,
+		},
+		{
+			name:    "shape",
+			tensors: []llm.Tensor{{Name: "output.weight", Shape: []uint64{4}, WriterTo: bytes.NewReader(make([]byte, 16))}},
+			err:     `tensor "output.weight" has type 0 and shape [4] but the model's has type 0 and shape [8]`,
+		},
+		{
+			name:    "architecture",
+			tensors: []llm.Tensor{tensor("output.weight", 1)},
+			kv:      llm.KV{"general.architecture": "qwen2"},
+			err:     `architecture "qwen2" doesn't match the model's "llama"`,
+		},
+		{
+			name:    "duplicate",
+			tensors: []llm.Tensor{tensor("blk.0.attn_q.weight", 4)},
+			err:     fmt.Sprintf(`merge conflict: tensor "blk.0.attn_q.weight" is in both %s and`, a),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := createBinFile(t, tt.kv, tt.tensors)
+			w := createRequest(t, s.CreateHandler, api.CreateRequest{
+				Name:      "test2",
+				Modelfile: fmt.Sprintf("FROM %s\nMERGE %s\nMERGE %s", bin, a, c),
+				Stream:    &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status code 400, actual %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp struct{ Error string }
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(resp.Error, tt.err) {
+				t.Errorf("expected error containing %q, got %q", tt.err, resp.Error)
+			}
+		})
+	}
+}
@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/types/model"
@@ -109,3 +113,93 @@ func TestDeleteDuplicateLayers(t *testing.T) {
 
 	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{})
 }
+
+func TestPrune(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	referenced, err := filepath.Glob(filepath.Join(p, "blobs", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan, err := NewLayer(strings.NewReader("orphan"), "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewLayer(strings.NewReader("loaded"), "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedPath, err := GetBlobsPath(loaded.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a model that was removed while it's still loaded
+	s.sched.loaded["loaded"] = &runnerRef{modelPath: loadedPath}
+
+	partial := filepath.Join(p, "blobs", "sha256-"+strings.Repeat("0", 64)+"-partial")
+	if err := os.WriteFile(partial, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := append(slices.Clone(referenced), loadedPath, partial)
+	slices.Sort(kept)
+
+	all := append(slices.Clone(kept), filepath.Join(p, "blobs", strings.Replace(orphan.Digest, ":", "-", 1)))
+	slices.Sort(all)
+
+	prune := func(t *testing.T, dryRun bool) {
+		t.Helper()
+
+		w := createRequest(t, s.PruneHandler, api.PruneRequest{DryRun: dryRun})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.PruneResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := api.PruneResponse{
+			Blobs: []api.PrunedBlob{{Digest: orphan.Digest, Size: orphan.Size}},
+			Size:  orphan.Size,
+		}
+
+		if diff := cmp.Diff(resp, want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		prune(t, true)
+		checkFileExists(t, filepath.Join(p, "blobs", "*"), all)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		prune(t, false)
+		checkFileExists(t, filepath.Join(p, "blobs", "*"), kept)
+
+		w = createRequest(t, s.ShowHandler, api.ShowRequest{Name: "test"})
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+type mockEmbedRunner struct {
+	mockRunner
+
+	// inputs records the inputs passed to Embedding
+	mu     sync.Mutex
+	inputs []string
+}
+
+func (m *mockEmbedRunner) Embedding(_ context.Context, input string) ([]float32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputs = append(m.inputs, input)
+	return []float32{3, 4}, nil
+}
+
+func (m *mockEmbedRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	var words []string
+	for _, token := range tokens {
+		words = append(words, strconv.Itoa(token))
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+func TestEmbed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockEmbedRunner
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     gpu.GetGPUInfo,
+			getCpuFn:     gpu.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	cases := []struct {
+		name     string
+		input    any
+		inputs   []string
+		expected [][]float32
+		count    int
+	}{
+		{
+			name:     "string",
+			input:    "why is the sky blue?",
+			inputs:   []string{"why is the sky blue?"},
+			expected: [][]float32{{0.6, 0.8}},
+			count:    5,
+		},
+		{
+			name:     "array",
+			input:    []string{"why is the sky blue?", "why is the grass green?"},
+			inputs:   []string{"why is the grass green?", "why is the sky blue?"},
+			expected: [][]float32{{0.6, 0.8}, {0.6, 0.8}},
+			count:    10,
+		},
+		{
+			name:     "empty array",
+			input:    []string{},
+			expected: [][]float32{},
+		},
+		{
+			name:     "empty string",
+			input:    "",
+			expected: [][]float32{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.inputs = nil
+
+			w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+				Model: "test",
+				Input: tt.input,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.EmbedResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(resp.Embeddings, tt.expected); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if resp.PromptEvalCount != tt.count {
+				t.Errorf("expected prompt_eval_count %d, got %d", tt.count, resp.PromptEvalCount)
+			}
+
+			// embeddings are generated concurrently so the order of inputs is not stable
+			slices.Sort(mock.inputs)
+			if diff := cmp.Diff(mock.inputs, tt.inputs, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("invalid input", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model: "test",
+			Input: []any{"hello", 1},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"invalid input type"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("normalize", func(t *testing.T) {
+		for _, normalize := range []bool{true, false} {
+			w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+				Model:     "test",
+				Input:     "why is the sky blue?",
+				Normalize: &normalize,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.EmbedResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			var sum float64
+			for _, v := range resp.Embeddings[0] {
+				sum += float64(v * v)
+			}
+
+			if length := math.Sqrt(sum); normalize && math.Abs(length-1) > 1e-6 {
+				t.Errorf("expected unit length, got %f", length)
+			} else if !normalize && length != 5 {
+				t.Errorf("expected the unnormalized length 5, got %f", length)
+			}
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		mock.inputs = nil
+
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:   "test",
+			Input:   "why is the sky blue?",
+			Options: map[string]any{"num_ctx": 2},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PromptEvalCount != 2 {
+			t.Errorf("expected prompt_eval_count 2, got %d", resp.PromptEvalCount)
+		}
+
+		if diff := cmp.Diff(mock.inputs, []string{"0 1"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("truncate false", func(t *testing.T) {
+		truncate := false
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:    "test",
+			Input:    []string{"short", "why is the sky blue?"},
+			Truncate: &truncate,
+			Options:  map[string]any{"num_ctx": 2},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", w.Code)
+		}
+
+		want := `{"code":"context_exceeded","error":"input length exceeds maximum context length: input 1 is 5 tokens but the context length is 2"}`
+		if diff := cmp.Diff(w.Body.String(), want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		streamed := true
+		input := []string{"a", "b", "c", "d", "e"}
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:  "test",
+			Input:  input,
+			Stream: &streamed,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("expected content type application/x-ndjson, got %q", ct)
+		}
+
+		d := json.NewDecoder(w.Body)
+		for i := range input {
+			var progress api.ProgressResponse
+			if err := d.Decode(&progress); err != nil {
+				t.Fatal(err)
+			}
+
+			want := api.ProgressResponse{Status: fmt.Sprintf("embedded %d/5", i+1), Completed: int64(i + 1), Total: 5}
+			if diff := cmp.Diff(progress, want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		}
+
+		var resp api.EmbedResponse
+		if err := d.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Embeddings) != len(input) {
+			t.Errorf("expected %d embeddings, got %d", len(input), len(resp.Embeddings))
+		}
+
+		if d.More() {
+			t.Error("expected the embeddings to be the last response")
+		}
+	})
+
+	t.Run("legacy embeddings", func(t *testing.T) {
+		w := createRequest(t, s.EmbeddingsHandler, api.EmbeddingRequest{
+			Model:  "test",
+			Prompt: "why is the sky blue?",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.EmbeddingResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Embedding, []float64{3, 4}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestErrorCodes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	registry := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(registry.Close)
+
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+
+	cases := []struct {
+		name    string
+		handler func(*gin.Context)
+		body    any
+		status  int
+		code    string
+	}{
+		{"pull missing", s.PullHandler, api.PullRequest{Name: u.Host + "/library/missing", Insecure: true, Stream: &stream}, http.StatusInternalServerError, api.ErrorCodeModelNotFound},
+		{"pull invalid name", s.PullHandler, api.PullRequest{Name: "invalid/name/here/x", Stream: &stream}, http.StatusBadRequest, api.ErrorCodeInvalidRequest},
+		{"generate missing", s.GenerateHandler, api.GenerateRequest{Model: "missing", Stream: &stream}, http.StatusNotFound, api.ErrorCodeModelNotFound},
+		{"show missing", s.ShowHandler, api.ShowRequest{Model: "missing"}, http.StatusNotFound, api.ErrorCodeModelNotFound},
+		{"delete missing", s.DeleteHandler, api.DeleteRequest{Model: "missing"}, http.StatusNotFound, api.ErrorCodeModelNotFound},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, tt.handler, tt.body)
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			var resp struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Error == "" {
+				t.Error("expected an error message")
+			}
+
+			if resp.Code != tt.code {
+				t.Errorf("expected code %q, got %q", tt.code, resp.Code)
+			}
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, api.ErrorCodeRequestCanceled},
+		{fmt.Errorf("pull model manifest: %w", errUnauthorized), api.ErrorCodeUnauthorized},
+		{fmt.Errorf("model %q: %w", "test", errCapabilities), api.ErrorCodeUnsupported},
+		{ErrMaxQueue, api.ErrorCodeServerBusy},
+		{llm.ErrInsufficientMemory, api.ErrorCodeOutOfMemory},
+		{fmt.Errorf("%w: runner", llm.ErrInsufficientMemory), api.ErrorCodeOutOfMemory},
+		{errors.New("cudaMalloc failed: out of memory"), api.ErrorCodeInternal},
+		{manifestNotFoundError{os.ErrNotExist}, api.ErrorCodeModelNotFound},
+		{fmt.Errorf("open cache: %w", os.ErrNotExist), api.ErrorCodeInternal},
+		{errors.New("something else"), api.ErrorCodeInternal},
+	}
+
+	for _, tt := range cases {
+		if got := errorCode(tt.err); got != tt.want {
+			t.Errorf("%v: expected %q, got %q", tt.err, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestEstimateHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_NUM_PARALLEL", "1")
+
+	var tensors []llm.Tensor
+	for i := range 5 {
+		tensors = append(tensors, llm.Tensor{Name: fmt.Sprintf("blk.%d.attn.weight", i), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 4))})
+	}
+	tensors = append(tensors, llm.Tensor{Name: "output.weight", Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 4))})
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":          "llama",
+		"llama.context_length":          uint32(4096),
+		"llama.embedding_length":        uint32(4096),
+		"llama.block_count":             uint32(5),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(32),
+		"tokenizer.ggml.tokens":         []string{" "},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, tensors)
+
+	ggml, err := llm.LoadModel(bin, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var free uint64
+	cuda := func() gpu.GpuInfoList {
+		g := gpu.GpuInfo{Library: "cuda", ID: "0", Name: "test"}
+		g.TotalMemory = format.GibiByte
+		g.FreeMemory = free
+		return gpu.GpuInfoList{g}
+	}
+
+	cpu := gpu.GpuInfoList{{Library: "cpu", ID: "0"}}
+	s := Server{
+		sched: &Scheduler{
+			loaded:   make(map[string]*runnerRef),
+			getGpuFn: cuda,
+			getCpuFn: func() gpu.GpuInfoList { return cpu },
+		},
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:     "test",
+		Modelfile: fmt.Sprintf("FROM %s\nPARAMETER num_ctx 512", bin),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// want is the estimate for the memory free on the GPU
+	want := func(gpus gpu.GpuInfoList, numCtx, numGPU int) api.EstimateResponse {
+		opts := api.DefaultOptions()
+		opts.NumCtx = numCtx
+		opts.NumGPU = numGPU
+		estimate := llm.EstimateGPULayers(gpus, ggml, nil, opts)
+
+		resp := api.EstimateResponse{
+			Model:         "test",
+			Library:       gpus[0].Library,
+			Size:          int64(estimate.TotalSize),
+			SizeVRAM:      int64(estimate.VRAMSize),
+			SizeRAM:       int64(estimate.TotalSize - estimate.VRAMSize),
+			ContextLength: numCtx,
+			GPULayers:     estimate.Layers,
+			CPULayers:     6 - estimate.Layers,
+		}
+
+		if estimate.Layers == 0 {
+			resp.Library = "cpu"
+			return resp
+		}
+
+		for i, g := range gpus {
+			resp.GPUs = append(resp.GPUs, api.EstimateGPU{
+				ID:          g.ID,
+				Name:        g.Name,
+				Library:     g.Library,
+				Size:        int64(estimate.GPUSizes[i]),
+				FreeMemory:  int64(g.FreeMemory),
+				TotalMemory: int64(g.TotalMemory),
+			})
+		}
+
+		return resp
+	}
+
+	estimate := func(t *testing.T, req api.EstimateRequest) api.EstimateResponse {
+		t.Helper()
+		w := createRequest(t, s.EstimateHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.EstimateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	t.Run("fits", func(t *testing.T) {
+		free = format.GibiByte
+		resp := estimate(t, api.EstimateRequest{Model: "test"})
+		if diff := cmp.Diff(want(cuda(), 512, -1), resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.GPULayers != 6 || resp.SizeRAM != 0 {
+			t.Errorf("expected the whole model on the GPU, got %d layers and %d bytes in RAM", resp.GPULayers, resp.SizeRAM)
+		}
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		free = 100 * format.MebiByte
+		resp := estimate(t, api.EstimateRequest{Model: "test"})
+		if diff := cmp.Diff(want(cuda(), 512, -1), resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.GPULayers == 0 || resp.CPULayers == 0 {
+			t.Errorf("expected the model split between GPU and CPU, got %d and %d layers", resp.GPULayers, resp.CPULayers)
+		}
+	})
+
+	t.Run("no fit", func(t *testing.T) {
+		free = 16 * format.MebiByte
+		resp := estimate(t, api.EstimateRequest{Model: "test"})
+		if diff := cmp.Diff(want(cuda(), 512, -1), resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.Library != "cpu" || resp.SizeVRAM != 0 {
+			t.Errorf("expected the model on the CPU, got %s with %d bytes of VRAM", resp.Library, resp.SizeVRAM)
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		free = format.GibiByte
+		numCtx, numGPU, numBatch := 1024, 3, 256
+		resp := estimate(t, api.EstimateRequest{Model: "test", NumCtx: &numCtx, NumGPU: &numGPU, NumBatch: &numBatch})
+
+		opts := api.DefaultOptions()
+		opts.NumCtx, opts.NumGPU, opts.NumBatch = numCtx, numGPU, numBatch
+		e := llm.EstimateGPULayers(cuda(), ggml, nil, opts)
+		if resp.GPULayers != 3 || resp.SizeVRAM != int64(e.VRAMSize) || resp.ContextLength != 1024 {
+			t.Errorf("expected 3 layers and %d bytes of VRAM for a context of 1024, got %d layers and %d bytes for %d", e.VRAMSize, resp.GPULayers, resp.SizeVRAM, resp.ContextLength)
+		}
+	})
+
+	t.Run("cpu", func(t *testing.T) {
+		numGPU := 0
+		resp := estimate(t, api.EstimateRequest{Model: "test", NumGPU: &numGPU})
+		if diff := cmp.Diff(want(cpu, 512, 0), resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("loaded models", func(t *testing.T) {
+		free = format.GibiByte
+		s.sched.loaded["other"] = &runnerRef{llama: &mockLlm{estimatedVRAMByGPU: map[string]uint64{"0": format.GibiByte - 100*format.MebiByte}}}
+		t.Cleanup(func() { delete(s.sched.loaded, "other") })
+
+		gpus := cuda()
+		gpus[0].FreeMemory = 100 * format.MebiByte
+		resp := estimate(t, api.EstimateRequest{Model: "test"})
+		if diff := cmp.Diff(want(gpus, 512, -1), resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		w := createRequest(t, s.EstimateHandler, api.EstimateRequest{Model: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.EstimateHandler, api.EstimateRequest{})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+	})
+}
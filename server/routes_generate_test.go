@@ -4,12 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-cmp/cmp"
@@ -25,10 +32,27 @@ type mockRunner struct {
 	// CompletionRequest is only valid until the next call to Completion
 	llm.CompletionRequest
 	llm.CompletionResponse
+
+	// CompletionResponses, if set, are sent in order instead of CompletionResponse
+	CompletionResponses []llm.CompletionResponse
+
+	// CompletionError, if set, is returned by Completion without a response
+	CompletionError error
 }
 
 func (m *mockRunner) Completion(_ context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
 	m.CompletionRequest = r
+	if m.CompletionError != nil {
+		return m.CompletionError
+	}
+
+	if len(m.CompletionResponses) > 0 {
+		for _, cr := range m.CompletionResponses {
+			fn(cr)
+		}
+		return nil
+	}
+
 	fn(m.CompletionResponse)
 	return nil
 }
@@ -41,8 +65,8 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, _ []llm.Adapter, _ []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -127,7 +151,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"model is required"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -138,7 +162,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"model is required"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -165,7 +189,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support chat"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"\"bert\" does not support chat"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -321,6 +345,47 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
+	t.Run("messages with system override", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:  "test-system",
+			System: "You can perform magic tricks.",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "System: You can perform magic tricks. User: Hello! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
+	})
+
+	t.Run("messages with system and system override", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:  "test-system",
+			System: "You are a pirate.",
+			Messages: []api.Message{
+				{Role: "system", Content: "You can perform magic tricks."},
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "System: You can perform magic tricks. User: Hello! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
 	t.Run("messages with interleaved system", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
 			Model: "test-system",
@@ -343,6 +408,267 @@ func TestGenerateChat(t *testing.T) {
 
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
+
+	t.Run("min_p and typical_p", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"min_p": 0.1, "typical_p": 0.9},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if p := mock.CompletionRequest.Options.MinP; p != 0.1 {
+			t.Errorf("expected min_p 0.1, got %v", p)
+		}
+
+		if p := mock.CompletionRequest.Options.TypicalP; p != 0.9 {
+			t.Errorf("expected typical_p 0.9, got %v", p)
+		}
+	})
+
+	t.Run("min_p out of range", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"min_p": 1.1},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"invalid option \"min_p\": must be between 0 and 1"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages exceed context", func(t *testing.T) {
+		messages := []api.Message{
+			{Role: "user", Content: strings.Repeat("Hello! ", 2100)},
+			{Role: "assistant", Content: "Hi!"},
+			{Role: "user", Content: "Help me write tests."},
+		}
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: messages,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200 truncating by default, got %d", w.Code)
+		}
+
+		if strings.Contains(mock.CompletionRequest.Prompt, "Hello!") {
+			t.Error("expected the oldest message to be truncated")
+		}
+
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: messages,
+			Truncate: &[]bool{false}[0],
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"context_exceeded","error":"prompt too long: 2108 tokens exceeds the context length of 2048"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("format json", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Format: "json",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Format != "json" {
+			t.Errorf("expected format json, got %q", mock.CompletionRequest.Format)
+		}
+
+		if mock.CompletionRequest.Grammar != "" {
+			t.Errorf("expected empty grammar, got %q", mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("format schema", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Format: api.Format(`{"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}`),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Format != "" {
+			t.Errorf("expected empty format, got %q", mock.CompletionRequest.Format)
+		}
+
+		if !strings.Contains(mock.CompletionRequest.Grammar, "root ::=") {
+			t.Errorf("expected grammar, got %q", mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("format invalid", func(t *testing.T) {
+		for _, format := range []api.Format{"xml", `{"$ref":"#/definitions/missing"}`} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Format: format,
+				Stream: &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", format, w.Code)
+			}
+		}
+	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test-tools",
+		Modelfile: `FROM test
+TEMPLATE """
+{{- if .Tools }}[AVAILABLE_TOOLS] {{ json .Tools }}[/AVAILABLE_TOOLS] {{ end }}
+{{- range .Messages }}
+{{- if .ToolCalls }}[TOOL_CALLS] [
+{{- range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ .Function.Arguments }}}
+{{- end }}]
+{{- else }}{{ .Content }}
+{{- end }}
+{{- end }}"""`,
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("stream tool calls", func(t *testing.T) {
+		output := `[TOOL_CALLS] [{"name": "get_weather", "arguments": {"location": "Paris", "unit": "celsius"}}]`
+		for i := 0; i < len(output); i += 4 {
+			mock.CompletionResponses = append(mock.CompletionResponses, llm.CompletionResponse{Content: output[i:min(i+4, len(output))]})
+		}
+		mock.CompletionResponses = append(mock.CompletionResponses, llm.CompletionResponse{Done: true, DoneReason: "stop"})
+		defer func() { mock.CompletionResponses = nil }()
+
+		streaming := true
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-tools",
+			Messages: []api.Message{
+				{Role: "user", Content: "What's the weather in Paris?"},
+			},
+			Tools: []api.Tool{{
+				Type: "function",
+				Function: api.ToolFunction{
+					Name:        "get_weather",
+					Description: "Get the weather",
+				},
+			}},
+			Stream: &streaming,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var name, arguments string
+		var final api.ChatResponse
+		dec := json.NewDecoder(w.Body)
+		for {
+			var resp api.ChatResponse
+			if err := dec.Decode(&resp); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Message.Content != "" {
+				t.Errorf("expected no content, got %q", resp.Message.Content)
+			}
+
+			if resp.Done {
+				final = resp
+				continue
+			}
+
+			for _, tc := range resp.Message.ToolCalls {
+				name += tc.Function.Name
+				arguments += tc.Function.PartialArguments
+			}
+		}
+
+		if name != "get_weather" {
+			t.Errorf("expected name %q, got %q", "get_weather", name)
+		}
+
+		if want := `{"location": "Paris", "unit": "celsius"}`; arguments != want {
+			t.Errorf("expected arguments %q, got %q", want, arguments)
+		}
+
+		if diff := cmp.Diff(final.Message.ToolCalls, []api.ToolCall{{
+			Function: api.ToolCallFunction{
+				Name:      "get_weather",
+				Arguments: api.ToolCallFunctionArguments{"location": "Paris", "unit": "celsius"},
+			},
+		}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid tool", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-tools",
+			Messages: []api.Message{
+				{Role: "user", Content: "What's the weather in Paris?"},
+			},
+			Tools: []api.Tool{{
+				Type: "function",
+				Function: api.ToolFunction{
+					Name:        "get_weather",
+					Description: "Get the weather",
+				},
+			}, {
+				Type:     "function",
+				Function: api.ToolFunction{Description: "nameless"},
+			}},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"invalid tool 1: function name is required"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -425,7 +751,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"model is required"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -436,7 +762,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"model is required"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -463,7 +789,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support generate"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"\"bert\" does not support generate"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -479,7 +805,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"test does not support insert"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"test does not support insert"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -711,4 +1037,1970 @@ TEMPLATE """{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	t.Run("format schema", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Format: `{"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}`,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if mock.CompletionRequest.Format != "" || !strings.Contains(mock.CompletionRequest.Grammar, "root ::=") {
+			t.Errorf("expected a grammar of the schema, got format %q and grammar %q", mock.CompletionRequest.Format, mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		abra := -0.1
+		logprobs := []api.TokenLogprob{
+			{Token: "Abra", Logprob: &abra, TopLogprobs: []api.TopLogprob{{Token: "Abra", Logprob: -0.1}, {Token: "Hi", Logprob: -2.3}}},
+		}
+		mock.CompletionResponse.Logprobs = logprobs
+		defer func() { mock.CompletionResponse.Logprobs = nil }()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    "test",
+			Prompt:   "Hello!",
+			Logprobs: 2,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Logprobs != 2 {
+			t.Errorf("expected logprobs 2, got %d", mock.CompletionRequest.Logprobs)
+		}
+
+		var actual api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(actual.Logprobs, logprobs); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("context shift disabled", func(t *testing.T) {
+		mock.CompletionResponse.DoneReason = "context_full"
+		defer func() { mock.CompletionResponse.DoneReason = "stop" }()
+
+		contextShift := false
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:        "test",
+			Prompt:       "Hello!",
+			ContextShift: &contextShift,
+			Stream:       &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if cs := mock.CompletionRequest.ContextShift; cs == nil || *cs {
+			t.Errorf("expected context shift to be disabled, got %v", cs)
+		}
+
+		var actual api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.DoneReason != "context_full" {
+			t.Errorf("expected done reason context_full, got %q", actual.DoneReason)
+		}
+	})
+
+	t.Run("negative logprobs", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    "test",
+			Prompt:   "Hello!",
+			Logprobs: -1,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"logprobs must be a non-negative integer"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("min_p and typical_p", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"min_p": 0.05, "typical_p": 0.7},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if p := mock.CompletionRequest.Options.MinP; p != 0.05 {
+			t.Errorf("expected min_p 0.05, got %v", p)
+		}
+
+		if p := mock.CompletionRequest.Options.TypicalP; p != 0.7 {
+			t.Errorf("expected typical_p 0.7, got %v", p)
+		}
+	})
+
+	t.Run("min_p and typical_p out of range", func(t *testing.T) {
+		cases := []struct {
+			options map[string]any
+			expect  string
+		}{
+			{map[string]any{"min_p": -0.1}, `{"code":"invalid_request","error":"invalid option \"min_p\": must be between 0 and 1"}`},
+			{map[string]any{"min_p": 1.5}, `{"code":"invalid_request","error":"invalid option \"min_p\": must be between 0 and 1"}`},
+			{map[string]any{"typical_p": 2}, `{"code":"invalid_request","error":"invalid option \"typical_p\": must be between 0 and 1"}`},
+			{map[string]any{"min_p": "high"}, `{"code":"invalid_request","error":"invalid option: option \"min_p\" must be of type float32"}`},
+		}
+
+		for _, tt := range cases {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Options: tt.options,
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%v: expected status 400, got %d", tt.options, w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), tt.expect); diff != "" {
+				t.Errorf("%v: mismatch (-got +want):\n%s", tt.options, diff)
+			}
+		}
+	})
+
+	t.Run("stop_regex", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"stop_regex": []any{`\n\d`, "User:"}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Options.StopRegex, []string{`\n\d`, "User:"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("stop_regex unsupported by runner", func(t *testing.T) {
+		mock.CompletionError = llm.ErrStopRegexUnsupported
+		defer func() { mock.CompletionError = nil }()
+
+		for _, streaming := range []bool{false, true} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Options: map[string]any{"stop_regex": []any{`\n\d`}},
+				Stream:  &streaming,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("stream %t: expected status 400, got %d: %s", streaming, w.Code, w.Body)
+			}
+
+			var resp api.StatusError
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Code != api.ErrorCodeUnsupported {
+				t.Errorf("stream %t: unexpected error %+v", streaming, resp)
+			}
+		}
+	})
+
+	t.Run("invalid stop_regex", func(t *testing.T) {
+		cases := []struct {
+			pattern string
+			expect  string
+		}{
+			{"User:(", `{"code":"invalid_request","error":"invalid option \"stop_regex\": error parsing regexp: missing closing ): ` + "`User:(`" + `"}`},
+			{" *", `{"code":"invalid_request","error":"invalid option \"stop_regex\": \" *\" matches an empty string"}`},
+			{"(User:)?", `{"code":"invalid_request","error":"invalid option \"stop_regex\": \"(User:)?\" matches an empty string"}`},
+		}
+
+		for _, tt := range cases {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Hello!",
+				Options: map[string]any{"stop_regex": []any{tt.pattern}},
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", tt.pattern, w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), tt.expect); diff != "" {
+				t.Errorf("%s: mismatch (-got +want):\n%s", tt.pattern, diff)
+			}
+		}
+	})
+
+	t.Run("num_ctx exceeds trained context", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"num_ctx": 16384},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if n := mock.CompletionRequest.Options.NumCtx; n != 8192 {
+			t.Errorf("expected num_ctx to be clamped to 8192, got %d", n)
+		}
+	})
+
+	t.Run("prompt exceeds context", func(t *testing.T) {
+		prompt := strings.Repeat("Hello! ", 3000)
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: prompt,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200 truncating by default, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    "test",
+			Prompt:   prompt,
+			Truncate: &[]bool{false}[0],
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"context_exceeded","error":"prompt too long: 3001 tokens exceeds the context length of 2048"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("prompt exceeds OLLAMA_MAX_PROMPT_TOKENS", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_PROMPT_TOKENS", "8")
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: strings.Repeat("Hello! ", 8),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"context_exceeded","error":"prompt too long: 9 tokens exceeds the maximum of 8 set by OLLAMA_MAX_PROMPT_TOKENS"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("stream stats", func(t *testing.T) {
+		for range 2 * streamStatsInterval {
+			mock.CompletionResponses = append(mock.CompletionResponses, llm.CompletionResponse{Content: "a"})
+		}
+		mock.CompletionResponses = append(mock.CompletionResponses, llm.CompletionResponse{Done: true, DoneReason: "stop", EvalCount: 2 * streamStatsInterval})
+		defer func() { mock.CompletionResponses = nil }()
+
+		streaming := true
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			Stream:      &streaming,
+			StreamStats: true,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		var counts []int
+		var content strings.Builder
+		dec := json.NewDecoder(w.Body)
+		for {
+			var resp api.GenerateResponse
+			if err := dec.Decode(&resp); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			content.WriteString(resp.Response)
+			if !resp.Done && resp.Response == "" {
+				counts = append(counts, resp.EvalCount)
+			}
+		}
+
+		if diff := cmp.Diff(counts, []int{streamStatsInterval, 2 * streamStatsInterval}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if content.Len() != 2*streamStatsInterval {
+			t.Errorf("expected %d content bytes, got %d", 2*streamStatsInterval, content.Len())
+		}
+	})
+}
+
+type keepAliveRunner struct {
+	mockLlm
+}
+
+func (r *keepAliveRunner) Completion(_ context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	fn(llm.CompletionResponse{Content: "Hi!"})
+	fn(llm.CompletionResponse{Done: true, DoneReason: "stop"})
+	return nil
+}
+
+func TestGenerateKeepAlive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_KEEP_ALIVE", "1h")
+
+	var mock keepAliveRunner
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     gpu.GetGPUInfo,
+			getCpuFn:     gpu.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+		},
+	}
+	s.sched.loadFn = s.sched.load
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	// generate runs a request whose context is canceled once the handler
+	// returns, as net/http does, so the scheduler sees it finish
+	generate := func(t *testing.T, keepAlive *api.Duration) {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.GenerateRequest{
+			Model:     "test",
+			Prompt:    "Hello!",
+			KeepAlive: keepAlive,
+			Stream:    &stream,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = (&http.Request{Body: io.NopCloser(&b)}).WithContext(ctx)
+
+		s.GenerateHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	sessionDuration := func(t *testing.T) time.Duration {
+		t.Helper()
+
+		s.sched.loadedMu.Lock()
+		defer s.sched.loadedMu.Unlock()
+		if len(s.sched.loaded) != 1 {
+			t.Fatalf("expected 1 loaded runner, got %d", len(s.sched.loaded))
+		}
+
+		for _, runner := range s.sched.loaded {
+			runner.refMu.Lock()
+			defer runner.refMu.Unlock()
+			return runner.sessionDuration
+		}
+
+		return 0
+	}
+
+	t.Run("default", func(t *testing.T) {
+		generate(t, nil)
+		if d := sessionDuration(t); d != time.Hour {
+			t.Errorf("expected session duration 1h, got %s", d)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		generate(t, &api.Duration{Duration: 10 * time.Minute})
+		if d := sessionDuration(t); d != 10*time.Minute {
+			t.Errorf("expected session duration 10m, got %s", d)
+		}
+	})
+
+	t.Run("omitted falls back to default", func(t *testing.T) {
+		generate(t, nil)
+		if d := sessionDuration(t); d != time.Hour {
+			t.Errorf("expected session duration 1h, got %s", d)
+		}
+	})
+
+	t.Run("zero unloads", func(t *testing.T) {
+		generate(t, &api.Duration{Duration: 0})
+
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			s.sched.loadedMu.Lock()
+			n := len(s.sched.loaded)
+			closed := mock.closeCalled
+			s.sched.loadedMu.Unlock()
+
+			if n == 0 && closed {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expected runner to unload, %d still loaded", n)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestGenerateLoad(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockLlm
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     gpu.GetGPUInfo,
+			getCpuFn:     gpu.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+		},
+	}
+	s.sched.loadFn = s.sched.load
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	loaded := func() int {
+		s.sched.loadedMu.Lock()
+		defer s.sched.loadedMu.Unlock()
+		return len(s.sched.loaded)
+	}
+
+	t.Run("load", func(t *testing.T) {
+		load := true
+		start := time.Now()
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model: "test",
+			Load:  &load,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("expected load to return quickly, took %s", d)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !resp.Done || resp.DoneReason != "load" || resp.Response != "" {
+			t.Errorf("expected an empty load response, got %+v", resp)
+		}
+
+		if n := loaded(); n != 1 {
+			t.Errorf("expected 1 loaded runner, got %d", n)
+		}
+	})
+
+	t.Run("load with prompt", func(t *testing.T) {
+		load := true
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Load:   &load,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"load requires an empty prompt"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("unload", func(t *testing.T) {
+		load := false
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model: "test",
+			Load:  &load,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.DoneReason != "unload" {
+			t.Errorf("expected done reason unload, got %q", resp.DoneReason)
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for loaded() > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected runner to unload")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// cancelRunner generates until the request context is cancelled
+type cancelRunner struct {
+	mockLlm
+	started chan struct{}
+	stopped chan struct{}
+}
+
+func (r *cancelRunner) Completion(ctx context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	r.started <- struct{}{}
+	defer func() { r.stopped <- struct{}{} }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+			fn(llm.CompletionResponse{Content: "a"})
+		}
+	}
+}
+
+func TestGenerateCancel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := cancelRunner{
+		started: make(chan struct{}, 1),
+		stopped: make(chan struct{}, 1),
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     gpu.GetGPUInfo,
+			getCpuFn:     gpu.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+		},
+	}
+	s.sched.loadFn = s.sched.load
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	// generate starts a request in the background and waits for the runner
+	// to start generating
+	generate := func(t *testing.T, ctx context.Context, requestID string) <-chan struct{} {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.GenerateRequest{
+			Model:     "test",
+			Prompt:    "Hello!",
+			RequestID: requestID,
+			Stream:    &stream,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		c, _ := gin.CreateTestContext(NewRecorder())
+		c.Request = (&http.Request{Body: io.NopCloser(&b)}).WithContext(ctx)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.GenerateHandler(c)
+		}()
+
+		select {
+		case <-mock.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for generation to start")
+		}
+
+		return done
+	}
+
+	stopped := func(t *testing.T, done <-chan struct{}) {
+		t.Helper()
+
+		for _, ch := range []<-chan struct{}{mock.stopped, done} {
+			select {
+			case <-ch:
+			case <-time.After(time.Second):
+				t.Fatal("expected generation to stop within 1s")
+			}
+		}
+	}
+
+	t.Run("client disconnect", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := generate(t, ctx, "")
+		cancel()
+		stopped(t, done)
+	})
+
+	t.Run("request id", func(t *testing.T) {
+		done := generate(t, context.Background(), "abc")
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:     "test",
+			Prompt:    "Hello!",
+			RequestID: "abc",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status 409, got %d", w.Code)
+		}
+
+		cw := NewRecorder()
+		c, _ := gin.CreateTestContext(cw)
+		c.Params = gin.Params{{Key: "id", Value: "abc"}}
+		s.CancelHandler(c)
+
+		if cw.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		stopped(t, done)
+	})
+
+	t.Run("unknown request id", func(t *testing.T) {
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{{Key: "id", Value: "abc"}}
+		s.CancelHandler(c)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestGenerateVerifyBlobs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture": "llama",
+		}, nil)),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate := func(t *testing.T) *httptest.ResponseRecorder {
+		t.Helper()
+		return createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		if w := generate(t); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	fi, err := os.Stat(m.ModelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite the blob in place, keeping its size and modification time
+	corrupt := func(t *testing.T, b byte) {
+		t.Helper()
+
+		bts, err := os.ReadFile(m.ModelPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts[len(bts)-1] = b
+		if err := os.WriteFile(m.ModelPath, bts, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(m.ModelPath, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		corrupt(t, 0xff)
+		if w := generate(t); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		if err := os.Chtimes(m.ModelPath, time.Now(), fi.ModTime().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		w := generate(t)
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", w.Code)
+		}
+
+		var resp map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(resp["error"], "model is corrupted, pull it again") {
+			t.Errorf("unexpected error %q", resp["error"])
+		}
+	})
+
+	t.Run("skip verify", func(t *testing.T) {
+		t.Setenv("OLLAMA_SKIP_VERIFY", "1")
+		if w := generate(t); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		if err := os.Truncate(m.ModelPath, fi.Size()/2); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := generate(t); w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", w.Code)
+		}
+	})
+}
+
+// seededRunner samples a response determined by the request's seed
+type seededRunner struct {
+	mockRunner
+}
+
+func (m *seededRunner) Completion(_ context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	if r.Options.Seed < 0 {
+		return errors.New("expected the server to choose a seed")
+	}
+
+	fn(llm.CompletionResponse{Content: fmt.Sprintf("sampled with seed %d", r.Options.Seed), Done: true, DoneReason: "stop"})
+	return nil
+}
+
+func TestGenerateSeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock seededRunner
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{llama: &mock}
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	generate := func(t *testing.T, options map[string]any) api.GenerateResponse {
+		t.Helper()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: options,
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed == nil {
+			t.Fatal("expected the seed to be returned")
+		}
+
+		return resp
+	}
+
+	t.Run("random", func(t *testing.T) {
+		first := generate(t, nil)
+		if *first.Seed < 0 || *first.Seed >= math.MaxUint32 {
+			t.Errorf("expected a seed the runner won't replace, got %d", *first.Seed)
+		}
+
+		// the returned seed reproduces the response
+		again := generate(t, map[string]any{"seed": *first.Seed})
+		if *again.Seed != *first.Seed {
+			t.Errorf("expected seed %d, got %d", *first.Seed, *again.Seed)
+		}
+
+		if again.Response != first.Response {
+			t.Errorf("expected the same response for the same seed, got %q and %q", first.Response, again.Response)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		resp := generate(t, map[string]any{"seed": 42})
+		if *resp.Seed != 42 {
+			t.Errorf("expected seed 42, got %d", *resp.Seed)
+		}
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Options:  map[string]any{"seed": 42},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed == nil || *resp.Seed != 42 {
+			t.Errorf("expected seed 42, got %v", resp.Seed)
+		}
+
+		if want := generate(t, map[string]any{"seed": 42}).Response; resp.Message.Content != want {
+			t.Errorf("expected %q, got %q", want, resp.Message.Content)
+		}
+	})
+}
+
+// crashingRunner is a runner whose process exits during its next crashes
+// completions
+type crashingRunner struct {
+	mockRunner
+	crashes     int
+	completions int
+	loads       int
+}
+
+func (r *crashingRunner) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	r.completions++
+	if r.crashes > 0 {
+		r.crashes--
+		return fmt.Errorf("%w: exit status 2", llm.ErrRunnerExited)
+	}
+
+	return r.mockRunner.Completion(ctx, req, fn)
+}
+
+func (*crashingRunner) Ping(context.Context) error             { return nil }
+func (*crashingRunner) WaitUntilRunning(context.Context) error { return nil }
+func (*crashingRunner) Close() error                           { return nil }
+func (*crashingRunner) EstimatedVRAM() uint64                  { return 0 }
+func (*crashingRunner) EstimatedTotal() uint64                 { return 0 }
+func (*crashingRunner) EstimatedVRAMByGPU(string) uint64       { return 0 }
+func (*crashingRunner) EstimatedLayers() (int, int)            { return 0, 0 }
+
+func TestGenerateRunnerCrash(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := crashingRunner{
+		mockRunner: mockRunner{
+			CompletionResponse: llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: "stop"},
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				mock.loads++
+				return &mock, nil
+			},
+			getGpuFn:     getCpuFn,
+			getCpuFn:     getCpuFn,
+			reschedDelay: 250 * time.Millisecond,
+		},
+	}
+	s.sched.loadFn = s.sched.load
+
+	events, unsubscribe := s.sched.events.subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	generate := func() *httptest.ResponseRecorder {
+		return createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+	}
+
+	t.Run("reload and retry", func(t *testing.T) {
+		mock.crashes = 1
+
+		w := generate()
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hi!" {
+			t.Errorf("expected response %q, got %q", "Hi!", resp.Response)
+		}
+
+		if mock.loads != 2 || mock.completions != 2 {
+			t.Errorf("expected 2 loads and completions, got %d loads and %d completions", mock.loads, mock.completions)
+		}
+
+		var types []string
+		for len(events) > 0 {
+			types = append(types, (<-events).Type)
+		}
+
+		if !slices.Contains(types, "crash") {
+			t.Errorf("expected a crash event, got %v", types)
+		}
+	})
+
+	t.Run("retried once", func(t *testing.T) {
+		mock.crashes, mock.loads, mock.completions = 2, 0, 0
+
+		if w := generate(); w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body)
+		}
+
+		// the runner loaded by the first subtest crashed, then the reloaded one
+		if mock.loads != 1 || mock.completions != 2 {
+			t.Errorf("expected 1 load and 2 completions, got %d loads and %d completions", mock.loads, mock.completions)
+		}
+	})
+
+	t.Run("repeated crashes", func(t *testing.T) {
+		mock.crashes, mock.loads, mock.completions = 1, 0, 0
+
+		// the model has now crashed maxRunnerCrashes times so isn't retried
+		if w := generate(); w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d: %s", w.Code, w.Body)
+		}
+
+		if mock.loads != 1 || mock.completions != 1 {
+			t.Errorf("expected 1 load and completion, got %d loads and %d completions", mock.loads, mock.completions)
+		}
+	})
+}
+
+func TestGenerateStreamFraming(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponses: []llm.CompletionResponse{
+			{Content: "Hi"},
+			{Content: " there!"},
+			{Done: true, DoneReason: "stop"},
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{llama: &mock}
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	// generate streams a response to a client accepting accept and returns
+	// its content type and the responses of its body framed by prefix and sep
+	generate := func(t *testing.T, accept, prefix, sep string) (string, []api.GenerateResponse) {
+		t.Helper()
+
+		body, err := json.Marshal(api.GenerateRequest{Model: "test", Prompt: "Hello!", Options: map[string]any{"seed": 42}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(body))
+		c.Request.Header.Set("Accept", accept)
+
+		s.GenerateHandler(c)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resps []api.GenerateResponse
+		for _, frame := range strings.SplitAfter(w.Body.String(), sep) {
+			if frame == "" {
+				continue
+			}
+
+			data, ok := strings.CutSuffix(frame, sep)
+			if !ok {
+				t.Fatalf("expected frame %q to end with %q", frame, sep)
+			}
+
+			if data, ok = strings.CutPrefix(data, prefix); !ok {
+				t.Fatalf("expected frame %q to start with %q", frame, prefix)
+			}
+
+			var resp api.GenerateResponse
+			if err := json.Unmarshal([]byte(data), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			// the times of the responses differ
+			resp.CreatedAt = time.Time{}
+			resp.TotalDuration, resp.LoadDuration = 0, 0
+			resps = append(resps, resp)
+		}
+
+		return w.Header().Get("Content-Type"), resps
+	}
+
+	ndjsonType, ndjson := generate(t, "application/x-ndjson", "", "\n")
+	if ndjsonType != "application/x-ndjson" {
+		t.Errorf("expected content type application/x-ndjson, got %s", ndjsonType)
+	}
+
+	// NDJSON is the default
+	if defaultType, _ := generate(t, "", "", "\n"); defaultType != "application/x-ndjson" {
+		t.Errorf("expected content type application/x-ndjson, got %s", defaultType)
+	}
+
+	sseType, sse := generate(t, "text/event-stream", "data: ", "\n\n")
+	if sseType != "text/event-stream" {
+		t.Errorf("expected content type text/event-stream, got %s", sseType)
+	}
+
+	if len(ndjson) != 3 {
+		t.Fatalf("expected 3 responses, got %d", len(ndjson))
+	}
+
+	if diff := cmp.Diff(ndjson, sse); diff != "" {
+		t.Errorf("expected the same responses (-ndjson +sse):\n%s", diff)
+	}
+}
+
+// fimRunner detokenizes the fill-in-the-middle tokens 1, 2 and 3
+type fimRunner struct {
+	mockRunner
+}
+
+func (*fimRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	pieces := map[int]string{1: "<|fim_prefix|>", 2: "<|fim_suffix|>", 3: "<|fim_middle|>"}
+
+	var sb strings.Builder
+	for _, token := range tokens {
+		sb.WriteString(pieces[token])
+	}
+
+	return sb.String(), nil
+}
+
+func TestGenerateFIM(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := fimRunner{
+		mockRunner: mockRunner{
+			CompletionResponse: llm.CompletionResponse{Done: true, DoneReason: "stop"},
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				return &mock, nil
+			},
+			getGpuFn:     gpu.GetGPUInfo,
+			getCpuFn:     gpu.GetCPUInfo,
+			reschedDelay: 250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	create := func(name string, kv llm.KV) {
+		t.Helper()
+		kv = maps.Clone(kv)
+		maps.Copy(kv, llm.KV{
+			"general.architecture":      "llama",
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		})
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     name,
+			Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, kv, nil)),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	create("fim", llm.KV{
+		"tokenizer.ggml.fim_pre_token_id": uint32(1),
+		"tokenizer.ggml.fim_suf_token_id": uint32(2),
+		"tokenizer.ggml.fim_mid_token_id": uint32(3),
+	})
+	create("fim-legacy", llm.KV{
+		"tokenizer.ggml.prefix_token_id": uint32(1),
+		"tokenizer.ggml.suffix_token_id": uint32(2),
+		"tokenizer.ggml.middle_token_id": uint32(3),
+	})
+	create("text", llm.KV{
+		"tokenizer.ggml.fim_pre_token_id": uint32(1),
+	})
+
+	for _, name := range []string{"fim", "fim-legacy"} {
+		t.Run(name, func(t *testing.T) {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:  name,
+				Prompt: "def add(a, b):\n",
+				Suffix: "\n    return c",
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+
+			if diff := cmp.Diff("<|fim_prefix|>def add(a, b):\n<|fim_suffix|>\n    return c<|fim_middle|>", mock.CompletionRequest.Prompt); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("without suffix", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "fim",
+			Prompt: "def add(a, b):",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if diff := cmp.Diff("def add(a, b):", mock.CompletionRequest.Prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "text",
+			Prompt: "def add(a, b):",
+			Suffix: "    return c",
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+
+		if diff := cmp.Diff(`{"code":"unsupported","error":"text does not support insert"}`, w.Body.String()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGenerateThinking(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponses: []llm.CompletionResponse{
+			{Content: "<thi"},
+			{Content: "nk>\nLet me"},
+			{Content: " think.</th"},
+			{Content: "ink>\n\nHello"},
+			{Content: "!", Done: true, DoneReason: "stop"},
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":      "llama",
+		"tokenizer.ggml.tokens":     []string{""},
+		"tokenizer.ggml.scores":     []float32{0},
+		"tokenizer.ggml.token_type": []int32{0},
+	}, nil)
+
+	for name, tmpl := range map[string]string{
+		"think": `{{ range .Messages }}{{ if eq .Role "assistant" }}<think></think>{{ end }}{{ .Content }}{{ end }}`,
+		"plain": `{{ range .Messages }}{{ .Content }}{{ end }}`,
+	} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     name,
+			Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"%s\"\"\"", bin, tmpl),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	enabled, disabled := true, false
+	cases := []struct {
+		name              string
+		think             *bool
+		thinking, content string
+	}{
+		{"separate", &enabled, "Let me think.", "Hello!"},
+		{"strip", &disabled, "", "Hello!"},
+		{"unset", nil, "", "<think>\nLet me think.</think>\n\nHello!"},
+	}
+
+	for _, tt := range cases {
+		t.Run("generate "+tt.name, func(t *testing.T) {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:  "think",
+				Prompt: "Hi!",
+				Think:  tt.think,
+				Stream: &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+
+			var resp api.GenerateResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Thinking != tt.thinking || resp.Response != tt.content {
+				t.Errorf("expected thinking %q and response %q, got %q and %q", tt.thinking, tt.content, resp.Thinking, resp.Response)
+			}
+		})
+
+		t.Run("chat "+tt.name, func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "think",
+				Messages: []api.Message{{Role: "user", Content: "Hi!"}},
+				Think:    tt.think,
+				Stream:   &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Message.Thinking != tt.thinking || resp.Message.Content != tt.content {
+				t.Errorf("expected thinking %q and content %q, got %q and %q", tt.thinking, tt.content, resp.Message.Thinking, resp.Message.Content)
+			}
+		})
+	}
+
+	t.Run("streamed", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "think",
+			Prompt: "Hi!",
+			Think:  &enabled,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var thinking, content strings.Builder
+		d := json.NewDecoder(w.Body)
+		for d.More() {
+			var resp api.GenerateResponse
+			if err := d.Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(resp.Thinking+resp.Response, "think>") {
+				t.Errorf("expected no thinking tags, got %+v", resp)
+			}
+
+			thinking.WriteString(resp.Thinking)
+			content.WriteString(resp.Response)
+		}
+
+		if thinking.String() != "Let me think." || content.String() != "Hello!" {
+			t.Errorf("expected thinking %q and response %q, got %q and %q", "Let me think.", "Hello!", thinking.String(), content.String())
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "plain",
+			Prompt: "Hi!",
+			Think:  &enabled,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"\"plain\" does not support thinking"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
+
+func TestGenerateGrammar(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "yes",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture":      "llama",
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		}, nil)),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	const yesNo = `root ::= "yes" | "no"`
+
+	t.Run("generate", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Is the sky blue?",
+			Grammar: yesNo,
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if mock.CompletionRequest.Grammar != yesNo {
+			t.Errorf("expected grammar %q, got %q", yesNo, mock.CompletionRequest.Grammar)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "yes" {
+			t.Errorf("expected response %q, got %q", "yes", resp.Response)
+		}
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Is the sky blue?"}},
+			Grammar:  yesNo,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if mock.CompletionRequest.Grammar != yesNo {
+			t.Errorf("expected grammar %q, got %q", yesNo, mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := map[string]struct {
+			generate api.GenerateRequest
+			chat     api.ChatRequest
+		}{
+			"blank": {
+				generate: api.GenerateRequest{Grammar: " \n"},
+				chat:     api.ChatRequest{Grammar: " \n"},
+			},
+			"with format": {
+				generate: api.GenerateRequest{Grammar: yesNo, Format: "json"},
+				chat:     api.ChatRequest{Grammar: yesNo, Format: "json"},
+			},
+			"with schema": {
+				chat: api.ChatRequest{Grammar: yesNo, Format: api.Format(`{"type": "string"}`)},
+			},
+		}
+
+		for name, tt := range cases {
+			t.Run(name, func(t *testing.T) {
+				if tt.generate.Grammar != "" {
+					tt.generate.Model, tt.generate.Prompt = "test", "Hi!"
+					if w := createRequest(t, s.GenerateHandler, tt.generate); w.Code != http.StatusBadRequest {
+						t.Errorf("generate: expected status 400, got %d: %s", w.Code, w.Body)
+					}
+				}
+
+				tt.chat.Model, tt.chat.Messages = "test", []api.Message{{Role: "user", Content: "Hi!"}}
+				if w := createRequest(t, s.ChatHandler, tt.chat); w.Code != http.StatusBadRequest {
+					t.Errorf("chat: expected status 400, got %d: %s", w.Code, w.Body)
+				}
+			})
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		mock.CompletionError = llm.ErrInvalidGrammar
+		defer func() { mock.CompletionError = nil }()
+
+		for _, streaming := range []bool{false, true} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Is the sky blue?",
+				Grammar: `root ::= "yes" | "no`,
+				Stream:  &streaming,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("stream %t: expected status 400, got %d: %s", streaming, w.Code, w.Body)
+			}
+
+			var resp api.StatusError
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.ErrorMessage != "invalid grammar" || resp.Code != api.ErrorCodeInvalidRequest {
+				t.Errorf("stream %t: unexpected error %+v", streaming, resp)
+			}
+		}
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Is the sky blue?"}},
+			Grammar:  `root ::= "yes" | "no`,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+	})
+}
+
+func TestStreamMultibyte(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockRunner
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture":      "llama",
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		}, nil)),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// the runner splits characters across responses, one byte at a time
+	const output = "héllo 世界 👋🏽\n\n  end \t"
+	for i := range len(output) {
+		mock.CompletionResponses = append(mock.CompletionResponses, llm.CompletionResponse{Content: output[i : i+1]})
+	}
+	mock.CompletionResponses = append(mock.CompletionResponses, llm.CompletionResponse{Done: true, DoneReason: "stop"})
+
+	streaming := true
+	for _, tt := range []struct {
+		name    string
+		handler func(*gin.Context)
+		req     any
+		content func([]byte) (string, error)
+	}{
+		{"generate", s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!", Stream: &streaming}, func(b []byte) (string, error) {
+			var resp api.GenerateResponse
+			err := json.Unmarshal(b, &resp)
+			return resp.Response, err
+		}},
+		{"chat", s.ChatHandler, api.ChatRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, Stream: &streaming}, func(b []byte) (string, error) {
+			var resp api.ChatResponse
+			err := json.Unmarshal(b, &resp)
+			return resp.Message.Content, err
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, tt.handler, tt.req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+
+			var sb strings.Builder
+			for _, line := range bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n")) {
+				content, err := tt.content(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !utf8.ValidString(content) || strings.ContainsRune(content, utf8.RuneError) {
+					t.Errorf("expected whole characters, got %q", content)
+				}
+
+				sb.WriteString(content)
+			}
+
+			if sb.String() != output {
+				t.Errorf("expected %q, got %q", output, sb.String())
+			}
+		})
+	}
+}
+
+func TestContextLengthClamp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	// a model trained with a context of only 256 tokens
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":      "llama",
+		"llama.context_length":      uint32(256),
+		"tokenizer.ggml.tokens":     []string{""},
+		"tokenizer.ggml.scores":     []float32{0},
+		"tokenizer.ggml.token_type": []int32{0},
+	}, nil)
+
+	for name, modelfile := range map[string]string{
+		"small":     fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", bin),
+		"small-128": fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}\nPARAMETER num_ctx 128", bin),
+		"small-big": fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}\nPARAMETER num_ctx 4096", bin),
+	} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{Model: name, Modelfile: modelfile, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		model    string
+		options  map[string]any
+		overflow bool
+		want     int
+	}{
+		{"request", "small", map[string]any{"num_ctx": 1024}, false, 256},
+		{"modelfile", "small-big", nil, false, 256},
+		{"default", "small", nil, false, 256},
+		{"within", "small-128", nil, false, 128},
+		{"request within", "small", map[string]any{"num_ctx": 64}, false, 64},
+		{"overflow request", "small", map[string]any{"num_ctx": 1024}, true, 1024},
+		{"overflow modelfile", "small-big", nil, true, 4096},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.overflow {
+				t.Setenv("OLLAMA_ALLOW_CONTEXT_OVERFLOW", "1")
+			}
+
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   tt.model,
+				Prompt:  "Hello!",
+				Options: tt.options,
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+
+			if n := mock.CompletionRequest.Options.NumCtx; n != tt.want {
+				t.Errorf("expected num_ctx %d, got %d", tt.want, n)
+			}
+		})
+	}
 }
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// stepRunner sends its first response then waits for next before sending
+// the final one, so tests can observe whether a response was flushed
+type stepRunner struct {
+	mockRunner
+	next chan struct{}
+}
+
+func (m *stepRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	fn(llm.CompletionResponse{Content: "Hi"})
+
+	select {
+	case <-m.next:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	fn(llm.CompletionResponse{Content: "!", Done: true, DoneReason: "stop"})
+	return nil
+}
+
+// newStepServer returns a server with a model "test" served by a stepRunner
+func newStepServer(t *testing.T) (*Server, *stepRunner) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	mock := &stepRunner{next: make(chan struct{})}
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{llama: mock}
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	return &s, mock
+}
+
+// h2cClient returns a client that talks HTTP/2 over plain TCP
+func h2cClient() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func TestHTTP2Generate(t *testing.T) {
+	s, mock := newStepServer(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newHTTPServer(s.GenerateRoutes())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	client := h2cClient()
+
+	body, err := json.Marshal(api.GenerateRequest{Model: "test", Prompt: "Hello!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Post("http://"+ln.Addr().String()+"/api/generate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	lines := make(chan api.GenerateResponse)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var r api.GenerateResponse
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				errCh <- err
+				return
+			}
+
+			lines <- r
+		}
+
+		errCh <- scanner.Err()
+	}()
+
+	// the first chunk must arrive before the runner is allowed to finish
+	select {
+	case r := <-lines:
+		if r.Response != "Hi" || r.Done {
+			t.Errorf("unexpected first response %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first streamed response")
+	}
+
+	close(mock.next)
+
+	var responses []api.GenerateResponse
+	for r := range lines {
+		responses = append(responses, r)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(responses) != 1 || responses[0].Response != "!" || !responses[0].Done {
+		t.Errorf("unexpected final responses %+v", responses)
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	t.Setenv("OLLAMA_HTTP_IDLE_TIMEOUT", "2m")
+	t.Setenv("OLLAMA_HTTP_READ_TIMEOUT", "30s")
+
+	srv := newHTTPServer(http.NotFoundHandler())
+	if srv.IdleTimeout != 2*time.Minute {
+		t.Errorf("expected idle timeout 2m, got %s", srv.IdleTimeout)
+	}
+
+	if srv.ReadTimeout != 30*time.Second {
+		t.Errorf("expected read timeout 30s, got %s", srv.ReadTimeout)
+	}
+}
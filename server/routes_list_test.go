@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"slices"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
 )
 
 func TestList(t *testing.T) {
@@ -63,3 +65,85 @@ func TestList(t *testing.T) {
 		t.Fatalf("expected slices to be equal %v", actualNames)
 	}
 }
+
+func TestListFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	for name, kv := range map[string]llm.KV{
+		"llama-q4_0":   {"general.architecture": "llama", "general.file_type": uint32(2)},
+		"llama-q4_k_m": {"general.architecture": "llama", "general.file_type": uint32(15)},
+		"gemma-q4_k_m": {"general.architecture": "gemma", "general.file_type": uint32(15)},
+		"gemma-q8_0":   {"general.architecture": "gemma", "general.file_type": uint32(7)},
+	} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, kv, nil)),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+		}
+	}
+
+	list := func(t *testing.T, query string) []api.ListModelResponse {
+		t.Helper()
+
+		w := NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/tags?"+query, nil)
+		s.ListHandler(c)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Models
+	}
+
+	cases := []struct {
+		query string
+		names []string
+	}{
+		{"", []string{"gemma-q4_k_m:latest", "gemma-q8_0:latest", "llama-q4_0:latest", "llama-q4_k_m:latest"}},
+		{"family=llama", []string{"llama-q4_0:latest", "llama-q4_k_m:latest"}},
+		{"family=Gemma", []string{"gemma-q4_k_m:latest", "gemma-q8_0:latest"}},
+		{"quantization=Q4_K_M", []string{"gemma-q4_k_m:latest", "llama-q4_k_m:latest"}},
+		{"family=llama&quantization=q4_k_m", []string{"llama-q4_k_m:latest"}},
+		{"family=mistral", []string{}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.query, func(t *testing.T) {
+			names := []string{}
+			for _, m := range list(t, tt.query) {
+				names = append(names, m.Name)
+			}
+			slices.Sort(names)
+
+			if !slices.Equal(names, tt.names) {
+				t.Errorf("expected %v, actual %v", tt.names, names)
+			}
+		})
+	}
+
+	t.Run("details", func(t *testing.T) {
+		models := list(t, "family=gemma&quantization=Q8_0")
+		if len(models) != 1 {
+			t.Fatalf("expected 1 model, actual %d", len(models))
+		}
+
+		details := models[0].Details
+		if details.Family != "gemma" || !slices.Equal(details.Families, []string{"gemma"}) || details.QuantizationLevel != "Q8_0" || details.ParameterSize == "" {
+			t.Errorf("unexpected details %+v", details)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := crashingRunner{
+		mockRunner: mockRunner{
+			CompletionResponse: llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: "stop"},
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn: func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+				mock.loads++
+				return &mock, nil
+			},
+			getGpuFn:     getCpuFn,
+			getCpuFn:     getCpuFn,
+			reschedDelay: 250 * time.Millisecond,
+		},
+	}
+	s.sched.loadFn = s.sched.load
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.sched.Run(ctx)
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []llm.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	create := func(temperature float32) {
+		t.Helper()
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     "test",
+			Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}\nPARAMETER temperature %g", bin, temperature),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	loaded := func() *runnerRef {
+		s.sched.loadedMu.Lock()
+		defer s.sched.loadedMu.Unlock()
+		for _, runner := range s.sched.loaded {
+			return runner
+		}
+
+		return nil
+	}
+
+	create(0.5)
+
+	w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+		Model:  "test",
+		Prompt: "Hello!",
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	if runner := loaded(); runner == nil || runner.Options.Temperature != 0.5 {
+		t.Fatalf("expected a runner loaded with temperature 0.5, got %v", runner)
+	}
+
+	create(0.9)
+
+	t.Run("reload", func(t *testing.T) {
+		w := createRequest(t, s.ReloadHandler, api.ReloadRequest{Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.ProcessModelResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "test:latest" {
+			t.Errorf("expected model %q, got %q", "test:latest", resp.Model)
+		}
+
+		if mock.loads != 2 {
+			t.Errorf("expected 2 loads, got %d", mock.loads)
+		}
+
+		if runner := loaded(); runner == nil || runner.Options.Temperature != 0.9 {
+			t.Errorf("expected the runner to be reloaded with temperature 0.9, got %v", runner)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.ReloadHandler, api.ReloadRequest{})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("model not found", func(t *testing.T) {
+		w := createRequest(t, s.ReloadHandler, api.ReloadRequest{Model: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", w.Code, w.Body)
+		}
+	})
+}
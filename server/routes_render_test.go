@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+const renderTemplate = `{{- range .Messages }}<|{{ .Role }}|>{{ .Content }}
+{{ end }}<|assistant|>`
+
+func createRenderModel(t *testing.T, s *Server) {
+	t.Helper()
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nSYSTEM You are a bot.\nTEMPLATE \"\"\"%s\"\"\"", createBinFile(t, llm.KV{
+			"general.architecture":      "llama",
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		}, nil), renderTemplate),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestRenderHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+	createRenderModel(t, &s)
+
+	cases := []struct {
+		name string
+		req  api.RenderRequest
+		want string
+	}{
+		{
+			name: "model",
+			req:  api.RenderRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+			want: "<|system|>You are a bot.\n<|user|>Hello!\n<|assistant|>",
+		},
+		{
+			name: "system",
+			req:  api.RenderRequest{Model: "test", System: "You are a cat.", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+			want: "<|system|>You are a cat.\n<|user|>Hello!\n<|assistant|>",
+		},
+		{
+			name: "system message",
+			req: api.RenderRequest{Model: "test", Messages: []api.Message{
+				{Role: "system", Content: "You are a dog."},
+				{Role: "user", Content: "Hello!"},
+				{Role: "assistant", Content: "Woof!"},
+				{Role: "user", Content: "Sit."},
+			}},
+			want: "<|system|>You are a dog.\n<|user|>Hello!\n<|assistant|>Woof!\n<|user|>Sit.\n<|assistant|>",
+		},
+		{
+			name: "template",
+			req:  api.RenderRequest{Model: "test", Template: "{{ range .Messages }}[{{ .Content }}]{{ end }}", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+			want: "[You are a bot.][Hello!]",
+		},
+		{
+			name: "template without model",
+			req:  api.RenderRequest{Template: "{{ range .Messages }}{{ .Role }}: {{ .Content }}{{ end }}", Messages: []api.Message{{Role: "user", Content: "Hello!"}}},
+			want: "user: Hello!",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.RenderHandler, tt.req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+
+			var resp api.RenderResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Prompt != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, resp.Prompt)
+			}
+		})
+	}
+
+	errCases := []struct {
+		name string
+		req  api.RenderRequest
+		code int
+	}{
+		{"missing model and template", api.RenderRequest{Messages: []api.Message{{Role: "user", Content: "Hello!"}}}, http.StatusBadRequest},
+		{"missing model", api.RenderRequest{Model: "missing", Messages: []api.Message{{Role: "user", Content: "Hello!"}}}, http.StatusNotFound},
+		{"invalid template", api.RenderRequest{Model: "test", Template: "{{ .Messages", Messages: []api.Message{{Role: "user", Content: "Hello!"}}}, http.StatusBadRequest},
+	}
+
+	for _, tt := range errCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.RenderHandler, tt.req)
+			if w.Code != tt.code {
+				t.Errorf("expected status %d, got %d: %s", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestDebugRender(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: "stop",
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+	createRenderModel(t, &s)
+
+	const want = "<|system|>You are a bot.\n<|user|>Hello!\n<|assistant|>"
+
+	t.Run("generate", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			DebugRender: true,
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.RenderedPrompt != want {
+			t.Errorf("expected %q, got %q", want, resp.RenderedPrompt)
+		}
+
+		if mock.CompletionRequest.Prompt != want {
+			t.Errorf("expected the rendered prompt %q to be sent, got %q", want, mock.CompletionRequest.Prompt)
+		}
+
+		if resp.Response != "Hi!" {
+			t.Errorf("expected the response to be generated, got %q", resp.Response)
+		}
+	})
+
+	t.Run("chat", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:       "test",
+			Messages:    []api.Message{{Role: "user", Content: "Hello!"}},
+			DebugRender: true,
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.RenderedPrompt != want {
+			t.Errorf("expected %q, got %q", want, resp.RenderedPrompt)
+		}
+
+		if resp.Message.Content != "Hi!" {
+			t.Errorf("expected the response to be generated, got %q", resp.Message.Content)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.RenderedPrompt != "" {
+			t.Errorf("expected no rendered prompt, got %q", resp.RenderedPrompt)
+		}
+	})
+}
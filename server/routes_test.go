@@ -5,15 +5,21 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
@@ -90,7 +96,7 @@ func Test_Routes(t *testing.T) {
 		fn := func(resp api.ProgressResponse) {
 			t.Logf("Status: %s", resp.Status)
 		}
-		err = CreateModel(context.TODO(), model.ParseName(name), "", "", modelfile, fn)
+		err = CreateModel(context.TODO(), model.ParseName(name), "", "", modelfile, false, fn)
 		if err != nil {
 			t.Fatalf("failed to create model: %v", err)
 		}
@@ -108,13 +114,23 @@ func Test_Routes(t *testing.T) {
 				if contentType != "application/json; charset=utf-8" {
 					t.Errorf("expected content type application/json; charset=utf-8, got %s", contentType)
 				}
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					t.Fatalf("failed to read response body: %v", err)
+				var versionResp api.VersionResponse
+				if err := json.NewDecoder(resp.Body).Decode(&versionResp); err != nil {
+					t.Fatalf("failed to decode response body: %v", err)
 				}
-				expectedBody := fmt.Sprintf(`{"version":"%s"}`, version.Version)
-				if string(body) != expectedBody {
-					t.Errorf("expected body %s, got %s", expectedBody, string(body))
+				if versionResp.Version == "" || versionResp.Version != version.Version {
+					t.Errorf("expected version %q, got %q", version.Version, versionResp.Version)
+				}
+				if !regexp.MustCompile(`^\d+\.\d+\.\d+$`).MatchString(versionResp.APIVersion) {
+					t.Errorf("expected a semantic api_version, got %q", versionResp.APIVersion)
+				}
+				for _, capability := range []string{"chat", "embed", "generate", "openai", "pull", "structured_outputs", "tools"} {
+					if !slices.Contains(versionResp.Capabilities, capability) {
+						t.Errorf("expected capability %q in %v", capability, versionResp.Capabilities)
+					}
+				}
+				if !slices.IsSorted(versionResp.Capabilities) {
+					t.Errorf("expected sorted capabilities, got %v", versionResp.Capabilities)
 				}
 			},
 		},
@@ -225,7 +241,7 @@ func Test_Routes(t *testing.T) {
 
 				// Verify the model was deleted
 				_, err := GetModel("model-to-delete")
-				if err == nil || !os.IsNotExist(err) {
+				if err == nil || !errors.Is(err, os.ErrNotExist) {
 					t.Errorf("expected model to be deleted, got error %v", err)
 				}
 			},
@@ -289,6 +305,15 @@ func Test_Routes(t *testing.T) {
 				if len(modelList.Data) != 1 || modelList.Data[0].Id != "test-model:latest" || modelList.Data[0].OwnedBy != "library" {
 					t.Errorf("expected model 'test-model:latest' owned by 'library', got %v", modelList.Data)
 				}
+
+				m, err := ParseNamedManifest(model.ParseName("test-model"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if modelList.Data[0].Created != m.fi.ModTime().Unix() {
+					t.Errorf("expected created %d, got %d", m.fi.ModTime().Unix(), modelList.Data[0].Created)
+				}
 			},
 		},
 		{
@@ -498,7 +523,7 @@ func TestCase(t *testing.T) {
 				t.Fatalf("expected status 200 got %d", w.Code)
 			}
 
-			expect, err := json.Marshal(map[string]string{"error": "a model with that name already exists"})
+			expect, err := json.Marshal(map[string]string{"error": "a model with that name already exists", "code": api.ErrorCodeInvalidRequest})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -588,6 +613,180 @@ func TestShow(t *testing.T) {
 	}
 }
 
+func TestShowSections(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name: "show-model",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}\nSYSTEM You are a pirate.\nPARAMETER temperature 0.5\nLICENSE MIT\n", createBinFile(t, llm.KV{
+			"general.architecture":   "llama",
+			"llama.context_length":   uint32(8192),
+			"llama.embedding_length": uint32(4096),
+		}, nil)),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	modelInfo := map[string]any{
+		"general.architecture":    "llama",
+		"general.parameter_count": float64(0),
+		"llama.context_length":    float64(8192),
+		"llama.embedding_length":  float64(4096),
+	}
+
+	parameters := fmt.Sprintf("%-30s %#v", "temperature", 0.5)
+
+	cases := []struct {
+		name   string
+		req    api.ShowRequest
+		expect api.ShowResponse
+	}{
+		{"template", api.ShowRequest{ShowTemplate: true}, api.ShowResponse{Template: "{{ .Prompt }}", ModelInfo: modelInfo}},
+		{"parameters", api.ShowRequest{ShowParameters: true}, api.ShowResponse{Parameters: parameters, ModelInfo: modelInfo}},
+		{"system", api.ShowRequest{ShowSystem: true}, api.ShowResponse{System: "You are a pirate.", ModelInfo: modelInfo}},
+		{"template and system", api.ShowRequest{ShowTemplate: true, ShowSystem: true}, api.ShowResponse{Template: "{{ .Prompt }}", System: "You are a pirate.", ModelInfo: modelInfo}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Model = "show-model"
+			w := createRequest(t, s.ShowHandler, tt.req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d", w.Code)
+			}
+
+			var resp api.ShowResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(resp, tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("all", func(t *testing.T) {
+		w := createRequest(t, s.ShowHandler, api.ShowRequest{Model: "show-model"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ShowResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.License != "MIT" || resp.Modelfile == "" || resp.Template == "" || resp.System == "" || resp.Parameters == "" {
+			t.Errorf("expected every section, got %+v", resp)
+		}
+	})
+}
+
+func TestShowCapabilities(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	create := func(name, modelfile string) {
+		t.Helper()
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{Name: name, Modelfile: modelfile, Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+		}
+	}
+
+	create("text", fmt.Sprintf("FROM %s\nTEMPLATE \"{{ .Prompt }}{{ if .Tools }}{{ .Tools }}{{ end }}\"", createBinFile(t, llm.KV{"general.architecture": "llama"}, nil)))
+	create("vision", fmt.Sprintf(
+		"FROM %s\nFROM %s\nTEMPLATE \"{{ .Prompt }}{{ .Suffix }}\"",
+		createBinFile(t, llm.KV{"general.architecture": "llama"}, nil),
+		createBinFile(t, llm.KV{"general.architecture": "clip"}, nil),
+	))
+	create("embedding", fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{"general.architecture": "bert", "bert.pooling_type": uint32(1)}, nil)))
+
+	cases := []struct {
+		model  string
+		expect []string
+	}{
+		{"text", []string{"completion", "tools"}},
+		{"vision", []string{"completion", "vision", "insert"}},
+		{"embedding", []string{"embedding"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model, func(t *testing.T) {
+			w := createRequest(t, s.ShowHandler, api.ShowRequest{Model: tt.model})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d", w.Code)
+			}
+
+			var resp api.ShowResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.expect, resp.Capabilities); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("images without vision", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "text",
+			Messages: []api.Message{{Role: "user", Content: "What is this?", Images: []api.ImageData{[]byte("image")}}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		var resp map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp["error"] != `"text" does not support images` || resp["code"] != api.ErrorCodeUnsupported {
+			t.Errorf("unexpected error %v", resp)
+		}
+	})
+}
+
+func TestModelOptions(t *testing.T) {
+	t.Setenv("OLLAMA_DEFAULT_TEMPERATURE", "0.2")
+	t.Setenv("OLLAMA_DEFAULT_TOP_P", "0.5")
+	t.Setenv("OLLAMA_DEFAULT_TOP_K", "10")
+
+	m := &Model{Options: map[string]any{"top_p": 0.6, "top_k": int64(20)}}
+
+	opts, err := modelOptions(m, map[string]any{"top_k": 30.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each layer replaces the one under it
+	if opts.Temperature != 0.2 {
+		t.Errorf("expected temperature 0.2 from the environment, got %v", opts.Temperature)
+	}
+
+	if opts.TopP != 0.6 {
+		t.Errorf("expected top_p 0.6 from the model, got %v", opts.TopP)
+	}
+
+	if opts.TopK != 30 {
+		t.Errorf("expected top_k 30 from the request, got %v", opts.TopK)
+	}
+
+	if want := api.DefaultOptions().MinP; opts.MinP != want {
+		t.Errorf("expected the built in min_p %v, got %v", want, opts.MinP)
+	}
+}
+
 func TestNormalize(t *testing.T) {
 	type testCase struct {
 		input []float32
@@ -622,3 +821,58 @@ func TestNormalize(t *testing.T) {
 		})
 	}
 }
+
+func TestPs(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	s := Server{
+		sched: &Scheduler{
+			loaded: map[string]*runnerRef{
+				"/models/test": {
+					model: &Model{
+						ShortName: "test:latest",
+						Digest:    "sha256:abc",
+						Config:    ConfigV2{ModelFormat: "gguf", ModelFamily: "llama"},
+					},
+					Options:        &api.Options{Runner: api.Runner{NumCtx: 8192}},
+					numParallel:    2,
+					estimatedTotal: 1000,
+					estimatedVRAM:  600,
+					gpuLayers:      20,
+					totalLayers:    33,
+					expiresAt:      expiresAt,
+				},
+			},
+		},
+	}
+
+	w := createRequest(t, s.PsHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var raw struct {
+		Models []map[string]any `json:"models"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw.Models) != 1 {
+		t.Fatalf("expected 1 model, got %d", len(raw.Models))
+	}
+
+	for k, v := range map[string]float64{"size": 1000, "size_vram": 600, "context_length": 4096, "gpu_layers": 20, "cpu_layers": 13} {
+		if raw.Models[0][k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, raw.Models[0][k])
+		}
+	}
+
+	var resp api.ProcessResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !resp.Models[0].ExpiresAt.Equal(expiresAt) {
+		t.Errorf("expected expires_at %s, got %s", expiresAt, resp.Models[0].ExpiresAt)
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+)
+
+type mockTokenizeRunner struct {
+	mockRunner
+	tokenize func()
+}
+
+func (m *mockTokenizeRunner) Tokenize(_ context.Context, s string) ([]int, error) {
+	if m.tokenize != nil {
+		m.tokenize()
+	}
+
+	return []int{len(s)}, nil
+}
+
+func (m *mockTokenizeRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	return fmt.Sprint(tokens), nil
+}
+
+func TestTokenize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tokens := []string{"<unk>", "<s>", "</s>"}
+	for i := range 256 {
+		tokens = append(tokens, fmt.Sprintf("<0x%02X>", i))
+	}
+	tokens = append(tokens, "▁", "d", "e", "h", "l", "o", "r", "w")
+
+	scores := make([]float32, len(tokens))
+	types := make([]int32, len(tokens))
+	for i := range tokens {
+		switch {
+		case i < 3:
+			types[i] = 3
+		case i < 259:
+			types[i] = 6
+		default:
+			types[i] = 1
+		}
+	}
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":            "llama",
+			"llama.block_count":               uint32(1),
+			"llama.context_length":            uint32(8192),
+			"llama.embedding_length":          uint32(4096),
+			"llama.attention.head_count":      uint32(32),
+			"llama.attention.head_count_kv":   uint32(8),
+			"tokenizer.ggml.model":            "llama",
+			"tokenizer.ggml.tokens":           tokens,
+			"tokenizer.ggml.scores":           scores,
+			"tokenizer.ggml.token_type":       types,
+			"tokenizer.ggml.add_space_prefix": false,
+			"tokenizer.ggml.bos_token_id":     uint32(1),
+			"tokenizer.ggml.eos_token_id":     uint32(2),
+			"tokenizer.ggml.unknown_token_id": uint32(0),
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:  "test",
+			Prompt: "hello world!",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// "!" isn't in the vocabulary so it falls back to its byte token
+		if diff := cmp.Diff(resp, api.TokenizeResponse{
+			Tokens: []int{262, 261, 263, 263, 264, 259, 266, 264, 265, 263, 260, 3 + '!'},
+			Count:  12,
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		w = createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{
+			Model:  "test",
+			Tokens: resp.Tokens,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var dresp api.DetokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&dresp); err != nil {
+			t.Fatal(err)
+		}
+
+		if dresp.Prompt != "hello world!" {
+			t.Errorf("expected prompt %q, got %q", "hello world!", dresp.Prompt)
+		}
+	})
+
+	t.Run("empty prompt", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"tokens":[],"count":0}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{
+			Model:  "test",
+			Tokens: []int{len(tokens)},
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Prompt: "hello"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"model is required"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("model not found", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Model: "missing", Prompt: "hello"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("loaded runner", func(t *testing.T) {
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// replicas after the first are keyed by their index
+		for _, replica := range []int{0, 1} {
+			t.Run(fmt.Sprint(replica), func(t *testing.T) {
+				mock := &mockTokenizeRunner{}
+				runner := &runnerRef{llama: mock, modelPath: m.ModelPath, replica: replica, sessionDuration: time.Minute}
+				s := Server{sched: &Scheduler{loaded: map[string]*runnerRef{runner.key(): runner}}}
+
+				// the runner is referenced while it tokenizes so it isn't unloaded
+				mock.tokenize = func() {
+					runner.refMu.Lock()
+					defer runner.refMu.Unlock()
+					if runner.refCount != 1 {
+						t.Errorf("expected 1 reference while tokenizing, got %d", runner.refCount)
+					}
+				}
+
+				w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Model: "test", Prompt: "hello"})
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				if diff := cmp.Diff(w.Body.String(), `{"tokens":[5],"count":1}`); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+
+				runner.refMu.Lock()
+				defer runner.refMu.Unlock()
+				if runner.refCount != 0 || runner.expireTimer == nil {
+					t.Errorf("expected the runner to be released and expiring, got %d references", runner.refCount)
+				}
+
+				if runner.expireTimer != nil {
+					runner.expireTimer.Stop()
+				}
+			})
+		}
+	})
+}
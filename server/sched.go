@@ -8,10 +8,12 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ollama/ollama/api"
@@ -30,22 +32,55 @@ type LlmRequest struct {
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
+	runner          *runnerRef // the runner given to the request
+	reload          bool       // unload the loaded runners of the model first
+	replica         int        // the index of the replica to load
+	priority        int        // higher priorities are scheduled first
+	queued          time.Time  // when the request was queued, earlier for higher priorities
+	seq             uint64     // the order the request was first queued in
+}
+
+// numReplicas returns the number of instances of the model to load for req
+func (req *LlmRequest) numReplicas() int {
+	if req.opts.NumReplicas > 0 {
+		return req.opts.NumReplicas
+	}
+
+	return max(int(envconfig.NumReplicas()), 1)
 }
 
 type Scheduler struct {
-	pendingReqCh  chan *LlmRequest
-	finishedReqCh chan *LlmRequest
-	expiredCh     chan *runnerRef
-	unloadedCh    chan interface{}
+	pendingReqCh chan *LlmRequest
+	// prioritizedReqCh receives the requests of pendingReqCh by priority. It's
+	// made by Run.
+	prioritizedReqCh chan *LlmRequest
+	finishedReqCh    chan *LlmRequest
+	expiredCh        chan *runnerRef
+	unloadedCh       chan interface{}
 
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
 
 	loadFn       func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int)
-	newServerFn  func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
+	newServerFn  func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []llm.Adapter, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() gpu.GpuInfoList
 	getCpuFn     func() gpu.GpuInfoList
 	reschedDelay time.Duration
+
+	events eventBroker
+
+	// crashes holds the recent times the runner of each model path exited
+	// unexpectedly. It's guarded by loadedMu.
+	crashes map[string][]time.Time
+
+	// replicaTurns holds the replica of each model path to try first next,
+	// so requests take turns between equally busy replicas. It's only used
+	// by processPending.
+	replicaTurns map[string]int
+
+	// queueLen is the number of requests waiting on pendingReqCh or in
+	// prioritizePending. getRunner bounds it by OLLAMA_MAX_QUEUE.
+	queueLen atomic.Int64
 }
 
 // Default automatic value for number of models we allow per GPU
@@ -60,6 +95,13 @@ var defaultParallel = 4
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+// Requests that fail because their runner crashed are retried until the
+// model's runner has crashed maxRunnerCrashes times within runnerCrashWindow
+const (
+	maxRunnerCrashes  = 3
+	runnerCrashWindow = 5 * time.Minute
+)
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
@@ -77,12 +119,28 @@ func InitScheduler(ctx context.Context) *Scheduler {
 	return sched
 }
 
-// context must be canceled to decrement ref count and release the runner
-func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) (chan *runnerRef, chan error) {
+// context must be canceled to decrement ref count and release the runner.
+// Requests with a higher priority are scheduled first.
+func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration, priority int) (chan *runnerRef, chan error) {
+	return s.getRunner(c, model, opts, sessionDuration, priority, false)
+}
+
+// ReloadRunner is GetRunner for a new runner of model. A loaded runner of the
+// model is unloaded once its requests complete, even if it could be used.
+func (s *Scheduler) ReloadRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) (chan *runnerRef, chan error) {
+	return s.getRunner(c, model, opts, sessionDuration, 0, true)
+}
+
+func (s *Scheduler) getRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration, priority int, reload bool) (chan *runnerRef, chan error) {
 	if opts.NumCtx < 4 {
 		opts.NumCtx = 4
 	}
 
+	// requests without a keep alive reset the runner to the server default
+	if sessionDuration == nil {
+		sessionDuration = &api.Duration{Duration: envconfig.KeepAlive()}
+	}
+
 	req := &LlmRequest{
 		ctx:             c,
 		model:           model,
@@ -90,11 +148,21 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		sessionDuration: sessionDuration,
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
+		reload:          reload,
+		priority:        priority,
+	}
+
+	if s.queueLen.Add(1) > int64(cap(s.pendingReqCh)) {
+		s.queueLen.Add(-1)
+		req.errCh <- ErrMaxQueue
+		return req.successCh, req.errCh
 	}
 
 	select {
 	case s.pendingReqCh <- req:
+		s.events.publish("queued", model.ShortName)
 	default:
+		s.queueLen.Add(-1)
 		req.errCh <- ErrMaxQueue
 	}
 	return req.successCh, req.errCh
@@ -103,6 +171,11 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 // Returns immediately, spawns go routines for the scheduler which will shutdown when ctx is done
 func (s *Scheduler) Run(ctx context.Context) {
 	slog.Debug("starting llm scheduler")
+	s.prioritizedReqCh = make(chan *LlmRequest)
+	go func() {
+		s.prioritizePending(ctx)
+	}()
+
 	go func() {
 		s.processPending(ctx)
 	}()
@@ -118,7 +191,9 @@ func (s *Scheduler) processPending(ctx context.Context) {
 		case <-ctx.Done():
 			slog.Debug("shutting down scheduler pending loop")
 			return
-		case pending := <-s.pendingReqCh:
+		case pending := <-s.prioritizedReqCh:
+			s.queueLen.Add(-1)
+
 			// Block other requests until we get this pending request running
 			pending.schedAttempts++
 			if pending.origNumCtx == 0 {
@@ -129,22 +204,32 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				slog.Debug("pending request cancelled or timed out, skipping scheduling")
 				continue
 			}
-			numParallel := int(envconfig.NumParallel())
+			numParallel, auto := envconfig.NumParallel()
 			// TODO (jmorganca): multimodal models don't support parallel yet
 			// see https://github.com/ollama/ollama/issues/4165
 			if len(pending.model.ProjectorPaths) > 0 && numParallel != 1 {
 				numParallel = 1
-				slog.Warn("multimodal models don't support parallel requests yet")
+				if !auto {
+					slog.Warn("multimodal models don't support parallel requests yet")
+				}
 			}
 
 			for {
 				var runnerToExpire *runnerRef
+				runner, replica := s.pickReplica(pending.model.ModelPath, pending.numReplicas())
+				pending.replica = max(replica, 0)
 				s.loadedMu.Lock()
-				runner := s.loaded[pending.model.ModelPath]
 				loadedCount := len(s.loaded)
 				s.loadedMu.Unlock()
+
+				// busy is a loaded replica to share if another can't be loaded
+				var busy *runnerRef
+				if runner != nil && replica >= 0 && !pending.reload && !runner.needsReload(ctx, pending) {
+					busy, runner = runner, nil
+				}
+
 				if runner != nil {
-					if runner.needsReload(ctx, pending) {
+					if pending.reload || runner.needsReload(ctx, pending) {
 						runnerToExpire = runner
 					} else {
 						// Runner is usable, return it
@@ -152,8 +237,8 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						break
 					}
 				} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
-					slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
-					runnerToExpire = s.findRunnerToUnload()
+					slog.Debug("max runners achieved, unloading the least recently used to make room", "runner_count", loadedCount)
+					runnerToExpire = s.findLRURunnerToUnload()
 				} else {
 					// Either no models are loaded or below envconfig.MaxRunners
 					// Get a refreshed GPU list
@@ -255,7 +340,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 						// model. If no other models are loading (both GPU lists
 						// are the same) then we need to unload another model to
 						// make room
-						if len(availGpus) < len(gpus) {
+						if len(availGpus) < len(gpus) && busy == nil {
 							// There are other requests pending, and this one
 							// needs more time, so put it on the back of the
 							// queue so that we might satisfy other pending
@@ -265,6 +350,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 								// the scheduler if our queue is full
 								slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
 								time.Sleep(s.reschedDelay)
+								s.queueLen.Add(1)
 								s.pendingReqCh <- pending
 							}()
 							break
@@ -273,6 +359,12 @@ func (s *Scheduler) processPending(ctx context.Context) {
 					}
 				}
 
+				if busy != nil {
+					slog.Debug("another replica doesn't fit, sharing a loaded one", "model", pending.model.ModelPath, "replica", busy.replica)
+					pending.useLoadedRunner(busy, s.finishedReqCh)
+					break
+				}
+
 				if runnerToExpire == nil {
 					// Shouildn't happen
 					slog.Error("runner to expire was nil!")
@@ -318,44 +410,22 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			slog.Debug("shutting down scheduler completed loop")
 			return
 		case finished := <-s.finishedReqCh:
+			s.events.publish("completed", finished.model.ShortName)
+			key := finished.model.ModelPath
+			if finished.runner != nil {
+				key = finished.runner.key()
+			}
 			s.loadedMu.Lock()
-			runner := s.loaded[finished.model.ModelPath]
+			runner := s.loaded[key]
 			s.loadedMu.Unlock()
 			if runner == nil {
 				slog.Error("finished request signal received after model unloaded", "modelPath", finished.model.ModelPath)
 				continue
+			} else if finished.runner != nil && finished.runner != runner {
+				slog.Debug("finished request signal received after runner was replaced", "modelPath", finished.model.ModelPath)
+				continue
 			}
-			runner.refMu.Lock()
-			runner.refCount--
-			if runner.refCount <= 0 {
-				if runner.sessionDuration <= 0 {
-					slog.Debug("runner with zero duration has gone idle, expiring to unload", "modelPath", runner.modelPath)
-					if runner.expireTimer != nil {
-						runner.expireTimer.Stop()
-						runner.expireTimer = nil
-					}
-					s.expiredCh <- runner
-				} else if runner.expireTimer == nil {
-					slog.Debug("runner with non-zero duration has gone idle, adding timer", "modelPath", runner.modelPath, "duration", runner.sessionDuration)
-					runner.expireTimer = time.AfterFunc(runner.sessionDuration, func() {
-						slog.Debug("timer expired, expiring to unload", "modelPath", runner.modelPath)
-						runner.refMu.Lock()
-						defer runner.refMu.Unlock()
-						if runner.expireTimer != nil {
-							runner.expireTimer.Stop()
-							runner.expireTimer = nil
-						}
-						s.expiredCh <- runner
-					})
-					runner.expiresAt = time.Now().Add(runner.sessionDuration)
-				} else {
-					slog.Debug("runner with non-zero duration has gone idle, resetting timer", "modelPath", runner.modelPath, "duration", runner.sessionDuration)
-					runner.expireTimer.Reset(runner.sessionDuration)
-					runner.expiresAt = time.Now().Add(runner.sessionDuration)
-				}
-			}
-			slog.Debug("after processing request finished event", "modelPath", runner.modelPath, "refCount", runner.refCount)
-			runner.refMu.Unlock()
+			s.release(runner)
 		case runner := <-s.expiredCh:
 			slog.Debug("runner expired event received", "modelPath", runner.modelPath)
 			runner.refMu.Lock()
@@ -374,11 +444,18 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			s.loadedMu.Lock()
 			slog.Debug("got lock to unload", "modelPath", runner.modelPath)
 			finished := runner.waitForVRAMRecovery()
+			var name string
+			if runner.model != nil {
+				name = runner.model.ShortName
+			}
 			runner.unload()
-			delete(s.loaded, runner.modelPath)
+			if s.loaded[runner.key()] == runner {
+				delete(s.loaded, runner.key())
+			}
 			s.loadedMu.Unlock()
 			slog.Debug("runner released", "modelPath", runner.modelPath)
 			runner.refMu.Unlock()
+			s.events.publish("unload", name)
 
 			<-finished
 			slog.Debug("sending an unloaded event", "modelPath", runner.modelPath)
@@ -387,6 +464,70 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 	}
 }
 
+// release drops a reference to runner and starts its expiry once it's idle
+func (s *Scheduler) release(runner *runnerRef) {
+	runner.refMu.Lock()
+	runner.refCount--
+	runner.lastUsed = time.Now()
+	if runner.refCount <= 0 {
+		if runner.sessionDuration <= 0 {
+			slog.Debug("runner with zero duration has gone idle, expiring to unload", "modelPath", runner.modelPath)
+			if runner.expireTimer != nil {
+				runner.expireTimer.Stop()
+				runner.expireTimer = nil
+			}
+			s.expiredCh <- runner
+		} else if runner.expireTimer == nil {
+			slog.Debug("runner with non-zero duration has gone idle, adding timer", "modelPath", runner.modelPath, "duration", runner.sessionDuration)
+			runner.expireTimer = time.AfterFunc(runner.sessionDuration, func() {
+				slog.Debug("timer expired, expiring to unload", "modelPath", runner.modelPath)
+				runner.refMu.Lock()
+				defer runner.refMu.Unlock()
+				if runner.expireTimer != nil {
+					runner.expireTimer.Stop()
+					runner.expireTimer = nil
+				}
+				s.expiredCh <- runner
+			})
+			runner.expiresAt = time.Now().Add(runner.sessionDuration)
+		} else {
+			slog.Debug("runner with non-zero duration has gone idle, resetting timer", "modelPath", runner.modelPath, "duration", runner.sessionDuration)
+			runner.expireTimer.Reset(runner.sessionDuration)
+			runner.expiresAt = time.Now().Add(runner.sessionDuration)
+		}
+	}
+	slog.Debug("after processing request finished event", "modelPath", runner.modelPath, "refCount", runner.refCount)
+	runner.refMu.Unlock()
+}
+
+// acquireLoaded returns a loaded runner of the model at path and its llama
+// with a reference taken on it so it isn't unloaded until it's released with
+// release, or nil if none is loaded
+func (s *Scheduler) acquireLoaded(path string) (*runnerRef, llm.LlamaServer) {
+	s.loadedMu.Lock()
+	var runners []*runnerRef
+	for _, runner := range s.loaded {
+		if runner.modelPath == path {
+			runners = append(runners, runner)
+		}
+	}
+	s.loadedMu.Unlock()
+
+	for _, runner := range runners {
+		runner.refMu.Lock()
+		// unloaded runners are left without a llama, which is only closed
+		// once no references are held
+		if llama := runner.llama; llama != nil && !runner.loading {
+			runner.refCount++
+			runner.refMu.Unlock()
+			return runner, llama
+		}
+		runner.refMu.Unlock()
+	}
+
+	return nil, nil
+}
+
 // Complete the pending request and send the runner back to the requester
 // Wires up a finished event after the request context is completed
 // Updates session duration, and resets expiration timer
@@ -394,6 +535,7 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 	runner.refMu.Lock()
 	defer runner.refMu.Unlock()
 	runner.refCount++
+	runner.lastUsed = time.Now()
 	if runner.expireTimer != nil {
 		runner.expireTimer.Stop()
 		runner.expireTimer = nil
@@ -401,6 +543,7 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 	if pending.sessionDuration != nil {
 		runner.sessionDuration = pending.sessionDuration.Duration
 	}
+	pending.runner = runner
 	pending.successCh <- runner
 	go func() {
 		<-pending.ctx.Done()
@@ -417,7 +560,7 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
-	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.Adapters, req.model.ProjectorPaths, req.opts, numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
@@ -429,6 +572,7 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 		req.errCh <- err
 		return
 	}
+	gpuLayers, totalLayers := llama.EstimatedLayers()
 	runner := &runnerRef{
 		model:           req.model,
 		modelPath:       req.model.ModelPath,
@@ -438,14 +582,18 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 		gpus:            gpus,
 		estimatedVRAM:   llama.EstimatedVRAM(),
 		estimatedTotal:  llama.EstimatedTotal(),
+		gpuLayers:       gpuLayers,
+		totalLayers:     totalLayers,
 		loading:         true,
 		refCount:        1,
+		lastUsed:        time.Now(),
+		replica:         req.replica,
 	}
 	runner.numParallel = numParallel
 	runner.refMu.Lock()
 
 	s.loadedMu.Lock()
-	s.loaded[req.model.ModelPath] = runner
+	s.loaded[runner.key()] = runner
 	slog.Info("loaded runners", "count", len(s.loaded))
 	s.loadedMu.Unlock()
 
@@ -461,6 +609,8 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 		}
 		slog.Debug("finished setting up runner", "model", req.model.ModelPath)
 		runner.loading = false
+		s.events.publish("load", req.model.ShortName)
+		req.runner = runner
 		go func() {
 			<-req.ctx.Done()
 			slog.Debug("context for request finished")
@@ -545,17 +695,35 @@ type runnerRef struct {
 	gpus           gpu.GpuInfoList // Recorded at time of provisioning
 	estimatedVRAM  uint64
 	estimatedTotal uint64
+	gpuLayers      int
+	totalLayers    int
 
 	sessionDuration time.Duration
 	expireTimer     *time.Timer
 	expiresAt       time.Time
+	lastUsed        time.Time // when a request last started or finished
 
 	model       *Model
 	modelPath   string
+	replica     int // the index of the instance of the model
 	numParallel int
 	*api.Options
 }
 
+// replicaKey returns the key in Scheduler.loaded of the replica of the model
+// at path. The first replica is keyed by the path alone.
+func replicaKey(path string, replica int) string {
+	if replica == 0 {
+		return path
+	}
+
+	return path + "#" + strconv.Itoa(replica)
+}
+
+func (runner *runnerRef) key() string {
+	return replicaKey(runner.modelPath, runner.replica)
+}
+
 // The refMu must already be held when calling unload
 func (runner *runnerRef) unload() {
 	if runner.expireTimer != nil {
@@ -585,20 +753,33 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 		return true
 	}
 
-	// Don't reload runner if num_gpu=-1 was provided
+	// Don't reload runner if num_gpu=-1 was provided or if the runner already
+	// offloads the requested number of layers
 	optsExisting := runner.Options.Runner
 	optsNew := req.opts.Runner
 	if optsNew.NumGPU < 0 {
 		optsExisting.NumGPU = -1
 		optsNew.NumGPU = -1
+	} else if optsNew.NumGPU != optsExisting.NumGPU {
+		if gpuLayers, totalLayers := runner.llama.EstimatedLayers(); totalLayers > 0 && min(optsNew.NumGPU, totalLayers) == gpuLayers {
+			optsExisting.NumGPU = optsNew.NumGPU
+		}
 	}
 
+	// The number of replicas doesn't change the runner
+	optsExisting.NumReplicas = optsNew.NumReplicas
+
 	// Normalize the NumCtx for parallelism
 	optsExisting.NumCtx = optsExisting.NumCtx / runner.numParallel
 
+	// Don't reload runner for a context that fits in the loaded one
+	if optsNew.NumCtx <= optsExisting.NumCtx {
+		optsNew.NumCtx = optsExisting.NumCtx
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
+	if !reflect.DeepEqual(runner.model.Adapters, req.model.Adapters) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
 		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
 		runner.llama.Ping(ctx) != nil {
@@ -710,7 +891,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoL
 			req.opts.NumCtx = req.origNumCtx * p
 			if !envconfig.SchedSpread() {
 				for _, g := range sgl {
-					if ok, estimatedVRAM = llm.PredictServerFit([]gpu.GpuInfo{g}, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
+					if ok, estimatedVRAM = llm.PredictServerFit([]gpu.GpuInfo{g}, ggml, req.model.Adapters, req.model.ProjectorPaths, req.opts); ok {
 						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 						*numParallel = p
 						return []gpu.GpuInfo{g}
@@ -726,7 +907,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoL
 		// Now try all the GPUs
 		for _, p := range numParallelToTry {
 			req.opts.NumCtx = req.origNumCtx * p
-			if ok, estimatedVRAM = llm.PredictServerFit(sgl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
+			if ok, estimatedVRAM = llm.PredictServerFit(sgl, ggml, req.model.Adapters, req.model.ProjectorPaths, req.opts); ok {
 				slog.Info("new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", sgl[0].Library, "parallel", p, "required", format.HumanBytes2(estimatedVRAM))
 				*numParallel = p
 				return sgl
@@ -749,7 +930,7 @@ func pickBestPartialFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuIn
 	var bestEstimate uint64
 	var bestFit int
 	for i, gl := range byLibrary {
-		_, estimatedVRAM := llm.PredictServerFit(gl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts)
+		_, estimatedVRAM := llm.PredictServerFit(gl, ggml, req.model.Adapters, req.model.ProjectorPaths, req.opts)
 		if estimatedVRAM > bestEstimate {
 			bestEstimate = estimatedVRAM
 			bestFit = i
@@ -758,6 +939,98 @@ func pickBestPartialFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuIn
 	return byLibrary[bestFit]
 }
 
+// estimate predicts how model would be loaded with opts as a load would pick
+// GPUs for it, given the memory left by the runners already loaded. It
+// returns the GPUs it would be loaded on, the estimate and the context it
+// would be loaded with.
+func (s *Scheduler) estimate(model *Model, ggml *llm.GGML, opts api.Options) (gpu.GpuInfoList, llm.MemoryEstimate, int) {
+	if opts.NumCtx < 4 {
+		opts.NumCtx = 4
+	}
+
+	req := &LlmRequest{model: model, opts: opts, origNumCtx: opts.NumCtx}
+
+	var gpus gpu.GpuInfoList
+	if opts.NumGPU == 0 {
+		gpus = s.getCpuFn()
+	} else {
+		gpus = s.getGpuFn()
+	}
+
+	numParallel, _ := envconfig.NumParallel()
+	if len(model.ProjectorPaths) > 0 || model.CheckCapabilities(CapabilityCompletion) != nil {
+		numParallel = 1
+	}
+
+	if len(gpus) == 1 && gpus[0].Library == "cpu" {
+		if numParallel <= 0 {
+			numParallel = defaultParallel
+		}
+
+		req.opts.NumCtx = req.origNumCtx * numParallel
+	} else {
+		s.updateFreeSpace(gpus)
+		if g := pickBestFullFitByLibrary(req, ggml, gpus, &numParallel); g != nil {
+			gpus = g
+		} else {
+			gpus = pickBestPartialFitByLibrary(req, ggml, gpus, &numParallel)
+		}
+	}
+
+	estimate := llm.EstimateGPULayers(gpus, ggml, model.ProjectorPaths, req.opts)
+
+	// the runner doesn't bother with GPUs that no layers fit on
+	if gpus[0].Library != "metal" && estimate.Layers == 0 {
+		gpus = s.getCpuFn()
+	}
+
+	return gpus, estimate, req.opts.NumCtx
+}
+
+// pickReplica returns the loaded replica of the model at path with the fewest
+// requests in flight, taking turns between equally busy replicas. If that
+// replica is busy, or none is loaded, and fewer than n are loaded, it also
+// returns the index to load another replica at, which is otherwise -1.
+func (s *Scheduler) pickReplica(path string, n int) (*runnerRef, int) {
+	s.loadedMu.Lock()
+	replicas := make([]*runnerRef, n)
+	for i := range replicas {
+		replicas[i] = s.loaded[replicaKey(path, i)]
+	}
+	s.loadedMu.Unlock()
+
+	if s.replicaTurns == nil {
+		s.replicaTurns = make(map[string]int)
+	}
+
+	free := slices.Index(replicas, nil)
+	turn := s.replicaTurns[path]
+
+	var best *runnerRef
+	var bestRefs uint
+	for j := range n {
+		i := (turn + j) % n
+		runner := replicas[i]
+		if runner == nil {
+			continue
+		}
+
+		runner.refMu.Lock()
+		refs := runner.refCount
+		runner.refMu.Unlock()
+		if best == nil || refs < bestRefs {
+			best, bestRefs = runner, refs
+			s.replicaTurns[path] = i + 1
+		}
+	}
+
+	if best != nil && bestRefs == 0 {
+		return best, -1
+	}
+
+	return best, free
+}
+
 // findRunnerToUnload finds a runner to unload to make room for a new model
 func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	s.loadedMu.Lock()
@@ -790,6 +1063,43 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	return runnerList[0]
 }
 
+// findLRURunnerToUnload returns the least recently used runner, preferring
+// idle runners, regardless of how long they're kept alive
+func (s *Scheduler) findLRURunnerToUnload() *runnerRef {
+	s.loadedMu.Lock()
+	runnerList := make([]*runnerRef, 0, len(s.loaded))
+	for _, r := range s.loaded {
+		runnerList = append(runnerList, r)
+	}
+	s.loadedMu.Unlock()
+	if len(runnerList) == 0 {
+		slog.Debug("no loaded runner to unload")
+		return nil
+	}
+
+	lastUsed := make(map[*runnerRef]time.Time, len(runnerList))
+	idle := make(map[*runnerRef]bool, len(runnerList))
+	for _, runner := range runnerList {
+		runner.refMu.Lock()
+		lastUsed[runner], idle[runner] = runner.lastUsed, runner.refCount == 0
+		runner.refMu.Unlock()
+	}
+
+	slices.SortFunc(runnerList, func(a, b *runnerRef) int {
+		return lastUsed[a].Compare(lastUsed[b])
+	})
+
+	for _, runner := range runnerList {
+		if idle[runner] {
+			slog.Debug("found the least recently used idle runner to unload", "modelPath", runner.modelPath)
+			return runner
+		}
+	}
+
+	slog.Debug("no idle runners, picking the least recently used", "count", len(runnerList))
+	return runnerList[0]
+}
+
 func (s *Scheduler) unloadAllRunners() {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
@@ -804,8 +1114,11 @@ func (s *Scheduler) unloadAllRunners() {
 func (s *Scheduler) expireRunner(model *Model) {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
-	runner, ok := s.loaded[model.ModelPath]
-	if ok {
+	for _, runner := range s.loaded {
+		if runner.modelPath != model.ModelPath {
+			continue
+		}
+
 		runner.refMu.Lock()
 		runner.expiresAt = time.Now()
 		if runner.expireTimer != nil {
@@ -820,6 +1133,65 @@ func (s *Scheduler) expireRunner(model *Model) {
 	}
 }
 
+// runnerCrashed unloads the runner of model after its process llama exited
+// unexpectedly so the next request for the model reloads it. It reports
+// whether a request that failed because of the crash should be retried,
+// which stops once the model has crashed maxRunnerCrashes times within
+// runnerCrashWindow.
+func (s *Scheduler) runnerCrashed(model *Model, llama llm.LlamaServer, err error) bool {
+	s.loadedMu.Lock()
+	if s.crashes == nil {
+		s.crashes = make(map[string][]time.Time)
+	}
+
+	crashes := slices.DeleteFunc(s.crashes[model.ModelPath], func(t time.Time) bool {
+		return time.Since(t) > runnerCrashWindow
+	})
+
+	var runner *runnerRef
+	for _, r := range s.loaded {
+		if r.modelPath == model.ModelPath && r.llama == llama {
+			runner = r
+			break
+		}
+	}
+
+	if runner == nil {
+		// another request that the crash failed already unloaded the runner
+		s.crashes[model.ModelPath] = crashes
+		s.loadedMu.Unlock()
+		return len(crashes) < maxRunnerCrashes
+	}
+
+	crashes = append(crashes, time.Now())
+	s.crashes[model.ModelPath] = crashes
+	delete(s.loaded, runner.key())
+	s.loadedMu.Unlock()
+
+	slog.Error("llama runner exited unexpectedly, unloading", "model", model.ModelPath, "crashes", len(crashes), "error", err)
+	s.events.publish("crash", model.ShortName)
+
+	runner.refMu.Lock()
+	finished := runner.waitForVRAMRecovery()
+	runner.unload()
+	runner.refMu.Unlock()
+	s.events.publish("unload", model.ShortName)
+
+	<-finished
+	// wake a pending request waiting for the runner to be unloaded
+	select {
+	case s.unloadedCh <- struct{}{}:
+	default:
+	}
+
+	if len(crashes) >= maxRunnerCrashes {
+		slog.Error("llama runner crashed repeatedly, not retrying requests", "model", model.ModelPath, "crashes", len(crashes), "window", runnerCrashWindow)
+		return false
+	}
+
+	return true
+}
+
 // If other runners are loaded, make sure the pending request will fit in system memory
 // If not, pick a runner to unload, else return nil and the request can be loaded
 func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) *runnerRef {
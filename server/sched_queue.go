@@ -0,0 +1,91 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"time"
+)
+
+// Requests waiting to be scheduled are served by priority and then in the
+// order they were made. A request's priority is worth priorityAging of
+// waiting per level so a request is only overtaken by higher priority
+// requests made less than that long after it for each level between them.
+// Priorities are limited to ±maxPriority levels which bounds how long any
+// request can be overtaken and so lower priority requests aren't starved.
+const (
+	maxPriority   = 10
+	priorityAging = 10 * time.Second
+)
+
+// queuedAt is when a request of priority made at t is treated as queued
+func queuedAt(t time.Time, priority int) time.Time {
+	priority = min(max(priority, -maxPriority), maxPriority)
+	return t.Add(-time.Duration(priority) * priorityAging)
+}
+
+// pendingQueue is a heap of requests waiting to be scheduled. The request
+// served next is first.
+type pendingQueue []*LlmRequest
+
+func (q pendingQueue) Len() int { return len(q) }
+
+func (q pendingQueue) Less(i, j int) bool {
+	if !q[i].queued.Equal(q[j].queued) {
+		return q[i].queued.Before(q[j].queued)
+	}
+
+	return q[i].seq < q[j].seq
+}
+
+func (q pendingQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *pendingQueue) Push(x any) { *q = append(*q, x.(*LlmRequest)) }
+
+func (q *pendingQueue) Pop() any {
+	old := *q
+	req := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return req
+}
+
+// prioritizePending moves requests from pendingReqCh to prioritizedReqCh
+// highest priority first. Requests put back on pendingReqCh to be scheduled
+// later keep their place.
+func (s *Scheduler) prioritizePending(ctx context.Context) {
+	var queue pendingQueue
+	var seq uint64
+	for {
+		var next *LlmRequest
+		var out chan *LlmRequest
+		if len(queue) > 0 {
+			next, out = queue[0], s.prioritizedReqCh
+		}
+
+		in := s.pendingReqCh
+		if len(queue) >= max(cap(s.pendingReqCh), 1) {
+			in = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-in:
+			if req.seq == 0 {
+				seq++
+				req.seq = seq
+
+				req.queued = queuedAt(time.Now(), req.priority)
+			}
+
+			heap.Push(&queue, req)
+		case out <- next:
+			heap.Pop(&queue)
+		}
+	}
+}
+
+// queueDepth returns the number of requests waiting to be scheduled
+func (s *Scheduler) queueDepth() int {
+	return int(s.queueLen.Load())
+}
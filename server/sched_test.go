@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"container/heap"
 	"context"
 	"errors"
 	"log/slog"
@@ -47,7 +48,7 @@ func TestLoad(t *testing.T) {
 		sessionDuration: &api.Duration{Duration: 2 * time.Second},
 	}
 	// Fail to load model first
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []llm.Adapter, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return nil, errors.New("something failed to load model blah")
 	}
 	gpus := gpu.GpuInfoList{}
@@ -61,7 +62,7 @@ func TestLoad(t *testing.T) {
 	require.Contains(t, err.Error(), "this model may be incompatible")
 
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []llm.Adapter, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, ggml, gpus, 0)
@@ -102,7 +103,7 @@ type reqBundle struct {
 	ggml    *llm.GGML
 }
 
-func (scenario *reqBundle) newServer(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (scenario *reqBundle) newServer(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []llm.Adapter, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 	return scenario.srv, nil
 }
 
@@ -238,7 +239,7 @@ func TestRequestsSimpleReloadSameModel(t *testing.T) {
 
 	// Trigger a reload
 	s.newServerFn = b.newServer
-	b.req.model.AdapterPaths = []string{"new"}
+	b.req.model.Adapters = []llm.Adapter{{Path: "new", Weight: 1}}
 	slog.Info("b")
 	s.pendingReqCh <- b.req
 	// finish first two requests, so model can reload
@@ -353,6 +354,288 @@ func TestRequestsMultipleLoadedModels(t *testing.T) {
 	s.loadedMu.Unlock()
 }
 
+func TestRequestsMaxLoadedModelsLRU(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	t.Setenv("OLLAMA_MAX_LOADED_MODELS", "2")
+
+	// b is kept alive longest but is the least recently used when c loads
+	a := newScenarioRequest(t, ctx, "ollama-model-a", 10, &api.Duration{Duration: time.Minute})
+	b := newScenarioRequest(t, ctx, "ollama-model-b", 10, &api.Duration{Duration: time.Hour})
+	a2 := newScenarioRequest(t, ctx, "ollama-model-a", 10, &api.Duration{Duration: time.Minute})
+	a2.req.model, a2.ggml = a.req.model, a.ggml
+	c := newScenarioRequest(t, ctx, "ollama-model-c", 10, &api.Duration{Duration: time.Minute})
+
+	servers := map[string]*mockLlm{
+		a.req.model.ModelPath: a.srv,
+		b.req.model.ModelPath: b.srv,
+		c.req.model.ModelPath: c.srv,
+	}
+	s.newServerFn = func(_ gpu.GpuInfoList, model string, _ *llm.GGML, _ []llm.Adapter, _ []string, _ api.Options, _ int) (llm.LlamaServer, error) {
+		return servers[model], nil
+	}
+	s.Run(ctx)
+
+	// run schedules r and waits for it to finish
+	run := func(r *reqBundle) {
+		t.Helper()
+		s.pendingReqCh <- r.req
+		var runner *runnerRef
+		select {
+		case runner = <-r.req.successCh:
+			require.Equal(t, r.srv, runner.llama)
+		case err := <-r.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+
+		r.ctxDone()
+		require.Eventually(t, func() bool {
+			runner.refMu.Lock()
+			defer runner.refMu.Unlock()
+			return runner.refCount == 0
+		}, 100*time.Millisecond, time.Millisecond)
+	}
+
+	run(a)
+	run(b)
+	a2.srv = a.srv
+	run(a2)
+
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 2)
+	s.loadedMu.Unlock()
+
+	run(c)
+
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	require.Len(t, s.loaded, 2)
+	require.Contains(t, s.loaded, a.req.model.ModelPath)
+	require.Contains(t, s.loaded, c.req.model.ModelPath)
+	require.NotContains(t, s.loaded, b.req.model.ModelPath)
+	require.True(t, b.srv.closeCalled)
+	require.False(t, a.srv.closeCalled)
+}
+
+func TestFindLRURunnerToUnload(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	now := time.Now()
+	r1 := &runnerRef{refCount: 1, lastUsed: now.Add(-time.Hour), sessionDuration: 1, numParallel: 1}
+	r2 := &runnerRef{lastUsed: now.Add(-time.Minute), sessionDuration: -1, numParallel: 1}
+	r3 := &runnerRef{lastUsed: now, sessionDuration: 1, numParallel: 1}
+
+	s := InitScheduler(ctx)
+	s.loadedMu.Lock()
+	s.loaded["a"] = r1
+	s.loaded["b"] = r2
+	s.loaded["c"] = r3
+	s.loadedMu.Unlock()
+
+	// idle runners are preferred
+	require.Equal(t, r2, s.findLRURunnerToUnload())
+
+	r2.refCount, r3.refCount = 1, 1
+	require.Equal(t, r1, s.findLRURunnerToUnload())
+}
+
+func TestRequestsReplicas(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	t.Setenv("OLLAMA_NUM_REPLICAS", "2")
+
+	duration := &api.Duration{Duration: time.Minute}
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, duration)
+	b := newScenarioRequest(t, ctx, "ollama-model-1", 10, duration)
+	c := newScenarioRequest(t, ctx, "ollama-model-1", 10, duration)
+	d := newScenarioRequest(t, ctx, "ollama-model-1", 10, duration)
+	for _, r := range []*reqBundle{b, c, d} {
+		r.req.model = a.req.model
+		r.ggml = a.ggml
+	}
+
+	var loads []*mockLlm
+	s.newServerFn = func(gpu.GpuInfoList, string, *llm.GGML, []llm.Adapter, []string, api.Options, int) (llm.LlamaServer, error) {
+		srv := []*mockLlm{a.srv, b.srv}[len(loads)]
+		loads = append(loads, srv)
+		return srv, nil
+	}
+	s.Run(ctx)
+
+	schedule := func(r *reqBundle) llm.LlamaServer {
+		t.Helper()
+		s.pendingReqCh <- r.req
+		select {
+		case resp := <-r.req.successCh:
+			return resp.llama
+		case err := <-r.req.errCh:
+			t.Fatal(err.Error())
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	// a busy replica loads another instead of queueing on it
+	require.Equal(t, a.srv, schedule(a))
+	require.Equal(t, b.srv, schedule(b))
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 2)
+	first, second := s.loaded[a.req.model.ModelPath], s.loaded[replicaKey(a.req.model.ModelPath, 1)]
+	s.loadedMu.Unlock()
+	require.NotNil(t, first)
+	require.NotNil(t, second)
+	require.Equal(t, 1, second.replica)
+
+	// an idle replica is preferred
+	a.ctxDone()
+	require.Eventually(t, func() bool {
+		first.refMu.Lock()
+		defer first.refMu.Unlock()
+		return first.refCount == 0
+	}, 100*time.Millisecond, time.Millisecond)
+	require.Equal(t, a.srv, schedule(c))
+
+	// with every replica loaded and busy, requests share them
+	require.Contains(t, []llm.LlamaServer{a.srv, b.srv}, schedule(d))
+	require.Len(t, loads, 2)
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 2)
+	s.loadedMu.Unlock()
+}
+
+func TestRequestsPriority(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	blocking := newScenarioRequest(t, ctx, "ollama-model-blocking", 10, nil)
+	low := newScenarioRequest(t, ctx, "ollama-model-low", 10, nil)
+	high := newScenarioRequest(t, ctx, "ollama-model-high", 10, nil)
+	high.req.priority = 5
+
+	// the first load holds up the queue until the others are queued
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var loaded []*LlmRequest
+	s.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		if req == blocking.req {
+			close(started)
+			<-release
+		}
+
+		loaded = append(loaded, req)
+		req.errCh <- errors.New("loaded")
+	}
+	s.Run(ctx)
+
+	s.pendingReqCh <- blocking.req
+	<-started
+
+	s.pendingReqCh <- low.req
+	s.pendingReqCh <- high.req
+	require.Eventually(t, func() bool { return len(s.pendingReqCh) == 0 }, 100*time.Millisecond, time.Millisecond)
+	close(release)
+
+	for _, r := range []*reqBundle{blocking, high, low} {
+		select {
+		case <-r.req.errCh:
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	require.Equal(t, []*LlmRequest{blocking.req, high.req, low.req}, loaded)
+}
+
+func TestPendingQueue(t *testing.T) {
+	now := time.Now()
+	request := func(seq uint64, priority int, age time.Duration) *LlmRequest {
+		return &LlmRequest{seq: seq, priority: priority, queued: queuedAt(now.Add(-age), priority)}
+	}
+
+	cases := []struct {
+		name     string
+		requests []*LlmRequest
+		want     []uint64
+	}{
+		{"fifo", []*LlmRequest{request(1, 0, 0), request(2, 0, 0), request(3, 0, 0)}, []uint64{1, 2, 3}},
+		{"priority", []*LlmRequest{request(1, 0, 0), request(2, 1, 0), request(3, 5, 0)}, []uint64{3, 2, 1}},
+		{"negative priority", []*LlmRequest{request(1, -1, 0), request(2, 0, 0)}, []uint64{2, 1}},
+		{"aging", []*LlmRequest{request(1, 0, 3*priorityAging), request(2, 2, 0)}, []uint64{1, 2}},
+		{"bounded", []*LlmRequest{request(1, -100, 0), request(2, 100, -2*maxPriority*priorityAging-time.Second)}, []uint64{1, 2}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var q pendingQueue
+			for _, req := range tt.requests {
+				heap.Push(&q, req)
+			}
+
+			var got []uint64
+			for q.Len() > 0 {
+				got = append(got, heap.Pop(&q).(*LlmRequest).seq)
+			}
+
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMaxQueue(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	t.Setenv("OLLAMA_MAX_QUEUE", "2")
+	s := InitScheduler(ctx)
+	s.prioritizedReqCh = make(chan *LlmRequest)
+	go s.prioritizePending(ctx)
+
+	model := &Model{ModelPath: "foo"}
+	getRunner := func() chan error {
+		_, errCh := s.GetRunner(ctx, model, api.DefaultOptions(), nil, 0)
+		return errCh
+	}
+
+	// requests moved off pendingReqCh still count towards the limit
+	for range 2 {
+		require.Empty(t, getRunner())
+		require.Eventually(t, func() bool { return len(s.pendingReqCh) == 0 }, 100*time.Millisecond, time.Millisecond)
+	}
+
+	errCh := getRunner()
+	require.Len(t, errCh, 1)
+	require.ErrorIs(t, <-errCh, ErrMaxQueue)
+	require.Equal(t, 2, s.queueDepth())
+
+	// scheduling requests makes room for others
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	go s.processPending(ctx)
+
+	require.Eventually(t, func() bool { return s.queueDepth() == 0 }, 100*time.Millisecond, time.Millisecond)
+	for range 2 {
+		select {
+		case err := <-getRunner():
+			require.NotErrorIs(t, err, ErrMaxQueue)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+}
+
 func TestGetRunner(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 200*time.Millisecond)
 	defer done()
@@ -366,10 +649,10 @@ func TestGetRunner(t *testing.T) {
 	s.getCpuFn = getCpuFn
 	s.newServerFn = a.newServer
 	slog.Info("a")
-	successCh1a, errCh1a := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration)
+	successCh1a, errCh1a := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration, 0)
 	require.Len(t, s.pendingReqCh, 1)
 	slog.Info("b")
-	successCh1b, errCh1b := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration)
+	successCh1b, errCh1b := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration, 0)
 	require.Len(t, s.pendingReqCh, 1)
 	require.Empty(t, successCh1b)
 	require.Len(t, errCh1b, 1)
@@ -393,7 +676,7 @@ func TestGetRunner(t *testing.T) {
 
 	c.req.model.ModelPath = "bad path"
 	slog.Info("c")
-	successCh1c, errCh1c := s.GetRunner(c.ctx, c.req.model, c.req.opts, c.req.sessionDuration)
+	successCh1c, errCh1c := s.GetRunner(c.ctx, c.req.model, c.req.opts, c.req.sessionDuration, 0)
 	// Starts in pending channel, then should be quickly processsed to return an error
 	time.Sleep(50 * time.Millisecond) // Long enough for the "a" model to expire and unload
 	require.Empty(t, successCh1c)
@@ -422,7 +705,7 @@ func TestExpireRunner(t *testing.T) {
 	var ggml *llm.GGML
 	gpus := gpu.GpuInfoList{}
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []llm.Adapter, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, ggml, gpus, 0)
@@ -467,7 +750,7 @@ func TestPrematureExpired(t *testing.T) {
 		return []gpu.GpuInfo{g}
 	}
 	s.newServerFn = scenario1a.newServer
-	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration)
+	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration, 0)
 	require.Len(t, s.pendingReqCh, 1)
 	s.Run(ctx)
 	select {
@@ -618,27 +901,27 @@ func TestNeedsReload(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer done()
 
-	llm := &mockLlm{estimatedVRAMByGPU: map[string]uint64{}}
+	mock := &mockLlm{estimatedVRAMByGPU: map[string]uint64{}}
 	do := api.DefaultOptions()
 	runner := &runnerRef{
 		model: &Model{
-			AdapterPaths:   []string{"adapter1"},
+			Adapters:       []llm.Adapter{{Path: "adapter1", Weight: 1}},
 			ProjectorPaths: []string{"projector1"},
 		},
 		Options:     &do,
-		llama:       llm,
+		llama:       mock,
 		numParallel: 1,
 	}
 	req := &LlmRequest{
 		model: &Model{
-			AdapterPaths:   []string{"adapter2"},
+			Adapters:       []llm.Adapter{{Path: "adapter2", Weight: 1}},
 			ProjectorPaths: []string{"projector2"},
 		},
 		opts: api.DefaultOptions(),
 	}
 	resp := runner.needsReload(ctx, req)
 	require.True(t, resp)
-	req.model.AdapterPaths = runner.model.AdapterPaths
+	req.model.Adapters = runner.model.Adapters
 	resp = runner.needsReload(ctx, req)
 	require.True(t, resp)
 	req.model.ProjectorPaths = runner.model.ProjectorPaths
@@ -647,10 +930,10 @@ func TestNeedsReload(t *testing.T) {
 	resp = runner.needsReload(ctx, req)
 	require.True(t, resp)
 	req.opts.NumBatch = runner.Options.NumBatch
-	llm.pingResp = errors.New("foo")
+	mock.pingResp = errors.New("foo")
 	resp = runner.needsReload(ctx, req)
 	require.True(t, resp)
-	llm.pingResp = nil
+	mock.pingResp = nil
 	resp = runner.needsReload(ctx, req)
 	require.False(t, resp)
 	req.opts.NumGPU = 99
@@ -659,6 +942,40 @@ func TestNeedsReload(t *testing.T) {
 	req.opts.NumGPU = -1
 	resp = runner.needsReload(ctx, req)
 	require.False(t, resp)
+
+	// a request for the number of layers the runner already offloads doesn't
+	// reload it but a differing number does
+	mock.gpuLayers, mock.totalLayers = 10, 33
+	req.opts.NumGPU = 10
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.opts.NumGPU = 0
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	req.opts.NumGPU = 99
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	mock.gpuLayers = 33
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+
+	// a request for a context that fits in the runner's reuses it but a
+	// larger context reloads it
+	req.opts.NumCtx = runner.Options.NumCtx / 2
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.opts.NumCtx = runner.Options.NumCtx
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.opts.NumCtx = runner.Options.NumCtx * 2
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+
+	// the runner's context is shared by its parallel requests
+	runner.numParallel = 2
+	req.opts.NumCtx = runner.Options.NumCtx
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
 }
 
 func TestUnloadAllRunners(t *testing.T) {
@@ -686,7 +1003,7 @@ func TestUnloadAllRunners(t *testing.T) {
 func TestUnload(t *testing.T) {
 	llm1 := &mockLlm{estimatedVRAMByGPU: map[string]uint64{}}
 	r1 := &runnerRef{llama: llm1, numParallel: 1}
-	r2 := &runnerRef{model: &Model{AdapterPaths: []string{"A"}}, numParallel: 1}
+	r2 := &runnerRef{model: &Model{Adapters: []llm.Adapter{{Path: "A", Weight: 1}}}, numParallel: 1}
 	r1.unload()
 	require.True(t, llm1.closeCalled)
 	r2.unload()
@@ -729,7 +1046,7 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 	s.getCpuFn = getCpuFn
 	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []llm.Adapter, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		require.Len(t, gpus, 1)
 		return a.newServer(gpus, model, ggml, adapters, projectors, opts, numParallel)
 	}
@@ -764,6 +1081,8 @@ type mockLlm struct {
 	estimatedVRAM      uint64
 	estimatedTotal     uint64
 	estimatedVRAMByGPU map[string]uint64
+	gpuLayers          int
+	totalLayers        int
 }
 
 func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
@@ -784,6 +1103,9 @@ func (s *mockLlm) Detokenize(ctx context.Context, tokens []int) (string, error)
 	return s.detokenizeResp, s.detonekizeRespErr
 }
 
+func (s *mockLlm) SaveCache(ctx context.Context, prompt, path string) error { return nil }
+func (s *mockLlm) RestoreCache(ctx context.Context, path string) error      { return nil }
+
 func (s *mockLlm) Close() error {
 	s.closeCalled = true
 	return s.closeResp
@@ -791,3 +1113,4 @@ func (s *mockLlm) Close() error {
 func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVRAM }
 func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
 func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
+func (s *mockLlm) EstimatedLayers() (int, int)            { return s.gpuLayers, s.totalLayers }
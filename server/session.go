@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// chatSession is the history of a chat kept by the server so each request
+// only sends its new messages
+type chatSession struct {
+	model    string
+	messages []api.Message
+	lastUsed time.Time
+}
+
+// chatSessions keeps chat sessions by ID until they've gone unused for
+// OLLAMA_SESSION_TTL. The zero value is ready to use.
+type chatSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*chatSession
+}
+
+// get returns the messages of session id of model
+func (s *chatSessions) get(id, model string, ttl time.Duration) ([]api.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now(), ttl)
+
+	session, ok := s.sessions[id]
+	if !ok || session.model != model {
+		return nil, false
+	}
+
+	session.lastUsed = time.Now()
+	return slices.Clip(session.messages), true
+}
+
+// put sets the messages of session id of model
+func (s *chatSessions) put(id, model string, messages []api.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*chatSession)
+	}
+
+	s.sessions[id] = &chatSession{model: model, messages: messages, lastUsed: time.Now()}
+}
+
+// expire removes the sessions unused for ttl. It's guarded by mu.
+func (s *chatSessions) expire(now time.Time, ttl time.Duration) {
+	for id, session := range s.sessions {
+		if now.Sub(session.lastUsed) >= ttl {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// newSessionID returns a random session ID
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// chatSession returns the ID and the prior messages of the session of a chat
+// request of model, which is empty if it doesn't use one. A new session is
+// started if req asks for one. It responds with an error and returns false
+// if the session doesn't exist.
+func (s *Server) chatSession(c *gin.Context, req api.ChatRequest, model string) (string, []api.Message, bool) {
+	if req.SessionID == "" && !req.Session {
+		return "", nil, true
+	}
+
+	ttl := envconfig.SessionTTL()
+	if ttl <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "sessions are disabled by OLLAMA_SESSION_TTL", "code": api.ErrorCodeUnsupported})
+		return "", nil, false
+	}
+
+	if req.SessionID == "" {
+		return newSessionID(), nil, true
+	}
+
+	messages, ok := s.sessions.get(req.SessionID, model, ttl)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("session %q not found for model %q", req.SessionID, model), "code": api.ErrorCodeSessionNotFound})
+		return "", nil, false
+	}
+
+	return req.SessionID, messages, true
+}
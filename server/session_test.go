@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestChatSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{Content: "Hello!", Done: true, DoneReason: "stop"},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	bin := createBinFile(t, llm.KV{
+		"general.architecture":      "llama",
+		"tokenizer.ggml.tokens":     []string{""},
+		"tokenizer.ggml.scores":     []float32{0},
+		"tokenizer.ggml.token_type": []int32{0},
+	}, []llm.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	for _, name := range []string{"test", "other"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:     name,
+			Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"{{ range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}\"", bin),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	chat := func(t *testing.T, req api.ChatRequest, status int) (api.ChatResponse, string) {
+		t.Helper()
+		req.Stream = &stream
+		w := createRequest(t, s.ChatHandler, req)
+		if w.Code != status {
+			t.Fatalf("expected status %d, got %d: %s", status, w.Code, w.Body)
+		}
+
+		if status != http.StatusOK {
+			var resp struct {
+				Code string `json:"code"`
+			}
+
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			return api.ChatResponse{}, resp.Code
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, ""
+	}
+
+	var id string
+	t.Run("start", func(t *testing.T) {
+		resp, _ := chat(t, api.ChatRequest{
+			Model:    "test",
+			System:   "Be nice.",
+			Messages: []api.Message{{Role: "user", Content: "Hi"}},
+			Session:  true,
+		}, http.StatusOK)
+
+		if resp.SessionID == "" {
+			t.Fatal("expected a session id")
+		}
+		id = resp.SessionID
+
+		if diff := cmp.Diff("system: Be nice. user: Hi ", mock.CompletionRequest.Prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		resp, _ := chat(t, api.ChatRequest{
+			Model:     "test:latest",
+			Messages:  []api.Message{{Role: "user", Content: "How are you?"}},
+			SessionID: id,
+		}, http.StatusOK)
+
+		if resp.SessionID != id {
+			t.Errorf("expected session id %q, got %q", id, resp.SessionID)
+		}
+
+		if diff := cmp.Diff("system: Be nice. user: Hi assistant: Hello! user: How are you? ", mock.CompletionRequest.Prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		chat(t, api.ChatRequest{
+			Model:     "test",
+			Messages:  []api.Message{{Role: "user", Content: "Bye"}},
+			SessionID: id,
+		}, http.StatusOK)
+
+		if diff := cmp.Diff("system: Be nice. user: Hi assistant: Hello! user: How are you? assistant: Hello! user: Bye ", mock.CompletionRequest.Prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("without session", func(t *testing.T) {
+		resp, _ := chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hi"}},
+		}, http.StatusOK)
+
+		if resp.SessionID != "" {
+			t.Errorf("expected no session id, got %q", resp.SessionID)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, code := chat(t, api.ChatRequest{
+			Model:     "test",
+			Messages:  []api.Message{{Role: "user", Content: "Hi"}},
+			SessionID: "missing",
+		}, http.StatusNotFound)
+
+		if code != api.ErrorCodeSessionNotFound {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeSessionNotFound, code)
+		}
+	})
+
+	t.Run("other model", func(t *testing.T) {
+		_, code := chat(t, api.ChatRequest{
+			Model:     "other",
+			Messages:  []api.Message{{Role: "user", Content: "Hi"}},
+			SessionID: id,
+		}, http.StatusNotFound)
+
+		if code != api.ErrorCodeSessionNotFound {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeSessionNotFound, code)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_SESSION_TTL", "0")
+		_, code := chat(t, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hi"}},
+			Session:  true,
+		}, http.StatusBadRequest)
+
+		if code != api.ErrorCodeUnsupported {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeUnsupported, code)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		t.Setenv("OLLAMA_SESSION_TTL", "1ms")
+		time.Sleep(2 * time.Millisecond)
+		chat(t, api.ChatRequest{
+			Model:     "test",
+			Messages:  []api.Message{{Role: "user", Content: "Hi"}},
+			SessionID: id,
+		}, http.StatusNotFound)
+	})
+}
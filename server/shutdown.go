@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// activeRequests tracks the requests being handled so shutdown can wait for
+// them to finish. http.Server.Shutdown alone doesn't wait for requests on
+// HTTP/2 connections since h2c hijacks them. The zero value is ready to use.
+type activeRequests struct {
+	mu      sync.Mutex
+	cancels map[*gin.Context]context.CancelFunc
+}
+
+func (r *activeRequests) add(c *gin.Context, cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancels == nil {
+		r.cancels = make(map[*gin.Context]context.CancelFunc)
+	}
+
+	r.cancels[c] = cancel
+}
+
+func (r *activeRequests) remove(c *gin.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cancels, c)
+}
+
+func (r *activeRequests) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.cancels)
+}
+
+// cancelAll cancels the context of every active request
+func (r *activeRequests) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+}
+
+// wait blocks until there are no active requests or ctx is done
+func (r *activeRequests) wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for r.len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// activeMiddleware registers each request with s.active for the duration of
+// the request so shutdown can wait for it or cancel it
+func (s *Server) activeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		s.active.add(c, cancel)
+		defer s.active.remove(c)
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// shutdown stops srv accepting new connections and waits for in-flight
+// requests to finish until ctx is done. Event streams are ended right away.
+// Requests still running when ctx is done are cancelled and their
+// connections closed, as are operations started with an Idempotency-Key.
+func (s *Server) shutdown(ctx context.Context, srv *http.Server) error {
+	s.sched.events.close()
+
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = s.active.wait(ctx)
+	}
+
+	if err != nil {
+		s.active.cancelAll()
+	}
+
+	// operations no request follows anymore would otherwise run on
+	s.operations.cancelAll()
+
+	srv.Close()
+	return err
+}
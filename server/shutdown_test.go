@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestShutdown(t *testing.T) {
+	clients := map[string]func() *http.Client{
+		"http/1.1": func() *http.Client { return &http.Client{} },
+		"h2c":      h2cClient,
+	}
+
+	// generate starts a generate request and waits for its first response.
+	// The returned channel receives the remaining responses.
+	generate := func(t *testing.T, client *http.Client, addr string) <-chan api.GenerateResponse {
+		t.Helper()
+
+		body, err := json.Marshal(api.GenerateRequest{Model: "test", Prompt: "Hello!"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Post("http://"+addr+"/api/generate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+
+		lines := make(chan api.GenerateResponse)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				var r api.GenerateResponse
+				if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+					return
+				}
+
+				lines <- r
+			}
+		}()
+
+		select {
+		case <-lines:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the first streamed response")
+		}
+
+		return lines
+	}
+
+	for name, newClient := range clients {
+		t.Run(name, func(t *testing.T) {
+			t.Run("drains", func(t *testing.T) {
+				s, mock := newStepServer(t)
+
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				srv := newHTTPServer(s.GenerateRoutes())
+				go srv.Serve(ln)
+
+				lines := generate(t, newClient(), ln.Addr().String())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				done := make(chan error, 1)
+				go func() { done <- s.shutdown(ctx, srv) }()
+
+				select {
+				case err := <-done:
+					t.Fatalf("expected shutdown to wait for the request, got %v", err)
+				case <-time.After(100 * time.Millisecond):
+				}
+
+				if _, err := (&http.Client{}).Get("http://" + ln.Addr().String() + "/api/version"); err == nil {
+					t.Error("expected new connections to be refused")
+				}
+
+				close(mock.next)
+
+				var responses []api.GenerateResponse
+				for r := range lines {
+					responses = append(responses, r)
+				}
+
+				if len(responses) != 1 || !responses[0].Done {
+					t.Errorf("expected the request to complete, got %+v", responses)
+				}
+
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Errorf("expected shutdown to succeed, got %v", err)
+					}
+				case <-ctx.Done():
+					t.Fatal("shutdown did not finish within the timeout")
+				}
+			})
+
+			t.Run("timeout", func(t *testing.T) {
+				s, _ := newStepServer(t)
+
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				srv := newHTTPServer(s.GenerateRoutes())
+				go srv.Serve(ln)
+
+				lines := generate(t, newClient(), ln.Addr().String())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+
+				if err := s.shutdown(ctx, srv); !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("expected deadline exceeded, got %v", err)
+				}
+
+				// the runner never finishes so the request is cancelled
+				select {
+				case r, ok := <-lines:
+					if ok && r.Done {
+						t.Errorf("expected the request to be cancelled, got %+v", r)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("expected the request to be cancelled")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// cacheSnapshot is a snapshot of a chat session. The runner's KV cache of it
+// is kept next to it.
+type cacheSnapshot struct {
+	Model     string        `json:"model"`
+	Digest    string        `json:"digest"`
+	SessionID string        `json:"session_id"`
+	Messages  []api.Message `json:"messages"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+var snapshotToken = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// snapshotPaths returns the paths of the snapshot with token and of its KV
+// cache in the cache directory of the models directory
+func snapshotPaths(token string) (snapshot, cache string) {
+	dir := filepath.Join(modelsDir(), "cache")
+	return filepath.Join(dir, token+".json"), filepath.Join(dir, token+".bin")
+}
+
+// pruneSnapshots removes the snapshots saved more than ttl ago
+func pruneSnapshots(ttl time.Duration) {
+	dir := filepath.Join(modelsDir(), "cache")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		token, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !snapshotToken.MatchString(token) {
+			continue
+		}
+
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) >= ttl {
+			removeSnapshot(token)
+		}
+	}
+}
+
+func removeSnapshot(token string) {
+	snapshot, cache := snapshotPaths(token)
+	for _, p := range []string{cache, snapshot} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("couldn't remove cache snapshot", "path", p, "error", err)
+		}
+	}
+}
+
+// SaveCacheHandler snapshots a chat session along with the runner's KV cache
+// of it so the session can be restored to this point later
+func (s *Server) SaveCacheHandler(c *gin.Context) {
+	var req api.CacheSaveRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	ttl := envconfig.CacheTTL()
+	if ttl <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "cache snapshots are disabled by OLLAMA_CACHE_TTL", "code": api.ErrorCodeUnsupported})
+		return
+	}
+
+	if req.SessionID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "session_id is required", "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	name := model.ParseName(req.Model).String()
+	messages, ok := s.sessions.get(req.SessionID, name, envconfig.SessionTTL())
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("session %q not found for model %q", req.SessionID, name), "code": api.ErrorCodeSessionNotFound})
+		return
+	}
+
+	ctx := c.Request.Context()
+	r, m, opts, err := s.scheduleRunner(ctx, req.Model, []Capability{CapabilityCompletion}, nil, nil, 0)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	// the prompt of the session as the chat handler renders it, which the
+	// runner matches against its cache
+	msgs := append(m.Messages, messages...)
+	if len(messages) > 0 && messages[0].Role != "system" && m.System != "" {
+		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+	}
+
+	prompt, _, err := chatPrompt(ctx, m, r.Tokenize, opts, msgs, nil, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	pruneSnapshots(ttl)
+
+	token := newSessionID()
+	snapshotPath, cachePath := snapshotPaths(token)
+	if err := os.MkdirAll(filepath.Dir(snapshotPath), 0o755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	if err := r.SaveCache(ctx, prompt, cachePath); errors.Is(err, llm.ErrNoCache) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no cache of session %q is loaded", req.SessionID), "code": api.ErrorCodeSessionNotFound})
+		return
+	} else if errors.Is(err, llm.ErrCacheUnsupported) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeUnsupported})
+		return
+	} else if err != nil {
+		removeSnapshot(token)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	snapshot := cacheSnapshot{
+		Model:     name,
+		Digest:    m.Digest,
+		SessionID: req.SessionID,
+		Messages:  messages,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	bts, err := json.Marshal(snapshot)
+	if err == nil {
+		err = os.WriteFile(snapshotPath, bts, 0o644)
+	}
+
+	if err != nil {
+		removeSnapshot(token)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.CacheSaveResponse{Token: token, ExpiresAt: snapshot.CreatedAt.Add(ttl)})
+}
+
+// RestoreCacheHandler restores a chat session and the runner's KV cache of it
+// to a snapshot saved by SaveCacheHandler
+func (s *Server) RestoreCacheHandler(c *gin.Context) {
+	var req api.CacheRestoreRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body", "code": api.ErrorCodeInvalidRequest})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	if !snapshotToken.MatchString(req.Token) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid token", "code": api.ErrorCodeInvalidRequest})
+		return
+	}
+
+	notFound := func() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("snapshot %q not found", req.Token), "code": api.ErrorCodeSnapshotNotFound})
+	}
+
+	snapshotPath, cachePath := snapshotPaths(req.Token)
+	bts, err := os.ReadFile(snapshotPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		notFound()
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(bts, &snapshot); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	if ttl := envconfig.CacheTTL(); time.Since(snapshot.CreatedAt) >= ttl {
+		removeSnapshot(req.Token)
+		notFound()
+		return
+	}
+
+	ctx := c.Request.Context()
+	r, m, _, err := s.scheduleRunner(ctx, snapshot.Model, []Capability{CapabilityCompletion}, nil, nil, 0)
+	if err != nil {
+		handleScheduleError(c, snapshot.Model, err)
+		return
+	}
+
+	// the cache is only valid for the weights it was computed with
+	if m.Digest != snapshot.Digest {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model %q has changed since the snapshot was saved", snapshot.Model), "code": api.ErrorCodeRequestConflict})
+		return
+	}
+
+	if err := r.RestoreCache(ctx, cachePath); errors.Is(err, llm.ErrCacheUnsupported) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": api.ErrorCodeUnsupported})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "code": errorCode(err)})
+		return
+	}
+
+	s.sessions.put(snapshot.SessionID, snapshot.Model, snapshot.Messages)
+	c.JSON(http.StatusOK, api.CacheRestoreResponse{Model: snapshot.Model, SessionID: snapshot.SessionID})
+}
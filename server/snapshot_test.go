@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// cacheRunner keeps the prompt it's asked to save so restoring it can be
+// checked without a runner
+type cacheRunner struct {
+	mockRunner
+	restored string
+}
+
+func (r *cacheRunner) SaveCache(ctx context.Context, prompt, path string) error {
+	return os.WriteFile(path, []byte(prompt), 0o644)
+}
+
+func (r *cacheRunner) RestoreCache(ctx context.Context, path string) error {
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	r.restored = string(bts)
+	return nil
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	mock := cacheRunner{
+		mockRunner: mockRunner{
+			CompletionResponse: llm.CompletionResponse{Content: "Hello!", Done: true, DoneReason: "stop"},
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock.mockRunner),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"{{ range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}\"", createBinFile(t, llm.KV{
+			"general.architecture":      "llama",
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	chat := func(t *testing.T, req api.ChatRequest) api.ChatResponse {
+		t.Helper()
+		req.Stream = &stream
+		w := createRequest(t, s.ChatHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	code := func(t *testing.T, w interface{ Bytes() []byte }) string {
+		t.Helper()
+		var resp struct {
+			Code string `json:"code"`
+		}
+
+		if err := json.Unmarshal(w.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Code
+	}
+
+	id := chat(t, api.ChatRequest{
+		Model:    "test",
+		Messages: []api.Message{{Role: "user", Content: "Hi"}},
+		Session:  true,
+	}).SessionID
+
+	var token string
+	t.Run("save", func(t *testing.T) {
+		w := createRequest(t, s.SaveCacheHandler, api.CacheSaveRequest{Model: "test", SessionID: id})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.CacheSaveResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !snapshotToken.MatchString(resp.Token) {
+			t.Fatalf("unexpected token %q", resp.Token)
+		}
+		token = resp.Token
+
+		if d := time.Until(resp.ExpiresAt); d <= 23*time.Hour || d > 24*time.Hour {
+			t.Errorf("expected the snapshot to expire in 24h, got %s", d)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		chat(t, api.ChatRequest{
+			Model:     "test",
+			Messages:  []api.Message{{Role: "user", Content: "How are you?"}},
+			SessionID: id,
+		})
+
+		w := createRequest(t, s.RestoreCacheHandler, api.CacheRestoreRequest{Token: token})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.CacheRestoreResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(api.CacheRestoreResponse{Model: "registry.ollama.ai/library/test:latest", SessionID: id}, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff("user: Hi assistant: Hello! ", mock.restored); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// the session continues from the snapshot, not the later message
+		chat(t, api.ChatRequest{
+			Model:     "test",
+			Messages:  []api.Message{{Role: "user", Content: "Bye"}},
+			SessionID: id,
+		})
+
+		if diff := cmp.Diff("user: Hi assistant: Hello! user: Bye ", mock.CompletionRequest.Prompt); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unknown session", func(t *testing.T) {
+		w := createRequest(t, s.SaveCacheHandler, api.CacheSaveRequest{Model: "test", SessionID: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body)
+		}
+
+		if got := code(t, w.Body); got != api.ErrorCodeSessionNotFound {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeSessionNotFound, got)
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		w := createRequest(t, s.RestoreCacheHandler, api.CacheRestoreRequest{Token: "../test"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		w := createRequest(t, s.RestoreCacheHandler, api.CacheRestoreRequest{Token: newSessionID()})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body)
+		}
+
+		if got := code(t, w.Body); got != api.ErrorCodeSnapshotNotFound {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeSnapshotNotFound, got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_CACHE_TTL", "0")
+		w := createRequest(t, s.SaveCacheHandler, api.CacheSaveRequest{Model: "test", SessionID: id})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body)
+		}
+
+		if got := code(t, w.Body); got != api.ErrorCodeUnsupported {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeUnsupported, got)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		t.Setenv("OLLAMA_CACHE_TTL", "1ms")
+		time.Sleep(2 * time.Millisecond)
+
+		w := createRequest(t, s.RestoreCacheHandler, api.CacheRestoreRequest{Token: token})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body)
+		}
+
+		snapshot, cache := snapshotPaths(token)
+		for _, p := range []string{snapshot, cache} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed, got %v", p, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+)
+
+// thinkingState is where a thinkingParser is in a response
+type thinkingState int
+
+const (
+	// thinkingLookingForOpening is before the response has started with or
+	// without the opening tag
+	thinkingLookingForOpening thinkingState = iota
+	// thinkingThinking is between the tags
+	thinkingThinking
+	// thinkingDone is after the closing tag, or the response didn't start
+	// with the opening tag
+	thinkingDone
+)
+
+// thinkingParser separates the reasoning of a model, delimited by its
+// thinking tags at the start of a response, from the content of the response
+// as it's streamed
+type thinkingParser struct {
+	open, close string
+
+	state thinkingState
+	// buf holds the text which may be the start of a tag
+	buf strings.Builder
+	// trim trims the whitespace after either tag
+	trim bool
+}
+
+// newThinkingParser returns a parser of responses to prompt, which start in
+// the reasoning if prompt ends with the opening tag
+func newThinkingParser(prompt, open, close string) *thinkingParser {
+	p := &thinkingParser{open: open, close: close}
+	if strings.HasSuffix(strings.TrimRightFunc(prompt, unicode.IsSpace), open) {
+		p.state, p.trim = thinkingThinking, true
+	}
+
+	return p
+}
+
+// thinking returns the parser of the reasoning in responses to prompt when
+// think is set and the model's template has thinking tags, otherwise nil
+func (m *Model) thinking(prompt string, think *bool) *thinkingParser {
+	if think == nil || m.Template == nil {
+		return nil
+	}
+
+	open, close := m.Template.ThinkingTags()
+	if open == "" {
+		return nil
+	}
+
+	return newThinkingParser(prompt, open, close)
+}
+
+// add returns the thinking and the content of the next part s of a response
+func (p *thinkingParser) add(s string) (thinking, content string) {
+	p.buf.WriteString(s)
+	for {
+		buf := p.buf.String()
+		if p.trim {
+			buf = strings.TrimLeftFunc(buf, unicode.IsSpace)
+			p.trim = buf == ""
+		}
+
+		switch p.state {
+		case thinkingLookingForOpening:
+			trimmed := strings.TrimLeftFunc(buf, unicode.IsSpace)
+			switch {
+			case strings.HasPrefix(trimmed, p.open):
+				p.state, p.trim = thinkingThinking, true
+				p.reset(trimmed[len(p.open):])
+			case strings.HasPrefix(p.open, trimmed):
+				// wait for more of the response
+				p.reset(buf)
+				return thinking, content
+			default:
+				p.state = thinkingDone
+				p.reset(buf)
+			}
+		case thinkingThinking:
+			if before, after, ok := strings.Cut(buf, p.close); ok {
+				thinking += strings.TrimRightFunc(before, unicode.IsSpace)
+				p.state, p.trim = thinkingDone, true
+				p.reset(after)
+				continue
+			}
+
+			// hold any whitespace and partial closing tag at the end
+			rest := strings.TrimRightFunc(buf[:len(buf)-overlap(buf, p.close)], unicode.IsSpace)
+			thinking += rest
+			p.reset(buf[len(rest):])
+			return thinking, content
+		default:
+			p.reset("")
+			return thinking, content + buf
+		}
+	}
+}
+
+// done returns the rest of the response held back when it ends
+func (p *thinkingParser) done() (thinking, content string) {
+	buf := p.buf.String()
+	p.reset("")
+	switch p.state {
+	case thinkingThinking:
+		return strings.TrimSpace(buf), ""
+	case thinkingLookingForOpening:
+		return "", buf
+	default:
+		return "", ""
+	}
+}
+
+func (p *thinkingParser) reset(s string) {
+	p.buf.Reset()
+	p.buf.WriteString(s)
+}
+
+// overlap returns the length of the longest suffix of s which is a prefix of
+// tag
+func overlap(s, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+
+	return 0
+}
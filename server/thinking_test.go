@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestThinkingParser(t *testing.T) {
+	cases := []struct {
+		name              string
+		prompt            string
+		response          string
+		thinking, content string
+	}{
+		{"thinking", "", "<think>\nLet me think.\n</think>\n\nHello!", "Let me think.", "Hello!"},
+		{"leading space", "", "  <think>a</think>b", "a", "b"},
+		{"no thinking", "", "Hello <think>!</think>", "", "Hello <think>!</think>"},
+		{"partial tag", "", "<thin", "", "<thin"},
+		{"unclosed", "", "<think>Let me think. ", "Let me think.", ""},
+		{"opened in prompt", "User: Hi!\nAssistant: <think>\n", "Let me think.</think>Hello!", "Let me think.", "Hello!"},
+		{"empty", "", "<think></think>\n\nHello!", "", "Hello!"},
+		{"multiline", "", "<think>a\n\nb\n</think>c\n\nd", "a\n\nb", "c\n\nd"},
+	}
+
+	for _, tt := range cases {
+		// a response is parsed the same however it's split
+		for _, size := range []int{1, 3, len(tt.response)} {
+			t.Run(tt.name, func(t *testing.T) {
+				p := newThinkingParser(tt.prompt, "<think>", "</think>")
+
+				var thinking, content string
+				for s := tt.response; s != ""; {
+					n := min(size, len(s))
+					a, b := p.add(s[:n])
+					thinking, content = thinking+a, content+b
+					s = s[n:]
+				}
+
+				a, b := p.done()
+				thinking, content = thinking+a, content+b
+
+				if thinking != tt.thinking || content != tt.content {
+					t.Errorf("parsed in parts of %d, expected thinking %q and content %q, got %q and %q", size, tt.thinking, tt.content, thinking, content)
+				}
+			})
+		}
+	}
+}
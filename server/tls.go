@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most, as connections are made
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of a pair of PEM files and reloads it
+// when either file changes so certificates can be rotated without a restart
+type certReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	stamp   [2]fileStamp
+	checked time.Time
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime int64
+	size    int64
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: certCheckInterval}
+	stamp, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.load(stamp); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// tlsReloader returns a certReloader of OLLAMA_TLS_CERT and OLLAMA_TLS_KEY or
+// nil if neither is set
+func tlsReloader() (*certReloader, error) {
+	certFile, keyFile := envconfig.TLSCert(), envconfig.TLSKey()
+	switch {
+	case certFile == "" && keyFile == "":
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("OLLAMA_TLS_CERT and OLLAMA_TLS_KEY must be set together")
+	}
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS certificate: %w", err)
+	}
+
+	return r, nil
+}
+
+// stat returns the stamps of the certificate and key files
+func (r *certReloader) stat() ([2]fileStamp, error) {
+	var stamp [2]fileStamp
+	for i, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return stamp, err
+		}
+
+		stamp[i] = fileStamp{modTime: fi.ModTime().UnixNano(), size: fi.Size()}
+	}
+
+	return stamp, nil
+}
+
+// load loads the certificate of the files at stamp. It's guarded by mu
+// except while r is created.
+func (r *certReloader) load(stamp [2]fileStamp) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert, r.stamp = &cert, stamp
+	return nil
+}
+
+// GetCertificate implements [tls.Config.GetCertificate]. A certificate that
+// fails to reload, e.g. while only one of the files has been replaced, is
+// logged and the previous certificate is served until the next check.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < r.interval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+
+	stamp, err := r.stat()
+	if err != nil {
+		slog.Warn("failed to check TLS certificate", "error", err)
+		return r.cert, nil
+	}
+
+	if stamp != r.stamp {
+		if err := r.load(stamp); err != nil {
+			slog.Warn("failed to reload TLS certificate", "error", err)
+		} else {
+			slog.Info("reloaded TLS certificate", "cert", r.certFile)
+		}
+	}
+
+	return r.cert, nil
+}
+
+// configureTLS makes srv serve the certificate of certs
+func configureTLS(srv *http.Server, certs *certReloader) {
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = &tls.Config{}
+	}
+
+	srv.TLSConfig.GetCertificate = certs.GetCertificate
+}
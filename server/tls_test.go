@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/version"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 with
+// serial and its key to certFile and keyFile and returns the certificate
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "ollama"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	t.Setenv("OLLAMA_TLS_CERT", certFile)
+	t.Setenv("OLLAMA_TLS_KEY", keyFile)
+
+	certs, err := tlsReloader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.interval = 0
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{addr: ln.Addr()}
+	srv := newHTTPServer(s.GenerateRoutes())
+	configureTLS(srv, certs)
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+
+	// serial returns the serial number of the certificate served
+	serial := func(t *testing.T) int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(first)
+
+		client := api.NewClient(
+			&url.URL{Scheme: "https", Host: ln.Addr().String()},
+			&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		)
+
+		v, err := client.Version(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v != version.Version {
+			t.Errorf("expected version %q, got %q", version.Version, v)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		if n := serial(t); n != 1 {
+			t.Fatalf("expected certificate 1, got %d", n)
+		}
+
+		writeSelfSignedCert(t, certFile, keyFile, 2)
+		if n := serial(t); n != 2 {
+			t.Errorf("expected the rotated certificate 2, got %d", n)
+		}
+	})
+
+	t.Run("invalid rotation", func(t *testing.T) {
+		// a certificate without its key keeps the previous one
+		writeSelfSignedCert(t, certFile, filepath.Join(dir, "other.pem"), 3)
+		if n := serial(t); n != 2 {
+			t.Errorf("expected certificate 2 to still be served, got %d", n)
+		}
+	})
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	cases := map[string]struct {
+		cert, key string
+		ok        bool
+	}{
+		"unset":          {"", "", true},
+		"valid":          {certFile, keyFile, true},
+		"missing key":    {certFile, "", false},
+		"missing cert":   {"", keyFile, false},
+		"swapped":        {keyFile, certFile, false},
+		"no such file":   {filepath.Join(dir, "missing.pem"), keyFile, false},
+		"mismatched key": {certFile, writeOtherKey(t, dir), false},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TLS_CERT", tt.cert)
+			t.Setenv("OLLAMA_TLS_KEY", tt.key)
+
+			if _, err := tlsReloader(); (err == nil) != tt.ok {
+				t.Errorf("expected ok %t, got error %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+// writeOtherKey writes the key of another certificate and returns its path
+func writeOtherKey(t *testing.T, dir string) string {
+	t.Helper()
+	keyFile := filepath.Join(dir, "other-key.pem")
+	writeSelfSignedCert(t, filepath.Join(dir, "other-cert.pem"), keyFile, 2)
+	return keyFile
+}
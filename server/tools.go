@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/ollama/ollama/api"
+)
+
+var errInvalidTool = errors.New("invalid tool")
+
+// schemaTypes are the types of a JSON schema
+var schemaTypes = []string{"string", "number", "integer", "boolean", "array", "object", "null"}
+
+// validateTools checks the definition of each tool. It returns tools without
+// those named like an earlier tool.
+func validateTools(tools []api.Tool) ([]api.Tool, error) {
+	var valid []api.Tool
+	for i, tool := range tools {
+		name := tool.Function.Name
+		if name == "" {
+			return nil, fmt.Errorf("%w %d: function name is required", errInvalidTool, i)
+		}
+
+		if tool.Type != "" && tool.Type != "function" {
+			return nil, fmt.Errorf("%w %q: type must be \"function\", got %q", errInvalidTool, name, tool.Type)
+		}
+
+		params := tool.Function.Parameters
+		if params.Type != "object" && (params.Type != "" || len(params.Properties) > 0 || len(params.Required) > 0) {
+			return nil, fmt.Errorf("%w %q: parameters must be a JSON schema of type \"object\", got type %q", errInvalidTool, name, params.Type)
+		}
+
+		properties := maps.Keys(params.Properties)
+		slices.Sort(properties)
+		for _, property := range properties {
+			if t := params.Properties[property].Type; t != "" && !slices.Contains(schemaTypes, t) {
+				return nil, fmt.Errorf("%w %q: parameter %q has invalid type %q", errInvalidTool, name, property, t)
+			}
+		}
+
+		for _, required := range params.Required {
+			if _, ok := params.Properties[required]; !ok {
+				return nil, fmt.Errorf("%w %q: required parameter %q isn't defined", errInvalidTool, name, required)
+			}
+		}
+
+		if slices.ContainsFunc(valid, func(t api.Tool) bool { return t.Function.Name == name }) {
+			continue
+		}
+
+		valid = append(valid, tool)
+	}
+
+	return valid, nil
+}
+
+// toolCallStreamer recognizes tool calls at the start of a streamed chat
+// response and emits fragments of their arguments as they are generated.
+// Content that doesn't start with a tool call is passed through unchanged.
+type toolCallStreamer struct {
+	m *Model
+
+	prefix, name, arguments string
+
+	// content and tools are set once the response is known to be plain
+	// content or a tool call
+	content, tools bool
+
+	b strings.Builder
+
+	// sent is the length of the arguments sent for each tool call
+	sent []int
+}
+
+// newToolCallStreamer returns a streamer for the model's tool call format or
+// nil if its template doesn't support tool calls
+func (m *Model) newToolCallStreamer() *toolCallStreamer {
+	prefix, name, arguments, ok := m.toolCallFormat()
+	if !ok {
+		return nil
+	}
+
+	return &toolCallStreamer{
+		m:         m,
+		prefix:    strings.Join(strings.Fields(prefix), ""),
+		name:      name,
+		arguments: arguments,
+	}
+}
+
+// add consumes the next piece of the response. It returns the content to
+// send and fragments of any tool calls it continues. Content is held back
+// while the start of the response may still be a tool call.
+func (t *toolCallStreamer) add(s string) (string, []api.ToolCall) {
+	if t.content {
+		return s, nil
+	}
+
+	t.b.WriteString(s)
+	if !t.tools {
+		// whitespace in the prefix is insignificant
+		s := strings.Join(strings.Fields(t.b.String()), "")
+		switch {
+		case s == "":
+			return "", nil
+		case s[0] == '{' || s[0] == '[', t.prefix != "" && strings.HasPrefix(s, t.prefix):
+			t.tools = true
+		case strings.HasPrefix(t.prefix, s):
+			return "", nil
+		default:
+			t.content = true
+			return t.b.String(), nil
+		}
+	}
+
+	var calls []api.ToolCall
+	for i, call := range scanToolCalls(t.b.String(), t.name, t.arguments) {
+		if call.name == "" {
+			// wait for the name so fragments are sent in order
+			break
+		}
+
+		if i == len(t.sent) {
+			t.sent = append(t.sent, len(call.arguments))
+			calls = append(calls, api.ToolCall{
+				Index: i,
+				Function: api.ToolCallFunction{
+					Name:             call.name,
+					PartialArguments: call.arguments,
+				},
+			})
+		} else if len(call.arguments) > t.sent[i] {
+			calls = append(calls, api.ToolCall{
+				Index: i,
+				Function: api.ToolCallFunction{
+					PartialArguments: call.arguments[t.sent[i]:],
+				},
+			})
+			t.sent[i] = len(call.arguments)
+		}
+	}
+
+	return "", calls
+}
+
+// done returns the complete tool calls of the response or, if it isn't a tool
+// call, any content that was held back
+func (t *toolCallStreamer) done() (string, []api.ToolCall) {
+	if t.content {
+		return "", nil
+	}
+
+	if t.tools {
+		if calls, ok := t.m.parseToolCalls(t.b.String()); ok {
+			for i := range calls {
+				calls[i].Index = i
+			}
+
+			return "", calls
+		}
+	}
+
+	return t.b.String(), nil
+}
+
+// streamedToolCall is a tool call read from a possibly incomplete response
+type streamedToolCall struct {
+	name string
+
+	// arguments is the raw JSON of the arguments generated so far
+	arguments string
+}
+
+// scanToolCalls finds the tool calls in s, which may end in the middle of a
+// tool call. A tool call is any object with the name key or an object valued
+// arguments key.
+func scanToolCalls(s, name, arguments string) []*streamedToolCall {
+	type frame struct {
+		object bool
+
+		// key is the current key of an object and value is set after its colon
+		key   string
+		value bool
+
+		call *streamedToolCall
+
+		// args is the tool call whose arguments the frame holds, starting at
+		// offset start of s
+		args  *streamedToolCall
+		start int
+
+		// inArgs is set for frames nested inside arguments
+		inArgs bool
+	}
+
+	var calls []*streamedToolCall
+	var stack []*frame
+
+	call := func(f *frame) *streamedToolCall {
+		if f.call == nil {
+			f.call = &streamedToolCall{}
+			calls = append(calls, f.call)
+		}
+
+		return f.call
+	}
+
+scan:
+	for i := 0; i < len(s); i++ {
+		var top *frame
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		switch c := s[i]; c {
+		case '"':
+			end := i + 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+
+			if end >= len(s) {
+				// the string is incomplete
+				break scan
+			}
+
+			var str string
+			if err := json.Unmarshal([]byte(s[i:end+1]), &str); err == nil && top != nil && top.object && !top.inArgs {
+				if !top.value {
+					top.key = str
+				} else if top.key == name {
+					call(top).name = str
+				}
+			}
+
+			if top != nil {
+				top.value = false
+			}
+
+			i = end
+		case ':':
+			if top != nil && top.object {
+				top.value = true
+			}
+		case ',':
+			if top != nil && top.object {
+				top.key, top.value = "", false
+			}
+		case '{', '[':
+			f := frame{object: c == '{'}
+			if top != nil {
+				f.inArgs = top.inArgs
+				if f.object && top.object && top.value && top.key == arguments && !top.inArgs {
+					f.args, f.start, f.inArgs = call(top), i, true
+				}
+
+				top.value = false
+			}
+
+			stack = append(stack, &f)
+		case '}', ']':
+			if top == nil {
+				continue
+			}
+
+			if top.args != nil {
+				top.args.arguments = s[top.start : i+1]
+			}
+
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	// arguments still open continue to the end of s
+	for _, f := range stack {
+		if f.args != nil {
+			f.args.arguments = s[f.start:]
+		}
+	}
+
+	return calls
+}
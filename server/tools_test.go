@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+func TestToolCallStreamer(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+	cases := []struct {
+		model  string
+		output string
+		ok     bool
+	}{
+		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`, true},
+		{"mistral", " The weather in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.", false},
+		{"command-r-plus", "Action: ```json" + `
+[
+    {
+        "tool_name": "get_current_weather",
+        "parameters": {
+            "format": "fahrenheit",
+            "location": "San Francisco, CA"
+        }
+    },
+    {
+        "tool_name": "get_current_weather",
+        "parameters": {
+            "format": "celsius",
+            "location": "Toronto, Canada"
+        }
+    }
+]
+` + "```", true},
+		{"command-r-plus", " The weather in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.", false},
+		{"firefunction", ` functools[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`, true},
+		{"llama3-groq-tool-use", `<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}
+{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}
+</tool_call>`, true},
+		{"llama3-groq-tool-use", "<tool>s aren't needed to answer that.", false},
+		{"xlam", `{"tool_calls": [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]}`, true},
+		{"nemotron", `<toolcall> {"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}} </toolcall> <toolcall> {"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}} </toolcall>`, true},
+	}
+
+	calls := []api.ToolCall{
+		{
+			Function: api.ToolCallFunction{
+				Name: "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "fahrenheit",
+					"location": "San Francisco, CA",
+				},
+			},
+		},
+		{
+			Index: 1,
+			Function: api.ToolCallFunction{
+				Name: "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "celsius",
+					"location": "Toronto, Canada",
+				},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", tt.model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+			for _, size := range []int{1, 3, 16} {
+				t.Run(fmt.Sprintf("chunk %d", size), func(t *testing.T) {
+					ts := m.newToolCallStreamer()
+					if ts == nil {
+						t.Fatal("expected a tool call streamer")
+					}
+
+					var content strings.Builder
+					var names []string
+					var arguments []string
+					add := func(s string, fragments []api.ToolCall) {
+						content.WriteString(s)
+						for _, fragment := range fragments {
+							if fragment.Index == len(arguments) {
+								names = append(names, fragment.Function.Name)
+								arguments = append(arguments, "")
+							} else if fragment.Function.Name != "" {
+								t.Errorf("tool call %d: unexpected name in later fragment", fragment.Index)
+							}
+
+							arguments[fragment.Index] += fragment.Function.PartialArguments
+						}
+					}
+
+					for i := 0; i < len(tt.output); i += size {
+						add(ts.add(tt.output[i:min(i+size, len(tt.output))]))
+					}
+
+					s, toolCalls := ts.done()
+					content.WriteString(s)
+
+					if !tt.ok {
+						if content.String() != tt.output {
+							t.Errorf("expected content %q, got %q", tt.output, content.String())
+						}
+
+						if len(toolCalls) > 0 || len(arguments) > 0 {
+							t.Errorf("expected no tool calls, got %v and %v", toolCalls, arguments)
+						}
+
+						return
+					}
+
+					if content.Len() > 0 {
+						t.Errorf("expected no content, got %q", content.String())
+					}
+
+					if diff := cmp.Diff(toolCalls, calls); diff != "" {
+						t.Errorf("mismatch (-got +want):\n%s", diff)
+					}
+
+					if len(arguments) != len(calls) {
+						t.Fatalf("expected %d streamed tool calls, got %d", len(calls), len(arguments))
+					}
+
+					for i, call := range calls {
+						if names[i] != call.Function.Name {
+							t.Errorf("tool call %d: expected name %q, got %q", i, call.Function.Name, names[i])
+						}
+
+						var args api.ToolCallFunctionArguments
+						if err := json.Unmarshal([]byte(arguments[i]), &args); err != nil {
+							t.Fatalf("tool call %d: %q: %v", i, arguments[i], err)
+						}
+
+						if diff := cmp.Diff(args, call.Function.Arguments); diff != "" {
+							t.Errorf("tool call %d: mismatch (-got +want):\n%s", i, diff)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestScanToolCalls(t *testing.T) {
+	type call struct {
+		Name, Arguments string
+	}
+
+	cases := []struct {
+		input string
+		want  []call
+	}{
+		{`{"name": "a", "arguments": {"x": 1}}`, []call{{"a", `{"x": 1}`}}},
+		{`{"arguments": {"x": 1}, "name": "a"}`, []call{{"a", `{"x": 1}`}}},
+		{`{"name": "a", "arguments": {"x": "}`, []call{{"a", `{"x": "}`}}},
+		{`{"name": "a", "arguments": {"x": "a \"quoted\" }"}`, []call{{"a", `{"x": "a \"quoted\" }"}`}}},
+		{`{"name": "a", "arguments": {"name": "b", "arguments": {}}}`, []call{{"a", `{"name": "b", "arguments": {}}`}}},
+		{`[{"name": "a", "arguments": {}}, {"name": "b", "argu`, []call{{"a", `{}`}, {"b", ""}}},
+		{`{"name": "a", "arguments": "x"}`, []call{{"a", ""}}},
+		{`{"na`, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.input, func(t *testing.T) {
+			var got []call
+			for _, c := range scanToolCalls(tt.input, "name", "arguments") {
+				got = append(got, call{c.name, c.arguments})
+			}
+
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateTools(t *testing.T) {
+	weather := `{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "required": ["location"], "properties": {"location": {"type": "string"}, "unit": {"type": "string", "enum": ["celsius", "fahrenheit"]}}}}}`
+
+	cases := []struct {
+		name  string
+		tools string
+		want  []string
+		err   string
+	}{
+		{"valid", `[` + weather + `, {"type": "function", "function": {"name": "get_time"}}]`, []string{"get_weather", "get_time"}, ""},
+		{"duplicate names", `[` + weather + `, {"type": "function", "function": {"name": "get_time"}}, {"type": "function", "function": {"name": "get_weather"}}]`, []string{"get_weather", "get_time"}, ""},
+		{"missing name", `[{"type": "function", "function": {"description": "nameless"}}]`, nil, `invalid tool 0: function name is required`},
+		{"type", `[{"type": "retrieval", "function": {"name": "search"}}]`, nil, `invalid tool "search": type must be "function", got "retrieval"`},
+		{"parameters type", `[{"type": "function", "function": {"name": "search", "parameters": {"type": "string"}}}]`, nil, `invalid tool "search": parameters must be a JSON schema of type "object", got type "string"`},
+		{"parameters without type", `[{"type": "function", "function": {"name": "search", "parameters": {"properties": {"query": {"type": "string"}}}}}]`, nil, `invalid tool "search": parameters must be a JSON schema of type "object", got type ""`},
+		{"property type", `[{"type": "function", "function": {"name": "search", "parameters": {"type": "object", "properties": {"query": {"type": "text"}}}}}]`, nil, `invalid tool "search": parameter "query" has invalid type "text"`},
+		{"undefined required", `[{"type": "function", "function": {"name": "search", "parameters": {"type": "object", "required": ["query"]}}}]`, nil, `invalid tool "search": required parameter "query" isn't defined`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var tools []api.Tool
+			if err := json.Unmarshal([]byte(tt.tools), &tools); err != nil {
+				t.Fatal(err)
+			}
+
+			valid, err := validateTools(tools)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, tool := range valid {
+				names = append(names, tool.Function.Name)
+			}
+
+			if diff := cmp.Diff(names, tt.want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -39,6 +39,10 @@ type blobUpload struct {
 
 	file *os.File
 
+	// mounted is set if the registry mounted the blob from another
+	// repository so there's nothing to upload
+	mounted bool
+
 	done       bool
 	err        error
 	references atomic.Int32
@@ -51,15 +55,22 @@ const (
 )
 
 func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *registryOptions) error {
-	p, err := GetBlobsPath(b.Digest)
+	store, err := blobStore()
+	if err != nil {
+		return err
+	}
+
+	// the blob may only be in the remote blob store
+	p, err := store.File(ctx, b.Digest)
 	if err != nil {
 		return err
 	}
 
-	if b.From != "" {
+	// blobs can only be mounted from a repository in the same registry
+	if from := ParseModelPath(b.From); b.From != "" && from.Registry == requestURL.Host {
 		values := requestURL.Query()
 		values.Add("mount", b.Digest)
-		values.Add("from", ParseModelPath(b.From).GetNamespaceRepository())
+		values.Add("from", from.GetNamespaceRepository())
 		requestURL.RawQuery = values.Encode()
 	}
 
@@ -84,7 +95,9 @@ func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *reg
 	// http.StatusCreated indicates a blob has been mounted
 	// ref: https://distribution.github.io/distribution/spec/api/#cross-repository-blob-mount
 	if resp.StatusCode == http.StatusCreated {
+		slog.Info(fmt.Sprintf("mounted %s from %s", b.Digest[7:19], b.From))
 		b.Completed.Store(b.Total)
+		b.mounted = true
 		b.done = true
 		return nil
 	}
@@ -126,13 +139,17 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 	defer blobUploadManager.Delete(b.Digest)
 	ctx, b.CancelFunc = context.WithCancel(ctx)
 
-	p, err := GetBlobsPath(b.Digest)
+	if b.mounted {
+		return
+	}
+
+	store, err := blobStore()
 	if err != nil {
 		b.err = err
 		return
 	}
 
-	b.file, err = os.Open(p)
+	b.file, err = store.Open(ctx, b.Digest)
 	if err != nil {
 		b.err = err
 		return
@@ -277,7 +294,7 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 	case resp.StatusCode == http.StatusUnauthorized:
 		w.Rollback()
 		challenge := parseRegistryChallenge(resp.Header.Get("www-authenticate"))
-		token, err := getAuthorizationToken(ctx, challenge)
+		token, err := getAuthorizationToken(ctx, challenge, opts)
 		if err != nil {
 			return err
 		}
@@ -324,8 +341,13 @@ func (b *blobUpload) Wait(ctx context.Context, fn func(api.ProgressResponse)) er
 			return ctx.Err()
 		}
 
+		status := fmt.Sprintf("pushing %s", b.Digest[7:19])
+		if b.mounted {
+			status = fmt.Sprintf("%s already exists", b.Digest[7:19])
+		}
+
 		fn(api.ProgressResponse{
-			Status:    fmt.Sprintf("pushing %s", b.Digest[7:19]),
+			Status:    status,
 			Digest:    b.Digest,
 			Total:     b.Total,
 			Completed: b.Completed.Load(),
@@ -374,7 +396,7 @@ func uploadBlob(ctx context.Context, mp ModelPath, layer Layer, opts *registryOp
 	default:
 		defer resp.Body.Close()
 		fn(api.ProgressResponse{
-			Status:    fmt.Sprintf("pushing %s", layer.Digest[7:19]),
+			Status:    fmt.Sprintf("%s already exists", layer.Digest[7:19]),
 			Digest:    layer.Digest,
 			Total:     layer.Size,
 			Completed: layer.Size,
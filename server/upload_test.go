@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// fakeUploadRegistry accepts blob uploads to library/test. Blobs in
+// existing are reported present and blobs in mountable can be mounted from
+// library/base.
+type fakeUploadRegistry struct {
+	existing  map[string]bool
+	mountable map[string]bool
+
+	mu       sync.Mutex
+	uploads  map[string]*bytes.Buffer
+	uploaded map[string][]byte
+	mounted  []string
+	manifest []byte
+}
+
+func newFakeUploadRegistry(t *testing.T, existing, mountable []string) (*fakeUploadRegistry, *url.URL) {
+	t.Helper()
+
+	r := &fakeUploadRegistry{
+		existing:  make(map[string]bool),
+		mountable: make(map[string]bool),
+		uploads:   make(map[string]*bytes.Buffer),
+		uploaded:  make(map[string][]byte),
+	}
+
+	for _, digest := range existing {
+		r.existing[digest] = true
+	}
+
+	for _, digest := range mountable {
+		r.mountable[digest] = true
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		switch {
+		case req.Method == http.MethodHead && strings.HasPrefix(req.URL.Path, "/v2/library/test/blobs/sha256:"):
+			if !r.existing[path.Base(req.URL.Path)] {
+				http.NotFound(w, req)
+			}
+		case req.Method == http.MethodPost && req.URL.Path == "/v2/library/test/blobs/uploads/":
+			if digest := req.URL.Query().Get("mount"); r.mountable[digest] && req.URL.Query().Get("from") == "library/base" {
+				r.mounted = append(r.mounted, digest)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+
+			id := fmt.Sprintf("upload-%d", len(r.uploads))
+			r.uploads[id] = &bytes.Buffer{}
+			w.Header().Set("Location", "http://"+req.Host+"/uploads/"+id)
+			w.WriteHeader(http.StatusAccepted)
+		case req.Method == http.MethodPatch && strings.HasPrefix(req.URL.Path, "/uploads/"):
+			io.Copy(r.uploads[path.Base(req.URL.Path)], req.Body)
+			w.Header().Set("Location", "http://"+req.Host+req.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/uploads/"):
+			r.uploaded[req.URL.Query().Get("digest")] = r.uploads[path.Base(req.URL.Path)].Bytes()
+			w.WriteHeader(http.StatusCreated)
+		case req.Method == http.MethodPut && req.URL.Path == "/v2/library/test/manifests/latest":
+			r.manifest, _ = io.ReadAll(req.Body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, u
+}
+
+func TestPushModelSkipsExistingBlobs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	blobs := map[string][]byte{
+		"existing":  []byte("a layer the repository already has"),
+		"mountable": []byte("a layer another repository has"),
+		"missing":   []byte("a layer the registry doesn't have"),
+		"config":    []byte(`{"model_format":"gguf"}`),
+	}
+
+	digest := func(name string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(blobs[name]))
+	}
+
+	registry, registryURL := newFakeUploadRegistry(t,
+		[]string{digest("existing")},
+		[]string{digest("mountable")},
+	)
+
+	layers := make(map[string]Layer)
+	for name, blob := range blobs {
+		layer, err := NewLayer(bytes.NewReader(blob), "application/vnd.ollama.image."+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layers[name] = layer
+	}
+
+	mountable := layers["mountable"]
+	mountable.From = registryURL.Host + "/library/base:latest"
+
+	name := registryURL.Host + "/library/test:latest"
+	if err := WriteManifest(model.ParseName(name), layers["config"], []Layer{layers["existing"], mountable, layers["missing"]}); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := make(map[string]string)
+	if err := PushModel(context.Background(), name, &registryOptions{Insecure: true}, func(resp api.ProgressResponse) {
+		if resp.Digest != "" {
+			statuses[resp.Digest] = resp.Status
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(registry.uploaded, map[string][]byte{
+		digest("missing"): blobs["missing"],
+		digest("config"):  blobs["config"],
+	}); diff != "" {
+		t.Errorf("expected only missing blobs to be uploaded (-got +want):\n%s", diff)
+	}
+
+	if !slices.Equal(registry.mounted, []string{digest("mountable")}) {
+		t.Errorf("expected %s to be mounted, got %v", digest("mountable"), registry.mounted)
+	}
+
+	for _, name := range []string{"existing", "mountable"} {
+		if want := digest(name)[7:19] + " already exists"; statuses[digest(name)] != want {
+			t.Errorf("%s: expected status %q, got %q", name, want, statuses[digest(name)])
+		}
+	}
+
+	if want := "pushing " + digest("missing")[7:19]; statuses[digest("missing")] != want {
+		t.Errorf("missing: expected status %q, got %q", want, statuses[digest("missing")])
+	}
+
+	if len(registry.manifest) == 0 {
+		t.Error("expected the manifest to be pushed")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"regexp"
 	"slices"
 	"strings"
 	"sync"
@@ -163,6 +164,113 @@ func (t *Template) Vars() []string {
 	return vars
 }
 
+// thinkingTag matches tags which may delimit the reasoning of a model, e.g.
+// <think> or <|begin_of_thought|>
+var thinkingTag = regexp.MustCompile(`<(\|?)(\w*(?:think|thought|reason)\w*)(\|?)>`)
+
+// ThinkingTags returns the tags which delimit the reasoning of models using
+// the template, e.g. "<think>" and "</think>", or empty strings if the
+// template doesn't have both.
+func (t *Template) ThinkingTags() (open, close string) {
+	for _, m := range thinkingTag.FindAllStringSubmatch(t.raw, -1) {
+		open, name := m[0], m[2]
+		for _, close := range []string{
+			"</" + name + ">",
+			"<" + m[1] + strings.Replace(name, "begin", "end", 1) + m[3] + ">",
+		} {
+			if close != open && strings.Contains(t.raw, close) {
+				return open, close
+			}
+		}
+	}
+
+	return "", ""
+}
+
+// variables are the fields available at the root of a template
+var variables = []string{"System", "Prompt", "Response", "Suffix", "Messages", "Tools"}
+
+// Validate checks that fields referenced at the root of the template are
+// provided when it is executed. Unknown fields otherwise render as empty
+// values without an error.
+func (t *Template) Validate() error {
+	var walk func(n parse.Node, root bool) error
+
+	// branch walks a branch node whose body is evaluated with dot at the root
+	// if body is true
+	branch := func(n *parse.BranchNode, root, body bool) error {
+		if err := walk(n.Pipe, root); err != nil {
+			return err
+		}
+
+		if err := walk(n.List, body); err != nil {
+			return err
+		}
+
+		if n.ElseList != nil {
+			return walk(n.ElseList, root)
+		}
+
+		return nil
+	}
+
+	walk = func(n parse.Node, root bool) error {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			for _, c := range n.Nodes {
+				if err := walk(c, root); err != nil {
+					return err
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe, root)
+		case *parse.TemplateNode:
+			if n.Pipe != nil {
+				return walk(n.Pipe, root)
+			}
+		case *parse.IfNode:
+			return branch(&n.BranchNode, root, root)
+		case *parse.WithNode:
+			// the body of with and range rebinds dot, the else branch does not
+			return branch(&n.BranchNode, root, false)
+		case *parse.RangeNode:
+			return branch(&n.BranchNode, root, false)
+		case *parse.PipeNode:
+			for _, c := range n.Cmds {
+				for _, a := range c.Args {
+					if err := walk(a, root); err != nil {
+						return err
+					}
+				}
+			}
+		case *parse.ChainNode:
+			return walk(n.Node, root)
+		case *parse.FieldNode:
+			if root {
+				return t.checkVariable(n, n.Ident[0])
+			}
+		case *parse.VariableNode:
+			// $ always refers to the root regardless of dot
+			if len(n.Ident) > 1 && n.Ident[0] == "$" {
+				return t.checkVariable(n, n.Ident[1])
+			}
+		}
+
+		return nil
+	}
+
+	return walk(t.Tree.Root, true)
+}
+
+func (t *Template) checkVariable(n parse.Node, name string) error {
+	if slices.Contains(variables, name) {
+		return nil
+	}
+
+	line := 1 + strings.Count(t.raw[:min(int(n.Position()), len(t.raw))], "\n")
+	return fmt.Errorf("line %d: undefined variable %q, must be one of %s", line, "."+name, strings.Join(variables, ", "))
+}
+
 type Values struct {
 	Messages []api.Message
 	api.Tools
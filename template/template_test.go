@@ -197,6 +197,90 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestThinkingTags(t *testing.T) {
+	cases := []struct {
+		template    string
+		open, close string
+	}{
+		{"{{ .Prompt }}", "", ""},
+		{"{{ .Prompt }}<think>", "", ""},
+		{"{{ range .Messages }}{{ .Content }}{{ end }}<|im_start|>assistant\n<think>\n\n</think>\n\n", "<think>", "</think>"},
+		{"{{ .Prompt }}<reasoning>{{ .Response }}</reasoning>", "<reasoning>", "</reasoning>"},
+		{"{{ .Prompt }}<|begin_of_thought|>{{ .Response }}<|end_of_thought|>", "<|begin_of_thought|>", "<|end_of_thought|>"},
+	}
+
+	for _, tt := range cases {
+		t.Run("", func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if open, close := tmpl.ThinkingTags(); open != tt.open || close != tt.close {
+				t.Errorf("expected %q and %q, got %q and %q", tt.open, tt.close, open, close)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		template string
+		err      string
+	}{
+		{"{{ .System }} {{ .Prompt }} {{ .Response }}", ""},
+		{"{{ .Prompt }} {{ .Suffix }}", ""},
+		{"{{ range .Messages }}{{ .Role }}: {{ .Content }}{{ if $.Tools }}{{ .ToolCalls }}{{ end }}{{ end }}", ""},
+		{"{{ with .Tools }}{{ range . }}{{ .Function.Name }}{{ end }}{{ else }}{{ .System }}{{ end }}", ""},
+		{"{{ range $i, $m := .Messages }}{{ $m.Content }}{{ end }}", ""},
+		{"{{ .System }}\n{{ .Promt }}", `line 2: undefined variable ".Promt"`},
+		{"{{ range .Messages }}{{ .Content }}{{ end }}\n\n{{ $.Input }}", `line 3: undefined variable ".Input"`},
+		{"{{ with .Tools }}{{ . }}{{ else }}{{ .Tool }}{{ end }}", `line 1: undefined variable ".Tool"`},
+		{"{{ if eq (len .Messages) 0 }}{{ .Prompts }}{{ end }}", `line 1: undefined variable ".Prompts"`},
+	}
+
+	for _, tt := range cases {
+		t.Run("", func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = tmpl.Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			} else if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("syntax error", func(t *testing.T) {
+		// syntax errors are reported when parsing along with their line
+		if _, err := Parse("{{ .System }}\n{{ if .Prompt }}"); err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Fatalf("expected a syntax error on line 2, got %v", err)
+		}
+	})
+
+	t.Run("named", func(t *testing.T) {
+		templates, err := templatesOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, n := range templates {
+			tmpl, err := Parse(string(n.Bytes))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tmpl.Validate(); err != nil {
+				t.Errorf("%s: %v", n.Name, err)
+			}
+		}
+	})
+}
+
 func TestExecuteWithMessages(t *testing.T) {
 	type template struct {
 		name     string
@@ -101,6 +101,8 @@ type Name struct {
 //		  { host } "/" { namespace } "/" { model } ":" { tag }
 //		  { host } "/" { namespace } "/" { model } "@" { digest }
 //		  { host } "/" { namespace } "/" { model }
+//		  { host } "/" { model } ":" { tag }
+//		  { host } "/" { model }
 //		  { namespace } "/" { model } ":" { tag } "@" { digest }
 //		  { namespace } "/" { model } ":" { tag }
 //		  { namespace } "/" { model } "@" { digest }
@@ -153,6 +155,11 @@ func ParseNameBare(s string) Name {
 		return n
 	}
 
+	if host, ok := bareHost(s); ok {
+		n.Host = host
+		return n
+	}
+
 	s, n.Namespace, promised = cutPromised(s, "/")
 	if !promised {
 		n.Namespace = s
@@ -168,6 +175,17 @@ func ParseNameBare(s string) Name {
 	return n
 }
 
+// bareHost returns the host of s, the part of a name before its model, if s is
+// a host rather than a namespace. Like docker, a host is told apart from a
+// namespace by a scheme, a "." or ":", or being "localhost".
+func bareHost(s string) (string, bool) {
+	if _, host, ok := strings.Cut(s, "://"); ok {
+		return host, !strings.Contains(host, "/")
+	}
+
+	return s, !strings.Contains(s, "/") && (strings.ContainsAny(s, ".:") || s == "localhost")
+}
+
 // ParseNameFromFilepath parses a 4-part filepath as a Name. The parts are
 // expected to be in the form:
 //
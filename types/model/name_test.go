@@ -77,6 +77,49 @@ func TestParseNameParts(t *testing.T) {
 			},
 			wantFilepath: filepath.Join("host:port", "namespace", "model", "latest"),
 		},
+		{
+			in: "registry.corp.com/model:tag",
+			want: Name{
+				Host:  "registry.corp.com",
+				Model: "model",
+				Tag:   "tag",
+			},
+			wantFilepath: filepath.Join("registry.corp.com", "library", "model", "tag"),
+		},
+		{
+			in: "localhost:5000/model",
+			want: Name{
+				Host:  "localhost:5000",
+				Model: "model",
+			},
+			wantFilepath: filepath.Join("localhost:5000", "library", "model", "latest"),
+		},
+		{
+			in: "localhost/model",
+			want: Name{
+				Host:  "localhost",
+				Model: "model",
+			},
+			wantFilepath: filepath.Join("localhost", "library", "model", "latest"),
+		},
+		{
+			in: "https://registry.corp.com/model",
+			want: Name{
+				Host:  "registry.corp.com",
+				Model: "model",
+			},
+			wantFilepath: filepath.Join("registry.corp.com", "library", "model", "latest"),
+		},
+		{
+			in: "registry.corp.com:5000/ns/model:tag",
+			want: Name{
+				Host:      "registry.corp.com:5000",
+				Namespace: "ns",
+				Model:     "model",
+				Tag:       "tag",
+			},
+			wantFilepath: filepath.Join("registry.corp.com:5000", "ns", "model", "tag"),
+		},
 		{
 			in: "namespace/model",
 			want: Name{